@@ -0,0 +1,179 @@
+package solidq
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+var (
+	ErrAppExists   = errors.New("app already exists")
+	ErrAppNotFound = errors.New("app does not exist")
+	errAppDeleted  = errors.New("app was deleted")
+)
+
+func (r *registry) path(appname string) string {
+	return filepath.Join(r.root, appname+".db")
+}
+
+// create creates the DB files of a new app and opens it, shards > 1 spreads it over that many files
+func (r *registry) create(appname string, shards int, by string) (*App, error) {
+	if err := validapp(appname); err != nil {
+		return nil, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.store.Load(appname); ok {
+		return nil, ErrAppExists
+	}
+
+	if _, err := os.Stat(r.path(appname)); err == nil {
+		return nil, ErrAppExists
+	}
+
+	a, err := r.openapp(appname, shards, by)
+	if err != nil {
+		os.Remove(r.path(appname))
+		return nil, err
+	}
+
+	r.store.Store(appname, a)
+	return a, nil
+}
+
+// delete closes an app and removes its DB files. Requests still holding the
+// handle get an error instead of reopening them.
+func (r *registry) delete(appname string) error {
+	if err := validapp(appname); err != nil {
+		return err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if v, ok := r.store.Load(appname); ok {
+		r.store.Delete(appname)
+		if a := v.(*App); a.store != nil {
+			a.store.draining.Store(true)
+			a.store.w.wake()
+			return a.Close()
+		}
+
+		for _, q := range v.(*App).shards {
+			q.mu.Lock()
+			q.closed = errAppDeleted
+			err := q.closelocked()
+			q.mu.Unlock()
+
+			q.wake()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err := os.Remove(r.path(appname))
+	if os.IsNotExist(err) {
+		return ErrAppNotFound
+	}
+	os.Remove(recurringmarker(r.path(appname)))
+
+	for i := 1; err == nil; i++ {
+		err = os.Remove(shardpath(r.path(appname), i))
+	}
+
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func (q *Que) isopen() bool {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	return q.db != nil
+}
+
+// evictlru closes the least recently used apps until the open app cap is met, keep stays open
+func (r *registry) evictlru(keep *Que) {
+	for r.maxopen > 0 && r.open.Load() > r.maxopen {
+		var lru *Que
+		r.eachque(func(appname string, q *Que) {
+			if q != keep && q.isopen() && (lru == nil || q.lastused.Load() < lru.lastused.Load()) {
+				lru = q
+			}
+		})
+
+		if lru == nil {
+			return
+		}
+
+		if err := lru.idleclose(); err != nil {
+			fmt.Println("Error closing least recently used app:", err)
+			return
+		}
+	}
+}
+
+// runidle closes apps that have not been used for timeout. They are opened again on their next request.
+func (r *registry) runidle(timeout time.Duration, stop <-chan struct{}) {
+	interval := timeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case <-stop:
+			return
+		case now = <-ticker.C:
+		}
+
+		r.closeidle(now, timeout)
+	}
+}
+
+// closeidle closes the apps last used more than timeout before now
+func (r *registry) closeidle(now time.Time, timeout time.Duration) {
+	r.eachque(func(appname string, q *Que) {
+		if q.isopen() && now.Sub(time.Unix(0, q.lastused.Load())) > timeout {
+			if err := q.idleclose(); err != nil {
+				fmt.Println("Error closing idle app:", appname, err)
+			}
+		}
+	})
+}
+
+// shard returns one file of an app by its index, as given in a query
+func (r *registry) shard(appname, index string) (*Que, error) {
+	a, err := r.ensure(appname)
+	if err != nil {
+		return nil, err
+	}
+
+	if a.store != nil {
+		return nil, errNotStored
+	}
+
+	i := 0
+	if index != "" {
+		if i, err = strconv.Atoi(index); err != nil {
+			return nil, fmt.Errorf("bad shard %q", index)
+		}
+	}
+
+	if i < 0 || i >= len(a.shards) {
+		return nil, fmt.Errorf("%s has %d shards", appname, len(a.shards))
+	}
+	return a.shards[i], nil
+}
@@ -0,0 +1,126 @@
+package solidq
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCreateDeleteApp(t *testing.T) {
+	r, err := newregistry(t.TempDir(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.closeall()
+
+	a, err := r.create("orders", 2, ShardByID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := r.create("orders", 0, ""); !errors.Is(err, ErrAppExists) {
+		t.Errorf("second create: %v, want ErrAppExists", err)
+	}
+
+	if _, err := r.create("../orders", 0, ""); err == nil {
+		t.Error("an app name leaving the root was accepted")
+	}
+
+	if err := a.Push("jobs", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := r.delete("orders"); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{r.path("orders"), shardpath(r.path("orders"), 1)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s left behind: %v", path, err)
+		}
+	}
+
+	// a request that still holds the app must not open the file again
+	if err := a.Push("jobs", "b"); !errors.Is(err, errAppDeleted) {
+		t.Errorf("push to a deleted app: %v, want errAppDeleted", err)
+	}
+
+	if err := r.delete("orders"); !errors.Is(err, ErrAppNotFound) {
+		t.Errorf("second delete: %v, want ErrAppNotFound", err)
+	}
+
+	if a, err := r.create("orders", 0, ""); err != nil || a.Shards() != 1 {
+		t.Errorf("create after the delete: %v", err)
+	}
+}
+
+func TestEvictLRU(t *testing.T) {
+	r, err := newregistry(t.TempDir(), 2, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.closeall()
+
+	apps := make(map[string]*App)
+	for i, name := range []string{"old", "recent", "new"} {
+		a, err := r.ensure(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := a.Push("jobs", name); err != nil {
+			t.Fatal(err)
+		}
+		a.meta().lastused.Store(int64(i + 1))
+		apps[name] = a
+	}
+
+	if n := r.open.Load(); n != 2 {
+		t.Errorf("%d apps open, want 2", n)
+	}
+
+	if apps["old"].meta().isopen() || !apps["recent"].meta().isopen() || !apps["new"].meta().isopen() {
+		t.Error("the least recently used app was not the one closed")
+	}
+
+	// the closed app opens again on its next request and closes the least recently used one
+	if n, err := apps["old"].Count("jobs"); err != nil || n != 1 {
+		t.Errorf("count after reopening: %d %v", n, err)
+	}
+
+	if apps["recent"].meta().isopen() || r.open.Load() != 2 {
+		t.Errorf("%d apps open after a reopen, recent open: %v", r.open.Load(), apps["recent"].meta().isopen())
+	}
+}
+
+func TestCloseIdle(t *testing.T) {
+	r, err := newregistry(t.TempDir(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.closeall()
+
+	a, err := r.ensure("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Push("jobs", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	r.closeidle(time.Now(), time.Minute)
+	if !a.meta().isopen() {
+		t.Fatal("an app used just now was closed")
+	}
+
+	r.closeidle(time.Now().Add(2*time.Minute), time.Minute)
+	if a.meta().isopen() || r.open.Load() != 0 {
+		t.Fatalf("idle app still open, %d open", r.open.Load())
+	}
+
+	if n, err := a.Count("jobs"); err != nil || n != 1 {
+		t.Errorf("count after an idle close: %d %v", n, err)
+	}
+}
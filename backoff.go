@@ -0,0 +1,214 @@
+package solidq
+
+import (
+	"encoding/binary"
+	"math"
+	"math/rand"
+	"strconv"
+	"time"
+
+	"github.com/sfi2k7/solidq/routes"
+	"go.etcd.io/bbolt"
+)
+
+// BackoffPolicy decides how long a nacked item waits before it is popped again
+type BackoffPolicy struct {
+	Base       routes.Duration `json:"base"`       // before the first retry, like "1.5s" or a number of seconds
+	Multiplier float64         `json:"multiplier"` // growth per attempt
+	Max        routes.Duration `json:"max"`        // upper bound of the delay
+	Jitter     float64         `json:"jitter"`     // 0..1, random +/- fraction of the delay
+}
+
+var defaultBackoff = BackoffPolicy{Base: routes.Duration(time.Second), Multiplier: 2, Max: routes.Duration(10 * time.Minute)}
+
+func (bp BackoffPolicy) delay(attempts int) time.Duration {
+	if bp.Base <= 0 {
+		bp.Base = defaultBackoff.Base
+	}
+
+	if bp.Multiplier < 1 {
+		bp.Multiplier = defaultBackoff.Multiplier
+	}
+
+	if bp.Max <= 0 {
+		bp.Max = defaultBackoff.Max
+	}
+
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	base, max := time.Duration(bp.Base).Seconds(), time.Duration(bp.Max).Seconds()
+	seconds := math.Min(base*math.Pow(bp.Multiplier, float64(attempts-1)), max)
+	if bp.Jitter > 0 {
+		seconds += seconds * math.Min(bp.Jitter, 1) * (rand.Float64()*2 - 1)
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func scheduledbucket(channel string) []byte {
+	return []byte(internalprefix + "scheduled:" + channel)
+}
+
+func attemptsbucket(channel string) []byte {
+	return []byte(internalprefix + "attempts:" + channel)
+}
+
+// scheduled keys sort by due time: 8 byte big endian unix nanos followed by the work ID
+func scheduledkey(due time.Time, id string) []byte {
+	k := make([]byte, 8, 8+len(id))
+	binary.BigEndian.PutUint64(k, uint64(due.UnixNano()))
+	return append(k, id...)
+}
+
+// promote moves scheduled items that are due back into the channel
+func promote(tx *bbolt.Tx, channel string, now time.Time) error {
+	b := tx.Bucket(scheduledbucket(channel))
+	if b == nil {
+		return nil
+	}
+
+	limit := uint64(now.UnixNano())
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.First() {
+		if len(k) < 8 || binary.BigEndian.Uint64(k[:8]) > limit {
+			return nil
+		}
+
+		if err := readyitem(tx, channel, string(k[8:]), v, StateScheduled); err != nil {
+			return err
+		}
+
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func attempts(tx *bbolt.Tx, channel, id string) int {
+	b := tx.Bucket(attemptsbucket(channel))
+	if b == nil {
+		return 0
+	}
+
+	n, _ := strconv.Atoi(string(b.Get([]byte(id))))
+	return n
+}
+
+// Nack returns a failed item to the channel after delay, with its payload. A delay of 0 applies
+// the channel's backoff policy based on how often the item has failed before. An item of a capped
+// channel that is not in flight, or one still waiting in the channel, gives ErrNotInFlight.
+// Uncapped channels don't track popped items, so any other ID is taken as popped; its payload
+// is kept for one lease after the pop.
+func (q *Que) Nack(channel, id string, delay time.Duration) error {
+	return q.nackat(stamp{}, channel, id, delay)
+}
+
+func (q *Que) nackat(st stamp, channel, id string, delay time.Duration) error {
+	if id == "" {
+		return invalidf("work ID cannot be empty")
+	}
+
+	err := q.updateat(st, func(tx *bbolt.Tx) error {
+		if err := inc(tx, channel+":nack"); err != nil {
+			return err
+		}
+
+		cc, err := readconfig(tx, channel)
+		if err != nil {
+			return err
+		}
+
+		var payload []byte
+		var record []byte
+		if b := tx.Bucket(inflightbucket(channel)); b != nil {
+			record = b.Get([]byte(id))
+		}
+
+		switch {
+		case record != nil:
+			if _, payload, err = parseinflight(record); err != nil {
+				return err
+			}
+
+			if err := tx.Bucket(inflightbucket(channel)).Delete([]byte(id)); err != nil {
+				return err
+			}
+		case cc.MaxInFlight > 0:
+			return ErrNotInFlight
+		default:
+			if b := tx.Bucket([]byte(channel)); b != nil && b.Get([]byte(id)) != nil {
+				return ErrNotInFlight
+			}
+
+			if b := tx.Bucket(poppedbucket(channel)); b != nil {
+				if v := b.Get([]byte(id)); v != nil {
+					if _, payload, err = parseinflight(v); err != nil {
+						return err
+					}
+
+					if err := b.Delete([]byte(id)); err != nil {
+						return err
+					}
+				}
+			}
+		}
+
+		ab, err := tx.CreateBucketIfNotExists(attemptsbucket(channel))
+		if err != nil {
+			return err
+		}
+
+		n := attempts(tx, channel, id) + 1
+		if err := ab.Put([]byte(id), []byte(strconv.Itoa(n))); err != nil {
+			return err
+		}
+
+		// changes from the Raft log carry the delay the leader drew, a node never draws its own
+		if delay <= 0 && st.index == 0 {
+			delay = cc.Backoff.delay(n)
+		}
+
+		sb, err := tx.CreateBucketIfNotExists(scheduledbucket(channel))
+		if err != nil {
+			return err
+		}
+
+		due := st.time().Add(delay)
+		if err := sb.Put(scheduledkey(due, id), payload); err != nil {
+			return err
+		}
+		return logop(tx, LogEntry{Op: LogMove, Channel: channel, IDs: []string{id}, Payload: string(payload), From: StateInFlight, To: StateScheduled, Due: due.UnixNano()})
+	})
+
+	// a freed in-flight slot may unblock waiting pops
+	q.wake()
+	return err
+}
+
+// Attempts returns how many times an item has been nacked
+func (q *Que) Attempts(channel, id string) (int, error) {
+	var n int
+	err := q.view(func(tx *bbolt.Tx) error {
+		n = attempts(tx, channel, id)
+		return nil
+	})
+
+	return n, err
+}
+
+// Scheduled returns the number of nacked items waiting for their retry
+func (q *Que) Scheduled(channel string) (int, error) {
+	var count int
+	err := q.view(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(scheduledbucket(channel))
+		if b == nil {
+			return nil
+		}
+		count = b.Stats().KeyN
+		return nil
+	})
+
+	return count, err
+}
@@ -0,0 +1,98 @@
+package solidq
+
+import (
+	"archive/tar"
+	"io"
+	"path/filepath"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// Backup writes a consistent snapshot of the app DB to w. It runs in a read transaction,
+// so pushes and pops keep working while the snapshot is streamed.
+func (q *Que) Backup(w io.Writer) (int64, error) {
+	var n int64
+	err := q.view(func(tx *bbolt.Tx) error {
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+
+	return n, err
+}
+
+// backupshards writes a snapshot of every shard of a sharded app into a tar stream, named like
+// the entries of backupall. Each shard is read in a transaction of its own.
+func (a *App) backupshards(w io.Writer) (int64, error) {
+	cw := &countwriter{w: w}
+	tw := tar.NewWriter(cw)
+	for _, q := range a.shards {
+		if err := q.tarsnapshot(tw); err != nil {
+			return cw.n, err
+		}
+	}
+
+	err := tw.Close()
+	return cw.n, err
+}
+
+// countwriter counts the bytes written through it
+type countwriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countwriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// backupall writes a snapshot of every app on disk into a tar stream, one <app>.db entry per app
+// and one <app>.db.<n> entry for every further shard
+func (r *registry) backupall(w io.Writer) error {
+	if r.backend == StorageMemory {
+		return errNotStored
+	}
+
+	apps, err := r.list(true)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	for _, app := range apps {
+		a, err := r.ensure(app)
+		if err != nil {
+			return err
+		}
+
+		for _, q := range a.shards {
+			if err := q.tarsnapshot(tw); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tw.Close()
+}
+
+// tarsnapshot writes the DB as one tar entry named after its file
+func (q *Que) tarsnapshot(tw *tar.Writer) error {
+	// header and body must come from the same transaction for the size to match
+	return q.view(func(tx *bbolt.Tx) error {
+		err := tw.WriteHeader(&tar.Header{
+			Name:    filepath.Base(q.path),
+			Mode:    0600,
+			Size:    tx.Size(),
+			ModTime: time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.WriteTo(tw)
+		return err
+	})
+}
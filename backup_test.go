@@ -0,0 +1,143 @@
+package solidq
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"go.etcd.io/bbolt"
+)
+
+// checkcopy runs bbolt's consistency check on a backup and returns its ready items per channel
+func checkcopy(t *testing.T, path string) map[string]int {
+	t.Helper()
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var counts map[string]int
+	err = db.View(func(tx *bbolt.Tx) error {
+		for err := range tx.Check() {
+			t.Errorf("%s: %v", filepath.Base(path), err)
+		}
+
+		counts = make(map[string]int)
+		return tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
+			if !isinternal(string(name)) {
+				counts[string(name)] = countkeys(b)
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return counts
+}
+
+func TestBackup(t *testing.T) {
+	q := openque(t)
+	if _, _, err := q.Import("jobs", strings.NewReader(`{"id":"a","payload":"first"}`+"\n"+`{"id":"b"}`+"\n"), DuplicateSkip); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(t.TempDir(), "copy.db")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := q.Backup(f)
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if st, err := os.Stat(path); err != nil || st.Size() != n {
+		t.Fatalf("backup of %d bytes, file %v %v", n, st, err)
+	}
+
+	if counts := checkcopy(t, path); counts["jobs"] != 2 {
+		t.Errorf("channels in the copy %v, want 2 items in jobs", counts)
+	}
+
+	copied, err := OpenQue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer copied.Close()
+
+	if payload, ok := exported(t, copied, "jobs", "a"); !ok || payload != "first" {
+		t.Errorf("payload in the copy %q (%v), want first", payload, ok)
+	}
+}
+
+func TestBackupAll(t *testing.T) {
+	r, err := newregistry(t.TempDir(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.closeall()
+
+	for app, ids := range map[string][]string{"orders": {"a", "b"}, "mail": {"c"}} {
+		a, err := r.ensure(app)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, id := range ids {
+			if err := a.Push("jobs", id); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := r.backupall(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	var names []string
+	counts := make(map[string]int)
+	tr := tar.NewReader(&buf)
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		path := filepath.Join(dir, h.Name)
+		f, err := os.Create(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := io.Copy(f, tr); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+
+		names = append(names, h.Name)
+		counts[h.Name] = checkcopy(t, path)["jobs"]
+	}
+
+	sort.Strings(names)
+	if strings.Join(names, ",") != "mail.db,orders.db" {
+		t.Fatalf("tar entries %v", names)
+	}
+
+	if counts["orders.db"] != 2 || counts["mail.db"] != 1 {
+		t.Errorf("items per app in the tar %v", counts)
+	}
+}
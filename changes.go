@@ -0,0 +1,148 @@
+package solidq
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// ErrChangesTrimmed tells a change feed reader that the offset it resumes from is no longer retained
+var ErrChangesTrimmed = errors.New("changes after this offset are no longer retained")
+
+// logTrimInterval is how often the logs of open apps are trimmed, so entries age out of apps
+// that see no changes
+const logTrimInterval = time.Minute
+
+func writeretention(b *bbolt.Bucket, entries int, age time.Duration, size int64) error {
+	if err := b.Put([]byte("log:entries"), []byte(strconv.Itoa(entries))); err != nil {
+		return err
+	}
+
+	if err := b.Put([]byte("log:bytes"), []byte(strconv.FormatInt(size, 10))); err != nil {
+		return err
+	}
+	return b.Put([]byte("log:age"), []byte(age.String()))
+}
+
+// logretention returns how many log entries a file keeps, for how long and how many bytes of
+// them. With none set the log keeps logRetention entries.
+func logretention(tx *bbolt.Tx) (int, time.Duration, int64) {
+	var entries int
+	var age time.Duration
+	var size int64
+	if b := tx.Bucket([]byte(settingsbucket)); b != nil {
+		entries, _ = strconv.Atoi(string(b.Get([]byte("log:entries"))))
+		age, _ = time.ParseDuration(string(b.Get([]byte("log:age"))))
+		size, _ = strconv.ParseInt(string(b.Get([]byte("log:bytes"))), 10, 64)
+	}
+
+	if entries <= 0 && age <= 0 && size <= 0 {
+		return logRetention, 0, 0
+	}
+	return entries, age, size
+}
+
+// logsize returns how many bytes of entries the log holds
+func logsize(tx *bbolt.Tx) int64 {
+	b := tx.Bucket([]byte(settingsbucket))
+	if b == nil {
+		return 0
+	}
+
+	n, _ := strconv.ParseInt(string(b.Get([]byte("log:size"))), 10, 64)
+	return n
+}
+
+// addlogsize keeps the byte count of the log up to date as entries come and go
+func addlogsize(tx *bbolt.Tx, delta int64) error {
+	b := tx.Bucket([]byte(settingsbucket))
+	if b == nil || delta == 0 {
+		return nil
+	}
+	return b.Put([]byte("log:size"), []byte(strconv.FormatInt(logsize(tx)+delta, 10)))
+}
+
+// trimopen applies the log retention of the file, unless it is closed
+func (q *Que) trimopen(now time.Time) error {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.db == nil {
+		return nil
+	}
+
+	return q.db.Update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(logbucket))
+		if b == nil {
+			return nil
+		}
+		return trimlog(tx, b, b.Sequence(), now)
+	})
+}
+
+// runlogtrim trims the logs of the open apps once per logTrimInterval, appends only trim every
+// logTrimEvery entries
+func (r *registry) runlogtrim(stop <-chan struct{}) {
+	ticker := time.NewTicker(logTrimInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case now := <-ticker.C:
+			r.eachque(func(appname string, q *Que) {
+				if err := q.trimopen(now); err != nil {
+					fmt.Println("Error trimming the change log of app:", appname, err)
+				}
+			})
+		}
+	}
+}
+
+// Changes returns up to logBatch entries of the mutation log after the since offset, waiting up
+// to wait for new ones, with the epoch of the log. An offset of 0 starts at the oldest entry kept.
+// Offsets only mean something within one epoch, a restore starts a new one.
+func (q *Que) Changes(since uint64, wait time.Duration) (string, []LogEntry, error) {
+	var epoch string
+	entries, err := q.waitlog(wait, func() ([]LogEntry, error) {
+		var entries []LogEntry
+		err := q.view(func(tx *bbolt.Tx) error {
+			epoch, _ = logposition(tx)
+			if epoch == "" {
+				return errNoLog
+			}
+
+			after := since
+			if after == 0 {
+				after = oldestentry(tx)
+			}
+
+			var ok bool
+			var err error
+			entries, ok, err = logentries(tx, after)
+			if err == nil && !ok {
+				return ErrChangesTrimmed
+			}
+			return err
+		})
+
+		return entries, err
+	})
+
+	return epoch, entries, err
+}
+
+// oldestentry returns the offset right before the oldest entry kept
+func oldestentry(tx *bbolt.Tx) uint64 {
+	b := tx.Bucket([]byte(logbucket))
+	k, _ := b.Cursor().First()
+	if k == nil {
+		return b.Sequence()
+	}
+	return binary.BigEndian.Uint64(k) - 1
+}
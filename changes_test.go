@@ -0,0 +1,72 @@
+package solidq
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// logbytes returns the byte count the file keeps for its log and the sum of its entries
+func logbytes(t *testing.T, q *Que) (int64, int64) {
+	t.Helper()
+	var kept, sum int64
+	err := q.view(func(tx *bbolt.Tx) error {
+		kept = logsize(tx)
+		return tx.Bucket([]byte(logbucket)).ForEach(func(k, v []byte) error {
+			sum += int64(len(v))
+			return nil
+		})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return kept, sum
+}
+
+func TestTrimLogBytes(t *testing.T) {
+	q := openque(t)
+	if err := q.preparelog(0, 0, 2000); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 300; i++ {
+		if err := q.Push("jobs", strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := q.trimopen(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+
+	kept, sum := logbytes(t, q)
+	if kept != sum {
+		t.Errorf("the file counts %d log bytes, the entries take %d", kept, sum)
+	}
+
+	if sum == 0 || sum > 2000 {
+		t.Errorf("%d log bytes kept under a budget of 2000", sum)
+	}
+}
+
+func TestTrimLogAge(t *testing.T) {
+	q := openque(t)
+	if err := q.preparelog(0, time.Minute, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.Push("jobs", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	// no append comes along, the timer trims the old entries
+	if err := q.trimopen(time.Now().Add(2 * time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	if kept, sum := logbytes(t, q); kept != 0 || sum != 0 {
+		t.Errorf("%d log bytes (%d counted) kept past their age", sum, kept)
+	}
+}
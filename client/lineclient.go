@@ -0,0 +1,222 @@
+package client
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LineClient talks to the line protocol of a server, one pipe delimited packet per line:
+// cmd|appname|channel|work_id|targetlist|data. It is cheaper than HTTP for small ID-only jobs.
+// Channels are named like with Client, "app:channel" or a channel of the core app.
+type LineClient struct {
+	mu      sync.Mutex
+	conn    net.Conn
+	r       *bufio.Reader
+	w       *bufio.Writer
+	timeout time.Duration
+}
+
+// LineReply is the reply of the server to one packet
+type LineReply struct {
+	Cmd      string          `json:"cmd"`
+	Appname  string          `json:"appname,omitempty"`
+	Channel  string          `json:"channel,omitempty"`
+	WorkId   string          `json:"work_id,omitempty"`
+	Success  bool            `json:"success"`
+	Error    string          `json:"error,omitempty"`
+	Ids      []string        `json:"ids,omitempty"`
+	Count    int             `json:"count,omitempty"`
+	Channels map[string]int  `json:"channels,omitempty"`
+	Data     json.RawMessage `json:"data,omitempty"`
+}
+
+// LineCommand is one packet of a pipeline
+type LineCommand struct {
+	Cmd     string
+	App     string // for commands on a whole app, without a channel
+	Channel string
+	ID      string
+	Data    interface{}
+}
+
+// DialLine connects to the line protocol port of a server and authenticates with secret.
+// timeout bounds every round trip, 0 means no limit.
+func DialLine(addr, secret string, timeout time.Duration) (*LineClient, error) {
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &LineClient{conn: conn, r: bufio.NewReader(conn), w: bufio.NewWriter(conn), timeout: timeout}
+	if secret != "" {
+		if _, err := c.do(LineCommand{Cmd: "auth", ID: secret}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *LineClient) Close() error {
+	return c.conn.Close()
+}
+
+// packet writes a command as a packet, "app:channel" is split into its fields
+func packet(cmd LineCommand) (string, error) {
+	app, channel := "-", "-"
+	if cmd.App != "" {
+		app = cmd.App
+	}
+
+	if cmd.Channel != "" {
+		r := request(cmd.Channel)
+		app, channel = r.App, r.Channel
+	}
+
+	id := cmd.ID
+	if id == "" {
+		id = "-"
+	}
+
+	if strings.ContainsAny(id, "|\r\n") {
+		return "", fmt.Errorf("work ID %q may not contain '|' or line breaks", cmd.ID)
+	}
+
+	data := "{}"
+	if cmd.Data != nil {
+		raw, err := json.Marshal(cmd.Data)
+		if err != nil {
+			return "", err
+		}
+		data = string(raw)
+	}
+	return cmd.Cmd + "|" + app + "|" + channel + "|" + id + "||" + data, nil
+}
+
+// Pipeline sends every command before reading any reply, the replies come in the same order.
+// A command the server failed is reported in its reply, not as an error.
+func (c *LineClient) Pipeline(cmds ...LineCommand) ([]LineReply, error) {
+	// a packet that can't be written must not leave the others half sent
+	packets := make([]string, len(cmds))
+	for i, cmd := range cmds {
+		p, err := packet(cmd)
+		if err != nil {
+			return nil, err
+		}
+		packets[i] = p
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.timeout))
+		defer c.conn.SetDeadline(time.Time{})
+	}
+
+	for _, p := range packets {
+		if _, err := c.w.WriteString(p + "\n"); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := c.w.Flush(); err != nil {
+		return nil, err
+	}
+
+	replies := make([]LineReply, len(cmds))
+	for i := range replies {
+		line, err := c.r.ReadBytes('\n')
+		if err != nil {
+			return replies[:i], err
+		}
+
+		if err := json.Unmarshal(line, &replies[i]); err != nil {
+			return replies[:i], err
+		}
+	}
+	return replies, nil
+}
+
+// do sends one command and turns a failed reply into an error
+func (c *LineClient) do(cmd LineCommand) (*LineReply, error) {
+	replies, err := c.Pipeline(cmd)
+	if err != nil {
+		return nil, err
+	}
+
+	if !replies[0].Success {
+		return &replies[0], errors.New(replies[0].Error)
+	}
+	return &replies[0], nil
+}
+
+func (c *LineClient) Push(channel, id string) error {
+	_, err := c.do(LineCommand{Cmd: "push", Channel: channel, ID: id})
+	return err
+}
+
+// PushMany pushes every ID in one pipeline, it returns the first failure
+func (c *LineClient) PushMany(channel string, ids ...string) error {
+	cmds := make([]LineCommand, len(ids))
+	for i, id := range ids {
+		cmds[i] = LineCommand{Cmd: "push", Channel: channel, ID: id}
+	}
+
+	replies, err := c.Pipeline(cmds...)
+	if err != nil {
+		return err
+	}
+
+	for i, reply := range replies {
+		if !reply.Success {
+			return fmt.Errorf("push %s: %s", ids[i], reply.Error)
+		}
+	}
+	return nil
+}
+
+func (c *LineClient) Pop(channel string, count int) ([]string, error) {
+	reply, err := c.do(LineCommand{Cmd: "pop_with_count", Channel: channel, Data: map[string]int{"count": count}})
+	if err != nil {
+		return nil, err
+	}
+	return reply.Ids, nil
+}
+
+func (c *LineClient) Count(channel string) (int, error) {
+	reply, err := c.do(LineCommand{Cmd: "count", Channel: channel})
+	if err != nil {
+		return 0, err
+	}
+	return reply.Count, nil
+}
+
+func (c *LineClient) Reset(channel string) error {
+	_, err := c.do(LineCommand{Cmd: "reset", Channel: channel})
+	return err
+}
+
+// List returns up to count IDs of a channel without popping them
+func (c *LineClient) List(channel string, count int) ([]string, error) {
+	reply, err := c.do(LineCommand{Cmd: "list", Channel: channel, Data: map[string]int{"count": count}})
+	if err != nil {
+		return nil, err
+	}
+	return reply.Ids, nil
+}
+
+// ListChannels returns the channels of an app with the number of items in each
+func (c *LineClient) ListChannels(appname string) (map[string]int, error) {
+	reply, err := c.do(LineCommand{Cmd: "list_channels_with_count", App: appname})
+	if err != nil {
+		return nil, err
+	}
+	return reply.Channels, nil
+}
@@ -5,14 +5,19 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
+
+	"github.com/sfi2k7/solidq/routes"
 )
 
 // serverResponse is the generic structure for responses from the SolidQ server.
@@ -24,14 +29,47 @@ type serverResponse struct {
 	Channels map[string]int `json:"channels,omitempty"`
 	Apps     []string       `json:"apps"`
 	IsPaused bool           `json:"isPaused"`
+	InFlight int            `json:"inFlight,omitempty"`
+	MustAck  bool           `json:"mustAck,omitempty"`
+	Jobs     []RecurringJob `json:"jobs,omitempty"`
+	Skipped  int            `json:"skipped,omitempty"`
+	Code     string         `json:"code,omitempty"`
 	Took     string         `json:"took"`
 }
 
+// ServerError is a failure reported by the server. Code is one of the routes.Code values for
+// the v2 routes, empty for the others.
+type ServerError struct {
+	Status  int
+	Code    string
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return "server error: " + e.Message
+}
+
+// RecurringJob is a schedule stored on the server that pushes a new item into Channel
+// on a cron expression or a fixed interval.
+type RecurringJob struct {
+	Name       string    `json:"name"`
+	Channel    string    `json:"channel"`
+	Cron       string    `json:"cron,omitempty"`     // standard 5 field expression or descriptor like @hourly
+	Interval   int       `json:"interval,omitempty"` // seconds, used when Cron is empty
+	IDTemplate string    `json:"idTemplate"`         // {name} {seq} {unix} {date} {time} are replaced per run
+	Payload    string    `json:"payload,omitempty"`
+	CatchUp    string    `json:"catchUp,omitempty"` // skip (default), once or all
+	NextRun    time.Time `json:"nextRun"`
+	LastRun    time.Time `json:"lastRun,omitempty"`
+	Runs       int64     `json:"runs"`
+}
+
 // Client is the API client for the SolidQ server.
 type Client struct {
 	baseURL         string
 	httpClient      *http.Client
 	defaultPollWait time.Duration // New field for default poll wait time
+	secret          string
 }
 
 // Option defines a functional option for configuring the Client.
@@ -57,6 +95,13 @@ func WithTimeout(timeout time.Duration) Option {
 	}
 }
 
+// WithSecret sets the server secret sent with every request.
+func WithSecret(secret string) Option {
+	return func(c *Client) {
+		c.secret = secret
+	}
+}
+
 // WithDefaultPollWait sets the default wait time when the queue is empty in WorkLoop.
 func WithDefaultPollWait(duration time.Duration) Option {
 	return func(c *Client) {
@@ -92,6 +137,14 @@ func NewClient(baseURL string, opts ...Option) (*Client, error) {
 
 // --- Worker Context Definition ---
 
+// Results a worker function in WorkLoop can return besides the name of the next channel.
+const (
+	// Done finishes the work item without routing it anywhere.
+	Done = "noop"
+	// Failed hands the work item back to the server, which retries it after a delay.
+	Failed = "nack"
+)
+
 // WorkerContext provides the current work item and methods to interact with the queue
 // to the worker function in WorkLoop.
 type SolidContext interface {
@@ -114,21 +167,18 @@ type SolidContext interface {
 	Reset(channel string) error
 	// ListChannels retrieves a map of all channels and their respective work item counts.
 	ListChannels(appname ...string) (map[string]int, error)
+
+	// RetryAfter sets the delay before a work item the worker returns Failed for is retried.
+	// Without it the channel's backoff policy on the server decides.
+	RetryAfter(delay time.Duration)
 }
 
 // solidContextImpl implements WorkerContext.
 type solidContextImpl struct {
-	id      string
-	client  *Client
-	channel string
-}
-
-func newSolidContext(id, channel string, client *Client) SolidContext {
-	return &solidContextImpl{
-		id:      id,
-		channel: channel,
-		client:  client,
-	}
+	id         string
+	client     *Client
+	channel    string
+	retryAfter time.Duration
 }
 
 func (wc *solidContextImpl) CurrentWork() string {
@@ -159,6 +209,10 @@ func (wc *solidContextImpl) ListChannels(appname ...string) (map[string]int, err
 	return wc.client.ListChannels(eitheror(appname, "core"))
 }
 
+func (wc *solidContextImpl) RetryAfter(delay time.Duration) {
+	wc.retryAfter = delay
+}
+
 func eitheror(list []string, orV string) string {
 	if len(list) > 0 {
 		return list[0]
@@ -183,12 +237,24 @@ func (c *Client) buildURL(path string, queryParams map[string]string) string {
 	return fullURL.String()
 }
 
-func (c *Client) doRequest(method, urlStr string, body io.Reader) (*serverResponse, error) {
+func (c *Client) newRequest(method, urlStr string, body io.Reader) (*http.Request, error) {
 	req, err := http.NewRequest(method, urlStr, body)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create request: %w", err)
 	}
 
+	if c.secret != "" {
+		req.Header.Set("Authorization", c.secret)
+	}
+	return req, nil
+}
+
+func (c *Client) doRequest(method, urlStr string, body io.Reader) (*serverResponse, error) {
+	req, err := c.newRequest(method, urlStr, body)
+	if err != nil {
+		return nil, err
+	}
+
 	if body != nil {
 		req.Header.Set("Content-Type", "application/json")
 	}
@@ -199,33 +265,63 @@ func (c *Client) doRequest(method, urlStr string, body io.Reader) (*serverRespon
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		var errorBodyBytes []byte
-		if resp.Body != nil {
-			errorBodyBytes, _ = io.ReadAll(resp.Body)
-		}
-		return nil, fmt.Errorf("server returned non-2xx status: %d %s. Body: %s", resp.StatusCode, http.StatusText(resp.StatusCode), string(errorBodyBytes))
+	raw, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read server response: %w", err)
 	}
 
+	ok := resp.StatusCode >= 200 && resp.StatusCode < 300
+
+	// the v2 routes answer failures with a status and a JSON body, the others with 200
 	var sr serverResponse
-	if err := json.NewDecoder(resp.Body).Decode(&sr); err != nil {
-		// Attempt to read the body as text for better debugging if JSON decoding fails
-		bodyBytes, readErr := io.ReadAll(resp.Body) // This won't work as resp.Body was already read by NewDecoder
-		// For robust error, one would read into buffer first then decode.
-		// For now, keeping it simple.
-		if readErr != nil {
-			return nil, fmt.Errorf("failed to decode server response (and failed to read body for debug): %w", err)
+	if err := json.Unmarshal(raw, &sr); err != nil {
+		if !ok {
+			return nil, fmt.Errorf("server returned non-2xx status: %d %s. Body: %s", resp.StatusCode, http.StatusText(resp.StatusCode), string(raw))
 		}
-		return nil, fmt.Errorf("failed to decode server response: %w. Raw body: %s", err, string(bodyBytes))
+		return nil, fmt.Errorf("failed to decode server response: %w. Raw body: %s", err, string(raw))
 	}
 
 	if !sr.Success && sr.Error != "" {
-		return &sr, fmt.Errorf("server error: %s", sr.Error)
+		return &sr, &ServerError{Status: resp.StatusCode, Code: sr.Code, Message: sr.Error}
 	}
 
+	if !ok {
+		return nil, fmt.Errorf("server returned non-2xx status: %d %s. Body: %s", resp.StatusCode, http.StatusText(resp.StatusCode), string(raw))
+	}
 	return &sr, nil
 }
 
+// call sends a request to a v2 route, in the query string for GET and as a JSON body otherwise
+func (c *Client) call(route routes.Route, r routes.Request) (*serverResponse, error) {
+	op := strings.ToLower(strings.TrimPrefix(route.Name, "v2"))
+	urlStr := c.buildURL(route.Path, nil)
+
+	var body io.Reader
+	if route.Method == http.MethodGet {
+		urlStr += "?" + r.Query().Encode()
+	} else {
+		raw, err := json.Marshal(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode %s request: %w", op, err)
+		}
+		body = bytes.NewReader(raw)
+	}
+
+	sr, err := c.doRequest(route.Method, urlStr, body)
+	if err != nil {
+		return sr, fmt.Errorf("%s request failed: %w", op, err)
+	}
+	return sr, nil
+}
+
+// request starts a v2 request for a channel named "app:channel" or a channel of the core app
+func request(channel string) routes.Request {
+	if app, ch, ok := strings.Cut(channel, ":"); ok {
+		return routes.Request{App: app, Channel: ch}
+	}
+	return routes.Request{App: "core", Channel: channel}
+}
+
 // --- Public API methods --- (Push, Pop, Count, Reset, ListChannels - assumed to be same as before)
 
 func (c *Client) Push(channel string, id string) error {
@@ -237,127 +333,538 @@ func (c *Client) Push(channel string, id string) error {
 		return fmt.Errorf("workID cannot be empty")
 	}
 
-	queryParams := map[string]string{
-		"channel": channel,
-		"id":      id,
+	r := request(channel)
+	r.ID = id
+	_, err := c.call(routes.V2Push, r)
+	return err
+}
+
+func (c *Client) Pop(channel string, count ...int) ([]string, error) {
+	co := 1
+	if len(count) > 0 {
+		co = count[0]
+	}
+
+	sr, err := c.pop(channel, co, 0)
+	if err != nil {
+		return nil, err
+	}
+	return sr.Ids, nil
+}
+
+// PopWait pops up to count items, letting the server hold the request for up to wait
+// when the channel is empty or its in-flight cap is reached.
+func (c *Client) PopWait(channel string, count int, wait time.Duration) ([]string, error) {
+	sr, err := c.pop(channel, count, wait)
+	if err != nil {
+		return nil, err
+	}
+	return sr.Ids, nil
+}
+
+func (c *Client) pop(channel string, count int, wait time.Duration) (*serverResponse, error) {
+	if channel == "" {
+		return nil, fmt.Errorf("channel cannot be empty")
+	}
+
+	if count < 1 {
+		count = 1
+	}
+
+	r := request(channel)
+	r.Count, r.Wait = count, routes.Duration(wait)
+	sr, err := c.call(routes.V2Pop, r)
+
+	// every in-flight slot of a capped channel is taken, there is nothing to pop until an ack
+	var se *ServerError
+	if errors.As(err, &se) && se.Code == routes.CodeAtCapacity {
+		return &serverResponse{}, nil
+	}
+	return sr, err
+}
+
+// Nack reports a failed work item. The server parks it and puts it back into the channel
+// after delay, or after the channel's backoff policy when no delay is given.
+func (c *Client) Nack(channel string, id string, delay ...time.Duration) error {
+	if channel == "" {
+		return fmt.Errorf("channel cannot be empty")
+	}
+
+	if id == "" {
+		return fmt.Errorf("workID cannot be empty")
+	}
+
+	r := request(channel)
+	r.ID = id
+	if len(delay) > 0 && delay[0] > 0 {
+		r.Delay = routes.Duration(delay[0])
+	}
+
+	_, err := c.call(routes.V2Nack, r)
+	return err
+}
+
+// BackoffPolicy controls the retry delay of nacked items: base * multiplier^(attempts-1),
+// capped at max and spread by +/- jitter (0..1).
+type BackoffPolicy struct {
+	Base       time.Duration
+	Multiplier float64
+	Max        time.Duration
+	Jitter     float64
+}
+
+// SetBackoff sets the retry policy the server applies to items nacked without a delay.
+func (c *Client) SetBackoff(channel string, policy BackoffPolicy) error {
+	if channel == "" {
+		return fmt.Errorf("channel cannot be empty")
+	}
+
+	return c.setConfig(channel, map[string]interface{}{
+		"backoff": map[string]interface{}{
+			"base":       routes.Duration(policy.Base),
+			"multiplier": policy.Multiplier,
+			"max":        routes.Duration(policy.Max),
+			"jitter":     policy.Jitter,
+		},
+	})
+}
+
+// setConfig changes the fields of a channel config that are in fields
+func (c *Client) setConfig(channel string, fields map[string]interface{}) error {
+	config, err := json.Marshal(fields)
+	if err != nil {
+		return fmt.Errorf("failed to encode config: %w", err)
+	}
+
+	r := request(channel)
+	r.Config = config
+	_, err = c.call(routes.V2SetConfig, r)
+	return err
+}
+
+// Ack releases an item popped from a channel with a max in-flight cap.
+func (c *Client) Ack(channel string, id string) error {
+	if channel == "" {
+		return fmt.Errorf("channel cannot be empty")
+	}
+
+	if id == "" {
+		return fmt.Errorf("workID cannot be empty")
+	}
+
+	r := request(channel)
+	r.ID = id
+	_, err := c.call(routes.V2Ack, r)
+	return err
+}
+
+// SetMaxInFlight caps how many items of a channel may be worked on at once across all consumers.
+// A max of 0 removes the cap. Items not acked within lease are put back into the channel;
+// pass 0 to keep the server default.
+func (c *Client) SetMaxInFlight(channel string, max int, lease time.Duration) error {
+	if channel == "" {
+		return fmt.Errorf("channel cannot be empty")
 	}
-	urlStr := c.buildURL("/solidq/push", queryParams)
 
+	fields := map[string]interface{}{"maxInFlight": max}
+	if lease > 0 {
+		fields["lease"] = int(lease.Seconds())
+	}
+	return c.setConfig(channel, fields)
+}
+
+// SetDurability sets how an app commits pushes on the server: always, batched or nosync.
+func (c *Client) SetDurability(appname, mode string) error {
+	if appname == "" {
+		return fmt.Errorf("appname cannot be empty")
+	}
+
+	urlStr := c.buildURL(routes.SetDurability.URL(appname), map[string]string{"mode": mode})
 	sr, err := c.doRequest(http.MethodPost, urlStr, bytes.NewBuffer([]byte{}))
 	if err != nil {
 		if sr != nil && sr.Error != "" {
-			return fmt.Errorf("server error on push: %s", sr.Error)
+			return fmt.Errorf("server error on setDurability: %s", sr.Error)
 		}
-		return fmt.Errorf("push request failed: %w", err)
+		return fmt.Errorf("setDurability request failed: %w", err)
 	}
 
 	if !sr.Success {
-		return fmt.Errorf("push operation failed on server without specific error message")
+		return fmt.Errorf("setDurability operation failed on server: %s", sr.Error)
 	}
 	return nil
 }
 
-func (c *Client) Pop(channel string, count ...int) ([]string, error) {
+func (c *Client) Count(channel string) (int, error) {
+	if channel == "" {
+		return 0, fmt.Errorf("channel cannot be empty")
+	}
+
+	sr, err := c.call(routes.V2Count, request(channel))
+	if err != nil {
+		return 0, err
+	}
+	return sr.Count, nil
+}
+
+// Peek returns up to count IDs of a channel without popping them, followers serve it too
+func (c *Client) Peek(channel string, count int) ([]string, error) {
 	if channel == "" {
 		return nil, fmt.Errorf("channel cannot be empty")
 	}
 
-	co := "1"
-	if len(count) > 0 {
-		co = fmt.Sprint(count[0])
+	r := request(channel)
+	r.Count = count
+	sr, err := c.call(routes.V2Peek, r)
+	if err != nil {
+		return nil, err
 	}
+	return sr.Ids, nil
+}
 
-	queryParams := map[string]string{
-		"channel": channel,
+func (c *Client) Reset(channel string) error {
+	if channel == "" {
+		return fmt.Errorf("channel cannot be empty")
 	}
-	urlStr := c.buildURL("/solidq/pop/"+co, queryParams)
 
+	_, err := c.call(routes.V2Reset, request(channel))
+	return err
+}
+
+func (c *Client) ListChannels(appname ...string) (map[string]int, error) {
+	sr, err := c.call(routes.V2Channels, routes.Request{App: eitheror(appname, "core")})
+	if err != nil {
+		return nil, err
+	}
+
+	if sr.Channels == nil {
+		return make(map[string]int), nil
+	}
+	return sr.Channels, nil
+}
+
+// Pause stops an app, or only one of its channels when channel is not empty. The pause is
+// kept across server restarts. With consumeOnly the server keeps accepting pushes.
+func (c *Client) Pause(appname, channel string, consumeOnly bool) error {
+	r := routes.Request{App: appname, Channel: channel}
+	if consumeOnly {
+		r.Mode = "consume"
+	}
+
+	_, err := c.call(routes.V2Pause, r)
+	return err
+}
+
+// Resume lifts a pause set with Pause.
+func (c *Client) Resume(appname, channel string) error {
+	_, err := c.call(routes.V2Resume, routes.Request{App: appname, Channel: channel})
+	return err
+}
+
+// CreateApp creates a new app on the server.
+func (c *Client) CreateApp(appname string) error {
+	return c.CreateShardedApp(appname, 1, "")
+}
+
+// CreateShardedApp creates a new app spread over shards database files on the server,
+// by channel name or by item ID ("channel" or "id").
+func (c *Client) CreateShardedApp(appname string, shards int, by string) error {
+	if appname == "" {
+		return fmt.Errorf("appname cannot be empty")
+	}
+
+	r := routes.Request{App: appname}
+	if shards > 1 {
+		r.Shards, r.ShardBy = shards, by
+	}
+
+	_, err := c.call(routes.V2CreateApp, r)
+	return err
+}
+
+// CreateChannel declares a channel of an app, which a server in strict mode requires before it is used.
+func (c *Client) CreateChannel(appname, channel string) error {
+	if appname == "" || channel == "" {
+		return fmt.Errorf("appname and channel cannot be empty")
+	}
+
+	_, err := c.call(routes.V2CreateChannel, routes.Request{App: appname, Channel: channel})
+	return err
+}
+
+// DeleteApp closes an app on the server and deletes its database with every channel in it.
+func (c *Client) DeleteApp(appname string) error {
+	if appname == "" {
+		return fmt.Errorf("appname cannot be empty")
+	}
+
+	_, err := c.call(routes.V2DeleteApp, routes.Request{App: appname})
+	return err
+}
+
+// Promote turns a follower into a primary, it stops replicating and starts taking writes
+func (c *Client) Promote() error {
+	urlStr := c.buildURL(routes.Promote.Path, nil)
+	sr, err := c.doRequest(http.MethodPost, urlStr, nil)
+	if err != nil {
+		if sr != nil && sr.Error != "" {
+			return fmt.Errorf("server error on promote: %s", sr.Error)
+		}
+		return fmt.Errorf("promote request failed: %w", err)
+	}
+
+	if !sr.Success {
+		return fmt.Errorf("promote operation failed on server: %s", sr.Error)
+	}
+	return nil
+}
+
+// --- Export and import ---
+
+// RepairDepths recounts the channels of an app on the server and fixes their depth counters.
+// It returns the channels whose counter was corrected, with their depth.
+func (c *Client) RepairDepths(appname string) (map[string]int, error) {
+	if appname == "" {
+		return nil, fmt.Errorf("appname cannot be empty")
+	}
+
+	urlStr := c.buildURL(routes.Repair.URL(appname), nil)
 	sr, err := c.doRequest(http.MethodGet, urlStr, nil)
 	if err != nil {
 		if sr != nil && sr.Error != "" {
-			return nil, fmt.Errorf("server error on pop: %s", sr.Error)
+			return nil, fmt.Errorf("server error on repairDepths: %s", sr.Error)
 		}
-		return nil, fmt.Errorf("pop request failed: %w", err)
+		return nil, fmt.Errorf("repairDepths request failed: %w", err)
 	}
 
 	if !sr.Success {
-		if sr.Error == "" { // Empty queue
-			return nil, nil
+		return nil, fmt.Errorf("repairDepths operation failed on server: %s", sr.Error)
+	}
+	return sr.Channels, nil
+}
+
+// Export streams every item of a channel to w as newline delimited JSON.
+func (c *Client) Export(appname, channel string, w io.Writer) error {
+	if channel == "" {
+		return fmt.Errorf("channel cannot be empty")
+	}
+
+	urlStr := c.buildURL(routes.Export.URL(appname, channel), nil)
+	req, err := c.newRequest(http.MethodGet, urlStr, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("export request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// errors come back as a JSON response instead of the stream
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/x-ndjson") {
+		var sr serverResponse
+		if err := json.NewDecoder(resp.Body).Decode(&sr); err == nil && sr.Error != "" {
+			return fmt.Errorf("server error on export: %s", sr.Error)
 		}
-		return nil, fmt.Errorf("pop operation failed on server: %s", sr.Error)
+		return fmt.Errorf("export failed: %s", resp.Status)
 	}
 
-	if sr.Ids == nil {
-		return nil, fmt.Errorf("pop operation succeeded but no work item was returned")
+	if _, err := io.Copy(w, resp.Body); err != nil {
+		return fmt.Errorf("export stream failed: %w", err)
 	}
-	return sr.Ids, nil
+	return nil
 }
 
-func (c *Client) Count(channel string) (int, error) {
+// Import sends newline delimited JSON written by Export into a channel. duplicates is skip (default),
+// overwrite or error. It returns how many items were imported and how many duplicates were skipped.
+func (c *Client) Import(appname, channel string, r io.Reader, duplicates string) (int, int, error) {
 	if channel == "" {
-		return 0, fmt.Errorf("channel cannot be empty")
+		return 0, 0, fmt.Errorf("channel cannot be empty")
 	}
 
-	queryParams := map[string]string{"channel": channel}
-	urlStr := c.buildURL("/solidq/count", queryParams)
-	sr, err := c.doRequest(http.MethodGet, urlStr, nil)
+	var queryParams map[string]string
+	if duplicates != "" {
+		queryParams = map[string]string{"duplicates": duplicates}
+	}
+
+	urlStr := c.buildURL(routes.Import.URL(appname, channel), queryParams)
+	sr, err := c.doRequest(http.MethodPost, urlStr, r)
 	if err != nil {
 		if sr != nil && sr.Error != "" {
-			return 0, fmt.Errorf("server error on count: %s", sr.Error)
+			return sr.Count, sr.Skipped, fmt.Errorf("server error on import: %s", sr.Error)
 		}
-		return 0, fmt.Errorf("count request failed: %w", err)
+		return 0, 0, fmt.Errorf("import request failed: %w", err)
 	}
+
 	if !sr.Success {
-		return 0, fmt.Errorf("count operation failed on server: %s", sr.Error)
+		return sr.Count, sr.Skipped, fmt.Errorf("import operation failed on server: %s", sr.Error)
 	}
-	return sr.Count, nil
+	return sr.Count, sr.Skipped, nil
 }
 
-func (c *Client) Reset(channel string) error {
-	if channel == "" {
-		return fmt.Errorf("channel cannot be empty")
+// --- Change feed ---
+
+// ChangeEntry is one mutation of a channel in the change feed of an app. Settings changes come
+// as config, pause, resume, createchannel, recurring, unrecurring and durability, with the new
+// value in Payload.
+type ChangeEntry struct {
+	Seq     uint64   `json:"seq"`
+	Time    int64    `json:"time"` // unix nanoseconds
+	Op      string   `json:"op"`   // push, pop, ack, move, reset or a settings change
+	Channel string   `json:"channel"`
+	IDs     []string `json:"ids,omitempty"`
+	Payload string   `json:"payload,omitempty"`
+	From    string   `json:"from,omitempty"` // for moves: ready, inflight or scheduled
+	To      string   `json:"to,omitempty"`
+}
+
+// Changes reads the change feed of one shard of an app (0 unless the app is sharded) after the
+// since offset, 0 for the oldest change kept, and calls fn for every entry. With follow it keeps
+// reading until ctx is done. It returns the epoch of the feed and the offset to resume from;
+// an offset is only valid for the same epoch.
+func (c *Client) Changes(ctx context.Context, appname string, shard int, since uint64, follow bool, fn func(ChangeEntry) error) (string, uint64, error) {
+	if appname == "" {
+		return "", since, fmt.Errorf("appname cannot be empty")
+	}
+
+	queryParams := map[string]string{
+		"shard":  strconv.Itoa(shard),
+		"since":  strconv.FormatUint(since, 10),
+		"follow": strconv.FormatBool(follow),
+	}
+
+	urlStr := c.buildURL(routes.Changes.URL(appname), queryParams)
+	req, err := c.newRequest(http.MethodGet, urlStr, nil)
+	if err != nil {
+		return "", since, err
+	}
+
+	resp, err := c.httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return "", since, fmt.Errorf("changes request failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/x-ndjson") {
+		var sr serverResponse
+		if err := json.NewDecoder(resp.Body).Decode(&sr); err == nil && sr.Error != "" {
+			return "", since, fmt.Errorf("server error on changes: %s", sr.Error)
+		}
+		return "", since, fmt.Errorf("changes failed: %s", resp.Status)
 	}
-	queryParams := map[string]string{"channel": channel}
-	urlStr := c.buildURL("/solidq/reset", queryParams)
+
+	epoch := resp.Header.Get("X-Solidq-Epoch")
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var e ChangeEntry
+		if err := dec.Decode(&e); err != nil {
+			if err == io.EOF || ctx.Err() != nil {
+				return epoch, since, nil
+			}
+			return epoch, since, fmt.Errorf("changes stream failed: %w", err)
+		}
+
+		if err := fn(e); err != nil {
+			return epoch, since, err
+		}
+		since = e.Seq
+	}
+}
+
+// --- Recurring jobs ---
+
+// ListRecurring returns the recurring job definitions of an app.
+func (c *Client) ListRecurring(appname ...string) ([]RecurringJob, error) {
+	app := eitheror(appname, "core")
+	urlStr := c.buildURL(routes.ListRecurring.URL(app), nil)
 	sr, err := c.doRequest(http.MethodGet, urlStr, nil)
 	if err != nil {
 		if sr != nil && sr.Error != "" {
-			return fmt.Errorf("server error on reset: %s", sr.Error)
+			return nil, fmt.Errorf("server error on listRecurring: %s", sr.Error)
 		}
-		return fmt.Errorf("reset request failed: %w", err)
+		return nil, fmt.Errorf("listRecurring request failed: %w", err)
 	}
+
 	if !sr.Success {
-		return fmt.Errorf("reset operation failed on server: %s", sr.Error)
+		return nil, fmt.Errorf("listRecurring operation failed on server: %s", sr.Error)
 	}
-	return nil
+	return sr.Jobs, nil
 }
 
-func (c *Client) ListChannels(appname ...string) (map[string]int, error) {
-	app := eitheror(appname, "core")
-	urlStr := c.buildURL("/solidq/channels/"+app, nil)
+// GetRecurring returns a single recurring job definition.
+func (c *Client) GetRecurring(appname, name string) (*RecurringJob, error) {
+	if name == "" {
+		return nil, fmt.Errorf("name cannot be empty")
+	}
+
+	urlStr := c.buildURL(routes.GetRecurring.URL(appname, name), nil)
 	sr, err := c.doRequest(http.MethodGet, urlStr, nil)
 	if err != nil {
 		if sr != nil && sr.Error != "" {
-			return nil, fmt.Errorf("server error on listChannels: %s", sr.Error)
+			return nil, fmt.Errorf("server error on getRecurring: %s", sr.Error)
 		}
-		return nil, fmt.Errorf("listChannels request failed: %w", err)
+		return nil, fmt.Errorf("getRecurring request failed: %w", err)
 	}
 
-	if !sr.Success {
-		return nil, fmt.Errorf("listChannels operation failed on server: %s", sr.Error)
+	if !sr.Success || len(sr.Jobs) == 0 {
+		return nil, fmt.Errorf("getRecurring operation failed on server: %s", sr.Error)
 	}
+	return &sr.Jobs[0], nil
+}
 
-	if sr.Channels == nil {
-		return make(map[string]int), nil
+// SetRecurring creates or replaces a recurring job definition and returns it with its next run.
+func (c *Client) SetRecurring(appname string, job RecurringJob) (*RecurringJob, error) {
+	if job.Name == "" {
+		return nil, fmt.Errorf("name cannot be empty")
 	}
-	return sr.Channels, nil
+
+	body, err := json.Marshal(job)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode recurring job: %w", err)
+	}
+
+	urlStr := c.buildURL(routes.SetRecurring.URL(appname), nil)
+	sr, err := c.doRequest(http.MethodPost, urlStr, bytes.NewBuffer(body))
+	if err != nil {
+		if sr != nil && sr.Error != "" {
+			return nil, fmt.Errorf("server error on setRecurring: %s", sr.Error)
+		}
+		return nil, fmt.Errorf("setRecurring request failed: %w", err)
+	}
+
+	if !sr.Success || len(sr.Jobs) == 0 {
+		return nil, fmt.Errorf("setRecurring operation failed on server: %s", sr.Error)
+	}
+	return &sr.Jobs[0], nil
+}
+
+// DeleteRecurring removes a recurring job definition.
+func (c *Client) DeleteRecurring(appname, name string) error {
+	if name == "" {
+		return fmt.Errorf("name cannot be empty")
+	}
+
+	urlStr := c.buildURL(routes.DelRecurring.URL(appname, name), nil)
+	sr, err := c.doRequest(http.MethodDelete, urlStr, nil)
+	if err != nil {
+		if sr != nil && sr.Error != "" {
+			return fmt.Errorf("server error on deleteRecurring: %s", sr.Error)
+		}
+		return fmt.Errorf("deleteRecurring request failed: %w", err)
+	}
+
+	if !sr.Success {
+		return fmt.Errorf("deleteRecurring operation failed on server: %s", sr.Error)
+	}
+	return nil
 }
 
 // --- WorkLoop Method ---
 
 // WorkLoop continuously polls a channel for work and processes it using the workerFunc.
 // It's a blocking call that exits on os.Interrupt or syscall.SIGTERM.
-// workerFunc is called synchronously for each piece of work.
+// workerFunc is called synchronously for each piece of work. It returns the channel to route
+// the work to next, Done (or "") to finish it, or Failed to nack it for a later retry.
 // If an error occurs during Pop (not an empty queue), it logs the error and continues.
 // If workerFunc itself panics, WorkLoop will also panic. Consider adding panic recovery
 // within workerFunc if needed.
@@ -407,7 +914,7 @@ func (c *Client) WorkLoop(
 			// Proceed with Pop
 		}
 
-		ids, err := c.Pop(channel)
+		sr, err := c.pop(channel, 1, 0)
 		if err != nil {
 			// Log Pop error and continue, unless context is cancelled
 			// This allows the loop to be resilient to transient network issues.
@@ -424,20 +931,34 @@ func (c *Client) WorkLoop(
 			}
 		}
 
-		if len(ids) > 0 {
-			for _, id := range ids {
+		if len(sr.Ids) > 0 {
+			for _, id := range sr.Ids {
 				// fmt.Printf("WorkLoop on channel '%s' received work: ID=%s\n", channel, work.ID)
-				workerCtx := newSolidContext(id, channel, c)
+				workerCtx := &solidContextImpl{id: id, channel: channel, client: c}
 				// Execute the worker function.
 				// Consider adding panic recovery here if workerFunc is untrusted.
 				// For now, if workerFunc panics, WorkLoop will panic.
 
 				nextChannel := workerFunc(workerCtx)
-				if nextChannel != "" && nextChannel != "noop" {
+				if nextChannel == Failed {
+					if err = c.Nack(channel, id, workerCtx.retryAfter); err != nil {
+						fmt.Printf("Unable to nack %s on channel '%s': %v\n", id, channel, err)
+					}
+					continue
+				}
+
+				if nextChannel != "" && nextChannel != Done {
 					if err = c.Push(nextChannel, id); err != nil {
 						fmt.Println("Unable to route to ", nextChannel)
 					}
 				}
+
+				// Capped channels and retried items are held by the server until they are acked
+				if sr.MustAck {
+					if err = c.Ack(channel, id); err != nil {
+						fmt.Printf("Unable to ack %s on channel '%s': %v\n", id, channel, err)
+					}
+				}
 			}
 			// After workerFunc completes, the loop continues to Pop immediately.
 		} else {
@@ -0,0 +1,551 @@
+package solidq
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+	"github.com/sfi2k7/solidq/routes"
+)
+
+const (
+	// clusterApplyTimeout bounds how long a change waits to be committed by the cluster
+	clusterApplyTimeout = 10 * time.Second
+	// clusterPoll is how often a node checks its membership
+	clusterPoll = time.Second
+	// forwardedHeader marks a request a member already forwarded, so it is never forwarded twice
+	forwardedHeader = "X-Solidq-Forwarded"
+)
+
+var (
+	ErrNotClustered = errors.New("not supported in a cluster")
+	ErrNoLeader     = errors.New("the cluster has no leader")
+)
+
+// ClusterMember is one node of a cluster
+type ClusterMember struct {
+	ID    string `json:"id"`
+	Raft  string `json:"raft"`
+	HTTP  string `json:"http,omitempty"`
+	Voter bool   `json:"voter"`
+}
+
+// ClusterStatus is what a node knows about its cluster
+type ClusterStatus struct {
+	ID      string          `json:"id"`
+	Leader  string          `json:"leader"`
+	State   string          `json:"state"`
+	Members []ClusterMember `json:"members"`
+}
+
+// cluster replicates every change to the apps of a registry through a Raft log. Only the leader
+// takes changes, the others forward requests to it.
+type cluster struct {
+	id        string
+	http      string
+	join      string
+	secret    string
+	raft      *raft.Raft
+	fsm       *clusterfsm
+	store     *raftboltdb.BoltStore
+	transport *raft.NetworkTransport
+}
+
+// newcluster starts the Raft node of a server, its log and snapshots live in root/raft
+func newcluster(apps *registry, options *SeverOptions) (*cluster, error) {
+	if options.ClusterID == "" || options.ClusterAddr == "" {
+		return nil, errors.New("a cluster node needs an ID and a Raft address")
+	}
+
+	dir := filepath.Join(apps.root, "raft")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	logger := hclog.New(&hclog.LoggerOptions{Name: "raft", Level: hclog.Warn})
+
+	config := raft.DefaultConfig()
+	config.LocalID = raft.ServerID(options.ClusterID)
+	config.Logger = logger
+
+	store, err := raftboltdb.NewBoltStore(filepath.Join(dir, "raft.db"))
+	if err != nil {
+		return nil, err
+	}
+
+	snaps, err := raft.NewFileSnapshotStoreWithLogger(dir, 2, logger)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	transport, err := raft.NewTCPTransportWithLogger(options.ClusterAddr, nil, 3, 10*time.Second, logger)
+	if err != nil {
+		store.Close()
+		return nil, err
+	}
+
+	c := &cluster{
+		id:        options.ClusterID,
+		http:      strings.TrimRight(options.ClusterHTTP, "/"),
+		join:      strings.TrimRight(options.ClusterJoin, "/"),
+		secret:    options.Secret,
+		fsm:       &clusterfsm{apps: apps},
+		store:     store,
+		transport: transport,
+	}
+
+	if c.http == "" {
+		host, _, _ := net.SplitHostPort(string(transport.LocalAddr()))
+		c.http = "http://" + net.JoinHostPort(host, strconv.Itoa(options.Port))
+	}
+
+	if c.raft, err = raft.NewRaft(config, c.fsm, store, store, snaps, transport); err != nil {
+		transport.Close()
+		store.Close()
+		return nil, err
+	}
+
+	if options.ClusterBootstrap {
+		existing, err := raft.HasExistingState(store, store, snaps)
+		if err == nil && !existing {
+			err = c.raft.BootstrapCluster(raft.Configuration{Servers: []raft.Server{
+				{ID: config.LocalID, Address: transport.LocalAddr()},
+			}}).Error()
+		}
+
+		if err != nil {
+			c.close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// close stops the Raft node, after it no change is applied to the apps
+func (c *cluster) close() error {
+	err := c.raft.Shutdown().Error()
+	if cerr := c.transport.Close(); err == nil {
+		err = cerr
+	}
+
+	if cerr := c.store.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// run joins the cluster through another member until this node is part of it, and while it
+// leads keeps its HTTP address in the log so the others can forward to it
+func (c *cluster) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(clusterPoll)
+	defer ticker.Stop()
+
+	for {
+		if c.leads() {
+			if addr, ok := c.fsm.peers.Load(c.id); !ok || addr != c.http {
+				if err := c.apply(command{Op: cmdPeer, Node: c.id, Addr: c.http}).err; err != nil {
+					fmt.Println("Cluster: announcing the leader:", err)
+				}
+			}
+		} else if c.join != "" && !c.member() {
+			if err := c.requestjoin(); err != nil {
+				fmt.Println("Cluster: joining through", c.join+":", err)
+			}
+		}
+
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// member tells whether this node is in the configuration it knows of
+func (c *cluster) member() bool {
+	f := c.raft.GetConfiguration()
+	if f.Error() != nil {
+		return false
+	}
+
+	for _, srv := range f.Configuration().Servers {
+		if string(srv.ID) == c.id {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *cluster) requestjoin() error {
+	query := url.Values{
+		"id":   {c.id},
+		"raft": {string(c.transport.LocalAddr())},
+		"http": {c.http},
+	}
+
+	req, err := http.NewRequest(routes.Join.Method, c.join+routes.Join.Path+"?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+
+	// the secret goes in a header, URLs end up in access logs
+	if c.secret != "" {
+		req.Header.Set("Authorization", c.secret)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	var r response
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return fmt.Errorf("join: %s", res.Status)
+	}
+
+	if !r.Success {
+		return errors.New(r.Error)
+	}
+	return nil
+}
+
+// apply commits a command to the log and returns what applying it on this node gave
+func (c *cluster) apply(cmd command) applied {
+	cmd.Now = time.Now().UnixNano()
+	data, err := json.Marshal(cmd)
+	if err != nil {
+		return applied{err: err}
+	}
+
+	f := c.raft.Apply(data, clusterApplyTimeout)
+	if err := f.Error(); err != nil {
+		return applied{err: err}
+	}
+	return f.Response().(applied)
+}
+
+// addmember adds a voter to the cluster, or updates its addresses when it is already in
+func (c *cluster) addmember(id, addr, httpurl string) error {
+	if id == "" || addr == "" || httpurl == "" {
+		return errors.New("a member needs an id, a raft address and an http URL")
+	}
+
+	f := c.raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		return err
+	}
+
+	known := false
+	for _, srv := range f.Configuration().Servers {
+		if string(srv.ID) == id && string(srv.Address) == addr {
+			known = true
+			continue
+		}
+
+		// an old member at the same ID or address is replaced
+		if string(srv.ID) == id || string(srv.Address) == addr {
+			if err := c.raft.RemoveServer(srv.ID, 0, clusterApplyTimeout).Error(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if !known {
+		if err := c.raft.AddVoter(raft.ServerID(id), raft.ServerAddress(addr), 0, clusterApplyTimeout).Error(); err != nil {
+			return err
+		}
+	}
+	return c.apply(command{Op: cmdPeer, Node: id, Addr: httpurl}).err
+}
+
+func (c *cluster) removemember(id string) error {
+	if err := c.raft.RemoveServer(raft.ServerID(id), 0, clusterApplyTimeout).Error(); err != nil {
+		return err
+	}
+	return c.apply(command{Op: cmdUnpeer, Node: id}).err
+}
+
+func (c *cluster) status() (*ClusterStatus, error) {
+	f := c.raft.GetConfiguration()
+	if err := f.Error(); err != nil {
+		return nil, err
+	}
+
+	_, leader := c.raft.LeaderWithID()
+	st := &ClusterStatus{ID: c.id, Leader: string(leader), State: c.raft.State().String()}
+	for _, srv := range f.Configuration().Servers {
+		m := ClusterMember{ID: string(srv.ID), Raft: string(srv.Address), Voter: srv.Suffrage == raft.Voter}
+		if addr, ok := c.fsm.peers.Load(m.ID); ok {
+			m.HTTP = addr.(string)
+		}
+		st.Members = append(st.Members, m)
+	}
+	return st, nil
+}
+
+func (c *cluster) leads() bool {
+	return c.raft.State() == raft.Leader
+}
+
+// leaderurl returns the HTTP URL of the leader to forward a request to, nil when this node leads
+func (c *cluster) leaderurl(req *http.Request) (*url.URL, error) {
+	if c.leads() {
+		return nil, nil
+	}
+
+	if req.Header.Get(forwardedHeader) != "" {
+		return nil, errors.New("this node is not the cluster leader")
+	}
+
+	_, id := c.raft.LeaderWithID()
+	if id == "" {
+		return nil, ErrNoLeader
+	}
+
+	addr, ok := c.fsm.peers.Load(string(id))
+	if !ok {
+		return nil, fmt.Errorf("%w: the address of %s is not known yet", ErrNoLeader, id)
+	}
+	return url.Parse(addr.(string))
+}
+
+// forward proxies a request to the leader, streamed responses are flushed as they come
+func (c *cluster) forward(leader *url.URL, w http.ResponseWriter, req *http.Request) {
+	proxy := httputil.NewSingleHostReverseProxy(leader)
+	proxy.FlushInterval = -1
+	req.Header.Set(forwardedHeader, c.id)
+	proxy.ServeHTTP(w, req)
+}
+
+// clusterlocal tells which requests a member answers itself instead of forwarding to the leader
+func clusterlocal(method, path string) bool {
+	return method == routes.Cluster.Method && path == routes.Cluster.Path
+}
+
+// queue is what the endpoints that change an app need of it: the app itself, or in a cluster a
+// clusterapp whose changes go through the Raft log
+type queue interface {
+	Count(channel string) (int, error)
+	Peek(channel string, count int) ([]string, error)
+	Push(channel, id string) error
+	PopWait(channel string, count int, wait time.Duration) ([]string, bool, error)
+	Ack(channel, id string) error
+	Nack(channel, id string, delay time.Duration) error
+	ResetChannel(channel string) error
+	ChannelConfig(channel string) (ChannelConfig, error)
+	SetChannelConfig(channel string, cc ChannelConfig) error
+	Pause(channel, mode string) error
+	Resume(channel string) error
+	CreateChannel(channel string) error
+	SetRecurring(job RecurringJob) (RecurringJob, error)
+	DeleteRecurring(name string) error
+	Import(channel string, r io.Reader, duplicates string) (int, int, error)
+}
+
+// clusterapp commits the changes to an app to the cluster, reads are served by the app
+type clusterapp struct {
+	*App
+	c    *cluster
+	name string
+}
+
+func (a clusterapp) Push(channel, id string) error {
+	return a.c.apply(command{Op: cmdPush, App: a.name, Channel: channel, ID: id}).err
+}
+
+// PopWait only commits a pop once one could return something, so waiting pops don't fill the
+// log with empty ones
+func (a clusterapp) PopWait(channel string, count int, wait time.Duration) ([]string, bool, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		changed := make([]<-chan struct{}, len(a.shards))
+		for i, q := range a.shards {
+			changed[i] = q.waiter()
+		}
+
+		if a.poppable(channel) {
+			res := a.c.apply(command{Op: cmdPop, App: a.name, Channel: channel, Count: count})
+			if res.err != nil || len(res.ids) > 0 {
+				return res.ids, res.mustack, res.err
+			}
+		}
+
+		left := time.Until(deadline)
+		if left <= 0 || a.meta().draining.Load() {
+			return nil, false, nil
+		}
+
+		if left > time.Second {
+			left = time.Second
+		}
+		anychange(changed, left)
+	}
+}
+
+// poppable tells whether a pop may return anything. Items in flight or scheduled can come back
+// any time, so they count too, as does an error the pop would return.
+func (a clusterapp) poppable(channel string) bool {
+	for _, q := range a.shards {
+		for _, count := range []func(string) (int, error){q.Count, q.InFlight, q.Scheduled} {
+			if n, err := count(channel); err != nil || n > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (a clusterapp) Ack(channel, id string) error {
+	return a.c.apply(command{Op: cmdAck, App: a.name, Channel: channel, ID: id}).err
+}
+
+// Nack draws the backoff delay, jitter included, before committing, so every node schedules
+// the retry at the same time
+func (a clusterapp) Nack(channel, id string, delay time.Duration) error {
+	if delay <= 0 {
+		cc, err := a.ChannelConfig(channel)
+		if err != nil {
+			return err
+		}
+
+		n, err := a.item(channel, id).Attempts(channel, id)
+		if err != nil {
+			return err
+		}
+		delay = cc.Backoff.delay(n + 1)
+	}
+
+	return a.c.apply(command{Op: cmdNack, App: a.name, Channel: channel, ID: id, Delay: delay}).err
+}
+
+func (a clusterapp) ResetChannel(channel string) error {
+	return a.c.apply(command{Op: cmdReset, App: a.name, Channel: channel}).err
+}
+
+func (a clusterapp) SetChannelConfig(channel string, cc ChannelConfig) error {
+	return a.c.apply(command{Op: cmdConfig, App: a.name, Channel: channel, Config: &cc}).err
+}
+
+func (a clusterapp) Pause(channel, mode string) error {
+	return a.c.apply(command{Op: cmdPause, App: a.name, Channel: channel, Mode: mode}).err
+}
+
+func (a clusterapp) Resume(channel string) error {
+	return a.c.apply(command{Op: cmdResume, App: a.name, Channel: channel}).err
+}
+
+func (a clusterapp) CreateChannel(channel string) error {
+	return a.c.apply(command{Op: cmdCreateChannel, App: a.name, Channel: channel}).err
+}
+
+// SetRecurring commits the job, every node computes its next run from the leader's clock
+func (a clusterapp) SetRecurring(job RecurringJob) (RecurringJob, error) {
+	if err := job.validate(); err != nil {
+		return job, err
+	}
+
+	res := a.c.apply(command{Op: cmdSetRecurring, App: a.name, Job: &job})
+	return res.job, res.err
+}
+
+func (a clusterapp) DeleteRecurring(name string) error {
+	return a.c.apply(command{Op: cmdDelRecurring, App: a.name, ID: name}).err
+}
+
+// Import commits every importBatch items of the export as one entry of the Raft log
+func (a clusterapp) Import(channel string, r io.Reader, duplicates string) (int, int, error) {
+	if err := validduplicates(duplicates); err != nil {
+		return 0, 0, err
+	}
+
+	imported, skipped := 0, 0
+	batch := make([]ExportItem, 0, importBatch)
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		res := a.c.apply(command{Op: cmdImport, App: a.name, Channel: channel, Items: batch, Mode: duplicates})
+		imported += res.count
+		skipped += res.skipped
+		batch = batch[:0]
+		return res.err
+	}
+
+	err := readitems(r, func(item ExportItem) error {
+		batch = append(batch, item)
+		if len(batch) < importBatch {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return imported, skipped, err
+	}
+	return imported, skipped, flush()
+}
+
+// firerecurring proposes a fire of the app's due jobs when this node leads. The runs and the
+// new next runs are then written by every node alike.
+func (c *cluster) firerecurring(app string, a *App, now time.Time) error {
+	if !c.leads() {
+		return nil
+	}
+
+	due, err := a.meta().recurringdue(now)
+	if err != nil || !due {
+		return err
+	}
+	return c.apply(command{Op: cmdFire, App: app}).err
+}
+
+// queue returns the app the write endpoints change
+func (s *Server) queue(appname string) (queue, error) {
+	a, err := s.apps.ensure(appname)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.cluster == nil {
+		return a, nil
+	}
+	return clusterapp{App: a, c: s.cluster, name: appname}, nil
+}
+
+func (s *Server) createapp(appname string, shards int, by string) error {
+	if s.cluster == nil {
+		_, err := s.apps.create(appname, shards, by)
+		return err
+	}
+
+	if err := validapp(appname); err != nil {
+		return err
+	}
+	return s.cluster.apply(command{Op: cmdCreateApp, App: appname, Shards: shards, By: by}).err
+}
+
+func (s *Server) deleteapp(appname string) error {
+	if s.cluster == nil {
+		return s.apps.delete(appname)
+	}
+
+	if err := validapp(appname); err != nil {
+		return err
+	}
+	return s.cluster.apply(command{Op: cmdDeleteApp, App: appname}).err
+}
@@ -0,0 +1,271 @@
+package solidq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/sfi2k7/solidq/client"
+	"github.com/sfi2k7/solidq/routes"
+)
+
+type testnode struct {
+	id     string
+	server *Server
+	http   *httptest.Server
+	client *client.Client
+}
+
+// startnode starts a cluster member behind an httptest.Server, whose URL it needs to know first
+func startnode(t *testing.T, root, id string, bootstrap bool, join string) *testnode {
+	t.Helper()
+	n := &testnode{id: id}
+	ready := make(chan struct{})
+	n.http = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-ready
+		n.server.Handler().ServeHTTP(w, r)
+	}))
+
+	var err error
+	n.server, err = NewServer(&SeverOptions{
+		RootPath:         root,
+		Secret:           "secret",
+		ClusterID:        id,
+		ClusterAddr:      "127.0.0.1:0",
+		ClusterHTTP:      n.http.URL,
+		ClusterBootstrap: bootstrap,
+		ClusterJoin:      join,
+	})
+	close(ready)
+	if err != nil {
+		n.http.Close()
+		t.Fatal(err)
+	}
+
+	if n.client, err = client.NewClient(n.http.URL, client.WithSecret("secret")); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(n.stop)
+	return n
+}
+
+func (n *testnode) stop() {
+	if n.server == nil {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	n.server.Shutdown(ctx)
+	n.http.Close()
+	n.server = nil
+}
+
+// waitleader waits until a node other than old leads a cluster of members nodes, all with their
+// HTTP address known
+func waitleader(t *testing.T, nodes []*testnode, old string, members int) *testnode {
+	t.Helper()
+	for deadline := time.Now().Add(30 * time.Second); time.Now().Before(deadline); time.Sleep(200 * time.Millisecond) {
+		for _, n := range nodes {
+			st, err := n.server.cluster.status()
+			if err != nil || st.State != "Leader" || st.ID == old {
+				continue
+			}
+
+			known := 0
+			for _, m := range st.Members {
+				if m.HTTP != "" {
+					known++
+				}
+			}
+
+			if known >= members {
+				return n
+			}
+		}
+	}
+	t.Fatal(errors.New("no leader was elected"))
+	return nil
+}
+
+// popall pops until count items came back or the channel is empty
+func popall(n *testnode, count int) ([]string, error) {
+	var ids []string
+	for len(ids) < count {
+		popped, err := n.client.Pop("core:jobs", count-len(ids))
+		if err != nil || len(popped) == 0 {
+			return ids, err
+		}
+		ids = append(ids, popped...)
+	}
+	return ids, nil
+}
+
+// TestClusterFailover runs a three node cluster, kills its leader and checks that pushes and
+// pops keep working on the two nodes left
+func TestClusterFailover(t *testing.T) {
+	if testing.Short() {
+		t.Skip("elections take a few seconds")
+	}
+
+	const items = 50
+	dir := t.TempDir()
+
+	var nodes []*testnode
+	for i := 0; i < 3; i++ {
+		join := ""
+		if i > 0 {
+			join = nodes[0].http.URL
+		}
+		nodes = append(nodes, startnode(t, filepath.Join(dir, "node"+strconv.Itoa(i)), "node"+strconv.Itoa(i), i == 0, join))
+	}
+
+	leader := waitleader(t, nodes, "", 3)
+
+	// write through the followers, they forward to the leader
+	var followers []*testnode
+	for _, n := range nodes {
+		if n != leader {
+			followers = append(followers, n)
+		}
+	}
+
+	for i := 0; i < items; i++ {
+		if err := followers[0].client.Push("core:jobs", "before-"+strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	popped, err := popall(followers[1], items/2)
+	if err != nil || len(popped) != items/2 {
+		t.Fatalf("popped %d of %d items before the failover: %v", len(popped), items/2, err)
+	}
+
+	leader.stop()
+	waitleader(t, followers, leader.id, 2)
+
+	for i := 0; i < items; i++ {
+		if err := followers[0].client.Push("core:jobs", "after-"+strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	rest, err := popall(followers[1], 2*items)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	seen := make(map[string]bool)
+	for _, id := range append(popped, rest...) {
+		if seen[id] {
+			t.Errorf("%s was popped twice", id)
+		}
+		seen[id] = true
+	}
+
+	if len(seen) != 2*items {
+		t.Errorf("popped %d of %d items", len(seen), 2*items)
+	}
+}
+
+// TestClusterRecurringAndImport checks that the leader fires recurring jobs and takes imports
+// through the Raft log, and that a restore is turned down
+func TestClusterRecurringAndImport(t *testing.T) {
+	if testing.Short() {
+		t.Skip("elections take a few seconds")
+	}
+
+	n := startnode(t, t.TempDir(), "node0", true, "")
+	waitleader(t, []*testnode{n}, "", 1)
+
+	job, err := n.client.SetRecurring("core", client.RecurringJob{Name: "tick", Channel: "jobs", Interval: 1, IDTemplate: "tick-{seq}"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if job.NextRun.IsZero() {
+		t.Error("the job came back without its next run")
+	}
+
+	eventually(t, "a run of the recurring job", func() bool {
+		count, err := n.client.Count("core:jobs")
+		return err == nil && count > 0
+	})
+
+	if err := n.client.DeleteRecurring("core", "tick"); err != nil {
+		t.Fatal(err)
+	}
+
+	imported, skipped, err := n.client.Import("core", "imported", strings.NewReader("{\"id\":\"x\"}\n{\"id\":\"y\"}\n{\"id\":\"x\"}\n"), "")
+	if err != nil || imported != 2 || skipped != 1 {
+		t.Fatalf("imported %d and skipped %d: %v", imported, skipped, err)
+	}
+
+	if count, err := n.client.Count("core:imported"); err != nil || count != 2 {
+		t.Errorf("count %d after the import: %v", count, err)
+	}
+
+	req, err := http.NewRequest(http.MethodPost, n.http.URL+routes.Restore.URL("core"), strings.NewReader("backup"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "secret")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var body response
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+
+	if body.Success || body.Error != ErrNotClustered.Error() {
+		t.Errorf("restore in a cluster answered %+v", body)
+	}
+}
+
+func TestJoinSecretInHeader(t *testing.T) {
+	requests := make(chan *http.Request, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests <- r
+		w.Write([]byte(`{"success":true}`))
+	}))
+	defer ts.Close()
+
+	transport, err := raft.NewTCPTransport("127.0.0.1:0", nil, 1, time.Second, io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer transport.Close()
+
+	c := &cluster{id: "node1", http: "http://node1", join: ts.URL, secret: "secret", transport: transport}
+	if err := c.requestjoin(); err != nil {
+		t.Fatal(err)
+	}
+
+	r := <-requests
+	if r.Header.Get("Authorization") != "secret" {
+		t.Errorf("join sent Authorization %q", r.Header.Get("Authorization"))
+	}
+
+	if strings.Contains(r.URL.RawQuery, "secret") {
+		t.Errorf("join sent the secret in the URL: %s", r.URL)
+	}
+
+	if r.URL.Query().Get("id") != "node1" || r.URL.Query().Get("http") != "http://node1" {
+		t.Errorf("join sent %s", r.URL)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/sfi2k7/solidq/client"
+)
+
+func usage() {
+	fmt.Println("usage: solidctl <export|import|repair> [flags]")
+	fmt.Println("  export -app core -channel jobs [-file jobs.ndjson]")
+	fmt.Println("  import -app core -channel jobs [-file jobs.ndjson] [-duplicates skip|overwrite|error]")
+	fmt.Println("  repair -app core")
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+
+	fs := flag.NewFlagSet(os.Args[1], flag.ExitOnError)
+	server := fs.String("server", "http://localhost:8080/", "SolidQ server URL")
+	secret := fs.String("secret", "", "Server secret")
+	app := fs.String("app", "core", "Application name")
+	channel := fs.String("channel", "", "Channel name")
+	file := fs.String("file", "-", "NDJSON file, - for stdin/stdout")
+	duplicates := fs.String("duplicates", "skip", "What import does with IDs already in the channel: skip, overwrite or error")
+	fs.Parse(os.Args[2:])
+
+	c, err := client.NewClient(*server, client.WithSecret(*secret))
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	switch os.Args[1] {
+	case "export":
+		err = export(c, *app, *channel, *file)
+	case "import":
+		err = importfile(c, *app, *channel, *file, *duplicates)
+	case "repair":
+		err = repair(c, *app)
+	default:
+		usage()
+		os.Exit(2)
+	}
+
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func export(c *client.Client, app, channel, file string) error {
+	var w io.Writer = os.Stdout
+	if file != "-" {
+		f, err := os.Create(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+
+	return c.Export(app, channel, w)
+}
+
+func importfile(c *client.Client, app, channel, file, duplicates string) error {
+	var r io.Reader = os.Stdin
+	if file != "-" {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	imported, skipped, err := c.Import(app, channel, r, duplicates)
+	fmt.Fprintf(os.Stderr, "Imported %d items, skipped %d duplicates\n", imported, skipped)
+	return err
+}
+
+func repair(c *client.Client, app string) error {
+	fixed, err := c.RepairDepths(app)
+	if err != nil {
+		return err
+	}
+
+	for channel, depth := range fixed {
+		fmt.Printf("%s: depth corrected to %d\n", channel, depth)
+	}
+	fmt.Fprintf(os.Stderr, "Repaired %d channels\n", len(fixed))
+	return nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// runbackup downloads a snapshot from a running server into a directory and keeps the newest ones
+func runbackup(args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	server := fs.String("server", "http://localhost:8080", "SolidQ server URL")
+	secret := fs.String("secret", "secret", "Server secret")
+	app := fs.String("app", "", "App to back up, all apps as a tar stream when empty")
+	dir := fs.String("dir", "./backups", "Directory to write backups to")
+	keep := fs.Int("keep", 7, "Number of backups to keep per app, 0 keeps all")
+	fs.Parse(args)
+
+	name, ext, path := "solidq", ".tar", "/solidq/admin/backup"
+	if *app != "" {
+		name, ext, path = *app, ".db", "/solidq/admin/backup/"+url.PathEscape(*app)
+	}
+
+	if err := os.MkdirAll(*dir, 0755); err != nil {
+		return err
+	}
+
+	resp, err := http.Get(strings.TrimSuffix(*server, "/") + path + "?secret=" + url.QueryEscape(*secret))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json") {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("backup failed: %s %s", resp.Status, string(body))
+	}
+
+	// a sharded app comes as a tar of its shards
+	if resp.Header.Get("Content-Type") == "application/x-tar" {
+		ext = ".tar"
+	}
+
+	// write to a temp file first so an interrupted download never looks like a backup
+	target := filepath.Join(*dir, name+"-"+time.Now().UTC().Format("20060102T150405Z")+ext)
+	tmp, err := os.CreateTemp(*dir, ".partial-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	n, err := io.Copy(tmp, resp.Body)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote %s (%d bytes)\n", target, n)
+
+	return rotate(*dir, name+"-", ext, *keep)
+}
+
+// rotate removes all but the newest keep files named <prefix><timestamp><ext>
+func rotate(dir, prefix, ext string, keep int) error {
+	if keep <= 0 {
+		return nil
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	var backups []string
+	for _, file := range files {
+		if !file.IsDir() && strings.HasPrefix(file.Name(), prefix) && strings.HasSuffix(file.Name(), ext) {
+			backups = append(backups, file.Name())
+		}
+	}
+
+	// timestamps sort lexically, oldest first
+	sort.Strings(backups)
+	for len(backups) > keep {
+		if err := os.Remove(filepath.Join(dir, backups[0])); err != nil {
+			return err
+		}
+		fmt.Println("Removed old backup", backups[0])
+		backups = backups[1:]
+	}
+	return nil
+}
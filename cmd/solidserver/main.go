@@ -3,16 +3,51 @@ package main
 import (
 	"flag"
 	"fmt"
+	"os"
+	"strings"
 
 	"github.com/sfi2k7/solidq"
 )
 
 func main() {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		if err := runcommand(os.Args[1], os.Args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	appname := flag.String("app", "core", "Application name")
 	port := flag.Int("port", 8080, "Port to listen on")
+	root := flag.String("root", "", "Directory of the app databases, /var/lib/solidq/ by default")
 	version := flag.Bool("version", false, "Show version information")
+	idle := flag.Duration("idle", 0, "Close app databases unused for this long, 0 keeps them open")
+	maxopen := flag.Int("maxopen", 0, "Maximum number of open app databases, 0 means no limit")
+	strict := flag.Bool("strict", false, "Require apps and channels to be created before they are used")
+	durability := flag.String("durability", "", "Default durability of apps: always, batched or nosync (batched when empty)")
+	replicate := flag.Bool("replicate", false, "Keep a mutation log so followers can replicate this server")
+	follow := flag.String("follow", "", "URL of a primary to replicate, the server only serves reads until promoted")
+	followsecret := flag.String("followsecret", "secret", "Secret of the primary")
+	changefeed := flag.Bool("changefeed", false, "Keep a change log of every app, served at /solidq/changes")
+	logentries := flag.Int("logentries", 0, "Change log entries kept per app file, 100000 when none of -logentries, -logage and -logbytes is set")
+	logage := flag.Duration("logage", 0, "How long change log entries are kept, 0 for no age limit")
+	logbytes := flag.Int64("logbytes", 0, "Bytes of change log entries kept per app file, 0 for no size limit")
+	clusterid := flag.String("clusterid", "", "Name of this node in a Raft cluster, empty runs a single server")
+	clusteraddr := flag.String("clusteraddr", "", "host:port this node takes Raft traffic on")
+	clusterhttp := flag.String("clusterhttp", "", "URL other members forward requests to, http://<clusteraddr host>:<port> when empty")
+	bootstrap := flag.Bool("bootstrap", false, "Start a new cluster with this node as its first member")
+	join := flag.String("join", "", "URL of a cluster member to join through")
+	resp := flag.String("resp", "", "Address to serve the Redis protocol on, like :6380, empty turns it off")
+	fpredis := flag.String("fpredis", "", "Address of a Redis server to take foreign packets from, empty turns the bridge off")
+	fppassword := flag.String("fppassword", "", "Password of the Redis server")
+	fpkey := flag.String("fpkey", "", "Sorted set the packets are popped from, solidq:fpset when empty")
+	fpreplykey := flag.String("fpreplykey", "", "List replies are pushed to, solidq:fpreplies when empty")
+	fpaddr := flag.String("fpaddr", "", "Address to serve the line protocol on, like :7070, empty turns it off")
+	storage := flag.String("storage", "", "Where apps are kept: bolt files or memory, lost on exit (bolt when empty)")
+	compact := flag.Float64("compact", 0, "Compact apps automatically once free pages pass this share of the file (0..1), 0 disables")
 	if *version {
-		fmt.Println("SolidQ version 0.0.3")
+		fmt.Println("SolidQ version", solidq.Version)
 		return
 	}
 
@@ -20,8 +55,33 @@ func main() {
 
 	fmt.Println("Starting SolidQ server...")
 	options := &solidq.SeverOptions{
-		Appname: *appname,
-		Port:    *port,
+		Appname:          *appname,
+		Port:             *port,
+		RootPath:         *root,
+		CompactThreshold: *compact,
+		IdleTimeout:      *idle,
+		MaxOpenApps:      *maxopen,
+		Strict:           *strict,
+		Durability:       *durability,
+		Replicate:        *replicate,
+		Follow:           *follow,
+		FollowSecret:     *followsecret,
+		ChangeFeed:       *changefeed,
+		ChangeLogEntries: *logentries,
+		ChangeLogAge:     *logage,
+		ChangeLogBytes:   *logbytes,
+		ClusterID:        *clusterid,
+		ClusterAddr:      *clusteraddr,
+		ClusterHTTP:      *clusterhttp,
+		ClusterBootstrap: *bootstrap,
+		ClusterJoin:      *join,
+		RESPAddr:         *resp,
+		FPRedisAddr:      *fpredis,
+		FPRedisPassword:  *fppassword,
+		FPKey:            *fpkey,
+		FPReplyKey:       *fpreplykey,
+		FPAddr:           *fpaddr,
+		Storage:          *storage,
 	}
 
 	err := solidq.StartQueServer(options)
@@ -29,3 +89,16 @@ func main() {
 		panic(err)
 	}
 }
+
+func runcommand(command string, args []string) error {
+	switch command {
+	case "backup":
+		return runbackup(args)
+	case "restore":
+		return runrestore(args)
+	case "promote":
+		return runpromote(args)
+	default:
+		return fmt.Errorf("unknown command %q", command)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// runpromote turns a follower into a primary: it stops replicating and starts taking writes
+func runpromote(args []string) error {
+	fs := flag.NewFlagSet("promote", flag.ExitOnError)
+	server := fs.String("server", "http://localhost:8080", "SolidQ follower URL")
+	secret := fs.String("secret", "secret", "Server secret")
+	fs.Parse(args)
+
+	urlStr := strings.TrimSuffix(*server, "/") + "/solidq/admin/promote?secret=" + url.QueryEscape(*secret)
+	resp, err := http.Post(urlStr, "application/json", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var sr struct {
+		Success bool   `json:"success"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&sr); err != nil {
+		return fmt.Errorf("promote failed: %s", resp.Status)
+	}
+
+	if !sr.Success {
+		return fmt.Errorf("promote failed: %s", sr.Error)
+	}
+
+	fmt.Println("Promoted", *server)
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runrestore uploads a backup to a running server. A .db file restores one app,
+// a .tar written by the backup command restores every app in it.
+func runrestore(args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	server := fs.String("server", "http://localhost:8080", "SolidQ server URL")
+	secret := fs.String("secret", "secret", "Server secret")
+	app := fs.String("app", "", "App to restore, defaults to the name of the .db file")
+	file := fs.String("file", "", "Snapshot (.db) or backup archive (.tar) to restore")
+	fs.Parse(args)
+
+	if *file == "" {
+		return errors.New("-file is required")
+	}
+
+	f, err := os.Open(*file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if strings.HasSuffix(*file, ".tar") {
+		tr := tar.NewReader(f)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			if !strings.HasSuffix(hdr.Name, ".db") || (*app != "" && hdr.Name != *app+".db") {
+				continue
+			}
+
+			if err := restoreapp(*server, *secret, strings.TrimSuffix(hdr.Name, ".db"), tr); err != nil {
+				return err
+			}
+		}
+	}
+
+	name := *app
+	if name == "" {
+		// backups are named <app>-<timestamp>.db
+		name = strings.TrimSuffix(filepath.Base(*file), ".db")
+		if i := strings.LastIndex(name, "-"); i > 0 {
+			name = name[:i]
+		}
+	}
+	return restoreapp(*server, *secret, name, f)
+}
+
+func restoreapp(server, secret, app string, snapshot io.Reader) error {
+	urlStr := strings.TrimSuffix(server, "/") + "/solidq/admin/restore/" + url.PathEscape(app) + "?secret=" + url.QueryEscape(secret)
+	resp, err := http.Post(urlStr, "application/octet-stream", snapshot)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var sr struct {
+		Success bool   `json:"success"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&sr); err != nil {
+		return fmt.Errorf("restore of %s failed: %s", app, resp.Status)
+	}
+
+	if !sr.Success {
+		return fmt.Errorf("restore of %s failed: %s", app, sr.Error)
+	}
+
+	fmt.Println("Restored", app)
+	return nil
+}
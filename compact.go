@@ -0,0 +1,110 @@
+package solidq
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// compactTxMaxSize bounds the size of each copy transaction during compaction
+const compactTxMaxSize = 64 << 20
+
+// files smaller than this are never compacted automatically
+const minAutoCompactSize = 1 << 20
+
+func filesize(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// Compact copies the live data of the app DB into a fresh file and swaps it in, giving the space
+// of freed pages back to the file system. Requests to the app wait until it is done.
+// It returns the file size before and after.
+func (q *Que) Compact() (int64, int64, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := q.openlocked(); err != nil {
+		return 0, 0, err
+	}
+
+	before := filesize(q.path)
+
+	tmp := q.path + ".compact"
+	os.Remove(tmp)
+	defer os.Remove(tmp)
+
+	dst, err := bbolt.Open(tmp, 0600, nil)
+	if err != nil {
+		return before, before, err
+	}
+
+	err = bbolt.Compact(dst, q.db, compactTxMaxSize)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return before, before, err
+	}
+
+	if err := q.swaplocked(tmp); err != nil {
+		return before, filesize(q.path), err
+	}
+
+	return before, filesize(q.path), nil
+}
+
+// FreeRatio returns the share of the file taken by free pages, 0 for an app closed for being idle
+func (q *Que) FreeRatio() (float64, error) {
+	q.mu.RLock()
+	defer q.mu.RUnlock()
+
+	if q.db == nil {
+		return 0, q.closed
+	}
+
+	size := filesize(q.path)
+	if size == 0 {
+		return 0, nil
+	}
+	return float64(q.db.Stats().FreeAlloc) / float64(size), nil
+}
+
+// runcompaction compacts every open app whose free page ratio passed threshold, once per interval
+func (r *registry) runcompaction(threshold float64, interval time.Duration, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		r.compactdue(threshold)
+	}
+}
+
+// compactdue compacts the open apps whose free page ratio passed threshold
+func (r *registry) compactdue(threshold float64) {
+	r.eachque(func(appname string, q *Que) {
+		ratio, err := q.FreeRatio()
+		if err != nil || ratio < threshold || filesize(q.path) < minAutoCompactSize {
+			return
+		}
+
+		before, after, err := q.Compact()
+		if err != nil {
+			fmt.Println("Error compacting app:", appname, err)
+			return
+		}
+
+		fmt.Printf("Compacted app %s from %d to %d bytes\n", appname, before, after)
+	})
+}
@@ -0,0 +1,102 @@
+package solidq
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// fill imports count items with a 1KB payload and resets the channel it did not keep,
+// leaving about a quarter of the file free
+func fill(t *testing.T, q *Que, count int) {
+	t.Helper()
+	payload := strings.Repeat("x", 1024)
+	for _, channel := range []string{"kept", "dropped"} {
+		var lines strings.Builder
+		for i := 0; i < count; i++ {
+			fmt.Fprintf(&lines, `{"id":"%s-%d","payload":"%s"}`+"\n", channel, i, payload)
+		}
+
+		if _, _, err := q.Import(channel, strings.NewReader(lines.String()), DuplicateSkip); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := q.ResetChannel("dropped"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompact(t *testing.T) {
+	q := openque(t)
+	fill(t, q, 2000)
+
+	before, after, err := q.Compact()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if after >= before || after != filesize(q.path) {
+		t.Errorf("compacted from %d to %d bytes, the file has %d", before, after, filesize(q.path))
+	}
+
+	if n, err := q.Count("kept"); err != nil || n != 2000 {
+		t.Errorf("%d items kept: %v", n, err)
+	}
+
+	if payload, ok := exported(t, q, "kept", "kept-7"); !ok || len(payload) != 1024 {
+		t.Errorf("payload of %d bytes kept (%v)", len(payload), ok)
+	}
+
+	if err := q.Push("kept", "after"); err != nil {
+		t.Errorf("push after the compaction: %v", err)
+	}
+}
+
+func TestCompactThreshold(t *testing.T) {
+	r, err := newregistry(t.TempDir(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.closeall()
+
+	sizes := make(map[string]int64)
+	for app, count := range map[string]int{"big": 2000, "small": 20} {
+		a, err := r.ensure(app)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fill(t, a.meta(), count)
+		sizes[app] = filesize(a.meta().path)
+	}
+
+	big, _ := r.ensure("big")
+	if ratio, err := big.meta().FreeRatio(); err != nil || ratio < 0.1 {
+		t.Fatalf("free ratio %v %v, want a good share of the file free", ratio, err)
+	}
+
+	// a threshold above the free ratio leaves the files alone
+	r.compactdue(0.99)
+	for app, size := range sizes {
+		a, _ := r.ensure(app)
+		if got := filesize(a.meta().path); got != size {
+			t.Errorf("%s went from %d to %d bytes above the threshold", app, size, got)
+		}
+	}
+
+	// files under minAutoCompactSize are never compacted
+	r.compactdue(0.01)
+	small, _ := r.ensure("small")
+	if got := filesize(small.meta().path); got != sizes["small"] {
+		t.Errorf("small app went from %d to %d bytes", sizes["small"], got)
+	}
+
+	if got := filesize(big.meta().path); got >= sizes["big"] {
+		t.Errorf("big app went from %d to %d bytes", sizes["big"], got)
+	}
+
+	if n, err := big.Count("kept"); err != nil || n != 2000 {
+		t.Errorf("%d items kept: %v", n, err)
+	}
+}
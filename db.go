@@ -7,35 +7,56 @@ import (
 	"path/filepath"
 	"runtime"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"go.etcd.io/bbolt"
 )
 
-var appstore sync.Map
-
-var rootpath string
+// registry holds the app DBs found under one root directory. Each Server has its own.
+type registry struct {
+	root    string
+	store   sync.Map
+	mu      sync.Mutex   // serializes opening, creating and deleting app files
+	open    atomic.Int64 // number of app DBs currently open
+	maxopen int64        // caps how many app DBs are open at once, 0 means no cap
+	strict  bool         // apps and channels must be created before they are used
+	backend string       // one of the Storage backends, bolt when empty
+
+	durability string // for apps without a durability setting of their own
+
+	mutationlog bool          // app files keep a mutation log for followers and the change feed
+	logentries  int           // how many log entries are kept, 0 for no count limit
+	logage      time.Duration // how old log entries may get, 0 for no age limit
+	logbytes    int64         // how many bytes of log entries are kept, 0 for no size limit
+	follower    atomic.Bool   // apps are replicated from a primary and only serve reads
+	clustered   bool          // changes come through the Raft log of a cluster
+}
 
-func init() {
+// defaultroot is where app DBs live when no root path is given
+func defaultroot() string {
 	if runtime.GOOS == "darwin" {
-		rootpath = "./"
-	} else {
-		rootpath = "/var/lib/solidq/"
-
-		_, err := os.Stat(rootpath)
-		if os.IsNotExist(err) {
-			err = os.MkdirAll(rootpath, 0755)
-			if err != nil {
-				panic("Failed to create root path: " + err.Error())
-			}
-		}
+		return "./"
+	}
+	return "/var/lib/solidq/"
+}
+
+func newregistry(root string, maxopen int, strict bool) (*registry, error) {
+	if root == "" {
+		root = defaultroot()
 	}
+
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, fmt.Errorf("creating root path: %w", err)
+	}
+	return &registry{root: root, maxopen: int64(maxopen), strict: strict}, nil
 }
 
-func listapps(physical bool) ([]string, error) {
+func (r *registry) list(physical bool) ([]string, error) {
 	var apps []string
 
-	if physical {
-		files, err := os.ReadDir(rootpath)
+	if physical && r.backend != StorageMemory {
+		files, err := os.ReadDir(r.root)
 		if err != nil {
 			fmt.Println("Error reading directory:", err)
 			return apps, err
@@ -49,77 +70,371 @@ func listapps(physical bool) ([]string, error) {
 		return apps, nil
 	}
 
-	appstore.Range(func(key, value interface{}) bool {
+	r.store.Range(func(key, value interface{}) bool {
 		apps = append(apps, key.(string))
 		return true
 	})
 	return apps, nil
 }
 
-func enusureQ(appname string) (*Que, error) {
-	if que, ok := appstore.Load(appname); ok {
-		return que.(*Que), nil
+func (r *registry) ensure(appname string) (*App, error) {
+	if a, ok := r.store.Load(appname); ok {
+		return a.(*App), nil
+	}
+
+	if err := validapp(appname); err != nil {
+		return nil, err
+	}
+
+	// two requests opening the same file would wait on each other's file lock forever
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if a, ok := r.store.Load(appname); ok {
+		return a.(*App), nil
+	}
+
+	if r.strict && !r.exists(appname) {
+		return nil, fmt.Errorf("%w: %s, create it first", ErrAppNotFound, appname)
+	}
+
+	a, err := r.openapp(appname, 0, "")
+	if err != nil {
+		return nil, err
+	}
+
+	r.store.Store(appname, a)
+	return a, nil
+}
+
+// openapp opens an app in the storage backend of the registry, the caller holds r.mu
+func (r *registry) openapp(appname string, shards int, by string) (*App, error) {
+	if r.backend == StorageMemory {
+		if shards > 1 {
+			return nil, errNotStored
+		}
+		return r.openstored()
 	}
 
-	path := filepath.Join(rootpath, appname+".db")
-	q, err := OpenQue(path)
+	a, err := openapp(r.path(appname), r, shards, by)
 	if err != nil {
 		return nil, err
 	}
 
-	appstore.Store(appname, q)
-	return q, nil
+	r.evictlru(a.meta())
+	return a, nil
+}
+
+// eachque calls fn for every shard of every app
+func (r *registry) eachque(fn func(appname string, q *Que)) {
+	r.store.Range(func(key, value interface{}) bool {
+		for _, q := range value.(*App).shards {
+			fn(key.(string), q)
+		}
+		return true
+	})
 }
 
 type Que struct {
-	db *bbolt.DB
+	mu       sync.RWMutex // held for reading by every transaction, for writing while the file is closed or swapped
+	db       *bbolt.DB    // nil while the app is closed for being idle
+	path     string
+	closed   error // set once the handle may not be reopened
+	lastused atomic.Int64
+	nextdue  atomic.Int64 // earliest recurring run in unix nanos, 0 when unknown, -1 when there are no jobs
+	draining atomic.Bool  // set on shutdown, long polls return instead of waiting
+	w        waiters
+	apps     *registry // nil for a Que opened on its own with OpenQue
+
+	durability string // one of the Durability modes, set while the DB is opened
 }
 
+var errNotOpen = errors.New("database is not open")
+
 func OpenQue(path string) (*Que, error) {
-	db, err := bbolt.Open(path, 0600, nil)
-	if err != nil {
+	q := &Que{path: path}
+	if err := q.openlocked(); err != nil {
 		return nil, err
 	}
 
-	return &Que{db: db}, nil
+	q.lastused.Store(time.Now().UnixNano())
+	return q, nil
 }
 
-func (q *Que) Close() error {
+// openlocked opens the DB file, the caller holds q.mu or owns q exclusively
+func (q *Que) openlocked() error {
+	if q.closed != nil {
+		return q.closed
+	}
+
 	if q.db != nil {
-		return q.db.Close()
+		return nil
+	}
+
+	db, err := bbolt.Open(q.path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return err
+	}
+
+	q.db = db
+	if q.apps != nil {
+		q.apps.open.Add(1)
+	}
+
+	if err := q.applydurability(); err != nil {
+		return err
+	}
+
+	if q.apps != nil && q.apps.mutationlog {
+		return q.preparelog(q.apps.logentries, q.apps.logage, q.apps.logbytes)
 	}
 	return nil
 }
 
-func (q *Que) Push(channel, id string) error {
+// closelocked closes the DB file, the caller holds q.mu
+func (q *Que) closelocked() error {
 	if q.db == nil {
-		return errors.New("database is not open")
+		return nil
 	}
 
-	if id == "" {
-		return errors.New("work ID cannot be empty")
+	err := q.db.Close()
+	q.db = nil
+	if q.apps != nil {
+		q.apps.open.Add(-1)
 	}
+	return err
+}
+
+func (q *Que) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closed = errNotOpen
+	return q.closelocked()
+}
 
-	q.Inc(channel + ":push")
-	return q.db.Update(func(tx *bbolt.Tx) error {
-		channelbucket, err := tx.CreateBucketIfNotExists([]byte(channel))
+// drain makes long polls of every app return, for shutdown
+func (r *registry) drain() {
+	r.store.Range(func(key, value interface{}) bool {
+		if a := value.(*App); a.store != nil {
+			a.store.draining.Store(true)
+			a.store.w.wake()
+		}
+
+		for _, q := range value.(*App).shards {
+			q.draining.Store(true)
+			q.wake()
+		}
+		return true
+	})
+}
+
+// closeall closes every open app, for shutdown
+func (r *registry) closeall() error {
+	var first error
+	r.store.Range(func(key, value interface{}) bool {
+		if err := value.(*App).Close(); err != nil && first == nil {
+			first = fmt.Errorf("closing app %s: %w", key, err)
+		}
+		r.store.Delete(key)
+		return true
+	})
+	return first
+}
+
+// idleclose closes the DB file but lets the next request open it again
+func (q *Que) idleclose() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.closelocked()
+}
+
+// rlock takes the read lock on an open DB, opening it again if it was closed for being idle
+func (q *Que) rlock() error {
+	q.lastused.Store(time.Now().UnixNano())
+	for {
+		q.mu.RLock()
+		if q.db != nil {
+			return nil
+		}
+		q.mu.RUnlock()
+
+		q.mu.Lock()
+		err := q.openlocked()
+		q.mu.Unlock()
 		if err != nil {
 			return err
 		}
 
-		return channelbucket.Put([]byte(id), []byte(""))
+		if q.apps != nil {
+			q.apps.evictlru(q)
+		}
+	}
+}
+
+func (q *Que) view(fn func(tx *bbolt.Tx) error) error {
+	if err := q.rlock(); err != nil {
+		return err
+	}
+	defer q.mu.RUnlock()
+
+	return q.db.View(fn)
+}
+
+func (q *Que) update(fn func(tx *bbolt.Tx) error) error {
+	if err := q.rlock(); err != nil {
+		return err
+	}
+	defer q.mu.RUnlock()
+
+	return q.db.Update(fn)
+}
+
+// writeat is write for changes applied from the Raft log, which get a transaction of their own
+func (q *Que) writeat(st stamp, fn func(tx *bbolt.Tx) error) error {
+	if st.index != 0 {
+		return q.updateat(st, fn)
+	}
+	return q.write(fn)
+}
+
+// write runs fn in a batched transaction, or in one of its own when the app's durability is always
+func (q *Que) write(fn func(tx *bbolt.Tx) error) error {
+	if err := q.rlock(); err != nil {
+		return err
+	}
+	defer q.mu.RUnlock()
+
+	if q.durability == DurabilityAlways {
+		return q.db.Update(fn)
+	}
+	return q.db.Batch(fn)
+}
+
+func (q *Que) Push(channel, id string) error {
+	return q.pushat(stamp{}, channel, id)
+}
+
+func (q *Que) pushat(st stamp, channel, id string) error {
+	if id == "" {
+		return invalidf("work ID cannot be empty")
+	}
+
+	// concurrent pushes share a commit unless the app asks for one fsync per push
+	err := q.writeat(st, func(tx *bbolt.Tx) error {
+		if err := q.checkchannel(tx, channel); err != nil {
+			return err
+		}
+
+		if pushpaused(tx, channel) {
+			return ErrPaused
+		}
+
+		if err := inc(tx, channel+":push"); err != nil {
+			return err
+		}
+		return putitem(tx, channel, id, nil)
 	})
+
+	q.wake()
+	return err
 }
 
-func (q *Que) ListChannels() ([]string, error) {
-	if q.db == nil {
-		return nil, errors.New("database is not open")
+func putitem(tx *bbolt.Tx, channel, id string, payload []byte) error {
+	return readyitem(tx, channel, id, payload, "")
+}
+
+// readyitem puts an item in the channel, from is the state it leaves (in-flight or scheduled)
+// or empty for a push. The log records a move in the first case.
+func readyitem(tx *bbolt.Tx, channel, id string, payload []byte, from string) error {
+	channelbucket, err := tx.CreateBucketIfNotExists([]byte(channel))
+	if err != nil {
+		return err
+	}
+
+	if payload == nil {
+		payload = []byte("")
+	}
+
+	existed := channelbucket.Get([]byte(id)) != nil
+	if err := channelbucket.Put([]byte(id), payload); err != nil {
+		return err
+	}
+
+	e := LogEntry{Op: LogPush, Channel: channel, IDs: []string{id}, Payload: string(payload)}
+	if from != "" {
+		e.Op, e.From, e.To = LogMove, from, StateReady
+	}
+
+	if err := logop(tx, e); err != nil {
+		return err
+	}
+
+	if existed {
+		return nil
+	}
+	return adddepth(tx, channel, 1)
+}
+
+// removeitems deletes ready items from a channel, IDs that are not there are ignored
+func removeitems(tx *bbolt.Tx, channel string, ids []string) error {
+	b := tx.Bucket([]byte(channel))
+	if b == nil || len(ids) == 0 {
+		return nil
+	}
+
+	removed := 0
+	for _, id := range ids {
+		if b.Get([]byte(id)) == nil {
+			continue
+		}
+
+		if err := b.Delete([]byte(id)); err != nil {
+			return err
+		}
+		removed++
+	}
+
+	if err := logop(tx, LogEntry{Op: LogPop, Channel: channel, IDs: ids}); err != nil {
+		return err
+	}
+	return adddepth(tx, channel, -removed)
+}
+
+// resetchannel drops a channel with its in-flight, popped, scheduled and attempt records
+func resetchannel(tx *bbolt.Tx, channel string) error {
+	for _, name := range [][]byte{inflightbucket(channel), poppedbucket(channel), scheduledbucket(channel), attemptsbucket(channel)} {
+		err := tx.DeleteBucket(name)
+		if err != nil && err != bbolt.ErrBucketNotFound {
+			return err
+		}
+	}
+
+	if err := dropdepth(tx, channel); err != nil {
+		return err
+	}
+
+	if err := logop(tx, LogEntry{Op: LogReset, Channel: channel}); err != nil {
+		return err
+	}
+
+	// resetting a channel that was never pushed to is a no-op
+	err := tx.DeleteBucket([]byte(channel))
+	if err == bbolt.ErrBucketNotFound {
+		return nil
 	}
+	return err
+}
 
+func (q *Que) ListChannels() ([]string, error) {
 	var channels []string
-	err := q.db.View(func(tx *bbolt.Tx) error {
+	err := q.view(func(tx *bbolt.Tx) error {
 		channels = make([]string, 0)
 		return tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
+			if isinternal(string(name)) {
+				return nil
+			}
 			channels = append(channels, string(name))
 			return nil
 		})
@@ -129,14 +444,13 @@ func (q *Que) ListChannels() ([]string, error) {
 }
 
 func (q *Que) ListChannelsWithCount() (map[string]int, error) {
-	if q.db == nil {
-		return nil, errors.New("database is not open")
-	}
-
 	channels := make(map[string]int)
-	err := q.db.View(func(tx *bbolt.Tx) error {
+	err := q.view(func(tx *bbolt.Tx) error {
 		return tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
-			channels[string(name)] = b.Stats().KeyN
+			if isinternal(string(name)) {
+				return nil
+			}
+			channels[string(name)] = depth(tx, string(name))
 			return nil
 		})
 	})
@@ -145,38 +459,38 @@ func (q *Que) ListChannelsWithCount() (map[string]int, error) {
 }
 
 func (q *Que) ResetChannel(channel string) error {
-	if q.db == nil {
-		return errors.New("database is not open")
-	}
+	return q.resetat(stamp{}, channel)
+}
 
-	return q.db.Update(func(tx *bbolt.Tx) error {
-		return tx.DeleteBucket([]byte(channel))
+func (q *Que) resetat(st stamp, channel string) error {
+	err := q.updateat(st, func(tx *bbolt.Tx) error {
+		return resetchannel(tx, channel)
 	})
+
+	q.wake()
+	return err
 }
 
 func (q *Que) Inc(chcommand string) error {
-	if q.db == nil {
-		return errors.New("database is not open")
-	}
-
-	return q.db.Update(func(tx *bbolt.Tx) error {
-		b, err := tx.CreateBucketIfNotExists([]byte("app_stats"))
-		if err != nil {
-			return err
-		}
-
-		count := fmt.Sprintf("%d", b.Stats().KeyN+1)
-		return b.Put([]byte(chcommand), []byte(count))
+	return q.update(func(tx *bbolt.Tx) error {
+		return inc(tx, chcommand)
 	})
 }
 
-func (q *Que) ListKeysWithValues(bucket string) (map[string]string, error) {
-	if q.db == nil {
-		return nil, errors.New("database is not open")
+// inc updates a command counter inside the caller's transaction
+func inc(tx *bbolt.Tx, chcommand string) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(statsbucket))
+	if err != nil {
+		return err
 	}
 
+	count := fmt.Sprintf("%d", b.Stats().KeyN+1)
+	return b.Put([]byte(chcommand), []byte(count))
+}
+
+func (q *Que) ListKeysWithValues(bucket string) (map[string]string, error) {
 	var keyvalues = make(map[string]string)
-	err := q.db.View(func(tx *bbolt.Tx) error {
+	err := q.view(func(tx *bbolt.Tx) error {
 		b := tx.Bucket([]byte(bucket))
 		if b == nil {
 			return errors.New("bucket does not exist") // Bucket does not exist
@@ -192,52 +506,111 @@ func (q *Que) ListKeysWithValues(bucket string) (map[string]string, error) {
 }
 
 func (q *Que) Count(channel string) (int, error) {
-	if q.db == nil {
-		return 0, errors.New("database is not open")
-	}
-
 	var count int
-	err := q.db.View(func(tx *bbolt.Tx) error {
+	err := q.view(func(tx *bbolt.Tx) error {
+		count = depth(tx, channel)
+		return nil
+	})
+
+	return count, err
+}
+
+// Peek returns up to count IDs in the order they would be popped, without removing them
+func (q *Que) Peek(channel string, count int) ([]string, error) {
+	var ids []string
+	err := q.view(func(tx *bbolt.Tx) error {
 		b := tx.Bucket([]byte(channel))
 		if b == nil {
 			return nil
 		}
-		count = b.Stats().KeyN
+
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil && len(ids) < count; k, _ = c.Next() {
+			ids = append(ids, string(k))
+		}
 		return nil
 	})
 
-	return count, err
+	return ids, err
 }
 
 func (q *Que) PopWithCount(channel string, count int) ([]string, error) {
-	if q.db == nil {
-		return nil, errors.New("database is not open")
-	}
+	ids, _, err := q.popwithcount(channel, count)
+	return ids, err
+}
 
-	q.Inc(channel + ":pop")
+// popwithcount also reports whether the popped items are tracked by the server and must be acked
+func (q *Que) popwithcount(channel string, count int) ([]string, bool, error) {
+	return q.popat(stamp{}, channel, count)
+}
 
+func (q *Que) popat(st stamp, channel string, count int) ([]string, bool, error) {
 	var ids []string
-	err := q.db.Update(func(tx *bbolt.Tx) error {
+	var mustack bool
+	now := st.time()
+	err := q.updateat(st, func(tx *bbolt.Tx) error {
+		if err := q.checkchannel(tx, channel); err != nil {
+			return err
+		}
+
+		if poppaused(tx, channel) {
+			return ErrPaused
+		}
+
+		if err := inc(tx, channel+":pop"); err != nil {
+			return err
+		}
+
+		if err := promote(tx, channel, now); err != nil {
+			return err
+		}
+
 		b := tx.Bucket([]byte(channel))
 		if b == nil {
 			return nil
 		}
 
+		cc, err := readconfig(tx, channel)
+		if err != nil {
+			return err
+		}
+
+		available, err := capacity(tx, channel, cc, now)
+		if err != nil {
+			return err
+		}
+
+		if available == 0 {
+			return nil
+		}
+
+		if available > 0 && count > available {
+			count = available
+		}
+
+		var payloads [][]byte
 		c := b.Cursor()
-		for i := 0; i < count; i++ {
-			k, _ := c.First()
-			if k == nil {
-				break
+		for k, v := c.First(); k != nil && len(ids) < count; k, v = c.Next() {
+			ids = append(ids, string(k))
+			payloads = append(payloads, append([]byte(nil), v...))
+			if attempts(tx, channel, string(k)) > 0 {
+				mustack = true
 			}
+		}
 
-			ids = append(ids, string(k))
-			err := b.Delete(k)
-			if err != nil {
+		// in-flight records go first so a follower replaying the log still finds the payloads
+		if available > 0 && len(ids) > 0 {
+			mustack = true
+			if err := markinflight(tx, channel, ids, payloads, now); err != nil {
+				return err
+			}
+		} else if available < 0 {
+			if err := keeppayloads(tx, channel, ids, payloads, cc.lease(), now); err != nil {
 				return err
 			}
 		}
-		return nil
+		return removeitems(tx, channel, ids)
 	})
 
-	return ids, err
+	return ids, mustack, err
 }
@@ -0,0 +1,125 @@
+package solidq
+
+import (
+	"encoding/binary"
+
+	"go.etcd.io/bbolt"
+)
+
+// depthbucket keeps the number of ready items of every channel, so counting doesn't walk the channel.
+// A channel without a counter, written by an older version, is counted from its bucket.
+const depthbucket = internalprefix + "depth"
+
+// depth returns the number of ready items in a channel
+func depth(tx *bbolt.Tx, channel string) int {
+	if b := tx.Bucket([]byte(depthbucket)); b != nil {
+		if v := b.Get([]byte(channel)); len(v) == 8 {
+			return int(binary.BigEndian.Uint64(v))
+		}
+	}
+
+	if b := tx.Bucket([]byte(channel)); b != nil {
+		return b.Stats().KeyN
+	}
+	return 0
+}
+
+// adddepth moves the counter of a channel by delta after the channel bucket was changed.
+// A missing counter is initialized from the bucket, which already includes the change.
+func adddepth(tx *bbolt.Tx, channel string, delta int) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(depthbucket))
+	if err != nil {
+		return err
+	}
+
+	var n int
+	if v := b.Get([]byte(channel)); len(v) == 8 {
+		n = int(binary.BigEndian.Uint64(v)) + delta
+	} else if cb := tx.Bucket([]byte(channel)); cb != nil {
+		n = countkeys(cb)
+	}
+
+	if n < 0 {
+		n = 0
+	}
+	return setdepth(b, channel, n)
+}
+
+// countkeys walks a bucket. Stats().KeyN is not reliable for a bucket changed in the current transaction.
+func countkeys(b *bbolt.Bucket) int {
+	n := 0
+	c := b.Cursor()
+	for k, _ := c.First(); k != nil; k, _ = c.Next() {
+		n++
+	}
+	return n
+}
+
+func setdepth(b *bbolt.Bucket, channel string, n int) error {
+	v := make([]byte, 8)
+	binary.BigEndian.PutUint64(v, uint64(n))
+	return b.Put([]byte(channel), v)
+}
+
+func dropdepth(tx *bbolt.Tx, channel string) error {
+	if b := tx.Bucket([]byte(depthbucket)); b != nil {
+		return b.Delete([]byte(channel))
+	}
+	return nil
+}
+
+// RepairDepths recounts every channel from its data and rewrites the depth counters.
+// It returns the channels whose counter was wrong or missing, with their corrected depth.
+func (q *Que) RepairDepths() (map[string]int, error) {
+	fixed := make(map[string]int)
+	err := q.update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(depthbucket))
+		if err != nil {
+			return err
+		}
+
+		counted := make(map[string]int)
+		err = tx.ForEach(func(name []byte, cb *bbolt.Bucket) error {
+			if !isinternal(string(name)) {
+				counted[string(name)] = countkeys(cb)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// counters of channels that no longer exist
+		var stale [][]byte
+		err = b.ForEach(func(k, v []byte) error {
+			if _, ok := counted[string(k)]; !ok {
+				stale = append(stale, append([]byte(nil), k...))
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range stale {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+			fixed[string(k)] = 0
+		}
+
+		for channel, n := range counted {
+			if v := b.Get([]byte(channel)); len(v) == 8 && int(binary.BigEndian.Uint64(v)) == n {
+				continue
+			}
+
+			if err := setdepth(b, channel, n); err != nil {
+				return err
+			}
+			fixed[channel] = n
+		}
+		return nil
+	})
+
+	return fixed, err
+}
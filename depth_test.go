@@ -0,0 +1,124 @@
+package solidq
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// counted returns the stored counter of a channel, -1 when there is none
+func counted(t *testing.T, q *Que, channel string) int {
+	t.Helper()
+	n := -1
+	err := q.view(func(tx *bbolt.Tx) error {
+		if b := tx.Bucket([]byte(depthbucket)); b != nil {
+			if v := b.Get([]byte(channel)); v != nil {
+				n = depth(tx, channel)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func TestDepthCounters(t *testing.T) {
+	q := openque(t)
+	if err := q.SetChannelConfig("jobs", ChannelConfig{MaxInFlight: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name  string
+		do    func() error
+		depth int
+	}{
+		{"push", func() error {
+			for _, id := range []string{"a", "b", "c", "d"} {
+				if err := q.Push("jobs", id); err != nil {
+					return err
+				}
+			}
+			return nil
+		}, 4},
+		{"push again", func() error { return q.Push("jobs", "a") }, 4},
+		{"pop", func() error { _, err := q.PopWithCount("jobs", 3); return err }, 1},
+		{"ack", func() error { return q.Ack("jobs", "a") }, 1},
+		{"nack", func() error { return q.Nack("jobs", "b", time.Millisecond) }, 1},
+		{"promote", func() error {
+			time.Sleep(5 * time.Millisecond)
+			_, err := q.PopWithCount("jobs", 0)
+			return err
+		}, 2},
+		{"reset", func() error { return q.ResetChannel("jobs") }, 0},
+	}
+
+	for _, step := range steps {
+		if err := step.do(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+
+		if n, err := q.Count("jobs"); err != nil || n != step.depth {
+			t.Errorf("after %s: count %d %v, want %d", step.name, n, err, step.depth)
+		}
+	}
+
+	if n := counted(t, q, "jobs"); n != -1 {
+		t.Errorf("counter %d left after the reset", n)
+	}
+}
+
+func TestRepairDepths(t *testing.T) {
+	q := openque(t)
+	for _, id := range []string{"a", "b", "c"} {
+		if err := q.Push("jobs", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := q.Push("mail", "m"); err != nil {
+		t.Fatal(err)
+	}
+
+	// a wrong counter, a missing one as written by older versions, and one of a dropped channel
+	err := q.update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(depthbucket))
+		if err := setdepth(b, "jobs", 7); err != nil {
+			return err
+		}
+
+		if err := b.Delete([]byte("mail")); err != nil {
+			return err
+		}
+		return setdepth(b, "gone", 2)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a missing counter is counted from the bucket
+	if n, _ := q.Count("mail"); n != 1 {
+		t.Errorf("count without a counter %d, want 1", n)
+	}
+
+	fixed, err := q.RepairDepths()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := map[string]int{"jobs": 3, "mail": 1, "gone": 0}; !reflect.DeepEqual(fixed, want) {
+		t.Errorf("fixed %v, want %v", fixed, want)
+	}
+
+	if n := counted(t, q, "jobs"); n != 3 {
+		t.Errorf("counter %d after the repair, want 3", n)
+	}
+
+	if fixed, err := q.RepairDepths(); err != nil || len(fixed) != 0 {
+		t.Errorf("second repair fixed %v %v", fixed, err)
+	}
+}
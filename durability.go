@@ -0,0 +1,97 @@
+package solidq
+
+import (
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// durability modes of an app, they trade push latency and crash safety for throughput
+const (
+	DurabilityAlways  = "always"  // every push is its own commit, fsynced before the push returns
+	DurabilityBatched = "batched" // concurrent pushes are grouped into one commit and one fsync
+	DurabilityNoSync  = "nosync"  // grouped commits without fsync, a crash can lose recent writes
+)
+
+const settingsbucket = internalprefix + "settings"
+
+// batchLinger is how long a batched commit waits for more pushes to join it
+const batchLinger = 2 * time.Millisecond
+
+func validdurability(mode string) error {
+	if mode != DurabilityAlways && mode != DurabilityBatched && mode != DurabilityNoSync {
+		return invalidf("durability must be always, batched or nosync")
+	}
+	return nil
+}
+
+// applydurability reads the durability setting of the app and configures the open DB for it,
+// the caller holds q.mu or owns q exclusively
+func (q *Que) applydurability() error {
+	mode := ""
+	err := q.db.View(func(tx *bbolt.Tx) error {
+		if b := tx.Bucket([]byte(settingsbucket)); b != nil {
+			mode = string(b.Get([]byte("durability")))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if mode == "" && q.apps != nil {
+		mode = q.apps.durability
+	}
+
+	if mode == "" {
+		mode = DurabilityBatched
+	}
+
+	q.durability = mode
+	q.db.NoSync = mode == DurabilityNoSync
+	q.db.MaxBatchDelay = batchLinger
+	return nil
+}
+
+// Durability returns the durability mode of the app
+func (q *Que) Durability() (string, error) {
+	if err := q.rlock(); err != nil {
+		return "", err
+	}
+	defer q.mu.RUnlock()
+
+	return q.durability, nil
+}
+
+// SetDurability stores the durability mode in the app DB and applies it right away
+func (q *Que) SetDurability(mode string) error {
+	if err := validdurability(mode); err != nil {
+		return err
+	}
+
+	err := q.update(func(tx *bbolt.Tx) error {
+		if err := writedurability(tx, mode); err != nil {
+			return err
+		}
+		return logop(tx, LogEntry{Op: LogDurability, Payload: mode})
+	})
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.db != nil {
+		return q.applydurability()
+	}
+	return nil
+}
+
+func writedurability(tx *bbolt.Tx, mode string) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(settingsbucket))
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte("durability"), []byte(mode))
+}
@@ -0,0 +1,43 @@
+package solidq
+
+import (
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"testing"
+)
+
+// BenchmarkPush measures concurrent pushes under each durability mode. Run it with -cpu to vary
+// the pushers, batched commits only pay off with company.
+func BenchmarkPush(b *testing.B) {
+	for _, mode := range []string{DurabilityAlways, DurabilityBatched, DurabilityNoSync} {
+		b.Run(mode, func(b *testing.B) {
+			benchpush(b, mode, 1, "")
+		})
+	}
+}
+
+func benchpush(b *testing.B, mode string, shards int, by string) {
+	a, err := OpenApp(filepath.Join(b.TempDir(), "bench.db"), shards, by)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer a.Close()
+
+	if err := a.SetDurability(mode); err != nil {
+		b.Fatal(err)
+	}
+
+	var next atomic.Int64
+	b.SetParallelism(8)
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			id := next.Add(1)
+			if err := a.Push("bench"+strconv.FormatInt(id%8, 10), strconv.FormatInt(id, 10)); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	})
+}
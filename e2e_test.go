@@ -0,0 +1,475 @@
+package solidq_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sfi2k7/solidq"
+	"github.com/sfi2k7/solidq/client"
+	"github.com/sfi2k7/solidq/routes"
+)
+
+// The end-to-end check runs every operation of the Go client against an in-process server, so
+// the client and the routes of the server can't drift apart
+
+type step struct {
+	name string
+	run  func() error
+}
+
+// freeaddr returns a loopback address nothing listens on
+func freeaddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestClient(t *testing.T) {
+	fpaddr := freeaddr(t)
+	base := serve(t, &solidq.SeverOptions{RootPath: t.TempDir(), ChangeFeed: true, FPAddr: fpaddr})
+
+	c, err := client.NewClient(base, client.WithSecret(secret), client.WithTimeout(10*time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := append(clientsteps(c), linesteps(fpaddr)...)
+	steps = append(steps, step{"Promote", func() error { return promote(t, base) }})
+
+	for _, st := range steps {
+		t.Run(st.name, func(t *testing.T) {
+			if err := st.run(); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+func equal(got []string, want ...string) error {
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		return fmt.Errorf("got %v, want %v", got, want)
+	}
+	return nil
+}
+
+func count(c *client.Client, channel string, want int) error {
+	n, err := c.Count(channel)
+	if err != nil {
+		return err
+	}
+
+	if n != want {
+		return fmt.Errorf("%s holds %d items, want %d", channel, n, want)
+	}
+	return nil
+}
+
+// code checks that err is a server error with the code
+func code(err error, want string) error {
+	var se *client.ServerError
+	if !errors.As(err, &se) || se.Code != want {
+		return fmt.Errorf("got %v, want a %s error", err, want)
+	}
+	return nil
+}
+
+func clientsteps(c *client.Client) []step {
+	return []step{
+		{"CreateApp", func() error {
+			if err := c.CreateApp("shop"); err != nil {
+				return err
+			}
+			return code(c.CreateApp("shop"), routes.CodeConflict)
+		}},
+		{"CreateShardedApp", func() error {
+			return c.CreateShardedApp("wide", 2, "id")
+		}},
+		{"CreateChannel", func() error {
+			return c.CreateChannel("shop", "orders")
+		}},
+		{"Push and Count", func() error {
+			for _, id := range []string{"o:1", "o:2"} {
+				if err := c.Push("shop:orders", id); err != nil {
+					return err
+				}
+			}
+
+			if err := code(c.Push("bad name", "x"), routes.CodeInvalid); err != nil {
+				return err
+			}
+			return count(c, "shop:orders", 2)
+		}},
+		{"Peek", func() error {
+			ids, err := c.Peek("shop:orders", 10)
+			if err != nil {
+				return err
+			}
+			return equal(ids, "o:1", "o:2")
+		}},
+		{"ListChannels", func() error {
+			channels, err := c.ListChannels("shop")
+			if err != nil {
+				return err
+			}
+
+			if channels["orders"] != 2 {
+				return fmt.Errorf("got %v, want orders with 2 items", channels)
+			}
+			return nil
+		}},
+		{"Pop and PopWait", func() error {
+			ids, err := c.Pop("shop:orders")
+			if err != nil {
+				return err
+			}
+
+			if err := equal(ids, "o:1"); err != nil {
+				return err
+			}
+
+			if ids, err = c.PopWait("shop:orders", 5, 100*time.Millisecond); err != nil {
+				return err
+			}
+
+			if err := equal(ids, "o:2"); err != nil {
+				return err
+			}
+
+			start := time.Now()
+			if ids, err = c.PopWait("shop:orders", 1, 200*time.Millisecond); err != nil {
+				return err
+			}
+
+			if time.Since(start) < 150*time.Millisecond {
+				return errors.New("the server did not hold the pop of an empty channel")
+			}
+			return equal(ids)
+		}},
+		{"SetMaxInFlight and Ack", func() error {
+			if err := c.SetMaxInFlight("shop:capped", 1, time.Hour); err != nil {
+				return err
+			}
+
+			for _, id := range []string{"x", "y"} {
+				if err := c.Push("shop:capped", id); err != nil {
+					return err
+				}
+			}
+
+			ids, err := c.Pop("shop:capped", 2)
+			if err != nil {
+				return err
+			}
+
+			if err := equal(ids, "x"); err != nil {
+				return err
+			}
+
+			// a capped channel with every slot taken pops nothing, it is not an error
+			if ids, err = c.Pop("shop:capped"); err != nil {
+				return err
+			}
+
+			if err := equal(ids); err != nil {
+				return err
+			}
+
+			if err := c.Ack("shop:capped", "x"); err != nil {
+				return err
+			}
+
+			if ids, err = c.Pop("shop:capped"); err != nil {
+				return err
+			}
+			return equal(ids, "y")
+		}},
+		{"SetBackoff and Nack", func() error {
+			if err := c.SetBackoff("shop:retry", client.BackoffPolicy{Base: time.Hour, Multiplier: 2, Max: 2 * time.Hour}); err != nil {
+				return err
+			}
+
+			for _, id := range []string{"r", "s"} {
+				if err := c.Push("shop:retry", id); err != nil {
+					return err
+				}
+			}
+
+			if _, err := c.Pop("shop:retry", 2); err != nil {
+				return err
+			}
+
+			// r waits for the backoff, s for its own short delay
+			if err := c.Nack("shop:retry", "r"); err != nil {
+				return err
+			}
+
+			if err := c.Nack("shop:retry", "s", 50*time.Millisecond); err != nil {
+				return err
+			}
+
+			time.Sleep(200 * time.Millisecond)
+			ids, err := c.PopWait("shop:retry", 2, 100*time.Millisecond)
+			if err != nil {
+				return err
+			}
+			return equal(ids, "s")
+		}},
+		{"SetBackoff below a second", func() error {
+			if err := c.SetBackoff("shop:fast", client.BackoffPolicy{Base: 50 * time.Millisecond, Multiplier: 2, Max: 100 * time.Millisecond}); err != nil {
+				return err
+			}
+
+			if err := c.Push("shop:fast", "f"); err != nil {
+				return err
+			}
+
+			if _, err := c.Pop("shop:fast"); err != nil {
+				return err
+			}
+
+			if err := c.Nack("shop:fast", "f"); err != nil {
+				return err
+			}
+
+			// the default policy would hold it for a second
+			time.Sleep(300 * time.Millisecond)
+			ids, err := c.Pop("shop:fast")
+			if err != nil {
+				return err
+			}
+			return equal(ids, "f")
+		}},
+		{"SetDurability", func() error {
+			if err := c.SetDurability("shop", "always"); err != nil {
+				return err
+			}
+
+			if err := c.SetDurability("shop", "sometimes"); err == nil {
+				return errors.New("an unknown mode was accepted")
+			}
+			return nil
+		}},
+		{"Pause and Resume", func() error {
+			if err := c.Pause("shop", "orders", false); err != nil {
+				return err
+			}
+
+			if err := code(c.Push("shop:orders", "p"), routes.CodePaused); err != nil {
+				return err
+			}
+
+			if err := c.Resume("shop", "orders"); err != nil {
+				return err
+			}
+			return c.Push("shop:orders", "p")
+		}},
+		{"Reset", func() error {
+			if err := c.Reset("shop:orders"); err != nil {
+				return err
+			}
+			return count(c, "shop:orders", 0)
+		}},
+		{"Export and Import", func() error {
+			for _, id := range []string{"a", "b"} {
+				if err := c.Push("shop:orders", id); err != nil {
+					return err
+				}
+			}
+
+			var buf bytes.Buffer
+			if err := c.Export("shop", "orders", &buf); err != nil {
+				return err
+			}
+
+			imported, skipped, err := c.Import("wide", "copy", &buf, "")
+			if err != nil {
+				return err
+			}
+
+			if imported != 2 || skipped != 0 {
+				return fmt.Errorf("imported %d and skipped %d, want 2 and 0", imported, skipped)
+			}
+			return count(c, "wide:copy", 2)
+		}},
+		{"RepairDepths", func() error {
+			_, err := c.RepairDepths("shop")
+			return err
+		}},
+		{"Changes", func() error {
+			pushes := 0
+			_, _, err := c.Changes(context.Background(), "shop", 0, 0, false, func(e client.ChangeEntry) error {
+				if e.Op == "push" {
+					pushes++
+				}
+				return nil
+			})
+
+			if err == nil && pushes == 0 {
+				err = errors.New("the change feed has no pushes")
+			}
+			return err
+		}},
+		{"Recurring jobs", func() error {
+			job, err := c.SetRecurring("shop", client.RecurringJob{Name: "tick", Channel: "ticks", Interval: 3600})
+			if err != nil {
+				return err
+			}
+
+			if job.NextRun.IsZero() {
+				return errors.New("the job has no next run")
+			}
+
+			if _, err := c.GetRecurring("shop", "tick"); err != nil {
+				return err
+			}
+
+			jobs, err := c.ListRecurring("shop")
+			if err != nil {
+				return err
+			}
+
+			if len(jobs) != 1 {
+				return fmt.Errorf("got %d jobs, want 1", len(jobs))
+			}
+			return c.DeleteRecurring("shop", "tick")
+		}},
+		{"DeleteApp", func() error {
+			if err := c.DeleteApp("wide"); err != nil {
+				return err
+			}
+			return code(c.DeleteApp("wide"), routes.CodeNotFound)
+		}},
+		{"WorkLoop", func() error {
+			for _, id := range []string{"w1", "w2"} {
+				if err := c.Push("loop", id); err != nil {
+					return err
+				}
+			}
+
+			done := make(chan error, 1)
+			go func() {
+				done <- c.WorkLoop("loop", func(ctx client.SolidContext) string { return "looped" }, 50*time.Millisecond)
+			}()
+
+			deadline := time.Now().Add(5 * time.Second)
+			for count(c, "looped", 2) != nil {
+				if time.Now().After(deadline) {
+					return errors.New("the work loop did not route the items")
+				}
+				time.Sleep(20 * time.Millisecond)
+			}
+
+			// the loop stops on SIGINT, which it catches itself
+			syscall.Kill(os.Getpid(), syscall.SIGINT)
+			select {
+			case err := <-done:
+				return err
+			case <-time.After(5 * time.Second):
+				return errors.New("the work loop did not stop")
+			}
+		}},
+	}
+}
+
+func linesteps(addr string) []step {
+	return []step{
+		{"LineClient", func() error {
+			if _, err := client.DialLine(addr, "wrong", time.Second); err == nil {
+				return errors.New("a wrong secret was accepted")
+			}
+
+			lc, err := client.DialLine(addr, secret, 5*time.Second)
+			if err != nil {
+				return err
+			}
+			defer lc.Close()
+
+			if err := lc.Push("shop:lines", "l1"); err != nil {
+				return err
+			}
+
+			if err := lc.PushMany("shop:lines", "l2", "l3"); err != nil {
+				return err
+			}
+
+			n, err := lc.Count("shop:lines")
+			if err != nil || n != 3 {
+				return fmt.Errorf("count %d, %v, want 3", n, err)
+			}
+
+			ids, err := lc.List("shop:lines", 10)
+			if err != nil {
+				return err
+			}
+
+			if err := equal(ids, "l1", "l2", "l3"); err != nil {
+				return err
+			}
+
+			if ids, err = lc.Pop("shop:lines", 2); err != nil {
+				return err
+			}
+
+			if err := equal(ids, "l1", "l2"); err != nil {
+				return err
+			}
+
+			channels, err := lc.ListChannels("shop")
+			if err != nil {
+				return err
+			}
+
+			if channels["lines"] != 1 {
+				return fmt.Errorf("got %v, want lines with 1 item", channels)
+			}
+
+			replies, err := lc.Pipeline(client.LineCommand{Cmd: "ping"}, client.LineCommand{Cmd: "nope", Channel: "shop:lines"})
+			if err != nil {
+				return err
+			}
+
+			if len(replies) != 2 || !replies[0].Success || replies[1].Success {
+				return fmt.Errorf("got %+v, want a pong and a failure", replies)
+			}
+
+			if err := lc.Reset("shop:lines"); err != nil {
+				return err
+			}
+
+			if n, err = lc.Count("shop:lines"); err != nil || n != 0 {
+				return fmt.Errorf("count %d, %v after the reset, want 0", n, err)
+			}
+			return nil
+		}},
+	}
+}
+
+// promote turns a follower of the primary into a primary
+func promote(t *testing.T, primary string) error {
+	base := serve(t, &solidq.SeverOptions{RootPath: t.TempDir(), Follow: primary, FollowSecret: secret})
+	c, err := client.NewClient(base, client.WithSecret(secret), client.WithTimeout(10*time.Second))
+	if err != nil {
+		return err
+	}
+
+	if err := code(c.Push("jobs", "f"), routes.CodeReadOnly); err != nil {
+		return err
+	}
+
+	if err := c.Promote(); err != nil {
+		return err
+	}
+	return c.Push("jobs", "f")
+}
@@ -0,0 +1,274 @@
+package solidq
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// duplicate policies for Import, applied when an ID is already in the channel
+const (
+	DuplicateSkip      = "skip"
+	DuplicateOverwrite = "overwrite"
+	DuplicateError     = "error"
+)
+
+const importBatch = 1000
+
+// ExportItem is one line of a channel export
+type ExportItem struct {
+	ID       string            `json:"id"`
+	Payload  string            `json:"payload,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"` // attempts, and due for items waiting for a retry
+}
+
+// Export writes every item of a channel to w as newline delimited JSON, from a single read
+// transaction. Items waiting for a retry are included with their due time, in-flight items are not.
+func (q *Que) Export(channel string, w io.Writer) (int, error) {
+	count := 0
+	err := q.view(func(tx *bbolt.Tx) error {
+		enc := json.NewEncoder(w)
+		write := func(id, payload []byte, due time.Time) error {
+			item := ExportItem{ID: string(id), Payload: string(payload)}
+			if n := attempts(tx, channel, item.ID); n > 0 {
+				item.Metadata = map[string]string{"attempts": strconv.Itoa(n)}
+			}
+
+			if !due.IsZero() {
+				if item.Metadata == nil {
+					item.Metadata = make(map[string]string)
+				}
+				item.Metadata["due"] = due.UTC().Format(time.RFC3339Nano)
+			}
+
+			count++
+			return enc.Encode(item)
+		}
+
+		if b := tx.Bucket([]byte(channel)); b != nil {
+			err := b.ForEach(func(k, v []byte) error {
+				return write(k, v, time.Time{})
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if b := tx.Bucket(scheduledbucket(channel)); b != nil {
+			return b.ForEach(func(k, v []byte) error {
+				if len(k) < 8 {
+					return nil
+				}
+				return write(k[8:], v, time.Unix(0, int64(binary.BigEndian.Uint64(k[:8]))))
+			})
+		}
+		return nil
+	})
+
+	return count, err
+}
+
+// Import reads newline delimited JSON written by Export into a channel, committing every
+// importBatch items. It returns how many items were written and how many duplicates were skipped.
+func (q *Que) Import(channel string, r io.Reader, duplicates string) (int, int, error) {
+	if err := validduplicates(duplicates); err != nil {
+		return 0, 0, err
+	}
+
+	imported, skipped := 0, 0
+	batch := make([]ExportItem, 0, importBatch)
+	flush := func() error {
+		i, s, err := q.importbatch(channel, batch, duplicates)
+		imported += i
+		skipped += s
+		batch = batch[:0]
+		return err
+	}
+
+	err := readitems(r, func(item ExportItem) error {
+		batch = append(batch, item)
+		if len(batch) < importBatch {
+			return nil
+		}
+		return flush()
+	})
+	if err != nil {
+		return imported, skipped, err
+	}
+	return imported, skipped, flush()
+}
+
+func validduplicates(duplicates string) error {
+	if duplicates != "" && duplicates != DuplicateSkip && duplicates != DuplicateOverwrite && duplicates != DuplicateError {
+		return invalidf("unknown duplicate policy %q", duplicates)
+	}
+	return nil
+}
+
+// readitems decodes an export line by line
+func readitems(r io.Reader, fn func(item ExportItem) error) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+
+		var item ExportItem
+		if err := json.Unmarshal(scanner.Bytes(), &item); err != nil {
+			return fmt.Errorf("line %d: %w", line, err)
+		}
+
+		if item.ID == "" {
+			return fmt.Errorf("line %d: work ID cannot be empty", line)
+		}
+
+		if err := fn(item); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// importbatch writes a batch of items in one transaction
+func (q *Que) importbatch(channel string, batch []ExportItem, duplicates string) (int, int, error) {
+	return q.importbatchat(stamp{}, channel, batch, duplicates)
+}
+
+func (q *Que) importbatchat(st stamp, channel string, batch []ExportItem, duplicates string) (int, int, error) {
+	if len(batch) == 0 {
+		return 0, 0, nil
+	}
+
+	if duplicates == "" {
+		duplicates = DuplicateSkip
+	}
+
+	imported, skipped := 0, 0
+	err := q.updateat(st, func(tx *bbolt.Tx) error {
+		if err := q.checkchannel(tx, channel); err != nil {
+			return err
+		}
+
+		if pushpaused(tx, channel) {
+			return ErrPaused
+		}
+
+		var err error
+		imported, skipped, err = importitems(tx, channel, batch, duplicates)
+		return err
+	})
+
+	q.wake()
+	return imported, skipped, err
+}
+
+// importitems writes items in the state their metadata asks for. An ID already in the channel,
+// in flight or waiting for a retry is a duplicate; overwriting it moves it out of that state,
+// so an item is never held twice.
+func importitems(tx *bbolt.Tx, channel string, items []ExportItem, duplicates string) (int, int, error) {
+	imported, skipped := 0, 0
+	b, err := tx.CreateBucketIfNotExists([]byte(channel))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// scheduled keys start with the due time, index them by ID once per batch
+	scheduled := make(map[string][]byte)
+	sb := tx.Bucket(scheduledbucket(channel))
+	if sb != nil {
+		err := sb.ForEach(func(k, v []byte) error {
+			if len(k) > 8 {
+				scheduled[string(k[8:])] = append([]byte(nil), k...)
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	inflight := tx.Bucket(inflightbucket(channel))
+	for _, item := range items {
+		from := ""
+		switch {
+		case b.Get([]byte(item.ID)) != nil:
+			from = StateReady
+		case inflight != nil && inflight.Get([]byte(item.ID)) != nil:
+			from = StateInFlight
+		case scheduled[item.ID] != nil:
+			from = StateScheduled
+		}
+
+		if from != "" {
+			switch duplicates {
+			case DuplicateError:
+				return 0, 0, errors.New("duplicate work ID: " + item.ID)
+			case DuplicateSkip:
+				skipped++
+				continue
+			}
+		}
+
+		if n, _ := strconv.Atoi(item.Metadata["attempts"]); n > 0 {
+			ab, err := tx.CreateBucketIfNotExists(attemptsbucket(channel))
+			if err != nil {
+				return 0, 0, err
+			}
+
+			if err := ab.Put([]byte(item.ID), []byte(strconv.Itoa(n))); err != nil {
+				return 0, 0, err
+			}
+		}
+
+		due, err := time.Parse(time.RFC3339Nano, item.Metadata["due"])
+		if err != nil {
+			// an overwritten ready item stays where it is with the new payload
+			if from == StateReady {
+				from = ""
+			}
+		} else if sb == nil {
+			if sb, err = tx.CreateBucketIfNotExists(scheduledbucket(channel)); err != nil {
+				return 0, 0, err
+			}
+		}
+
+		// the log records the state that is left with the entry that follows
+		if err := leave(tx, channel, item.ID, from); err != nil {
+			return 0, 0, err
+		}
+		delete(scheduled, item.ID)
+
+		if due.IsZero() {
+			if err := readyitem(tx, channel, item.ID, []byte(item.Payload), from); err != nil {
+				return 0, 0, err
+			}
+			imported++
+			continue
+		}
+
+		k := scheduledkey(due, item.ID)
+		if err := sb.Put(k, []byte(item.Payload)); err != nil {
+			return 0, 0, err
+		}
+		scheduled[item.ID] = k
+
+		e := LogEntry{Op: LogPush, Channel: channel, IDs: []string{item.ID}, Payload: item.Payload, From: from, To: StateScheduled, Due: due.UnixNano()}
+		if err := logop(tx, e); err != nil {
+			return 0, 0, err
+		}
+		imported++
+	}
+
+	return imported, skipped, nil
+}
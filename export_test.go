@@ -0,0 +1,119 @@
+package solidq
+
+import (
+	"bytes"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExportImport(t *testing.T) {
+	src, dst := openque(t), openque(t)
+	if err := src.SetChannelConfig("jobs", ChannelConfig{MaxInFlight: 5}); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := `{"id":"a","payload":"first"}` + "\n" + `{"id":"b","payload":"second"}` + "\n" + `{"id":"c"}` + "\n"
+	if n, _, err := src.Import("jobs", strings.NewReader(lines), DuplicateSkip); err != nil || n != 3 {
+		t.Fatalf("imported %d: %v", n, err)
+	}
+
+	// b waits for a retry, it is exported with its attempts and due time
+	if _, _, err := src.popwithcount("jobs", 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Nack("jobs", "b", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	if n, err := src.Export("jobs", &buf); err != nil || n != 2 {
+		t.Fatalf("exported %d: %v, want b and c, a is in flight", n, err)
+	}
+
+	export := buf.String()
+	if n, _, err := dst.Import("jobs", strings.NewReader(export), DuplicateSkip); err != nil || n != 2 {
+		t.Fatalf("imported %d: %v", n, err)
+	}
+
+	if n, _ := dst.Scheduled("jobs"); n != 1 {
+		t.Errorf("%d items scheduled after the import, want 1", n)
+	}
+
+	if n, _ := dst.Attempts("jobs", "b"); n != 1 {
+		t.Errorf("%d attempts of b after the import, want 1", n)
+	}
+
+	var again bytes.Buffer
+	if _, err := dst.Export("jobs", &again); err != nil {
+		t.Fatal(err)
+	}
+
+	want, _ := decodeitems(bytes.NewBufferString(export))
+	got, _ := decodeitems(&again)
+	for _, items := range [][]ExportItem{want, got} {
+		sort.Slice(items, func(i, j int) bool { return items[i].ID < items[j].ID })
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("export of the import %+v, want %+v", got, want)
+	}
+}
+
+func TestImportDuplicateStates(t *testing.T) {
+	q := openque(t)
+	if err := q.SetChannelConfig("jobs", ChannelConfig{MaxInFlight: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"a", "b", "c"} {
+		if err := q.Push("jobs", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// a is in flight, b waits for a retry and c is ready
+	if ids, _, err := q.popwithcount("jobs", 2); err != nil || len(ids) != 2 {
+		t.Fatalf("pop: %v %v", ids, err)
+	}
+	if err := q.Nack("jobs", "b", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	states := func() (int, int, int) {
+		t.Helper()
+		ready, _ := q.Count("jobs")
+		inflight, _ := q.InFlight("jobs")
+		scheduled, _ := q.Scheduled("jobs")
+		return ready, inflight, scheduled
+	}
+
+	due := time.Now().Add(2 * time.Hour).UTC().Format(time.RFC3339Nano)
+	later := `{"id":"a","metadata":{"due":"` + due + `"}}` + "\n" + `{"id":"b","metadata":{"due":"` + due + `"}}` + "\n" + `{"id":"c","metadata":{"due":"` + due + `"}}` + "\n"
+
+	if n, skipped, err := q.Import("jobs", strings.NewReader(later), DuplicateSkip); err != nil || n != 0 || skipped != 3 {
+		t.Errorf("import of items in every state: %d imported, %d skipped, %v", n, skipped, err)
+	}
+
+	if _, _, err := q.Import("jobs", strings.NewReader(`{"id":"a","metadata":{"due":"`+due+`"}}`), DuplicateError); err == nil {
+		t.Error("an in-flight duplicate was accepted")
+	}
+
+	if n, _, err := q.Import("jobs", strings.NewReader(later), DuplicateOverwrite); err != nil || n != 3 {
+		t.Fatalf("overwrite: %d %v", n, err)
+	}
+
+	if ready, inflight, scheduled := states(); ready != 0 || inflight != 0 || scheduled != 3 {
+		t.Errorf("%d ready, %d in flight, %d scheduled after overwriting with due items, want 3 scheduled", ready, inflight, scheduled)
+	}
+
+	now := `{"id":"a"}` + "\n" + `{"id":"b"}` + "\n"
+	if n, _, err := q.Import("jobs", strings.NewReader(now), DuplicateOverwrite); err != nil || n != 2 {
+		t.Fatalf("overwrite: %d %v", n, err)
+	}
+
+	if ready, inflight, scheduled := states(); ready != 2 || inflight != 0 || scheduled != 1 {
+		t.Errorf("%d ready, %d in flight, %d scheduled after overwriting with ready items, want 2 and 1 scheduled", ready, inflight, scheduled)
+	}
+}
@@ -0,0 +1,360 @@
+package solidq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sfi2k7/solidq/routes"
+	"go.etcd.io/bbolt"
+)
+
+const (
+	// followPoll is how often a follower looks for new apps on the primary
+	followPoll = 5 * time.Second
+	// followRetry is how long a follower waits after a failed request to the primary
+	followRetry = 2 * time.Second
+	// followWait is how long a log request waits on the primary for new entries
+	followWait = 30 * time.Second
+)
+
+// follower keeps the apps of a registry in sync with a primary: every shard of every app gets a
+// snapshot, then the primary's mutation log is replayed on it. In-flight and scheduled items
+// are replicated with their payloads, so a promoted follower only hands out again what the
+// primary had not acked.
+type follower struct {
+	apps    *registry
+	primary string
+	secret  string
+	client  *http.Client
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu        sync.Mutex
+	following map[string]bool
+}
+
+func newfollower(apps *registry, primary, secret string) *follower {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &follower{
+		apps:      apps,
+		primary:   strings.TrimRight(primary, "/"),
+		secret:    secret,
+		client:    &http.Client{Timeout: followWait + 30*time.Second},
+		ctx:       ctx,
+		cancel:    cancel,
+		following: make(map[string]bool),
+	}
+}
+
+// run looks for new apps on the primary until stop is closed or the follower is stopped
+func (f *follower) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(followPoll)
+	defer ticker.Stop()
+
+	for {
+		if err := f.discover(); err != nil {
+			fmt.Println("Replication: listing apps on the primary:", err)
+		}
+
+		select {
+		case <-stop:
+			f.stop()
+			return
+		case <-f.ctx.Done():
+			f.wg.Wait()
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// stop ends replication and waits for the shards being followed to finish their last apply
+func (f *follower) stop() {
+	f.cancel()
+	f.wg.Wait()
+}
+
+func (f *follower) discover() error {
+	var r response
+	if err := f.getjson(routes.ListApps.URL("true"), nil, &r); err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.ctx.Err() != nil {
+		return nil
+	}
+
+	for _, appname := range r.Apps {
+		if f.following[appname] || validapp(appname) != nil {
+			continue
+		}
+
+		f.following[appname] = true
+		f.wg.Add(1)
+		go func(appname string) {
+			defer f.wg.Done()
+			f.followapp(appname)
+		}(appname)
+	}
+	return nil
+}
+
+// followapp installs the first shard of an app that is not here yet, which carries the shard
+// layout, then follows every shard
+func (f *follower) followapp(appname string) {
+	var a *App
+	for {
+		err := f.installnew(appname)
+		if err == nil {
+			a, err = f.apps.ensure(appname)
+		}
+
+		if err == nil {
+			break
+		}
+
+		if !f.retry(appname, 0, err) {
+			return
+		}
+	}
+
+	for i := 1; i < len(a.shards); i++ {
+		f.wg.Add(1)
+		go func(i int) {
+			defer f.wg.Done()
+			f.followque(appname, i, a.shards[i])
+		}(i)
+	}
+	f.followque(appname, 0, a.shards[0])
+}
+
+// installnew puts a snapshot of the first shard in place when the app has no file here yet
+func (f *follower) installnew(appname string) error {
+	if f.apps.exists(appname) {
+		return nil
+	}
+
+	tmp, err := f.snapshot(appname, 0, f.apps.path(appname))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	f.apps.mu.Lock()
+	defer f.apps.mu.Unlock()
+
+	// a request may have opened the app meanwhile, the shard is then swapped by followque
+	if f.apps.exists(appname) {
+		return nil
+	}
+	return os.Rename(tmp, f.apps.path(appname))
+}
+
+// followque replays the primary log of one shard, taking a new snapshot whenever its position is lost
+func (f *follower) followque(appname string, shard int, q *Que) {
+	for f.ctx.Err() == nil {
+		epoch, seq, err := q.replicapos()
+		if err == nil && epoch == "" {
+			err = ErrResnapshot
+		}
+
+		if err == nil {
+			var entries []LogEntry
+			entries, err = f.readlog(appname, shard, epoch, seq)
+			if err == nil && len(entries) > 0 {
+				err = q.applylog(epoch, entries)
+			}
+		}
+
+		if errors.Is(err, ErrResnapshot) {
+			err = f.resnapshot(appname, shard, q)
+		}
+
+		if err != nil && !f.retry(appname, shard, err) {
+			return
+		}
+	}
+}
+
+func (f *follower) resnapshot(appname string, shard int, q *Que) error {
+	tmp, err := f.snapshot(appname, shard, q.path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	return q.swap(tmp)
+}
+
+// retry reports a failure and waits before the next attempt, it returns false once the follower is stopped
+func (f *follower) retry(appname string, shard int, err error) bool {
+	if f.ctx.Err() != nil {
+		return false
+	}
+
+	fmt.Printf("Replication: %s shard %d: %v\n", appname, shard, err)
+	select {
+	case <-f.ctx.Done():
+		return false
+	case <-time.After(followRetry):
+		return true
+	}
+}
+
+// snapshot downloads a shard from the primary into a temp file next to path, stamped with the
+// log position it was taken at. The caller removes the file.
+func (f *follower) snapshot(appname string, shard int, path string) (string, error) {
+	res, err := f.get(routes.Snapshot.URL(appname), url.Values{"shard": {strconv.Itoa(shard)}})
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	epoch := res.Header.Get("X-Solidq-Epoch")
+	if epoch == "" {
+		var r response
+		if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+			return "", fmt.Errorf("snapshot: %s", res.Status)
+		}
+		return "", errors.New(r.Error)
+	}
+
+	seq, err := strconv.ParseUint(res.Header.Get("X-Solidq-Seq"), 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("snapshot: bad log position: %w", err)
+	}
+
+	tmp, err := receivesnapshot(path, res.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if err := stampreplica(tmp, epoch, seq); err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	return tmp, nil
+}
+
+// stampreplica records in a snapshot file the primary log position it was taken at
+func stampreplica(path, epoch string, seq uint64) error {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		return writereplicapos(tx, epoch, seq)
+	})
+
+	if cerr := db.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func (f *follower) readlog(appname string, shard int, epoch string, after uint64) ([]LogEntry, error) {
+	query := url.Values{
+		"shard": {strconv.Itoa(shard)},
+		"epoch": {epoch},
+		"after": {strconv.FormatUint(after, 10)},
+		"wait":  {followWait.String()},
+	}
+
+	var r response
+	if err := f.getjson(routes.Log.URL(appname), query, &r); err != nil {
+		return nil, err
+	}
+
+	if r.Error == ErrResnapshot.Error() {
+		return nil, ErrResnapshot
+	}
+
+	if r.Error != "" {
+		return nil, errors.New(r.Error)
+	}
+	return r.Log, nil
+}
+
+func (f *follower) get(path string, query url.Values) (*http.Response, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+
+	if f.secret != "" {
+		query.Set("secret", f.secret)
+	}
+
+	req, err := http.NewRequestWithContext(f.ctx, http.MethodGet, f.primary+path+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	return f.client.Do(req)
+}
+
+func (f *follower) getjson(path string, query url.Values, v interface{}) error {
+	res, err := f.get(path, query)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", path, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// promote stops following and gives every file a new log epoch, followers of this server
+// then take a snapshot instead of continuing a log that diverged from the old primary
+func (r *registry) promote(f *follower) error {
+	if f != nil {
+		f.stop()
+	}
+	r.follower.Store(false)
+
+	var first error
+	r.eachque(func(appname string, q *Que) {
+		if err := q.newepoch(); err != nil && first == nil {
+			first = fmt.Errorf("%s: %w", appname, err)
+		}
+	})
+
+	// the replicated jobs fire here from now on, also after a restart
+	r.store.Range(func(key, value interface{}) bool {
+		if err := value.(*App).meta().markrecurring(); err != nil && first == nil {
+			first = fmt.Errorf("%s: %w", key, err)
+		}
+		return true
+	})
+	return first
+}
+
+// followerallows tells which requests a follower serves: the read-only routes and promote.
+// Everything else would change a file outside the replicated log and has to go to the primary.
+func followerallows(method, path string) bool {
+	if routes.Promote.Match(method, path) {
+		return true
+	}
+
+	for _, route := range routes.ReadOnly {
+		if route.Match(method, path) {
+			return true
+		}
+	}
+	return false
+}
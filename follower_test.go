@@ -0,0 +1,259 @@
+package solidq
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sfi2k7/solidq/client"
+	"github.com/sfi2k7/solidq/routes"
+	"go.etcd.io/bbolt"
+)
+
+// testserver starts a server behind an httptest.Server, both stop with the test
+func testserver(t *testing.T, options *SeverOptions) (*Server, *httptest.Server) {
+	t.Helper()
+	s, err := NewServer(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(func() {
+		s.Shutdown(context.Background())
+		ts.Close()
+	})
+	return s, ts
+}
+
+// eventually polls cond until it holds or a few seconds have passed
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); time.Sleep(20 * time.Millisecond) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatalf("timed out waiting for %s", what)
+}
+
+func TestFollower(t *testing.T) {
+	primary, pts := testserver(t, &SeverOptions{RootPath: t.TempDir(), Replicate: true})
+	pc, err := client.NewClient(pts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"a", "b", "c"} {
+		if err := pc.Push("orders:jobs", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := pc.SetMaxInFlight("orders:jobs", 10, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	follower, fts := testserver(t, &SeverOptions{RootPath: t.TempDir(), Follow: pts.URL})
+	fc, err := client.NewClient(fts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, "the snapshot", func() bool {
+		n, err := fc.Count("orders:jobs")
+		return err == nil && n == 3
+	})
+
+	if err := fc.Push("orders:jobs", "x"); err == nil {
+		t.Error("the follower took a push")
+	}
+
+	res, err := http.Get(fts.URL + routes.Compact.URL("orders"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var r response
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil || r.Error != errReadOnly.Error() {
+		t.Errorf("compact on the follower: %q %v, want %q", r.Error, err, errReadOnly)
+	}
+
+	ids, err := pc.Pop("orders:jobs", 2)
+	if err != nil || len(ids) != 2 {
+		t.Fatalf("pop %v %v", ids, err)
+	}
+
+	if err := pc.Ack("orders:jobs", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pc.Nack("orders:jobs", "b", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if ids, err := pc.Pop("orders:jobs", 1); err != nil || len(ids) != 1 || ids[0] != "c" {
+		t.Fatalf("pop %v %v, want [c]", ids, err)
+	}
+
+	fa, err := follower.apps.ensure("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fq := fa.shards[0]
+
+	replicated := func() bool {
+		n, _ := fq.Count("jobs")
+		inflight, _ := fq.InFlight("jobs")
+		scheduled, _ := fq.Scheduled("jobs")
+		return n == 0 && inflight == 1 && scheduled == 1
+	}
+	eventually(t, "the pops, ack and nack", replicated)
+
+	// a restore gives the primary log a new epoch, the follower takes a new snapshot
+	pa, err := primary.apps.ensure("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var backup bytes.Buffer
+	if _, err := pa.shards[0].Backup(&backup); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pc.Push("orders:jobs", "d"); err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, "the push", func() bool {
+		n, _ := fq.Count("jobs")
+		return n == 1
+	})
+
+	if err := pa.shards[0].Restore(&backup); err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, "the snapshot after the restore", replicated)
+
+	if err := fc.Promote(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a is acked, b waits for its retry and c is still leased: nothing is handed out again
+	if ids, err := fc.Pop("orders:jobs", 10); err != nil || len(ids) != 0 {
+		t.Errorf("pop on the promoted follower: %v %v, want nothing", ids, err)
+	}
+
+	if err := fc.Push("orders:jobs", "e"); err != nil {
+		t.Fatal(err)
+	}
+
+	if ids, err := fc.Pop("orders:jobs", 10); err != nil || len(ids) != 1 || ids[0] != "e" {
+		t.Errorf("pop on the promoted follower: %v %v, want [e]", ids, err)
+	}
+
+	if err := fc.Ack("orders:jobs", "c"); err != nil {
+		t.Error(err)
+	}
+}
+
+// TestFollowerSettings checks that the settings of channels and of the app reach a follower
+func TestFollowerSettings(t *testing.T) {
+	primary, pts := testserver(t, &SeverOptions{RootPath: t.TempDir(), Replicate: true})
+	pa, err := primary.apps.ensure("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pa.Push("jobs", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	follower, _ := testserver(t, &SeverOptions{RootPath: t.TempDir(), Follow: pts.URL})
+	fa, err := follower.apps.ensure("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fq := fa.shards[0]
+
+	eventually(t, "the snapshot", func() bool {
+		n, err := fq.Count("jobs")
+		return err == nil && n == 1
+	})
+
+	steps := []func() error{
+		func() error { return pa.SetChannelConfig("jobs", ChannelConfig{MaxInFlight: 5, Lease: 30}) },
+		func() error { return pa.Pause("jobs", PauseConsume) },
+		func() error { return pa.Pause("", PauseAll) },
+		func() error { return pa.Resume("") },
+		func() error { return pa.CreateChannel("declared") },
+		func() error {
+			_, err := pa.SetRecurring(RecurringJob{Name: "tick", Channel: "jobs", Interval: 60, IDTemplate: "tick-{seq}"})
+			return err
+		},
+		func() error {
+			_, err := pa.SetRecurring(RecurringJob{Name: "gone", Channel: "jobs", Interval: 1, IDTemplate: "gone-{seq}"})
+			return err
+		},
+		func() error { return pa.DeleteRecurring("gone") },
+		func() error {
+			// the next run stays a minute out, so the primary fires nothing more meanwhile
+			_, err := pa.FireRecurring(time.Now().Add(90 * time.Second))
+			return err
+		},
+		func() error { return pa.SetDurability(DurabilityNoSync) },
+	}
+	for i, step := range steps {
+		if err := step(); err != nil {
+			t.Fatalf("step %d: %v", i, err)
+		}
+	}
+
+	eventually(t, "the durability", func() bool {
+		mode, _ := fq.Durability()
+		return mode == DurabilityNoSync
+	})
+
+	if cc, err := fq.ChannelConfig("jobs"); err != nil || cc.MaxInFlight != 5 || cc.Lease != 30 {
+		t.Errorf("config on the follower %+v %v", cc, err)
+	}
+
+	if states, err := fq.PauseStates(); err != nil || len(states) != 1 || states["jobs"] != PauseConsume {
+		t.Errorf("pauses on the follower %v %v, want jobs paused for consume", states, err)
+	}
+
+	declared := false
+	fq.view(func(tx *bbolt.Tx) error {
+		declared = tx.Bucket([]byte(channelsbucket)) != nil && tx.Bucket([]byte(channelsbucket)).Get([]byte("declared")) != nil
+		return nil
+	})
+	if !declared {
+		t.Error("the declared channel is missing on the follower")
+	}
+
+	want, err := pa.ListRecurring()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	eventually(t, "the recurring jobs", func() bool {
+		jobs, err := fq.ListRecurring()
+		return err == nil && reflect.DeepEqual(jobs, want)
+	})
+
+	if len(want) != 1 || want[0].Runs == 0 {
+		t.Errorf("jobs on the primary %+v, want tick with its runs", want)
+	}
+
+	if _, err := os.Stat(recurringmarker(fq.path)); err != nil {
+		t.Errorf("no recurring marker on the follower: %v", err)
+	}
+}
@@ -1,121 +1,266 @@
 package solidq
 
-// import (
-// 	"context"
-// 	"encoding/json"
-// 	"fmt"
-// 	"strings"
-
-// 	"github.com/go-redis/redis/v8"
-// )
-
-// const redisfpset = "solidq:fpset"
-
-// const (
-// 	FPCmdPush                  = "push"
-// 	FPCmdPop                   = "pop"
-// 	FPCmdList                  = "list"
-// 	FPCmdReset                 = "reset"
-// 	FPCmdCount                 = "count"
-// 	FPCmdPopWithCount          = "pop_with_count"
-// 	FPCmdListChannels          = "list_channels"
-// 	FPCmdListChannelsWithCount = "list_channels_with_count"
-// 	FPCmdResetChannel          = "reset_channel"
-// 	FPCmdVersion               = "version"
-// 	FPCmdPing                  = "ping"
-// 	FPCmdPong                  = "pong"
-// 	FPCmdSet                   = "set"
-// 	FPCmdGet                   = "get"
-// 	FPCmdDel                   = "del"
-// )
-
-// // foreign packet
-// type FP struct {
-// 	Cmd        string          `json:"cmd"`
-// 	Appname    string          `json:"appname"`
-// 	Channel    string          `json:"channel"`
-// 	WorkId     string          `json:"work_id"`
-// 	TargetList string          `json:"target_list,omitempty"` // optional, used for some commands
-// 	Data       json.RawMessage `json:"data"`
-// }
-
-// func (fp *FP) String() string {
-// 	app, channel := channeltoappchannel(fp.Channel)
-
-// 	if len(fp.WorkId) == 0 {
-// 		fp.WorkId = "-"
-// 	}
-
-// 	if len(fp.Data) == 0 {
-// 		fp.Data = json.RawMessage("{}")
-// 	}
-
-// 	return fp.Cmd + "|" + app + "|" + channel + "|" + fp.WorkId + "|" + string(fp.Data)
-// }
-
-// // cmd|appname|channel|work_id|targetlist|data
-
-// func ToFP(str string) *FP {
-// 	parts := strings.SplitN(str, "|", 6)
-// 	if len(parts) < 5 {
-// 		return nil
-// 	}
-
-// 	fp := &FP{
-// 		Cmd:        parts[0],
-// 		Appname:    parts[1],
-// 		Channel:    parts[2],
-// 		WorkId:     parts[3],
-// 		TargetList: parts[4],
-// 		Data:       json.RawMessage(parts[5]),
-// 	}
-
-// 	if len(fp.Data) == 0 {
-// 		fp.Data = json.RawMessage("{}")
-// 	}
-
-// 	return fp
-// }
-
-// func fpbackground() {
-// 	r := redis.NewClient(&redis.Options{
-// 		Network:  "tcp",
-// 		Addr:     "localhost:6379",
-// 		Password: "passme",
-// 		DB:       0,
-// 	})
-
-// 	for {
-// 		zs, err := r.ZPopMax(context.Background(), redisfpset, 1).Result()
-// 		if err != nil {
-// 			continue
-// 		}
-
-// 		for _, z := range zs {
-// 			p := ToFP(z.Member.(string))
-
-// 			que, err := enusureQ(p.Appname)
-// 			if err != nil {
-// 				continue
-// 			}
-
-// 			var payload Payload
-// 			if err := json.Unmarshal(p.Data, &payload); err != nil {
-// 				fmt.Println("Error unmarshalling payload:", err)
-// 			}
-
-// 			switch p.Cmd {
-// 			case FPCmdPush:
-// 				work := Work{
-// 					Id:   p.WorkId,
-// 					Data: payload,
-// 				}
-// 				if err := que.Push(p.Channel, work); err != nil {
-// 					fmt.Println("Error pushing work:", err)
-// 				}
-// 			case FPCmdPop:
-// 				work, err := que.Pop(p.Channel)
-// 			}
-// 		}
-// 	}
-// }
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Version of the server, reported by the version command
+const Version = "0.0.3"
+
+const redisfpset = "solidq:fpset"
+
+const (
+	FPCmdPush                  = "push"
+	FPCmdPop                   = "pop"
+	FPCmdList                  = "list"
+	FPCmdReset                 = "reset"
+	FPCmdCount                 = "count"
+	FPCmdPopWithCount          = "pop_with_count"
+	FPCmdListChannels          = "list_channels"
+	FPCmdListChannelsWithCount = "list_channels_with_count"
+	FPCmdResetChannel          = "reset_channel"
+	FPCmdVersion               = "version"
+	FPCmdPing                  = "ping"
+	FPCmdPong                  = "pong"
+	FPCmdSet                   = "set"
+	FPCmdGet                   = "get"
+	FPCmdDel                   = "del"
+)
+
+// fpListDefault is how many IDs list returns without a count
+const fpListDefault = 100
+
+// foreign packet
+type FP struct {
+	Cmd        string          `json:"cmd"`
+	Appname    string          `json:"appname"`
+	Channel    string          `json:"channel"`
+	WorkId     string          `json:"work_id"`
+	TargetList string          `json:"target_list,omitempty"` // optional, used for some commands
+	Data       json.RawMessage `json:"data"`
+}
+
+// String writes the packet as cmd|appname|channel|work_id|targetlist|data, empty fields but
+// the target list as "-"
+func (fp *FP) String() string {
+	field := func(s string) string {
+		if s == "" {
+			return "-"
+		}
+		return s
+	}
+
+	data := fp.Data
+	if len(data) == 0 {
+		data = json.RawMessage("{}")
+	}
+	return fp.Cmd + "|" + field(fp.Appname) + "|" + field(fp.Channel) + "|" + field(fp.WorkId) + "|" + fp.TargetList + "|" + string(data)
+}
+
+// cmd|appname|channel|work_id|targetlist|data
+
+// ToFP parses a packet, the data may be left out. It returns nil when str is not a packet.
+func ToFP(str string) *FP {
+	parts := strings.SplitN(str, "|", 6)
+	if len(parts) < 5 {
+		return nil
+	}
+
+	fp := &FP{
+		Cmd:        parts[0],
+		Appname:    parts[1],
+		Channel:    parts[2],
+		WorkId:     parts[3],
+		TargetList: parts[4],
+	}
+
+	for _, field := range []*string{&fp.Appname, &fp.Channel, &fp.WorkId} {
+		if *field == "-" {
+			*field = ""
+		}
+	}
+
+	if len(parts) == 6 {
+		fp.Data = json.RawMessage(parts[5])
+	}
+
+	if len(fp.Data) == 0 {
+		fp.Data = json.RawMessage("{}")
+	}
+
+	return fp
+}
+
+// FPReply is the result of a packet
+type FPReply struct {
+	Cmd      string          `json:"cmd"`
+	Appname  string          `json:"appname,omitempty"`
+	Channel  string          `json:"channel,omitempty"`
+	WorkId   string          `json:"work_id,omitempty"`
+	Success  bool            `json:"success"`
+	Error    string          `json:"error,omitempty"`
+	Ids      []string        `json:"ids,omitempty"`
+	Count    int             `json:"count,omitempty"`
+	Channels map[string]int  `json:"channels,omitempty"`
+	Data     json.RawMessage `json:"data,omitempty"`
+}
+
+// fpdata is what the data of a packet may carry besides a value to set
+type fpdata struct {
+	Count int `json:"count"`
+}
+
+var errFPNoWorkID = errors.New("packet has no work ID")
+
+// execfp applies a packet to the apps of a server
+func (s *Server) execfp(p *FP) FPReply {
+	reply := FPReply{Cmd: p.Cmd, Appname: p.Appname, Channel: p.Channel, WorkId: p.WorkId}
+	if err := s.applyfp(p, &reply); err != nil {
+		reply.Error = err.Error()
+		return reply
+	}
+
+	reply.Success = true
+	return reply
+}
+
+func (s *Server) applyfp(p *FP, reply *FPReply) error {
+	switch p.Cmd {
+	case FPCmdPing:
+		reply.Cmd = FPCmdPong
+		return nil
+	case FPCmdVersion:
+		reply.Data, _ = json.Marshal(Version)
+		return nil
+	}
+
+	if s.apps.follower.Load() {
+		return errors.New("this server is a follower, send packets to the primary")
+	}
+
+	if err := validapp(p.Appname); err != nil {
+		return err
+	}
+
+	var data fpdata
+	if len(p.Data) > 0 {
+		// the data of set is the value, anything else may hold options
+		json.Unmarshal(p.Data, &data)
+	}
+
+	switch p.Cmd {
+	case FPCmdListChannels, FPCmdListChannelsWithCount:
+		a, err := s.apps.ensure(p.Appname)
+		if err != nil {
+			return err
+		}
+
+		channels, err := a.ListChannelsWithCount()
+		if err != nil {
+			return err
+		}
+
+		if p.Cmd == FPCmdListChannelsWithCount {
+			reply.Channels = channels
+			return nil
+		}
+
+		reply.Ids = make([]string, 0, len(channels))
+		for channel := range channels {
+			reply.Ids = append(reply.Ids, channel)
+		}
+		return nil
+	case FPCmdSet, FPCmdGet, FPCmdDel:
+		return s.fpvalue(p, reply)
+	}
+
+	if err := validchannel(p.Channel); err != nil {
+		return err
+	}
+
+	a, err := s.queue(p.Appname)
+	if err != nil {
+		return err
+	}
+
+	switch p.Cmd {
+	case FPCmdPush:
+		if p.WorkId == "" {
+			return errFPNoWorkID
+		}
+		return a.Push(p.Channel, p.WorkId)
+	case FPCmdPop, FPCmdPopWithCount:
+		count := 1
+		if p.Cmd == FPCmdPopWithCount && data.Count > 1 {
+			count = data.Count
+		}
+
+		ids, _, err := a.PopWait(p.Channel, count, 0)
+		reply.Ids, reply.Count = ids, len(ids)
+		return err
+	case FPCmdList:
+		count := data.Count
+		if count < 1 {
+			count = fpListDefault
+		}
+
+		ids, err := a.Peek(p.Channel, count)
+		reply.Ids, reply.Count = ids, len(ids)
+		return err
+	case FPCmdCount:
+		n, err := a.Count(p.Channel)
+		reply.Count = n
+		return err
+	case FPCmdReset, FPCmdResetChannel:
+		return a.ResetChannel(p.Channel)
+	}
+	return fmt.Errorf("unknown command %q", p.Cmd)
+}
+
+// fpvalue runs set, get and del on the values of an app, the work ID is the key
+func (s *Server) fpvalue(p *FP, reply *FPReply) error {
+	if p.WorkId == "" {
+		return errFPNoWorkID
+	}
+
+	a, err := s.apps.ensure(p.Appname)
+	if err != nil {
+		return err
+	}
+
+	switch p.Cmd {
+	case FPCmdSet:
+		if s.cluster != nil {
+			return ErrNotClustered
+		}
+
+		if !json.Valid(p.Data) {
+			return errors.New("data of set must be JSON")
+		}
+		return a.SetValue(p.WorkId, p.Data)
+	case FPCmdGet:
+		value, err := a.Value(p.WorkId)
+		if err != nil {
+			return err
+		}
+
+		if value == nil {
+			return fmt.Errorf("%s is not set", p.WorkId)
+		}
+		reply.Data = value
+		return nil
+	default:
+		if s.cluster != nil {
+			return ErrNotClustered
+		}
+
+		existed, err := a.DeleteValue(p.WorkId)
+		if existed {
+			reply.Count = 1
+		}
+		return err
+	}
+}
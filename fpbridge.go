@@ -0,0 +1,174 @@
+package solidq
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+const (
+	// fpReplies is the list replies go to when neither the bridge nor the packet names one
+	fpReplies = "solidq:fpreplies"
+	// fpBatch is how many packets the bridge pops at once
+	fpBatch = 64
+	// fpPoll is how long the bridge waits when the sorted set is empty
+	fpPoll = 200 * time.Millisecond
+	// fpRetry is how long the bridge waits after Redis failed
+	fpRetry = 2 * time.Second
+)
+
+// FPQueue is where the bridge takes packets from and sends replies to. The bridge uses a Redis
+// server, anything else that speaks ZPOPMAX and RPUSH, or a stand-in handed in as FPQueue.
+type FPQueue interface {
+	// Next removes and returns up to count packets with the highest scores from the sorted set at key
+	Next(ctx context.Context, key string, count int) ([]string, error)
+	// Reply appends replies to the list at key
+	Reply(ctx context.Context, key string, replies ...string) error
+}
+
+type redisfp struct {
+	c *redis.Client
+}
+
+// NewRedisFPQueue returns an FPQueue on a Redis server
+func NewRedisFPQueue(addr, password string) FPQueue {
+	return redisfp{c: redis.NewClient(&redis.Options{Addr: addr, Password: password})}
+}
+
+func (r redisfp) Next(ctx context.Context, key string, count int) ([]string, error) {
+	zs, err := r.c.ZPopMax(ctx, key, int64(count)).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	packets := make([]string, 0, len(zs))
+	for _, z := range zs {
+		if member, ok := z.Member.(string); ok {
+			packets = append(packets, member)
+		}
+	}
+	return packets, nil
+}
+
+func (r redisfp) Reply(ctx context.Context, key string, replies ...string) error {
+	values := make([]interface{}, len(replies))
+	for i, reply := range replies {
+		values[i] = reply
+	}
+	return r.c.RPush(ctx, key, values...).Err()
+}
+
+func (r redisfp) Close() error {
+	return r.c.Close()
+}
+
+// fpbridge applies the packets it pops from a Redis sorted set, highest score first, and pushes
+// a JSON reply for each to the packet's target list or the reply key. A packet is removed from
+// Redis before it is applied, one lost to a crash in between is not retried.
+type fpbridge struct {
+	s     *Server
+	queue FPQueue
+	key   string
+	reply string
+}
+
+func newfpbridge(s *Server, options *SeverOptions) *fpbridge {
+	b := &fpbridge{s: s, queue: options.FPQueue, key: options.FPKey, reply: options.FPReplyKey}
+	if b.queue == nil {
+		b.queue = NewRedisFPQueue(options.FPRedisAddr, options.FPRedisPassword)
+	}
+
+	if b.key == "" {
+		b.key = redisfpset
+	}
+
+	if b.reply == "" {
+		b.reply = fpReplies
+	}
+	return b
+}
+
+// run applies packets until stop is closed. Only a server that takes writes pops them.
+func (b *fpbridge) run(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	if c, ok := b.queue.(interface{ Close() error }); ok {
+		defer c.Close()
+	}
+
+	for ctx.Err() == nil {
+		wait := fpPoll
+		if b.active() {
+			n, err := b.next(ctx)
+			if err != nil && ctx.Err() == nil {
+				fmt.Println("FP bridge:", err)
+				wait = fpRetry
+			} else if n > 0 {
+				continue
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(wait):
+		}
+	}
+}
+
+// active tells whether this server applies packets, a follower or a cluster member that does
+// not lead leaves them to the one that takes writes
+func (b *fpbridge) active() bool {
+	if b.s.apps.follower.Load() {
+		return false
+	}
+	return b.s.cluster == nil || b.s.cluster.leads()
+}
+
+// next applies one batch of packets and returns how many there were
+func (b *fpbridge) next(ctx context.Context) (int, error) {
+	packets, err := b.queue.Next(ctx, b.key, fpBatch)
+	if err != nil || len(packets) == 0 {
+		if errors.Is(err, redis.Nil) {
+			err = nil
+		}
+		return 0, err
+	}
+
+	replies := make(map[string][]string)
+	var order []string
+	for _, str := range packets {
+		target, reply := b.reply, FPReply{Success: false, Error: "malformed packet"}
+		if p := ToFP(str); p != nil {
+			if p.TargetList != "" {
+				target = p.TargetList
+			}
+			reply = b.s.execfp(p)
+		}
+
+		data, err := json.Marshal(reply)
+		if err != nil {
+			return len(packets), err
+		}
+
+		if _, ok := replies[target]; !ok {
+			order = append(order, target)
+		}
+		replies[target] = append(replies[target], string(data))
+	}
+
+	for _, target := range order {
+		if err := b.queue.Reply(ctx, target, replies[target]...); err != nil {
+			return len(packets), err
+		}
+	}
+	return len(packets), nil
+}
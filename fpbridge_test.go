@@ -0,0 +1,133 @@
+package solidq
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"testing"
+)
+
+// memfp is an FPQueue kept in memory, a stand-in for Redis
+type memfp struct {
+	mu    sync.Mutex
+	sets  map[string]map[string]float64
+	lists map[string][]string
+}
+
+func newmemfp() *memfp {
+	return &memfp{sets: make(map[string]map[string]float64), lists: make(map[string][]string)}
+}
+
+func (m *memfp) add(key string, score float64, packet string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.sets[key] == nil {
+		m.sets[key] = make(map[string]float64)
+	}
+	m.sets[key][packet] = score
+}
+
+func (m *memfp) Next(ctx context.Context, key string, count int) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	set := m.sets[key]
+	packets := make([]string, 0, len(set))
+	for packet := range set {
+		packets = append(packets, packet)
+	}
+
+	sort.Slice(packets, func(i, j int) bool { return set[packets[i]] > set[packets[j]] })
+	if len(packets) > count {
+		packets = packets[:count]
+	}
+
+	for _, packet := range packets {
+		delete(set, packet)
+	}
+	return packets, nil
+}
+
+func (m *memfp) Reply(ctx context.Context, key string, replies ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.lists[key] = append(m.lists[key], replies...)
+	return nil
+}
+
+// replies decodes the list at key
+func (m *memfp) replies(t *testing.T, key string) []FPReply {
+	t.Helper()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var replies []FPReply
+	for _, data := range m.lists[key] {
+		var reply FPReply
+		if err := json.Unmarshal([]byte(data), &reply); err != nil {
+			t.Fatal(err)
+		}
+		replies = append(replies, reply)
+	}
+	return replies
+}
+
+func TestFPBridge(t *testing.T) {
+	s, err := NewServer(&SeverOptions{RootPath: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	mem := newmemfp()
+	b := newfpbridge(s, &SeverOptions{FPQueue: mem})
+
+	packets := []*FP{
+		{Cmd: FPCmdPush, Appname: "orders", Channel: "jobs", WorkId: "a"},
+		{Cmd: FPCmdPush, Appname: "orders", Channel: "jobs", WorkId: "b", TargetList: "orders:replies"},
+		{Cmd: FPCmdCount, Appname: "orders", Channel: "jobs"},
+		{Cmd: FPCmdPopWithCount, Appname: "orders", Channel: "jobs", TargetList: "orders:replies", Data: json.RawMessage(`{"count":2}`)},
+	}
+	for i, p := range packets {
+		mem.add(redisfpset, float64(len(packets)-i), p.String())
+	}
+	mem.add(redisfpset, 0, "junk")
+
+	n, err := b.next(context.Background())
+	if err != nil || n != len(packets)+1 {
+		t.Fatalf("applied %d packets: %v", n, err)
+	}
+
+	if n, err := b.next(context.Background()); err != nil || n != 0 {
+		t.Errorf("applied %d more packets from an empty set: %v", n, err)
+	}
+
+	replies := mem.replies(t, fpReplies)
+	if len(replies) != 3 {
+		t.Fatalf("%d replies on the default list, want 3: %+v", len(replies), replies)
+	}
+
+	if r := replies[0]; !r.Success || r.Cmd != FPCmdPush || r.WorkId != "a" {
+		t.Errorf("push reply %+v", r)
+	}
+
+	if r := replies[1]; !r.Success || r.Count != 2 {
+		t.Errorf("count reply %+v, want 2", r)
+	}
+
+	if r := replies[2]; r.Success || r.Error != "malformed packet" {
+		t.Errorf("reply to a malformed packet %+v", r)
+	}
+
+	targeted := mem.replies(t, "orders:replies")
+	if len(targeted) != 2 {
+		t.Fatalf("%d replies on the target list, want 2: %+v", len(targeted), targeted)
+	}
+
+	if r := targeted[1]; !r.Success || len(r.Ids) != 2 || r.Ids[0] != "a" || r.Ids[1] != "b" {
+		t.Errorf("pop reply %+v, want a and b", r)
+	}
+}
@@ -0,0 +1,88 @@
+package solidq
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"strings"
+)
+
+const (
+	FPCmdAuth = "auth"
+
+	// maxFPLine caps one packet of the line protocol
+	maxFPLine = 64 << 10
+)
+
+// servefp speaks the foreign packet format over TCP: every line is a packet, and every packet
+// gets one line back with its JSON reply, in order. Clients may pipeline packets. With a secret
+// set the first packet must be auth|-|-|<secret>| or the connection is closed.
+func (s *Server) servefp(conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReaderSize(conn, maxFPLine)
+	w := bufio.NewWriter(conn)
+	authed := s.options.Secret == ""
+
+	for {
+		line, err := r.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			writefp(w, FPReply{Error: "packet is too long"})
+			w.Flush()
+			return
+		}
+
+		if err != nil {
+			return
+		}
+
+		str := strings.TrimRight(string(line), "\r\n")
+		if str == "" {
+			continue
+		}
+
+		var reply FPReply
+		p := ToFP(str)
+		switch {
+		case p == nil:
+			reply = FPReply{Error: "malformed packet"}
+		case p.Cmd == FPCmdAuth:
+			reply = FPReply{Cmd: p.Cmd, Success: s.options.Secret == "" || p.WorkId == s.options.Secret}
+			if !reply.Success {
+				reply.Error = "Unauthorized"
+			}
+			authed = reply.Success
+		case !authed:
+			reply = FPReply{Cmd: p.Cmd, Error: "Unauthorized"}
+		default:
+			reply = s.execfp(p)
+		}
+
+		if err := writefp(w, reply); err != nil {
+			return
+		}
+
+		if !authed {
+			w.Flush()
+			return
+		}
+
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func writefp(w *bufio.Writer, reply FPReply) error {
+	data, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(data); err != nil {
+		return err
+	}
+	return w.WriteByte('\n')
+}
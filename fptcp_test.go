@@ -0,0 +1,127 @@
+package solidq
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sfi2k7/solidq/client"
+)
+
+func TestLineProtocolAuth(t *testing.T) {
+	s, err := NewServer(&SeverOptions{RootPath: t.TempDir(), Secret: "secret", FPAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+	addr := s.fp.ln.Addr().String()
+
+	if _, err := client.DialLine(addr, "wrong", time.Second); err == nil {
+		t.Error("a wrong secret was accepted")
+	}
+
+	// a packet before auth is answered once, then the connection is closed
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("push|core|jobs|a||{}\ncount|core|jobs|-||{}\n")); err != nil {
+		t.Fatal(err)
+	}
+
+	r := bufio.NewReader(conn)
+	if line, err := r.ReadString('\n'); err != nil || !strings.Contains(line, "Unauthorized") {
+		t.Errorf("reply before auth %q %v", line, err)
+	}
+
+	if line, err := r.ReadString('\n'); err == nil {
+		t.Errorf("connection still open after a packet before auth, got %q", line)
+	}
+
+	c, err := client.DialLine(addr, "secret", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if n, err := c.Count("jobs"); err != nil || n != 0 {
+		t.Errorf("count %d %v, the rejected push must not have gone through", n, err)
+	}
+}
+
+func TestLineClient(t *testing.T) {
+	s, err := NewServer(&SeverOptions{RootPath: t.TempDir(), FPAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	c, err := client.DialLine(s.fp.ln.Addr().String(), "", 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	ids := make([]string, 100)
+	for i := range ids {
+		ids[i] = "job-" + strconv.Itoa(i)
+	}
+
+	if err := c.PushMany("orders:jobs", ids...); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Push("orders:mail", "m"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := c.Count("orders:jobs"); err != nil || n != 100 {
+		t.Errorf("count %d %v, want 100", n, err)
+	}
+
+	listed, err := c.List("orders:jobs", 3)
+	if err != nil || len(listed) != 3 {
+		t.Errorf("list %v %v", listed, err)
+	}
+
+	popped, err := c.Pop("orders:jobs", 3)
+	if err != nil || strings.Join(popped, ",") != strings.Join(listed, ",") {
+		t.Errorf("pop %v %v, want the listed %v", popped, err, listed)
+	}
+
+	channels, err := c.ListChannels("orders")
+	if err != nil || channels["jobs"] != 97 || channels["mail"] != 1 {
+		t.Errorf("channels %v %v", channels, err)
+	}
+
+	// replies of a pipeline come back in order, a failed command does not stop the others
+	replies, err := c.Pipeline(
+		client.LineCommand{Cmd: "count", Channel: "orders:jobs"},
+		client.LineCommand{Cmd: "nope", Channel: "orders:jobs"},
+		client.LineCommand{Cmd: "reset", Channel: "orders:jobs"},
+		client.LineCommand{Cmd: "count", Channel: "orders:jobs"},
+	)
+	if err != nil || len(replies) != 4 {
+		t.Fatalf("pipeline %v %v", replies, err)
+	}
+
+	if replies[0].Count != 97 || replies[1].Success || !replies[2].Success || replies[3].Count != 0 {
+		t.Errorf("pipeline replies %+v", replies)
+	}
+
+	if _, err := c.Pipeline(client.LineCommand{Cmd: "push", Channel: "orders:jobs", ID: "a|b"}); err == nil {
+		t.Error("a work ID with a pipe was sent")
+	}
+
+	// a reset drops the channel
+	if channels, err := c.ListChannels("orders"); err != nil || len(channels) != 1 || channels["mail"] != 1 {
+		t.Errorf("channels after the reset %v %v", channels, err)
+	}
+}
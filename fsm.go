@@ -0,0 +1,441 @@
+package solidq
+
+import (
+	"archive/tar"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"go.etcd.io/bbolt"
+)
+
+// stamp is the Raft log entry a change is applied from. Files record the last index applied to
+// them so a replayed entry is skipped, and now is the leader's clock so every node computes the
+// same leases and retry times. The zero stamp is a change made directly.
+type stamp struct {
+	index uint64
+	now   time.Time
+}
+
+func (st stamp) time() time.Time {
+	if st.now.IsZero() {
+		return time.Now()
+	}
+	return st.now
+}
+
+// stamped holds the leader's clock for the transactions applying the Raft log, so what they
+// record, like the times of log entries, is the same on every node
+var stamped sync.Map // *bbolt.Tx -> time.Time
+
+// txtime returns the time a change is made at inside tx
+func txtime(tx *bbolt.Tx) time.Time {
+	if now, ok := stamped.Load(tx); ok {
+		return now.(time.Time)
+	}
+	return time.Now()
+}
+
+// updateat runs fn in a transaction that also records the stamp's log index in the file.
+// A file that already has the entry skips it.
+func (q *Que) updateat(st stamp, fn func(tx *bbolt.Tx) error) error {
+	if st.index == 0 {
+		return q.update(fn)
+	}
+
+	return q.update(func(tx *bbolt.Tx) error {
+		stamped.Store(tx, st.now)
+		defer stamped.Delete(tx)
+
+		b, err := tx.CreateBucketIfNotExists([]byte(settingsbucket))
+		if err != nil {
+			return err
+		}
+
+		if v := b.Get([]byte("raft:index")); len(v) == 8 && binary.BigEndian.Uint64(v) >= st.index {
+			return nil
+		}
+
+		if err := fn(tx); err != nil {
+			return err
+		}
+		return b.Put([]byte("raft:index"), logkey(st.index))
+	})
+}
+
+// commands of the Raft log
+const (
+	cmdPush          = "push"
+	cmdPop           = "pop"
+	cmdAck           = "ack"
+	cmdNack          = "nack"
+	cmdReset         = "reset"
+	cmdConfig        = "config"
+	cmdPause         = "pause"
+	cmdResume        = "resume"
+	cmdCreateChannel = "createchannel"
+	cmdSetRecurring  = "setrecurring"
+	cmdDelRecurring  = "delrecurring"
+	cmdFire          = "fire"
+	cmdImport        = "import"
+	cmdCreateApp     = "createapp"
+	cmdDeleteApp     = "deleteapp"
+	cmdPeer          = "peer"
+	cmdUnpeer        = "unpeer"
+)
+
+// command is one change replicated through the Raft log
+type command struct {
+	Op      string         `json:"op"`
+	App     string         `json:"app,omitempty"`
+	Channel string         `json:"channel,omitempty"`
+	ID      string         `json:"id,omitempty"`
+	Count   int            `json:"count,omitempty"`
+	Delay   time.Duration  `json:"delay,omitempty"`
+	Mode    string         `json:"mode,omitempty"`
+	Config  *ChannelConfig `json:"config,omitempty"`
+	Job     *RecurringJob  `json:"job,omitempty"`
+	Items   []ExportItem   `json:"items,omitempty"`
+	Shards  int            `json:"shards,omitempty"`
+	By      string         `json:"by,omitempty"`
+	Node    string         `json:"node,omitempty"`
+	Addr    string         `json:"addr,omitempty"`
+	Now     int64          `json:"now"`
+}
+
+// applied is what applying a command returned, handed back to the node that proposed it
+type applied struct {
+	ids     []string
+	mustack bool
+	count   int
+	skipped int
+	job     RecurringJob
+	err     error
+}
+
+var errAppReplaced = errors.New("app was replaced by a cluster snapshot")
+
+// clusterfsm applies the Raft log to the app files of a registry. It also keeps the HTTP
+// address of every member, so writes can be forwarded to the leader.
+type clusterfsm struct {
+	apps  *registry
+	peers sync.Map // node ID -> HTTP URL
+}
+
+func (f *clusterfsm) Apply(l *raft.Log) interface{} {
+	var c command
+	if err := json.Unmarshal(l.Data, &c); err != nil {
+		return applied{err: err}
+	}
+	return f.apply(stamp{index: l.Index, now: time.Unix(0, c.Now)}, c)
+}
+
+func (f *clusterfsm) apply(st stamp, c command) applied {
+	switch c.Op {
+	case cmdPeer:
+		f.peers.Store(c.Node, c.Addr)
+		return applied{}
+	case cmdUnpeer:
+		f.peers.Delete(c.Node)
+		return applied{}
+	case cmdCreateApp:
+		_, err := f.apps.create(c.App, c.Shards, c.By)
+		return applied{err: err}
+	case cmdDeleteApp:
+		return applied{err: f.apps.delete(c.App)}
+	}
+
+	a, err := f.apps.ensure(c.App)
+	if err != nil {
+		return applied{err: err}
+	}
+
+	switch c.Op {
+	case cmdPush:
+		err = a.pushat(st, c.Channel, c.ID)
+	case cmdPop:
+		ids, mustack, err := a.popat(st, c.Channel, c.Count)
+		return applied{ids: ids, mustack: mustack, err: err}
+	case cmdAck:
+		err = a.ackat(st, c.Channel, c.ID)
+	case cmdNack:
+		err = a.nackat(st, c.Channel, c.ID, c.Delay)
+	case cmdReset:
+		err = a.resetat(st, c.Channel)
+	case cmdConfig:
+		if c.Config == nil {
+			return applied{err: errors.New("config missing")}
+		}
+		err = a.setconfigat(st, c.Channel, *c.Config)
+	case cmdPause:
+		err = a.pauseat(st, c.Channel, c.Mode)
+	case cmdResume:
+		err = a.resumeat(st, c.Channel)
+	case cmdCreateChannel:
+		err = a.createchannelat(st, c.Channel)
+	case cmdSetRecurring:
+		if c.Job == nil {
+			return applied{err: errors.New("recurring job missing")}
+		}
+		job, err := a.setrecurringat(st, *c.Job)
+		return applied{job: job, err: err}
+	case cmdDelRecurring:
+		err = a.deleterecurringat(st, c.ID)
+	case cmdFire:
+		fired, err := a.firerecurringat(st)
+		return applied{count: fired, err: err}
+	case cmdImport:
+		imported, skipped, err := a.importat(st, c.Channel, c.Items, c.Mode)
+		return applied{count: imported, skipped: skipped, err: err}
+	default:
+		err = fmt.Errorf("unknown command %q", c.Op)
+	}
+	return applied{err: err}
+}
+
+// Snapshot opens a read transaction on every app file, Persist then streams them while the log
+// keeps being applied
+func (f *clusterfsm) Snapshot() (raft.FSMSnapshot, error) {
+	apps, err := f.apps.list(true)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, app := range apps {
+		if _, err := f.apps.ensure(app); err != nil {
+			return nil, err
+		}
+	}
+
+	snap := &clustersnapshot{peers: make(map[string]string)}
+	f.peers.Range(func(k, v interface{}) bool {
+		snap.peers[k.(string)] = v.(string)
+		return true
+	})
+
+	f.apps.eachque(func(appname string, q *Que) {
+		if err != nil {
+			return
+		}
+
+		var tx *bbolt.Tx
+		if tx, err = q.begin(); err == nil {
+			snap.files = append(snap.files, snapshotfile{q: q, tx: tx})
+		}
+	})
+
+	if err != nil {
+		snap.Release()
+		return nil, err
+	}
+	return snap, nil
+}
+
+// Restore replaces every app file with the ones in the snapshot
+func (f *clusterfsm) Restore(rc io.ReadCloser) error {
+	defer rc.Close()
+
+	files := make(map[string]string)
+	defer func() {
+		for _, tmp := range files {
+			os.Remove(tmp)
+		}
+	}()
+
+	peers := make(map[string]string)
+	tr := tar.NewReader(rc)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if hdr.Name == "cluster.json" {
+			if err := json.NewDecoder(tr).Decode(&peers); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !isappfile(hdr.Name) {
+			return fmt.Errorf("unexpected file in cluster snapshot: %s", hdr.Name)
+		}
+
+		tmp, err := receivesnapshot(filepath.Join(f.apps.root, hdr.Name), tr)
+		if err != nil {
+			return err
+		}
+		files[hdr.Name] = tmp
+	}
+
+	if err := f.apps.replaceall(files); err != nil {
+		return err
+	}
+
+	f.peers.Range(func(k, v interface{}) bool {
+		f.peers.Delete(k)
+		return true
+	})
+	for id, addr := range peers {
+		f.peers.Store(id, addr)
+	}
+	return nil
+}
+
+type snapshotfile struct {
+	q  *Que
+	tx *bbolt.Tx
+}
+
+// clustersnapshot is a tar stream with the member addresses in cluster.json and every app file
+type clustersnapshot struct {
+	peers    map[string]string
+	files    []snapshotfile
+	released sync.Once
+}
+
+func (s *clustersnapshot) Persist(sink raft.SnapshotSink) error {
+	err := s.write(sink)
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+	return sink.Close()
+}
+
+func (s *clustersnapshot) write(w io.Writer) error {
+	tw := tar.NewWriter(w)
+
+	peers, err := json.Marshal(s.peers)
+	if err != nil {
+		return err
+	}
+
+	if err := tw.WriteHeader(&tar.Header{Name: "cluster.json", Mode: 0600, Size: int64(len(peers)), ModTime: time.Now()}); err != nil {
+		return err
+	}
+
+	if _, err := tw.Write(peers); err != nil {
+		return err
+	}
+
+	for _, f := range s.files {
+		err := tw.WriteHeader(&tar.Header{
+			Name:    filepath.Base(f.q.path),
+			Mode:    0600,
+			Size:    f.tx.Size(),
+			ModTime: time.Now(),
+		})
+		if err != nil {
+			return err
+		}
+
+		if _, err := f.tx.WriteTo(tw); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func (s *clustersnapshot) Release() {
+	s.released.Do(func() {
+		for _, f := range s.files {
+			f.q.end(f.tx)
+		}
+	})
+}
+
+// begin starts a read transaction that keeps the DB open until end is called with it. Unlike rlock
+// it never evicts other apps, a snapshot holds several of them at once.
+func (q *Que) begin() (*bbolt.Tx, error) {
+	q.mu.RLock()
+	for q.db == nil {
+		q.mu.RUnlock()
+
+		q.mu.Lock()
+		err := q.openlocked()
+		q.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+
+		q.mu.RLock()
+	}
+
+	tx, err := q.db.Begin(false)
+	if err != nil {
+		q.mu.RUnlock()
+		return nil, err
+	}
+	return tx, nil
+}
+
+func (q *Que) end(tx *bbolt.Tx) {
+	tx.Rollback()
+	q.mu.RUnlock()
+}
+
+var appfile = regexp.MustCompile(`^[^/\\]+\.db(\.[0-9]+)?$`)
+
+// isappfile tells the app and shard files in a root path from anything else
+func isappfile(name string) bool {
+	return appfile.MatchString(name)
+}
+
+// replaceall closes every app and puts the given files, file name to temp path, in place of
+// the app files in the root path. Apps that are not among them are removed.
+func (r *registry) replaceall(files map[string]string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var first error
+	r.store.Range(func(key, value interface{}) bool {
+		r.store.Delete(key)
+		for _, q := range value.(*App).shards {
+			q.mu.Lock()
+			q.closed = errAppReplaced
+			if err := q.closelocked(); err != nil && first == nil {
+				first = err
+			}
+			q.mu.Unlock()
+			q.wake()
+		}
+		return true
+	})
+
+	if first != nil {
+		return first
+	}
+
+	entries, err := os.ReadDir(r.root)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if !e.IsDir() && isappfile(e.Name()) {
+			if err := os.Remove(filepath.Join(r.root, e.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	for name, tmp := range files {
+		if err := os.Rename(tmp, filepath.Join(r.root, name)); err != nil {
+			return err
+		}
+		delete(files, name)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package solidq
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+	"github.com/sfi2k7/solidq/routes"
+	"go.etcd.io/bbolt"
+)
+
+func testfsm(t *testing.T) *clusterfsm {
+	t.Helper()
+	apps, err := newregistry(t.TempDir(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apps.mutationlog = true
+	apps.clustered = true
+	t.Cleanup(func() { apps.closeall() })
+	return &clusterfsm{apps: apps}
+}
+
+// dumpfiles returns every key of every app file, the log epoch aside: it is drawn when a node
+// creates the file and a new node gets it from the snapshot it starts from
+func dumpfiles(t *testing.T, f *clusterfsm) map[string]string {
+	t.Helper()
+	dump := make(map[string]string)
+
+	var walk func(prefix string, b *bbolt.Bucket) error
+	walk = func(prefix string, b *bbolt.Bucket) error {
+		return b.ForEach(func(k, v []byte) error {
+			if v == nil {
+				return walk(prefix+string(k)+"/", b.Bucket(k))
+			}
+
+			if string(k) != "logepoch" {
+				dump[prefix+string(k)] = string(v)
+			}
+			return nil
+		})
+	}
+
+	f.apps.eachque(func(appname string, q *Que) {
+		err := q.view(func(tx *bbolt.Tx) error {
+			return tx.ForEach(func(name []byte, b *bbolt.Bucket) error {
+				return walk(q.path[len(f.apps.root):]+":"+string(name)+"/", b)
+			})
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	return dump
+}
+
+func TestFSMDeterministic(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	jittered := &ChannelConfig{MaxInFlight: 3, Lease: 60, Backoff: BackoffPolicy{Base: routes.Duration(5 * time.Second), Multiplier: 2, Max: routes.Duration(time.Minute), Jitter: 1}}
+	commands := []command{
+		{Op: cmdCreateApp, App: "orders", Shards: 2, By: ShardByID},
+		{Op: cmdConfig, App: "orders", Channel: "jobs", Config: jittered},
+		{Op: cmdSetRecurring, App: "orders", Job: &RecurringJob{Name: "tick", Channel: "jobs", Interval: 4, IDTemplate: "tick-{seq}"}},
+		{Op: cmdSetRecurring, App: "orders", Job: &RecurringJob{Name: "gone", Channel: "jobs", Interval: 1, IDTemplate: "gone-{seq}"}},
+		{Op: cmdDelRecurring, App: "orders", ID: "gone"},
+		{Op: cmdPush, App: "orders", Channel: "jobs", ID: "a"},
+		{Op: cmdPush, App: "orders", Channel: "jobs", ID: "b"},
+		{Op: cmdPush, App: "orders", Channel: "jobs", ID: "c"},
+		{Op: cmdPop, App: "orders", Channel: "jobs", Count: 3},
+		{Op: cmdAck, App: "orders", Channel: "jobs", ID: "a"},
+		{Op: cmdNack, App: "orders", Channel: "jobs", ID: "b"},
+		{Op: cmdNack, App: "orders", Channel: "jobs", ID: "c", Delay: 3 * time.Second},
+		{Op: cmdPop, App: "orders", Channel: "jobs", Count: 3},
+		{Op: cmdPush, App: "orders", Channel: "other", ID: "d"},
+		{Op: cmdReset, App: "orders", Channel: "other"},
+		{Op: cmdImport, App: "orders", Channel: "imported", Mode: DuplicateSkip, Items: []ExportItem{
+			{ID: "x", Payload: "one"},
+			{ID: "y", Payload: "two"},
+			{ID: "z", Metadata: map[string]string{"due": start.Add(time.Hour).Format(time.RFC3339Nano)}},
+		}},
+		{Op: cmdImport, App: "orders", Channel: "imported", Mode: DuplicateSkip, Items: []ExportItem{{ID: "x"}}},
+		{Op: cmdFire, App: "orders"},
+	}
+
+	var logs []*raft.Log
+	for i, c := range commands {
+		c.Now = start.Add(time.Duration(i) * time.Second).UnixNano()
+		data, err := json.Marshal(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		logs = append(logs, &raft.Log{Index: uint64(i + 1), Data: data})
+	}
+
+	var dumps []map[string]string
+	for node := 0; node < 2; node++ {
+		f := testfsm(t)
+		var results []applied
+		for _, l := range logs {
+			res := f.Apply(l).(applied)
+			if res.err != nil {
+				t.Fatalf("node %d, entry %d: %v", node, l.Index, res.err)
+			}
+			results = append(results, res)
+		}
+
+		if res := results[len(results)-3]; res.count != 3 {
+			t.Errorf("imported %d items, want 3", res.count)
+		}
+
+		if res := results[len(results)-2]; res.count != 0 || res.skipped != 1 {
+			t.Errorf("imported %d and skipped %d of a duplicate, want 0 and 1", res.count, res.skipped)
+		}
+
+		if res := results[len(results)-1]; res.count == 0 {
+			t.Error("the fire pushed no run of the recurring job")
+		}
+
+		// a node applies entries again after a restart, they must be skipped
+		dump := dumpfiles(t, f)
+		for _, l := range logs[1:] {
+			if res := f.Apply(l).(applied); res.err != nil {
+				t.Fatalf("node %d, replayed entry %d: %v", node, l.Index, res.err)
+			}
+		}
+
+		if !reflect.DeepEqual(dump, dumpfiles(t, f)) {
+			t.Errorf("node %d changed when replaying its log", node)
+		}
+		dumps = append(dumps, dump)
+	}
+
+	if len(dumps[0]) == 0 {
+		t.Fatal("nothing applied")
+	}
+
+	for k, v := range dumps[0] {
+		if dumps[1][k] != v {
+			t.Errorf("%s: %q on one node, %q on the other", k, v, dumps[1][k])
+		}
+	}
+
+	if !reflect.DeepEqual(dumps[0], dumps[1]) {
+		t.Errorf("the nodes hold %d and %d keys", len(dumps[0]), len(dumps[1]))
+	}
+}
@@ -0,0 +1,363 @@
+package solidq
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// buckets starting with internalprefix hold solidq bookkeeping and are never listed as channels
+const internalprefix = "solidq:"
+
+const configbucket = internalprefix + "config"
+
+const defaultLease = 5 * time.Minute
+
+// statsbucket holds the per channel command counters, it predates internalprefix
+const statsbucket = "app_stats"
+
+func isinternal(name string) bool {
+	return strings.HasPrefix(name, internalprefix) || name == statsbucket
+}
+
+func inflightbucket(channel string) []byte {
+	return []byte(internalprefix + "inflight:" + channel)
+}
+
+// poppedbucket keeps the payloads of items popped from an uncapped channel for one lease, so a
+// nack puts them back with their payload. Items without a payload are not kept.
+func poppedbucket(channel string) []byte {
+	return []byte(internalprefix + "popped:" + channel)
+}
+
+// ErrNotInFlight is returned for a nack of an item that was not popped, or whose lease ran out
+var ErrNotInFlight = errors.New("item is not in flight")
+
+// in-flight values are the pop time in unix nanos, a colon and the payload. Files from before
+// payloads were kept hold the time alone.
+func inflightvalue(since time.Time, payload []byte) []byte {
+	return append([]byte(strconv.FormatInt(since.UnixNano(), 10)+":"), payload...)
+}
+
+func parseinflight(v []byte) (time.Time, []byte, error) {
+	since, payload, _ := strings.Cut(string(v), ":")
+	n, err := strconv.ParseInt(since, 10, 64)
+	return time.Unix(0, n), []byte(payload), err
+}
+
+// ChannelConfig holds per channel settings, stored in the app DB
+type ChannelConfig struct {
+	MaxInFlight int           `json:"maxInFlight"` // 0 means no cap and no in-flight tracking
+	Lease       int           `json:"lease"`       // seconds an in-flight item is held before it is requeued
+	Backoff     BackoffPolicy `json:"backoff"`     // retry delay for nacked items
+}
+
+func (cc ChannelConfig) lease() time.Duration {
+	if cc.Lease <= 0 {
+		return defaultLease
+	}
+	return time.Duration(cc.Lease) * time.Second
+}
+
+func readconfig(tx *bbolt.Tx, channel string) (ChannelConfig, error) {
+	var cc ChannelConfig
+
+	b := tx.Bucket([]byte(configbucket))
+	if b == nil {
+		return cc, nil
+	}
+
+	v := b.Get([]byte(channel))
+	if v == nil {
+		return cc, nil
+	}
+
+	err := json.Unmarshal(v, &cc)
+	return cc, err
+}
+
+func writeconfig(tx *bbolt.Tx, channel string, cc ChannelConfig) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(configbucket))
+	if err != nil {
+		return err
+	}
+
+	v, err := json.Marshal(cc)
+	if err != nil {
+		return err
+	}
+
+	return b.Put([]byte(channel), v)
+}
+
+func (q *Que) ChannelConfig(channel string) (ChannelConfig, error) {
+	var cc ChannelConfig
+	err := q.view(func(tx *bbolt.Tx) error {
+		var err error
+		cc, err = readconfig(tx, channel)
+		return err
+	})
+
+	return cc, err
+}
+
+func (q *Que) SetChannelConfig(channel string, cc ChannelConfig) error {
+	return q.setconfigat(stamp{}, channel, cc)
+}
+
+func (q *Que) setconfigat(st stamp, channel string, cc ChannelConfig) error {
+	if cc.MaxInFlight < 0 {
+		return invalidf("max in-flight cannot be negative")
+	}
+
+	err := q.updateat(st, func(tx *bbolt.Tx) error {
+		if err := writeconfig(tx, channel, cc); err != nil {
+			return err
+		}
+
+		v, err := json.Marshal(cc)
+		if err != nil {
+			return err
+		}
+		return logop(tx, LogEntry{Op: LogConfig, Channel: channel, Payload: string(v)})
+	})
+
+	q.wake()
+	return err
+}
+
+// InFlight returns the number of items popped from a capped channel and not yet acked
+func (q *Que) InFlight(channel string) (int, error) {
+	var count int
+	err := q.view(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(inflightbucket(channel))
+		if b == nil {
+			return nil
+		}
+		count = b.Stats().KeyN
+		return nil
+	})
+
+	return count, err
+}
+
+// leased counts the in-flight items of a channel whose lease has not run out at now
+func (q *Que) leased(channel string, lease time.Duration, now time.Time) (int, error) {
+	count := 0
+	err := q.view(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(inflightbucket(channel))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			if since, _, err := parseinflight(v); err == nil && now.Sub(since) <= lease {
+				count++
+			}
+			return nil
+		})
+	})
+
+	return count, err
+}
+
+// Ack releases an in-flight item so its slot can be used by the next pop, and forgets its failed attempts
+func (q *Que) Ack(channel, id string) error {
+	return q.ackat(stamp{}, channel, id)
+}
+
+func (q *Que) ackat(st stamp, channel, id string) error {
+	if id == "" {
+		return invalidf("work ID cannot be empty")
+	}
+
+	err := q.updateat(st, func(tx *bbolt.Tx) error {
+		if err := forget(tx, channel, []string{id}, inflightbucket(channel), poppedbucket(channel), attemptsbucket(channel)); err != nil {
+			return err
+		}
+		return logop(tx, LogEntry{Op: LogAck, Channel: channel, IDs: []string{id}})
+	})
+
+	q.wake()
+	return err
+}
+
+// reclaim puts in-flight items whose lease ran out back into the channel
+func reclaim(tx *bbolt.Tx, channel string, lease time.Duration, now time.Time) error {
+	b := tx.Bucket(inflightbucket(channel))
+	if b == nil {
+		return nil
+	}
+
+	expired := make(map[string][]byte)
+	err := b.ForEach(func(k, v []byte) error {
+		since, payload, err := parseinflight(v)
+		if err != nil || now.Sub(since) > lease {
+			expired[string(k)] = payload
+		}
+		return nil
+	})
+	if err != nil || len(expired) == 0 {
+		return err
+	}
+
+	for id, payload := range expired {
+		if err := b.Delete([]byte(id)); err != nil {
+			return err
+		}
+		if err := readyitem(tx, channel, id, payload, StateInFlight); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// capacity returns how many items may be popped right now under the channel's cap, -1 when uncapped
+func capacity(tx *bbolt.Tx, channel string, cc ChannelConfig, now time.Time) (int, error) {
+	if cc.MaxInFlight == 0 {
+		return -1, nil
+	}
+
+	if tx.Writable() {
+		if err := reclaim(tx, channel, cc.lease(), now); err != nil {
+			return 0, err
+		}
+	}
+
+	inflight := 0
+	if b := tx.Bucket(inflightbucket(channel)); b != nil {
+		inflight = countkeys(b)
+	}
+
+	if inflight >= cc.MaxInFlight {
+		return 0, nil
+	}
+	return cc.MaxInFlight - inflight, nil
+}
+
+// markinflight records popped items with their payloads, which go back to the channel with
+// them on a nack or an expired lease
+func markinflight(tx *bbolt.Tx, channel string, ids []string, payloads [][]byte, now time.Time) error {
+	b, err := tx.CreateBucketIfNotExists(inflightbucket(channel))
+	if err != nil {
+		return err
+	}
+
+	for i, id := range ids {
+		if err := b.Put([]byte(id), inflightvalue(now, payloads[i])); err != nil {
+			return err
+		}
+	}
+	return logop(tx, LogEntry{Time: now.UnixNano(), Op: LogMove, Channel: channel, IDs: ids, From: StateReady, To: StateInFlight})
+}
+
+// keeppayloads records the payloads popped from an uncapped channel and drops the ones popped
+// more than lease before now
+func keeppayloads(tx *bbolt.Tx, channel string, ids []string, payloads [][]byte, lease time.Duration, now time.Time) error {
+	b := tx.Bucket(poppedbucket(channel))
+	if b != nil {
+		var expired [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			if since, _, err := parseinflight(v); err != nil || now.Sub(since) > lease {
+				expired = append(expired, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range expired {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+	}
+
+	for i, id := range ids {
+		if len(payloads[i]) == 0 {
+			continue
+		}
+
+		if b == nil {
+			var err error
+			if b, err = tx.CreateBucketIfNotExists(poppedbucket(channel)); err != nil {
+				return err
+			}
+		}
+
+		if err := b.Put([]byte(id), inflightvalue(now, payloads[i])); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// waiters lets long-polling pops sleep until something changes in the app
+type waiters struct {
+	mu sync.Mutex
+	ch chan struct{}
+}
+
+// changed returns a channel that is closed on the next wake
+func (w *waiters) changed() <-chan struct{} {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.ch == nil {
+		w.ch = make(chan struct{})
+	}
+	return w.ch
+}
+
+func (w *waiters) wake() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.ch != nil {
+		close(w.ch)
+		w.ch = nil
+	}
+}
+
+func (q *Que) waiter() <-chan struct{} {
+	return q.w.changed()
+}
+
+func (q *Que) wake() {
+	q.w.wake()
+}
+
+// PopWait behaves like PopWithCount but waits up to wait for items or in-flight capacity.
+// It also reports whether the popped items must be acked.
+func (q *Que) PopWait(channel string, count int, wait time.Duration) ([]string, bool, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		changed := q.waiter()
+
+		ids, mustack, err := q.popwithcount(channel, count)
+		if err != nil || len(ids) > 0 {
+			return ids, mustack, err
+		}
+
+		left := time.Until(deadline)
+		if left <= 0 || q.draining.Load() {
+			return nil, false, nil
+		}
+
+		// re-check at least every second so expired leases and due retries are picked up while waiting
+		if left > time.Second {
+			left = time.Second
+		}
+
+		select {
+		case <-changed:
+		case <-time.After(left):
+		}
+	}
+}
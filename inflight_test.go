@@ -0,0 +1,278 @@
+package solidq
+
+import (
+	"bytes"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+func openque(t *testing.T) *Que {
+	t.Helper()
+	q, err := OpenQue(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { q.Close() })
+	return q
+}
+
+// exported returns the payload Export writes for an item, and whether it was written at all
+func exported(t *testing.T, q *Que, channel, id string) (string, bool) {
+	t.Helper()
+	var buf bytes.Buffer
+	if _, err := q.Export(channel, &buf); err != nil {
+		t.Fatal(err)
+	}
+
+	items, err := decodeitems(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, item := range items {
+		if item.ID == id {
+			return item.Payload, true
+		}
+	}
+	return "", false
+}
+
+func decodeitems(r *bytes.Buffer) ([]ExportItem, error) {
+	var items []ExportItem
+	err := readitems(r, func(item ExportItem) error {
+		items = append(items, item)
+		return nil
+	})
+	return items, err
+}
+
+func TestRetryKeepsPayload(t *testing.T) {
+	q := openque(t)
+	if err := q.SetChannelConfig("jobs", ChannelConfig{MaxInFlight: 2, Lease: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := q.Import("jobs", strings.NewReader(`{"id":"a","payload":"first"}`+"\n"+`{"id":"b","payload":"second"}`+"\n"), DuplicateSkip); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, _, err := q.popwithcount("jobs", 2)
+	if err != nil || len(ids) != 2 {
+		t.Fatalf("pop: %v %v", ids, err)
+	}
+
+	if err := q.Nack("jobs", "a", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+
+	if payload, ok := exported(t, q, "jobs", "a"); !ok || payload != "first" {
+		t.Errorf("nacked item exported with payload %q (%v), want first", payload, ok)
+	}
+
+	// b's lease runs out and the next pop reclaims it
+	err = q.update(func(tx *bbolt.Tx) error {
+		return reclaim(tx, "jobs", time.Second, time.Now().Add(time.Minute))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if payload, ok := exported(t, q, "jobs", "b"); !ok || payload != "second" {
+		t.Errorf("reclaimed item exported with payload %q (%v), want second", payload, ok)
+	}
+}
+
+func TestNackNotInFlight(t *testing.T) {
+	q := openque(t)
+	if err := q.Push("open", "queued"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.Nack("open", "queued", time.Second); !errors.Is(err, ErrNotInFlight) {
+		t.Errorf("nack of a queued item: %v, want ErrNotInFlight", err)
+	}
+
+	if err := q.SetChannelConfig("capped", ChannelConfig{MaxInFlight: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.Nack("capped", "never", time.Second); !errors.Is(err, ErrNotInFlight) {
+		t.Errorf("nack of an item never popped: %v, want ErrNotInFlight", err)
+	}
+
+	if n, _ := q.Scheduled("capped"); n != 0 {
+		t.Errorf("%d items scheduled after a rejected nack", n)
+	}
+}
+
+func TestRetryUncappedKeepsPayload(t *testing.T) {
+	q := openque(t)
+	if _, _, err := q.Import("jobs", strings.NewReader(`{"id":"a","payload":"first"}`+"\n"+`{"id":"b"}`+"\n"), DuplicateSkip); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, mustack, err := q.popwithcount("jobs", 2)
+	if err != nil || len(ids) != 2 || mustack {
+		t.Fatalf("pop: %v %v %v", ids, mustack, err)
+	}
+
+	for _, id := range ids {
+		if err := q.Nack("jobs", id, time.Hour); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if payload, ok := exported(t, q, "jobs", "a"); !ok || payload != "first" {
+		t.Errorf("nacked item exported with payload %q (%v), want first", payload, ok)
+	}
+
+	if payload, ok := exported(t, q, "jobs", "b"); !ok || payload != "" {
+		t.Errorf("nacked item without a payload exported with %q (%v)", payload, ok)
+	}
+
+	// popped payloads are kept for one lease only
+	if err := q.Push("jobs", "c"); err != nil {
+		t.Fatal(err)
+	}
+
+	err = q.update(func(tx *bbolt.Tx) error {
+		if err := keeppayloads(tx, "jobs", []string{"old"}, [][]byte{[]byte("x")}, defaultLease, time.Now().Add(-time.Hour)); err != nil {
+			return err
+		}
+		return keeppayloads(tx, "jobs", []string{"new"}, [][]byte{[]byte("y")}, defaultLease, time.Now())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = q.view(func(tx *bbolt.Tx) error {
+		b := tx.Bucket(poppedbucket("jobs"))
+		if b.Get([]byte("old")) != nil || b.Get([]byte("new")) == nil || b.Get([]byte("a")) != nil {
+			t.Errorf("popped payloads after the lease: old %q, new %q, a %q", b.Get([]byte("old")), b.Get([]byte("new")), b.Get([]byte("a")))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestInFlightCap(t *testing.T) {
+	q := openque(t)
+	if err := q.SetChannelConfig("jobs", ChannelConfig{MaxInFlight: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"a", "b", "c"} {
+		if err := q.Push("jobs", id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ids, mustack, err := q.popwithcount("jobs", 3)
+	if err != nil || len(ids) != 2 || !mustack {
+		t.Fatalf("pop over the cap: %v %v %v, want 2 items to ack", ids, mustack, err)
+	}
+
+	if ids, _, err := q.popwithcount("jobs", 1); err != nil || len(ids) != 0 {
+		t.Fatalf("pop with every slot taken: %v %v", ids, err)
+	}
+
+	if n, _ := q.InFlight("jobs"); n != 2 {
+		t.Errorf("%d in flight, want 2", n)
+	}
+
+	if err := q.Ack("jobs", ids[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if ids, _, err := q.popwithcount("jobs", 3); err != nil || len(ids) != 1 || ids[0] != "c" {
+		t.Errorf("pop after an ack: %v %v, want c", ids, err)
+	}
+
+	if err := q.SetChannelConfig("jobs", ChannelConfig{MaxInFlight: -1}); err == nil {
+		t.Error("a negative cap was accepted")
+	}
+}
+
+func TestLeaseReclaim(t *testing.T) {
+	q := openque(t)
+	if err := q.SetChannelConfig("jobs", ChannelConfig{MaxInFlight: 1, Lease: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.Push("jobs", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if ids, _, err := q.popwithcount("jobs", 1); err != nil || len(ids) != 1 {
+		t.Fatalf("pop: %v %v", ids, err)
+	}
+
+	// a pop within the lease finds the slot taken, one after it gets the item again
+	if ids, _, err := q.popat(stamp{now: time.Now()}, "jobs", 1); err != nil || len(ids) != 0 {
+		t.Fatalf("pop within the lease: %v %v", ids, err)
+	}
+
+	ids, _, err := q.popat(stamp{now: time.Now().Add(2 * time.Second)}, "jobs", 1)
+	if err != nil || len(ids) != 1 || ids[0] != "a" {
+		t.Fatalf("pop after the lease: %v %v, want a", ids, err)
+	}
+
+	if n, _ := q.leased("jobs", time.Second, time.Now().Add(2*time.Second)); n != 1 {
+		t.Errorf("%d items leased, want the one popped again", n)
+	}
+}
+
+func TestPopWaitWakes(t *testing.T) {
+	q := openque(t)
+	if err := q.SetChannelConfig("capped", ChannelConfig{MaxInFlight: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		name    string
+		channel string
+		change  func() error
+	}{
+		{"push", "jobs", func() error { return q.Push("jobs", "a") }},
+		{"ack", "capped", func() error { return q.Ack("capped", "b") }},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.channel == "capped" {
+				if err := q.Push("capped", "b"); err != nil {
+					t.Fatal(err)
+				}
+				if err := q.Push("capped", "c"); err != nil {
+					t.Fatal(err)
+				}
+				if ids, _, err := q.popwithcount("capped", 1); err != nil || len(ids) != 1 {
+					t.Fatalf("pop: %v %v", ids, err)
+				}
+			}
+
+			time.AfterFunc(100*time.Millisecond, func() { tc.change() })
+
+			start := time.Now()
+			ids, _, err := q.PopWait(tc.channel, 1, 10*time.Second)
+			if err != nil || len(ids) != 1 {
+				t.Fatalf("PopWait: %v %v", ids, err)
+			}
+
+			// the wait loop re-checks every second on its own, a wakeup comes well before that
+			if took := time.Since(start); took > 900*time.Millisecond {
+				t.Errorf("PopWait returned after %v", took)
+			}
+		})
+	}
+
+	start := time.Now()
+	if ids, _, err := q.PopWait("empty", 1, 200*time.Millisecond); err != nil || len(ids) != 0 || time.Since(start) < 200*time.Millisecond {
+		t.Errorf("PopWait on an empty channel: %v %v after %v", ids, err, time.Since(start))
+	}
+}
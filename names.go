@@ -0,0 +1,126 @@
+package solidq
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"go.etcd.io/bbolt"
+)
+
+const (
+	MaxAppNameLength     = 64
+	MaxChannelNameLength = 128
+)
+
+const channelsbucket = internalprefix + "channels"
+
+var ErrUnknownChannel = errors.New("channel does not exist")
+
+// invalid is an error in what the caller sent, the v2 API answers it with 400
+type invalid struct {
+	msg string
+}
+
+func (e invalid) Error() string {
+	return e.msg
+}
+
+func invalidf(format string, args ...interface{}) error {
+	return invalid{msg: fmt.Sprintf(format, args...)}
+}
+
+// validname allows letters, digits, '_', '-' and '.', not leading with '.' or '-',
+// so a name can never leave the data directory or clash with solidq's own buckets
+func validname(kind, name string, max int) error {
+	if name == "" {
+		return invalidf("%s name cannot be empty", kind)
+	}
+
+	if len(name) > max {
+		return invalidf("%s name is longer than %d characters", kind, max)
+	}
+
+	if name[0] == '.' || name[0] == '-' {
+		return invalidf("%s name cannot start with %q", kind, name[0])
+	}
+
+	for _, r := range name {
+		ok := r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '_' || r == '-' || r == '.'
+		if !ok {
+			return invalidf("%s name %q contains %q, only letters, digits, '_', '-' and '.' are allowed", kind, name, r)
+		}
+	}
+	return nil
+}
+
+func validapp(appname string) error {
+	return validname("app", appname, MaxAppNameLength)
+}
+
+func validchannel(channel string) error {
+	if isinternal(channel) {
+		return invalidf("channel name %q is reserved", channel)
+	}
+	return validname("channel", channel, MaxChannelNameLength)
+}
+
+// exists reports whether the app has a DB file, for strict mode
+func (r *registry) exists(appname string) bool {
+	if _, ok := r.store.Load(appname); ok {
+		return true
+	}
+
+	_, err := os.Stat(r.path(appname))
+	return err == nil
+}
+
+// checkchannel fails for channels that were never created when strict mode is on.
+// Channels that already hold data count as created.
+func (q *Que) checkchannel(tx *bbolt.Tx, channel string) error {
+	if q.apps == nil || !q.apps.strict {
+		return nil
+	}
+
+	if tx.Bucket([]byte(channel)) != nil {
+		return nil
+	}
+
+	if b := tx.Bucket([]byte(channelsbucket)); b != nil && b.Get([]byte(channel)) != nil {
+		return nil
+	}
+	return fmt.Errorf("%w: %s, create it first", ErrUnknownChannel, channel)
+}
+
+// CreateChannel declares a channel, which strict mode requires before it can be used
+func (q *Que) CreateChannel(channel string) error {
+	return q.createchannelat(stamp{}, channel)
+}
+
+func (q *Que) createchannelat(st stamp, channel string) error {
+	if err := validchannel(channel); err != nil {
+		return err
+	}
+
+	return q.updateat(st, func(tx *bbolt.Tx) error {
+		if err := declarechannel(tx, channel); err != nil {
+			return err
+		}
+		return logop(tx, LogEntry{Op: LogCreateChannel, Channel: channel})
+	})
+}
+
+// declarechannel records the channel as created and gives it its bucket
+func declarechannel(tx *bbolt.Tx, channel string) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(channelsbucket))
+	if err != nil {
+		return err
+	}
+
+	if err := b.Put([]byte(channel), []byte("")); err != nil {
+		return err
+	}
+
+	_, err = tx.CreateBucketIfNotExists([]byte(channel))
+	return err
+}
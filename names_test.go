@@ -0,0 +1,98 @@
+package solidq
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestValidName(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		ok   bool
+	}{
+		{"orders", true},
+		{"orders_v2.eu-west", true},
+		{"Orders9", true},
+		{"", false},
+		{".hidden", false},
+		{"-flag", false},
+		{"../etc", false},
+		{"a/b", false},
+		{"a b", false},
+		{"naïve", false},
+		{strings.Repeat("a", MaxAppNameLength), true},
+		{strings.Repeat("a", MaxAppNameLength+1), false},
+	} {
+		err := validapp(tc.name)
+		if (err == nil) != tc.ok {
+			t.Errorf("validapp(%q): %v", tc.name, err)
+		}
+
+		var inv invalid
+		if err != nil && !errors.As(err, &inv) {
+			t.Errorf("validapp(%q) gave %T, want an invalid error", tc.name, err)
+		}
+	}
+
+	for _, channel := range []string{internalprefix + "config", statsbucket} {
+		if err := validchannel(channel); err == nil {
+			t.Errorf("reserved channel %q was accepted", channel)
+		}
+	}
+
+	if err := validchannel(strings.Repeat("c", MaxChannelNameLength)); err != nil {
+		t.Errorf("channel of the maximum length: %v", err)
+	}
+}
+
+func TestStrictChannels(t *testing.T) {
+	r, err := newregistry(t.TempDir(), 0, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.closeall()
+
+	if _, err := r.ensure("orders"); !errors.Is(err, ErrAppNotFound) {
+		t.Fatalf("app that was never created: %v, want ErrAppNotFound", err)
+	}
+
+	a, err := r.create("orders", 0, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Push("jobs", "a"); !errors.Is(err, ErrUnknownChannel) {
+		t.Errorf("push to a channel that was never created: %v, want ErrUnknownChannel", err)
+	}
+
+	if _, _, err := a.PopWait("jobs", 1, 0); !errors.Is(err, ErrUnknownChannel) {
+		t.Errorf("pop from a channel that was never created: %v, want ErrUnknownChannel", err)
+	}
+
+	if err := a.CreateChannel("bad name"); err == nil {
+		t.Error("a channel with a space was created")
+	}
+
+	if err := a.CreateChannel("jobs"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.Push("jobs", "a"); err != nil {
+		t.Errorf("push to a created channel: %v", err)
+	}
+
+	// creating it again keeps what it holds
+	if err := a.CreateChannel("jobs"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := a.Count("jobs"); err != nil || n != 1 {
+		t.Errorf("count after creating the channel again: %d %v", n, err)
+	}
+
+	// the declared but empty channel is listed
+	if channels, err := a.ListChannelsWithCount(); err != nil || len(channels) != 1 {
+		t.Errorf("channels %v %v", channels, err)
+	}
+}
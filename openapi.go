@@ -0,0 +1,236 @@
+package solidq
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sfi2k7/blueweb"
+	"github.com/sfi2k7/solidq/routes"
+)
+
+// doc is a node of the OpenAPI document
+type doc = map[string]interface{}
+
+// routeopenapi serves the OpenAPI document of every route the router registered. It is built on
+// the first request, once every route is in.
+func (s *Server) routeopenapi(api *router) {
+	var once sync.Once
+	var spec []byte
+	api.Handle(routes.OpenAPI, func(ctx *blueweb.Context) {
+		once.Do(func() {
+			spec, _ = json.MarshalIndent(openapi(api.routes), "", "  ")
+		})
+
+		if s.options.CrossOrigin {
+			ctx.SetHeader("Access-Control-Allow-Origin", "*")
+		}
+		ctx.SetHeader("Content-Type", routes.JSON)
+		ctx.ResponseWriter.Write(spec)
+	})
+}
+
+// openapi describes the routes as an OpenAPI 3 document
+func openapi(registered []routes.Route) doc {
+	g := &schemas{defs: doc{}}
+	responseref := g.of(reflect.TypeOf(response{}))
+	requestref := g.of(reflect.TypeOf(routes.Request{}))
+	bodies := map[string]doc{routes.SetRecurring.Name: g.of(reflect.TypeOf(RecurringJob{}))}
+
+	// the code of a v2 failure is one of a known set
+	g.defs["Response"].(doc)["properties"].(doc)["code"] = doc{"type": "string", "enum": routes.Codes}
+
+	paths := doc{}
+	for _, route := range registered {
+		op := doc{
+			"operationId": route.Name,
+			"summary":     route.Doc,
+			"tags":        []string{tag(route)},
+			"responses":   responses(route, responseref),
+		}
+
+		if route.Name == routes.OpenAPI.Name {
+			op["security"] = []doc{}
+		}
+
+		var params []doc
+		for _, p := range route.Params {
+			params = append(params, doc{
+				"name":        p.Name,
+				"in":          p.In,
+				"description": p.Doc,
+				"required":    p.Required,
+				"schema":      doc{"type": "string"},
+			})
+		}
+
+		if params != nil {
+			op["parameters"] = params
+		}
+
+		if route.Body != "" {
+			schema := doc{"type": "string", "format": "binary"}
+			if route.Body == routes.JSON {
+				schema = requestref
+				if body, ok := bodies[route.Name]; ok {
+					schema = body
+				}
+			}
+			op["requestBody"] = doc{"required": true, "content": doc{route.Body: doc{"schema": schema}}}
+		}
+
+		path := openapipath(route.Path)
+		if paths[path] == nil {
+			paths[path] = doc{}
+		}
+		paths[path].(doc)[strings.ToLower(route.Method)] = op
+	}
+
+	return doc{
+		"openapi": "3.0.3",
+		"info": doc{
+			"title":       "solidq",
+			"version":     Version,
+			"description": "Durable work queues. The /solidq routes answer 200 with success false when they fail, the /v2 routes answer with an HTTP status and an error code.",
+		},
+		"paths": paths,
+		"components": doc{
+			"schemas": g.defs,
+			"securitySchemes": doc{
+				"header": doc{"type": "apiKey", "in": "header", "name": "Authorization", "description": "the server secret"},
+				"query":  doc{"type": "apiKey", "in": "query", "name": "secret", "description": "the server secret, api_key, key and access_token work too"},
+			},
+		},
+		"security": []doc{{"header": []string{}}, {"query": []string{}}},
+	}
+}
+
+func tag(route routes.Route) string {
+	if route.V2() {
+		return "v2"
+	}
+	return "v1"
+}
+
+func responses(route routes.Route, responseref doc) doc {
+	if route.Produces != "" {
+		return doc{"200": doc{
+			"description": "the stream, a failure before it starts is a JSON response",
+			"content": doc{
+				route.Produces: doc{"schema": doc{"type": "string", "format": "binary"}},
+				routes.JSON:    doc{"schema": responseref},
+			},
+		}}
+	}
+
+	content := doc{routes.JSON: doc{"schema": responseref}}
+	if !route.V2() {
+		return doc{"200": doc{"description": "success, or success false with an error", "content": content}}
+	}
+
+	res := doc{"200": doc{"description": "success", "content": content}}
+	for status, why := range map[int]string{
+		http.StatusBadRequest:          "invalid_argument",
+		http.StatusUnauthorized:        "unauthorized",
+		http.StatusNotFound:            "not_found, the app or channel does not exist",
+		http.StatusConflict:            "conflict",
+		http.StatusTooManyRequests:     "at_capacity, every in-flight slot of the channel is taken",
+		http.StatusServiceUnavailable:  "paused, read_only or unavailable",
+		http.StatusInternalServerError: "internal",
+		http.StatusNotImplemented:      "not_supported by this server or its storage",
+	} {
+		res[strconv.Itoa(status)] = doc{"description": why, "content": content}
+	}
+	return res
+}
+
+// openapipath turns :name segments into {name}
+func openapipath(path string) string {
+	segments := strings.Split(path, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") {
+			segments[i] = "{" + segment[1:] + "}"
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// schemas derives JSON schemas from Go types, named structs go to defs and are referenced
+type schemas struct {
+	defs doc
+}
+
+var (
+	timetype     = reflect.TypeOf(time.Time{})
+	rawtype      = reflect.TypeOf(json.RawMessage{})
+	durationtype = reflect.TypeOf(routes.Duration(0))
+)
+
+func (g *schemas) of(t reflect.Type) doc {
+	switch t {
+	case timetype:
+		return doc{"type": "string", "format": "date-time"}
+	case rawtype:
+		return doc{"description": "any JSON value"}
+	case durationtype:
+		return doc{"oneOf": []doc{{"type": "string"}, {"type": "number"}}, "description": "a duration like 1.5s or a number of seconds"}
+	}
+
+	switch t.Kind() {
+	case reflect.Ptr:
+		return g.of(t.Elem())
+	case reflect.Struct:
+		name := t.Name()
+		if name == "response" {
+			name = "Response"
+		}
+
+		if _, ok := g.defs[name]; !ok {
+			g.defs[name] = doc{} // a type that refers to itself finds its name taken
+			g.defs[name] = g.object(t)
+		}
+		return doc{"$ref": "#/components/schemas/" + name}
+	case reflect.Slice:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return doc{"type": "string", "format": "byte"}
+		}
+		return doc{"type": "array", "items": g.of(t.Elem())}
+	case reflect.Map:
+		return doc{"type": "object", "additionalProperties": g.of(t.Elem())}
+	case reflect.String:
+		return doc{"type": "string"}
+	case reflect.Bool:
+		return doc{"type": "boolean"}
+	case reflect.Float32, reflect.Float64:
+		return doc{"type": "number"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return doc{"type": "integer"}
+	}
+	return doc{}
+}
+
+func (g *schemas) object(t reflect.Type) doc {
+	props := doc{}
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+
+		if name == "" {
+			name = f.Name
+		}
+		props[name] = g.of(f.Type)
+	}
+	return doc{"type": "object", "properties": props}
+}
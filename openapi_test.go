@@ -0,0 +1,112 @@
+package solidq_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/sfi2k7/solidq"
+	"github.com/sfi2k7/solidq/routes"
+)
+
+// TestOpenAPI checks every route of the table is registered and described by the OpenAPI
+// document, and the document describes nothing else
+func TestOpenAPI(t *testing.T) {
+	base := serve(t, &solidq.SeverOptions{RootPath: t.TempDir()})
+
+	res, err := http.Get(base + routes.OpenAPI.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	var spec struct {
+		OpenAPI string `json:"openapi"`
+		Paths   map[string]map[string]struct {
+			OperationID string `json:"operationId"`
+			Parameters  []struct {
+				Name string `json:"name"`
+				In   string `json:"in"`
+			} `json:"parameters"`
+			Responses map[string]json.RawMessage `json:"responses"`
+		} `json:"paths"`
+		Components struct {
+			Schemas map[string]json.RawMessage `json:"schemas"`
+		} `json:"components"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&spec); err != nil {
+		t.Fatalf("openapi document: %v", err)
+	}
+
+	if res.StatusCode != http.StatusOK || !strings.HasPrefix(spec.OpenAPI, "3.") {
+		t.Errorf("status %d, version %q", res.StatusCode, spec.OpenAPI)
+	}
+
+	if _, ok := spec.Components.Schemas["Response"]; !ok {
+		t.Errorf("no Response schema")
+	}
+
+	known := map[string]bool{}
+	for _, route := range routes.All {
+		known[route.Name] = true
+		path := route.Path
+		for _, p := range route.Params {
+			path = strings.Replace(path, ":"+p.Name, "{"+p.Name+"}", 1)
+		}
+
+		op, ok := spec.Paths[path][strings.ToLower(route.Method)]
+		if !ok || op.OperationID != route.Name {
+			t.Errorf("%s %s (%s) is not documented", route.Method, route.Path, route.Name)
+			continue
+		}
+
+		if len(op.Responses) == 0 {
+			t.Errorf("%s has no responses", route.Name)
+		}
+
+		for _, segment := range strings.Split(route.Path, "/") {
+			if !strings.HasPrefix(segment, ":") {
+				continue
+			}
+
+			declared := false
+			for _, p := range op.Parameters {
+				declared = declared || (p.In == "path" && p.Name == segment[1:])
+			}
+
+			if !declared {
+				t.Errorf("%s does not declare the path parameter %s", route.Name, segment[1:])
+			}
+		}
+
+		// a route the router knows answers anything but 404 and 405, even without the secret
+		values := make([]string, strings.Count(route.Path, ":"))
+		for i := range values {
+			values[i] = "x"
+		}
+
+		req, err := http.NewRequest(route.Method, base+route.URL(values...), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		probe, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		probe.Body.Close()
+
+		if probe.StatusCode == http.StatusNotFound || probe.StatusCode == http.StatusMethodNotAllowed {
+			t.Errorf("%s %s (%s) is not registered, got %d", route.Method, route.Path, route.Name, probe.StatusCode)
+		}
+	}
+
+	for path, ops := range spec.Paths {
+		for method, op := range ops {
+			if !known[op.OperationID] {
+				t.Errorf("%s %s (%s) is documented but not in the route table", method, path, op.OperationID)
+			}
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package solidq
+
+import (
+	"errors"
+
+	"go.etcd.io/bbolt"
+)
+
+const pausebucket = internalprefix + "paused"
+
+// the pause key used for a whole app
+const appwide = "*"
+
+const (
+	PauseAll     = "all"     // reject pushes and pops
+	PauseConsume = "consume" // keep accepting pushes, hold back pops
+)
+
+var ErrPaused = errors.New("paused")
+
+// pausemode returns the effective pause mode of a channel, taking the app wide pause into account
+func pausemode(tx *bbolt.Tx, channel string) string {
+	b := tx.Bucket([]byte(pausebucket))
+	if b == nil {
+		return ""
+	}
+
+	app := string(b.Get([]byte(appwide)))
+	ch := string(b.Get([]byte(channel)))
+	if app == PauseAll || ch == PauseAll {
+		return PauseAll
+	}
+
+	if app == PauseConsume || ch == PauseConsume {
+		return PauseConsume
+	}
+	return ""
+}
+
+func pushpaused(tx *bbolt.Tx, channel string) bool {
+	return pausemode(tx, channel) == PauseAll
+}
+
+func poppaused(tx *bbolt.Tx, channel string) bool {
+	return pausemode(tx, channel) != ""
+}
+
+// Pause stops a channel, or the whole app when channel is empty. The state is kept in the app DB.
+func (q *Que) Pause(channel, mode string) error {
+	return q.pauseat(stamp{}, channel, mode)
+}
+
+func (q *Que) pauseat(st stamp, channel, mode string) error {
+	if mode == "" {
+		mode = PauseAll
+	}
+
+	if mode != PauseAll && mode != PauseConsume {
+		return invalidf("pause mode must be all or consume")
+	}
+
+	if channel == "" {
+		channel = appwide
+	} else if err := validchannel(channel); err != nil {
+		return err
+	}
+
+	return q.updateat(st, func(tx *bbolt.Tx) error {
+		if err := setpause(tx, channel, mode); err != nil {
+			return err
+		}
+		return logop(tx, LogEntry{Op: LogPause, Channel: channel, Payload: mode})
+	})
+}
+
+// Resume lifts the pause of a channel, or of the whole app when channel is empty.
+// A channel stays paused while its app is paused.
+func (q *Que) Resume(channel string) error {
+	return q.resumeat(stamp{}, channel)
+}
+
+func (q *Que) resumeat(st stamp, channel string) error {
+	if channel == "" {
+		channel = appwide
+	}
+
+	err := q.updateat(st, func(tx *bbolt.Tx) error {
+		if err := setpause(tx, channel, ""); err != nil {
+			return err
+		}
+		return logop(tx, LogEntry{Op: LogResume, Channel: channel})
+	})
+
+	q.wake()
+	return err
+}
+
+// setpause stores the pause mode of a channel, or of the app under appwide. No mode lifts it.
+func setpause(tx *bbolt.Tx, channel, mode string) error {
+	if mode == "" {
+		b := tx.Bucket([]byte(pausebucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(channel))
+	}
+
+	b, err := tx.CreateBucketIfNotExists([]byte(pausebucket))
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(channel), []byte(mode))
+}
+
+// PauseStates returns the pause mode of every paused channel, the app wide pause is keyed by "*"
+func (q *Que) PauseStates() (map[string]string, error) {
+	states := make(map[string]string)
+	err := q.view(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(pausebucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			states[string(k)] = string(v)
+			return nil
+		})
+	})
+
+	return states, err
+}
@@ -0,0 +1,139 @@
+package solidq
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+)
+
+func TestPauseModes(t *testing.T) {
+	q := openque(t)
+	if err := q.Push("jobs", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.Pause("jobs", PauseConsume); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.Push("jobs", "b"); err != nil {
+		t.Errorf("push to a channel paused for consumers: %v", err)
+	}
+
+	if _, err := q.PopWithCount("jobs", 1); !errors.Is(err, ErrPaused) {
+		t.Errorf("pop from a channel paused for consumers: %v, want ErrPaused", err)
+	}
+
+	if err := q.Pause("jobs", PauseAll); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.Push("jobs", "c"); !errors.Is(err, ErrPaused) {
+		t.Errorf("push to a paused channel: %v, want ErrPaused", err)
+	}
+
+	if err := q.Push("other", "c"); err != nil {
+		t.Errorf("push to a channel that is not paused: %v", err)
+	}
+
+	if err := q.Pause("jobs", "later"); err == nil {
+		t.Error("an unknown pause mode was accepted")
+	}
+
+	if err := q.Resume("jobs"); err != nil {
+		t.Fatal(err)
+	}
+
+	if ids, err := q.PopWithCount("jobs", 2); err != nil || len(ids) != 2 {
+		t.Errorf("pop after a resume: %v %v", ids, err)
+	}
+}
+
+func TestPauseAppWide(t *testing.T) {
+	q := openque(t)
+	if err := q.Pause("", PauseConsume); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.Pause("jobs", PauseAll); err != nil {
+		t.Fatal(err)
+	}
+
+	// the stricter of the app and the channel pause applies
+	if err := q.Push("jobs", "a"); !errors.Is(err, ErrPaused) {
+		t.Errorf("push to a paused channel of a consume paused app: %v", err)
+	}
+
+	if err := q.Push("other", "a"); err != nil {
+		t.Errorf("push to a consume paused app: %v", err)
+	}
+
+	if _, err := q.PopWithCount("other", 1); !errors.Is(err, ErrPaused) {
+		t.Errorf("pop from a consume paused app: %v, want ErrPaused", err)
+	}
+
+	states, err := q.PauseStates()
+	if err != nil || states[appwide] != PauseConsume || states["jobs"] != PauseAll {
+		t.Errorf("pause states %v %v", states, err)
+	}
+
+	// a channel stays paused while its app is
+	if err := q.Resume("jobs"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := q.PopWithCount("jobs", 1); !errors.Is(err, ErrPaused) {
+		t.Errorf("pop from a resumed channel of a paused app: %v, want ErrPaused", err)
+	}
+
+	if err := q.Resume(""); err != nil {
+		t.Fatal(err)
+	}
+
+	if ids, err := q.PopWithCount("other", 1); err != nil || len(ids) != 1 {
+		t.Errorf("pop after the app was resumed: %v %v", ids, err)
+	}
+}
+
+func TestPauseKept(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "test.db")
+	q, err := OpenQue(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := q.Pause("jobs", PauseConsume); err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+
+	if q, err = OpenQue(path); err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	if states, err := q.PauseStates(); err != nil || states["jobs"] != PauseConsume {
+		t.Errorf("pause states after a reopen %v %v", states, err)
+	}
+}
+
+func TestServerPauseInMemory(t *testing.T) {
+	root := t.TempDir()
+	s, err := NewServer(&SeverOptions{RootPath: root})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.paused.Store(true)
+	s.Shutdown(context.Background())
+
+	if s, err = NewServer(&SeverOptions{RootPath: root}); err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	if s.paused.Load() {
+		t.Error("the server wide pause survived a restart")
+	}
+}
@@ -0,0 +1,539 @@
+package solidq
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron/v3"
+	"go.etcd.io/bbolt"
+)
+
+const recurringbucket = internalprefix + "recurring"
+
+// catch up policies for runs missed while the server was down
+const (
+	CatchUpSkip = "skip" // drop missed runs, only fire runs that are on time
+	CatchUpOnce = "once" // fire a single run for everything that was missed
+	CatchUpAll  = "all"  // fire every missed run, the first maxCatchUp of them
+)
+
+// a run is on time when it fires within recurringGrace of its schedule
+const recurringGrace = time.Minute
+
+const maxCatchUp = 1000
+
+// RecurringJob pushes a new item into Channel on a cron schedule or a fixed interval
+type RecurringJob struct {
+	Name       string    `json:"name"`
+	Channel    string    `json:"channel"`
+	Cron       string    `json:"cron,omitempty"`     // standard 5 field expression or descriptor like @hourly
+	Interval   int       `json:"interval,omitempty"` // seconds, used when Cron is empty
+	IDTemplate string    `json:"idTemplate"`         // {name} {seq} {unix} {date} {time} are replaced per run
+	Payload    string    `json:"payload,omitempty"`
+	CatchUp    string    `json:"catchUp,omitempty"`
+	NextRun    time.Time `json:"nextRun"`
+	LastRun    time.Time `json:"lastRun,omitempty"`
+	Runs       int64     `json:"runs"`
+}
+
+type intervalSchedule time.Duration
+
+func (s intervalSchedule) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(s))
+}
+
+func (j *RecurringJob) schedule() (cron.Schedule, error) {
+	if j.Cron != "" {
+		return cron.ParseStandard(j.Cron)
+	}
+
+	if j.Interval <= 0 {
+		return nil, errors.New("either cron or a positive interval is required")
+	}
+	return intervalSchedule(time.Duration(j.Interval) * time.Second), nil
+}
+
+func (j *RecurringJob) validate() error {
+	if j.Name == "" {
+		return errors.New("recurring job name cannot be empty")
+	}
+
+	if err := validchannel(j.Channel); err != nil {
+		return err
+	}
+
+	if j.Cron != "" && j.Interval > 0 {
+		return errors.New("recurring job takes either cron or interval, not both")
+	}
+
+	if j.IDTemplate == "" {
+		j.IDTemplate = "{name}-{unix}"
+	}
+
+	switch j.CatchUp {
+	case "":
+		j.CatchUp = CatchUpSkip
+	case CatchUpSkip, CatchUpOnce, CatchUpAll:
+	default:
+		return fmt.Errorf("unknown catch up policy %q", j.CatchUp)
+	}
+
+	sched, err := j.schedule()
+	if err != nil {
+		return err
+	}
+
+	// cron gives up after five years without a match, like on the 30th of February
+	if sched.Next(time.Now()).IsZero() {
+		return errors.New("recurring job schedule never fires")
+	}
+	return nil
+}
+
+func (j *RecurringJob) workid(at time.Time) string {
+	return strings.NewReplacer(
+		"{name}", j.Name,
+		"{seq}", strconv.FormatInt(j.Runs, 10),
+		"{unix}", strconv.FormatInt(at.Unix(), 10),
+		"{date}", at.UTC().Format("2006-01-02"),
+		"{time}", at.UTC().Format(time.RFC3339),
+	).Replace(j.IDTemplate)
+}
+
+// dueruns returns the scheduled times to fire at now according to the catch up policy,
+// and the next run after them. Missed runs are found without walking every slot since NextRun,
+// a job that fires every second and was down for a day costs a few steps, not 86400.
+func (j *RecurringJob) dueruns(sched cron.Schedule, now time.Time) ([]time.Time, time.Time) {
+	if j.NextRun.After(now) {
+		return nil, j.NextRun
+	}
+
+	last := lastslot(sched, j.NextRun, j.NextRun, now)
+	if last.IsZero() {
+		return nil, last
+	}
+
+	next := sched.Next(last)
+	switch j.CatchUp {
+	case CatchUpAll:
+		// the first maxCatchUp missed runs, the rest are dropped
+		var missed []time.Time
+		for at := j.NextRun; !at.IsZero() && !at.After(now) && len(missed) < maxCatchUp; at = sched.Next(at) {
+			missed = append(missed, at)
+		}
+		return missed, next
+	case CatchUpOnce:
+		return []time.Time{last}, next
+	default:
+		if now.Sub(last) <= recurringGrace {
+			return []time.Time{last}, next
+		}
+		return nil, next
+	}
+}
+
+// lastslot returns the latest scheduled time in [from, now] of a schedule that fires at first,
+// zero when there is none or the schedule stopped firing. Fixed intervals are counted off from first, cron expressions are
+// searched over a window that doubles until a slot falls into it.
+func lastslot(sched cron.Schedule, first, from, now time.Time) time.Time {
+	var period time.Duration
+	switch s := sched.(type) {
+	case intervalSchedule:
+		period = time.Duration(s)
+	case cron.ConstantDelaySchedule:
+		period = s.Delay
+	}
+
+	if period > 0 {
+		at := first.Add(now.Sub(first) / period * period)
+		if at.Before(from) {
+			return time.Time{}
+		}
+		return at
+	}
+
+	for window := time.Minute; ; window *= 2 {
+		start := now.Add(-window)
+		if !start.After(from) {
+			start = from.Add(-time.Nanosecond)
+		}
+
+		at := sched.Next(start)
+		if at.IsZero() {
+			return at
+		}
+
+		if !at.After(now) {
+			for n := sched.Next(at); !n.IsZero() && !n.After(now); n = sched.Next(n) {
+				at = n
+			}
+			return at
+		}
+
+		if !start.After(from) {
+			return time.Time{}
+		}
+	}
+}
+
+func (q *Que) SetRecurring(job RecurringJob) (RecurringJob, error) {
+	return q.setrecurringat(stamp{}, job)
+}
+
+func (q *Que) setrecurringat(st stamp, job RecurringJob) (RecurringJob, error) {
+	if err := job.validate(); err != nil {
+		return job, err
+	}
+
+	sched, _ := job.schedule()
+	err := q.updateat(st, func(tx *bbolt.Tx) error {
+		if err := q.checkchannel(tx, job.Channel); err != nil {
+			return err
+		}
+
+		b, err := tx.CreateBucketIfNotExists([]byte(recurringbucket))
+		if err != nil {
+			return err
+		}
+
+		// keep the run history of an existing definition, but restart its schedule
+		if v := b.Get([]byte(job.Name)); v != nil {
+			var existing RecurringJob
+			if err := json.Unmarshal(v, &existing); err == nil {
+				job.LastRun = existing.LastRun
+				job.Runs = existing.Runs
+			}
+		}
+		job.NextRun = sched.Next(st.time())
+		return putrecurring(tx, b, job)
+	})
+
+	q.nextdue.Store(0)
+	if err == nil {
+		err = q.markrecurring()
+	}
+	return job, err
+}
+
+func (q *Que) GetRecurring(name string) (*RecurringJob, error) {
+	var job *RecurringJob
+	err := q.view(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(recurringbucket))
+		if b == nil {
+			return nil
+		}
+
+		v := b.Get([]byte(name))
+		if v == nil {
+			return nil
+		}
+
+		job = &RecurringJob{}
+		return json.Unmarshal(v, job)
+	})
+
+	if err == nil && job == nil {
+		err = errors.New("recurring job not found")
+	}
+	return job, err
+}
+
+func (q *Que) ListRecurring() ([]RecurringJob, error) {
+	jobs := make([]RecurringJob, 0)
+	err := q.view(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(recurringbucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			var job RecurringJob
+			if err := json.Unmarshal(v, &job); err != nil {
+				return err
+			}
+			jobs = append(jobs, job)
+			return nil
+		})
+	})
+
+	return jobs, err
+}
+
+func (q *Que) DeleteRecurring(name string) error {
+	return q.deleterecurringat(stamp{}, name)
+}
+
+func (q *Que) deleterecurringat(st stamp, name string) error {
+	err := q.updateat(st, func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(recurringbucket))
+		if b == nil {
+			return nil
+		}
+		return deleterecurring(tx, b, name)
+	})
+
+	q.nextdue.Store(0)
+	if err == nil {
+		err = q.markrecurring()
+	}
+	return err
+}
+
+// putrecurring stores a job and logs it whole, so a follower replays the change as is
+func putrecurring(tx *bbolt.Tx, b *bbolt.Bucket, job RecurringJob) error {
+	v, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+
+	if err := b.Put([]byte(job.Name), v); err != nil {
+		return err
+	}
+	return logop(tx, LogEntry{Op: LogRecurring, Channel: job.Channel, IDs: []string{job.Name}, Payload: string(v)})
+}
+
+// deleterecurring removes a job, logging it with the channel it pushed to
+func deleterecurring(tx *bbolt.Tx, b *bbolt.Bucket, name string) error {
+	v := b.Get([]byte(name))
+	if v == nil {
+		return nil
+	}
+
+	var job RecurringJob
+	json.Unmarshal(v, &job)
+	if err := b.Delete([]byte(name)); err != nil {
+		return err
+	}
+	return logop(tx, LogEntry{Op: LogUnrecurring, Channel: job.Channel, IDs: []string{name}})
+}
+
+// recurringmarker is a file next to an app that has recurring jobs, so a starting server only
+// opens those apps to fire their jobs
+func recurringmarker(path string) string {
+	return path + ".recurring"
+}
+
+// markrecurring creates or removes the marker of the app, depending on whether it has jobs
+func (q *Que) markrecurring() error {
+	if q.apps == nil {
+		return nil
+	}
+
+	jobs, err := q.ListRecurring()
+	if err != nil {
+		return err
+	}
+
+	if len(jobs) == 0 {
+		if err := os.Remove(recurringmarker(q.path)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+	return os.WriteFile(recurringmarker(q.path), nil, 0600)
+}
+
+// FireRecurring enqueues every recurring job that is due at now. The pushes and the
+// new NextRun are written in one transaction, so a restart can never fire a run twice.
+func (q *Que) FireRecurring(now time.Time) (int, error) {
+	return q.firerecurring(stamp{now: now}, nil)
+}
+
+// recurringrun is one run of a job, handed to the sink of firerecurring
+type recurringrun struct {
+	channel, id string
+	payload     []byte
+}
+
+// firerecurring pushes the runs in the same transaction, or hands them to sink when it is set
+func (q *Que) firerecurring(st stamp, sink func(tx *bbolt.Tx, r recurringrun) error) (int, error) {
+	now := st.time()
+	fired, scanned := 0, false
+	nextdue := int64(-1)
+	err := q.updateat(st, func(tx *bbolt.Tx) error {
+		scanned = true
+		b := tx.Bucket([]byte(recurringbucket))
+		if b == nil {
+			return nil
+		}
+
+		var updates []RecurringJob
+		err := b.ForEach(func(k, v []byte) error {
+			var job RecurringJob
+			if err := json.Unmarshal(v, &job); err != nil {
+				return err
+			}
+
+			// a schedule that never fires again, stored before validate caught those
+			if job.NextRun.IsZero() {
+				return nil
+			}
+
+			// a paused channel keeps the job due, its catch up policy applies on resume
+			if job.NextRun.After(now) || pushpaused(tx, job.Channel) {
+				if nextdue < 0 || job.NextRun.UnixNano() < nextdue {
+					nextdue = job.NextRun.UnixNano()
+				}
+				return nil
+			}
+
+			sched, err := job.schedule()
+			if err != nil {
+				return err
+			}
+
+			runs, next := job.dueruns(sched, now)
+			for _, at := range runs {
+				job.Runs++
+				run := recurringrun{channel: job.Channel, id: job.workid(at), payload: []byte(job.Payload)}
+				if sink != nil {
+					if err := sink(tx, run); err != nil {
+						return err
+					}
+				} else if err := putitem(tx, run.channel, run.id, run.payload); err != nil {
+					return err
+				}
+				job.LastRun = at
+				fired++
+			}
+			job.NextRun = next
+			if !next.IsZero() && (nextdue < 0 || next.UnixNano() < nextdue) {
+				nextdue = next.UnixNano()
+			}
+
+			updates = append(updates, job)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		// buckets can't be modified while iterating them
+		for _, job := range updates {
+			if err := putrecurring(tx, b, job); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	// a replayed log entry skips the scan and leaves nextdue as it is
+	if err == nil && scanned {
+		q.nextdue.Store(nextdue)
+	}
+
+	if fired > 0 {
+		q.wake()
+	}
+	return fired, err
+}
+
+// recurringdue tells whether a job has a run due at now on a channel that takes pushes, so a
+// cluster leader only proposes a fire that changes something
+func (q *Que) recurringdue(now time.Time) (bool, error) {
+	due := false
+	err := q.view(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(recurringbucket))
+		if b == nil {
+			return nil
+		}
+
+		return b.ForEach(func(k, v []byte) error {
+			var job RecurringJob
+			if err := json.Unmarshal(v, &job); err != nil {
+				return err
+			}
+
+			if !job.NextRun.IsZero() && !job.NextRun.After(now) && !pushpaused(tx, job.Channel) {
+				due = true
+			}
+			return nil
+		})
+	})
+	return due, err
+}
+
+// recurringindexed marks a root whose apps have recurring markers. A root from before the
+// markers gets every app opened once to write them.
+const recurringindexed = ".recurring-indexed"
+
+// recurringapps returns the apps on disk that have recurring jobs
+func (r *registry) recurringapps() []string {
+	if r.backend == StorageMemory {
+		return nil
+	}
+
+	if _, err := os.Stat(filepath.Join(r.root, recurringindexed)); os.IsNotExist(err) {
+		apps, _ := r.list(true)
+		for _, app := range apps {
+			if a, err := r.ensure(app); err == nil {
+				a.meta().markrecurring()
+			}
+		}
+		os.WriteFile(filepath.Join(r.root, recurringindexed), nil, 0600)
+	}
+
+	markers, _ := filepath.Glob(filepath.Join(r.root, "*.db.recurring"))
+	apps := make([]string, 0, len(markers))
+	for _, marker := range markers {
+		apps = append(apps, strings.TrimSuffix(filepath.Base(marker), ".db.recurring"))
+	}
+	return apps
+}
+
+// runrecurring hands the apps with a run due to fire once a second. A server fires them directly,
+// a cluster node proposes the fire through the Raft log when it leads.
+func (r *registry) runrecurring(stop <-chan struct{}, fire func(app string, a *App, now time.Time) error) {
+	// apps are opened lazily, make sure the ones on disk with jobs get them fired
+	for _, app := range r.recurringapps() {
+		if _, err := r.ensure(app); err != nil {
+			fmt.Println("Error opening app with recurring jobs:", app, err)
+		}
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		var now time.Time
+		select {
+		case <-stop:
+			return
+		case now = <-ticker.C:
+		}
+
+		// a follower gets the runs of its primary through replication
+		if r.follower.Load() {
+			continue
+		}
+
+		r.store.Range(func(key, value interface{}) bool {
+			// only touch apps with a run due, so idle apps stay closed until then
+			a := value.(*App)
+			if a.store != nil {
+				return true
+			}
+
+			if due := a.meta().nextdue.Load(); due < 0 || due > now.UnixNano() {
+				return true
+			}
+
+			if err := fire(key.(string), a, now); err != nil {
+				fmt.Println("Error firing recurring jobs for app:", key, err)
+			}
+			return true
+		})
+	}
+}
+
+// firerecurring fires the due jobs of an app on a server that is not in a cluster
+func firerecurring(app string, a *App, now time.Time) error {
+	_, err := a.FireRecurring(now)
+	return err
+}
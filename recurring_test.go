@@ -0,0 +1,118 @@
+package solidq
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+func TestDueRunsAfterDowntime(t *testing.T) {
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	now := start.Add(24*time.Hour + 500*time.Millisecond)
+
+	for _, tc := range []struct {
+		name    string
+		job     RecurringJob
+		runs    int
+		last    time.Time
+		nextrun time.Time
+	}{
+		{"interval skip", RecurringJob{Interval: 1, CatchUp: CatchUpSkip}, 1, start.Add(24 * time.Hour), start.Add(24*time.Hour + time.Second)},
+		{"interval once", RecurringJob{Interval: 1, CatchUp: CatchUpOnce}, 1, start.Add(24 * time.Hour), start.Add(24*time.Hour + time.Second)},
+		{"interval all", RecurringJob{Interval: 1, CatchUp: CatchUpAll}, maxCatchUp, start.Add((maxCatchUp - 1) * time.Second), start.Add(24*time.Hour + time.Second)},
+		{"every", RecurringJob{Cron: "@every 1s", CatchUp: CatchUpOnce}, 1, start.Add(24 * time.Hour), start.Add(24*time.Hour + time.Second)},
+		{"cron once", RecurringJob{Cron: "0 * * * *", CatchUp: CatchUpOnce}, 1, start.Add(24 * time.Hour), start.Add(25 * time.Hour)},
+		{"cron skip late", RecurringJob{Cron: "0 3 * * *", CatchUp: CatchUpSkip}, 0, time.Time{}, start.Add(27 * time.Hour)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			tc.job.NextRun = start
+			sched, err := tc.job.schedule()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			runs, next := tc.job.dueruns(sched, now)
+			if len(runs) != tc.runs {
+				t.Fatalf("got %d runs, want %d", len(runs), tc.runs)
+			}
+
+			if tc.runs > 0 && !runs[len(runs)-1].Equal(tc.last) {
+				t.Errorf("last run at %v, want %v", runs[len(runs)-1], tc.last)
+			}
+
+			if !next.Equal(tc.nextrun) {
+				t.Errorf("next run at %v, want %v", next, tc.nextrun)
+			}
+		})
+	}
+}
+
+func TestRecurringMarker(t *testing.T) {
+	r, err := newregistry(t.TempDir(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.closeall()
+
+	for _, app := range []string{"idle", "timed"} {
+		if _, err := r.ensure(app); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a, _ := r.ensure("timed")
+	if _, err := a.SetRecurring(RecurringJob{Name: "tick", Channel: "jobs", Interval: 60}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(r.root, "timed.db.recurring")); err != nil {
+		t.Fatal("no marker for an app with jobs:", err)
+	}
+
+	if got := r.recurringapps(); len(got) != 1 || got[0] != "timed" {
+		t.Fatalf("recurring apps %v, want [timed]", got)
+	}
+
+	if err := a.DeleteRecurring("tick"); err != nil {
+		t.Fatal(err)
+	}
+
+	if got := r.recurringapps(); len(got) != 0 {
+		t.Fatalf("recurring apps %v after deleting the job", got)
+	}
+}
+
+func TestRecurringNeverFires(t *testing.T) {
+	q := openque(t)
+	if _, err := q.SetRecurring(RecurringJob{Name: "leap", Channel: "jobs", Cron: "0 0 30 2 *"}); err == nil {
+		t.Fatal("a schedule on the 30th of February was accepted")
+	}
+
+	// one stored before validate rejected them must not hang the app
+	job := RecurringJob{Name: "leap", Channel: "jobs", Cron: "0 0 30 2 *", CatchUp: CatchUpAll}
+	v, _ := json.Marshal(job)
+	err := q.update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(recurringbucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(job.Name), v)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fired, err := q.FireRecurring(time.Now()); err != nil || fired != 0 {
+		t.Errorf("fired %d runs: %v", fired, err)
+	}
+
+	sched, _ := job.schedule()
+	job.NextRun = time.Now().Add(-time.Hour)
+	if runs, next := job.dueruns(sched, time.Now()); len(runs) != 0 || !next.IsZero() {
+		t.Errorf("%d runs, next at %v", len(runs), next)
+	}
+}
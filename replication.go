@@ -0,0 +1,604 @@
+package solidq
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// logbucket holds the mutation log that followers replay and the change feed reads, keyed by an
+// 8 byte big endian sequence. It only exists in the files of a server started with replication or
+// the change feed on, putitem and friends append to it whenever it is there.
+const logbucket = internalprefix + "log"
+
+// logRetention is how many log entries are kept when no retention is configured
+const logRetention = 100000
+
+// logBatch caps how many entries one log request returns
+const logBatch = 1000
+
+// logTrimEvery is how many appends pass between two retention checks
+const logTrimEvery = 256
+
+// log operations
+const (
+	LogPush  = "push"
+	LogPop   = "pop"
+	LogAck   = "ack"
+	LogMove  = "move" // an item changes state without being pushed or popped, From and To tell how
+	LogReset = "reset"
+
+	// changes to the settings of a channel or an app, carried in Payload
+	LogConfig        = "config"        // the channel config as JSON
+	LogPause         = "pause"         // the pause mode, the channel is "*" for the whole app
+	LogResume        = "resume"        // a lifted pause, "*" for the whole app
+	LogCreateChannel = "createchannel" // a declared channel
+	LogRecurring     = "recurring"     // a recurring job as JSON, named in IDs, after a change or a fire
+	LogUnrecurring   = "unrecurring"   // a deleted recurring job, named in IDs
+	LogDurability    = "durability"    // the durability mode of the app, no channel
+)
+
+// item states a move goes between
+const (
+	StateReady     = "ready"
+	StateInFlight  = "inflight"
+	StateScheduled = "scheduled"
+)
+
+var errNoLog = errors.New("this server keeps no mutation log, turn on replication or the change feed")
+
+// ErrResnapshot tells a follower that its position is not in the log anymore
+var ErrResnapshot = errors.New("replication position lost, take a new snapshot")
+
+// LogEntry is one mutation of a channel, or of the settings of a channel or the app
+type LogEntry struct {
+	Seq     uint64   `json:"seq"`
+	Time    int64    `json:"time"` // unix nanoseconds
+	Op      string   `json:"op"`
+	Channel string   `json:"channel"`
+	IDs     []string `json:"ids,omitempty"`
+	Payload string   `json:"payload,omitempty"`
+	From    string   `json:"from,omitempty"`
+	To      string   `json:"to,omitempty"`
+	Due     int64    `json:"due,omitempty"` // unix nanoseconds, for items moved to scheduled
+}
+
+func logkey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+// logop appends a mutation to the log inside the caller's transaction, when the file keeps one
+func logop(tx *bbolt.Tx, e LogEntry) error {
+	b := tx.Bucket([]byte(logbucket))
+	if b == nil {
+		return nil
+	}
+
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	now := txtime(tx)
+	e.Seq = 0
+	if e.Time == 0 {
+		e.Time = now.UnixNano()
+	}
+
+	v, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	if err := b.Put(logkey(seq), v); err != nil {
+		return err
+	}
+
+	if err := addlogsize(tx, int64(len(v))); err != nil {
+		return err
+	}
+
+	if seq%logTrimEvery == 0 {
+		return trimlog(tx, b, seq, now)
+	}
+	return nil
+}
+
+// trimlog drops the entries that fall out of the retention stored in the file's settings,
+// by count, by age and by size
+func trimlog(tx *bbolt.Tx, b *bbolt.Bucket, seq uint64, now time.Time) error {
+	entries, age, budget := logretention(tx)
+	size := logsize(tx)
+
+	var dropped int64
+	c := b.Cursor()
+	for k, v := c.First(); k != nil; k, v = c.First() {
+		overflow := entries > 0 && binary.BigEndian.Uint64(k)+uint64(entries) <= seq
+		oversize := budget > 0 && size-dropped > budget
+		if !overflow && !oversize && !expired(v, age, now) {
+			break
+		}
+
+		dropped += int64(len(v))
+		if err := b.Delete(k); err != nil {
+			return err
+		}
+	}
+	return addlogsize(tx, -dropped)
+}
+
+func expired(v []byte, age time.Duration, now time.Time) bool {
+	if age <= 0 {
+		return false
+	}
+
+	var e LogEntry
+	if err := json.Unmarshal(v, &e); err != nil {
+		return true
+	}
+	return now.Sub(time.Unix(0, e.Time)) > age
+}
+
+func newtoken() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// preparelog creates the log of a file and its epoch, which changes whenever the file is
+// replaced so followers and feed readers know their position means nothing anymore.
+// The retention is stored with the log and applied right away.
+func (q *Que) preparelog(entries int, age time.Duration, size int64) error {
+	return q.db.Update(func(tx *bbolt.Tx) error {
+		lb, err := tx.CreateBucketIfNotExists([]byte(logbucket))
+		if err != nil {
+			return err
+		}
+
+		b, err := tx.CreateBucketIfNotExists([]byte(settingsbucket))
+		if err != nil {
+			return err
+		}
+
+		if err := writeretention(b, entries, age, size); err != nil {
+			return err
+		}
+
+		// files from before the size count was kept get it once
+		if b.Get([]byte("log:size")) == nil {
+			var n int64
+			lb.ForEach(func(k, v []byte) error {
+				n += int64(len(v))
+				return nil
+			})
+
+			if err := b.Put([]byte("log:size"), []byte(strconv.FormatInt(n, 10))); err != nil {
+				return err
+			}
+		}
+
+		if b.Get([]byte("logepoch")) == nil {
+			if err := b.Put([]byte("logepoch"), []byte(newtoken())); err != nil {
+				return err
+			}
+		}
+		return trimlog(tx, lb, lb.Sequence(), time.Now())
+	})
+}
+
+// newepoch gives the log a new epoch, if the file keeps one
+func (q *Que) newepoch() error {
+	return q.update(func(tx *bbolt.Tx) error {
+		if tx.Bucket([]byte(logbucket)) == nil {
+			return nil
+		}
+		return tx.Bucket([]byte(settingsbucket)).Put([]byte("logepoch"), []byte(newtoken()))
+	})
+}
+
+// logposition returns the epoch and the last sequence of the log
+func logposition(tx *bbolt.Tx) (string, uint64) {
+	b := tx.Bucket([]byte(logbucket))
+	if b == nil {
+		return "", 0
+	}
+
+	epoch := ""
+	if s := tx.Bucket([]byte(settingsbucket)); s != nil {
+		epoch = string(s.Get([]byte("logepoch")))
+	}
+	return epoch, b.Sequence()
+}
+
+// Snapshot writes the DB like Backup and hands the log position the snapshot is at to
+// position before the first byte is written
+func (q *Que) Snapshot(w io.Writer, position func(epoch string, seq uint64)) (int64, error) {
+	var n int64
+	err := q.view(func(tx *bbolt.Tx) error {
+		epoch, seq := logposition(tx)
+		if epoch == "" {
+			return errNoLog
+		}
+
+		position(epoch, seq)
+
+		var err error
+		n, err = tx.WriteTo(w)
+		return err
+	})
+
+	return n, err
+}
+
+// ReadLog returns up to logBatch entries after seq, waiting up to wait for new ones
+func (q *Que) ReadLog(epoch string, after uint64, wait time.Duration) ([]LogEntry, error) {
+	return q.waitlog(wait, func() ([]LogEntry, error) {
+		return q.readlog(epoch, after)
+	})
+}
+
+// waitlog calls read until it returns entries or fails, for up to wait
+func (q *Que) waitlog(wait time.Duration, read func() ([]LogEntry, error)) ([]LogEntry, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		changed := q.waiter()
+
+		entries, err := read()
+		if err != nil || len(entries) > 0 {
+			return entries, err
+		}
+
+		left := time.Until(deadline)
+		if left <= 0 || q.draining.Load() {
+			return nil, nil
+		}
+
+		if left > time.Second {
+			left = time.Second
+		}
+
+		select {
+		case <-changed:
+		case <-time.After(left):
+		}
+	}
+}
+
+func (q *Que) readlog(epoch string, after uint64) ([]LogEntry, error) {
+	var entries []LogEntry
+	err := q.view(func(tx *bbolt.Tx) error {
+		current, _ := logposition(tx)
+		if current == "" {
+			return errNoLog
+		}
+
+		if current != epoch {
+			return ErrResnapshot
+		}
+
+		var ok bool
+		var err error
+		entries, ok, err = logentries(tx, after)
+		if err == nil && !ok {
+			return ErrResnapshot
+		}
+		return err
+	})
+
+	return entries, err
+}
+
+// logentries reads up to logBatch entries after a sequence. ok is false when the entry right
+// after it was trimmed, or the sequence is ahead of the log.
+func logentries(tx *bbolt.Tx, after uint64) ([]LogEntry, bool, error) {
+	b := tx.Bucket([]byte(logbucket))
+	if after > b.Sequence() {
+		return nil, false, nil
+	}
+
+	if after == b.Sequence() {
+		return nil, true, nil
+	}
+
+	c := b.Cursor()
+	k, v := c.Seek(logkey(after + 1))
+	if k == nil || binary.BigEndian.Uint64(k) != after+1 {
+		return nil, false, nil
+	}
+
+	var entries []LogEntry
+	for ; k != nil && len(entries) < logBatch; k, v = c.Next() {
+		var e LogEntry
+		if err := json.Unmarshal(v, &e); err != nil {
+			return nil, false, err
+		}
+		e.Seq = binary.BigEndian.Uint64(k)
+		entries = append(entries, e)
+	}
+	return entries, true, nil
+}
+
+// replicapos returns the primary log position a follower file has applied, epoch is empty for a
+// file that never got a snapshot
+func (q *Que) replicapos() (string, uint64, error) {
+	var epoch string
+	var seq uint64
+	err := q.view(func(tx *bbolt.Tx) error {
+		epoch, seq = readreplicapos(tx)
+		return nil
+	})
+
+	return epoch, seq, err
+}
+
+func readreplicapos(tx *bbolt.Tx) (string, uint64) {
+	b := tx.Bucket([]byte(settingsbucket))
+	if b == nil {
+		return "", 0
+	}
+
+	v := b.Get([]byte("replica:seq"))
+	if len(v) != 8 {
+		return "", 0
+	}
+	return string(b.Get([]byte("replica:epoch"))), binary.BigEndian.Uint64(v)
+}
+
+func writereplicapos(tx *bbolt.Tx, epoch string, seq uint64) error {
+	b, err := tx.CreateBucketIfNotExists([]byte(settingsbucket))
+	if err != nil {
+		return err
+	}
+
+	if err := b.Put([]byte("replica:epoch"), []byte(epoch)); err != nil {
+		return err
+	}
+	return b.Put([]byte("replica:seq"), logkey(seq))
+}
+
+// applylog replays primary log entries on a follower file, in order and in one transaction
+func (q *Que) applylog(epoch string, entries []LogEntry) error {
+	durability, recurring := false, false
+	err := q.update(func(tx *bbolt.Tx) error {
+		current, seq := readreplicapos(tx)
+		if current != epoch {
+			return ErrResnapshot
+		}
+
+		for _, e := range entries {
+			if e.Seq != seq+1 {
+				return fmt.Errorf("log entry %d out of order after %d", e.Seq, seq)
+			}
+
+			if err := applyentry(tx, e); err != nil {
+				return err
+			}
+			seq = e.Seq
+
+			durability = durability || e.Op == LogDurability
+			recurring = recurring || e.Op == LogRecurring || e.Op == LogUnrecurring
+		}
+		return writereplicapos(tx, epoch, seq)
+	})
+
+	// settings kept outside the file follow what was replayed, so a promoted follower has them
+	if err == nil && durability {
+		q.mu.Lock()
+		if q.db != nil {
+			err = q.applydurability()
+		}
+		q.mu.Unlock()
+	}
+
+	if err == nil && recurring {
+		q.nextdue.Store(0)
+		err = q.markrecurring()
+	}
+
+	q.wake()
+	return err
+}
+
+func applyentry(tx *bbolt.Tx, e LogEntry) error {
+	switch {
+	case e.Op == LogAck:
+		if err := forget(tx, e.Channel, e.IDs, inflightbucket(e.Channel), poppedbucket(e.Channel), attemptsbucket(e.Channel)); err != nil {
+			return err
+		}
+		return logop(tx, e)
+	case e.Op == LogMove && e.To == StateInFlight:
+		// the pop entry that removes the items from the channel follows, payloads are still there
+		payloads := make([][]byte, len(e.IDs))
+		if b := tx.Bucket([]byte(e.Channel)); b != nil {
+			for i, id := range e.IDs {
+				payloads[i] = append([]byte(nil), b.Get([]byte(id))...)
+			}
+		}
+		return markinflight(tx, e.Channel, e.IDs, payloads, time.Unix(0, e.Time))
+	case e.To == StateScheduled:
+		return scheduleitems(tx, e)
+	case e.Op == LogPush || e.Op == LogMove && e.To == StateReady:
+		for _, id := range e.IDs {
+			if err := leave(tx, e.Channel, id, e.From); err != nil {
+				return err
+			}
+			if err := readyitem(tx, e.Channel, id, []byte(e.Payload), e.From); err != nil {
+				return err
+			}
+		}
+		return nil
+	case e.Op == LogPop:
+		if err := keepreplicated(tx, e); err != nil {
+			return err
+		}
+		return removeitems(tx, e.Channel, e.IDs)
+	case e.Op == LogReset:
+		return resetchannel(tx, e.Channel)
+	case e.Op == LogConfig:
+		var cc ChannelConfig
+		if err := json.Unmarshal([]byte(e.Payload), &cc); err != nil {
+			return err
+		}
+		if err := writeconfig(tx, e.Channel, cc); err != nil {
+			return err
+		}
+	case e.Op == LogPause:
+		if err := setpause(tx, e.Channel, e.Payload); err != nil {
+			return err
+		}
+	case e.Op == LogResume:
+		if err := setpause(tx, e.Channel, ""); err != nil {
+			return err
+		}
+	case e.Op == LogCreateChannel:
+		if err := declarechannel(tx, e.Channel); err != nil {
+			return err
+		}
+	case e.Op == LogRecurring, e.Op == LogUnrecurring:
+		if err := replayrecurring(tx, e); err != nil {
+			return err
+		}
+	case e.Op == LogDurability:
+		if err := writedurability(tx, e.Payload); err != nil {
+			return err
+		}
+	}
+	return logop(tx, e)
+}
+
+// replayrecurring stores or deletes the recurring job of an entry
+func replayrecurring(tx *bbolt.Tx, e LogEntry) error {
+	if len(e.IDs) != 1 {
+		return fmt.Errorf("recurring log entry %d names %d jobs", e.Seq, len(e.IDs))
+	}
+
+	b, err := tx.CreateBucketIfNotExists([]byte(recurringbucket))
+	if err != nil {
+		return err
+	}
+
+	if e.Op == LogUnrecurring {
+		return b.Delete([]byte(e.IDs[0]))
+	}
+
+	if !json.Valid([]byte(e.Payload)) {
+		return fmt.Errorf("recurring log entry %d holds no job", e.Seq)
+	}
+	return b.Put([]byte(e.IDs[0]), []byte(e.Payload))
+}
+
+// keepreplicated keeps the payloads of a pop from an uncapped channel, as popat does
+func keepreplicated(tx *bbolt.Tx, e LogEntry) error {
+	cc, err := readconfig(tx, e.Channel)
+	if err != nil || cc.MaxInFlight > 0 {
+		return err
+	}
+
+	b := tx.Bucket([]byte(e.Channel))
+	if b == nil {
+		return nil
+	}
+
+	payloads := make([][]byte, len(e.IDs))
+	for i, id := range e.IDs {
+		payloads[i] = append([]byte(nil), b.Get([]byte(id))...)
+	}
+	return keeppayloads(tx, e.Channel, e.IDs, payloads, cc.lease(), time.Unix(0, e.Time))
+}
+
+// scheduleitems replays items put aside for a retry, by a nack or an import. An import that
+// overwrote an item in flight or waiting for a retry names that state in From.
+func scheduleitems(tx *bbolt.Tx, e LogEntry) error {
+	if e.Op == LogPush {
+		for _, id := range e.IDs {
+			if err := leave(tx, e.Channel, id, e.From); err != nil {
+				return err
+			}
+		}
+	} else if e.From == StateInFlight {
+		if err := forget(tx, e.Channel, e.IDs, inflightbucket(e.Channel), poppedbucket(e.Channel)); err != nil {
+			return err
+		}
+
+		ab, err := tx.CreateBucketIfNotExists(attemptsbucket(e.Channel))
+		if err != nil {
+			return err
+		}
+
+		for _, id := range e.IDs {
+			if err := ab.Put([]byte(id), []byte(strconv.Itoa(attempts(tx, e.Channel, id)+1))); err != nil {
+				return err
+			}
+		}
+	}
+
+	sb, err := tx.CreateBucketIfNotExists(scheduledbucket(e.Channel))
+	if err != nil {
+		return err
+	}
+
+	for _, id := range e.IDs {
+		if err := sb.Put(scheduledkey(time.Unix(0, e.Due), id), []byte(e.Payload)); err != nil {
+			return err
+		}
+	}
+	return logop(tx, e)
+}
+
+// leave drops the record of the state an item moves out of
+func leave(tx *bbolt.Tx, channel, id, from string) error {
+	switch from {
+	case StateReady:
+		b := tx.Bucket([]byte(channel))
+		if b == nil || b.Get([]byte(id)) == nil {
+			return nil
+		}
+
+		if err := b.Delete([]byte(id)); err != nil {
+			return err
+		}
+		return adddepth(tx, channel, -1)
+	case StateInFlight:
+		return forget(tx, channel, []string{id}, inflightbucket(channel))
+	case StateScheduled:
+		b := tx.Bucket(scheduledbucket(channel))
+		if b == nil {
+			return nil
+		}
+
+		c := b.Cursor()
+		for k, _ := c.First(); k != nil; k, _ = c.Next() {
+			if len(k) == 8+len(id) && string(k[8:]) == id {
+				return b.Delete(k)
+			}
+		}
+	}
+	return nil
+}
+
+// forget deletes the IDs from the named buckets that exist
+func forget(tx *bbolt.Tx, channel string, ids []string, names ...[]byte) error {
+	for _, name := range names {
+		b := tx.Bucket(name)
+		if b == nil {
+			continue
+		}
+
+		for _, id := range ids {
+			if err := b.Delete([]byte(id)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
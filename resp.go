@@ -0,0 +1,457 @@
+package solidq
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+)
+
+const (
+	// maxRESPLine caps an inline command or a length header
+	maxRESPLine = 64 << 10
+	// maxRESPBulk caps one argument of a command
+	maxRESPBulk = 16 << 20
+	// maxRESPArgs caps the number of arguments of a command
+	maxRESPArgs = 1 << 20
+	// maxRESPUnauthed caps a line and an argument before AUTH, maxRESPUnauthedArgs the arguments
+	maxRESPUnauthed     = 4 << 10
+	maxRESPUnauthedArgs = 8
+)
+
+var errRESPProtocol = errors.New("Protocol error")
+
+// serveresp maps a subset of the Redis protocol onto the apps of a server, so Redis clients
+// can use it as a durable queue. Keys are channels named like in the HTTP API, app:channel or a
+// channel of the core app. LPUSH and RPUSH both push, LPOP and RPOP both pop in the order the
+// HTTP pop uses, which is by ID and not by when items were pushed. Items popped from a capped
+// channel stay in flight until ACK key id [id ...] confirms them.
+func (s *Server) serveresp(conn net.Conn) {
+	defer conn.Close()
+
+	c := &respconn{
+		s:      s,
+		r:      bufio.NewReaderSize(conn, maxRESPLine),
+		w:      bufio.NewWriter(conn),
+		authed: s.options.Secret == "",
+	}
+
+	for {
+		args, err := c.read()
+		if err != nil {
+			if errors.Is(err, errRESPProtocol) {
+				c.error("ERR " + err.Error())
+				c.w.Flush()
+			}
+			return
+		}
+
+		quit := len(args) > 0 && c.exec(args)
+		if c.r.Buffered() == 0 || quit {
+			if err := c.w.Flush(); err != nil || quit {
+				return
+			}
+		}
+	}
+}
+
+// respconn is one client connection, replies are flushed once no pipelined command is waiting
+type respconn struct {
+	s      *Server
+	r      *bufio.Reader
+	w      *bufio.Writer
+	authed bool
+}
+
+func (c *respconn) line() (string, error) {
+	line, err := c.r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull || !c.authed && len(line) > maxRESPUnauthed {
+		return "", fmt.Errorf("%w: too big inline request", errRESPProtocol)
+	}
+
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// read reads one command, sent as an array of bulk strings or inline as words on a line.
+// Until the client is authenticated a command may only be small.
+func (c *respconn) read() ([]string, error) {
+	maxargs, maxbulk := maxRESPArgs, maxRESPBulk
+	if !c.authed {
+		maxargs, maxbulk = maxRESPUnauthedArgs, maxRESPUnauthed
+	}
+
+	line, err := c.line()
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(line, "*") {
+		return strings.Fields(line), nil
+	}
+
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n > maxargs {
+		return nil, fmt.Errorf("%w: invalid multibulk length", errRESPProtocol)
+	}
+
+	var args []string
+	for i := 0; i < n; i++ {
+		header, err := c.line()
+		if err != nil {
+			return nil, err
+		}
+
+		if !strings.HasPrefix(header, "$") {
+			return nil, fmt.Errorf("%w: expected '$', got %q", errRESPProtocol, header)
+		}
+
+		size, err := strconv.Atoi(header[1:])
+		if err != nil || size < 0 || size > maxbulk {
+			return nil, fmt.Errorf("%w: invalid bulk length", errRESPProtocol)
+		}
+
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+
+		if buf[size] != '\r' || buf[size+1] != '\n' {
+			return nil, fmt.Errorf("%w: bulk string is not terminated", errRESPProtocol)
+		}
+		args = append(args, string(buf[:size]))
+	}
+	return args, nil
+}
+
+func (c *respconn) simple(s string) {
+	c.w.WriteString("+" + s + "\r\n")
+}
+
+func (c *respconn) error(s string) {
+	c.w.WriteString("-" + strings.NewReplacer("\r", " ", "\n", " ").Replace(s) + "\r\n")
+}
+
+func (c *respconn) integer(n int) {
+	c.w.WriteString(":" + strconv.Itoa(n) + "\r\n")
+}
+
+func (c *respconn) bulk(s string) {
+	c.w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n" + s + "\r\n")
+}
+
+func (c *respconn) null() {
+	c.w.WriteString("$-1\r\n")
+}
+
+func (c *respconn) array(n int) {
+	c.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+func (c *respconn) nullarray() {
+	c.w.WriteString("*-1\r\n")
+}
+
+// respwrites are the commands a follower refuses
+var respwrites = map[string]bool{
+	"LPUSH": true, "RPUSH": true, "LPOP": true, "RPOP": true, "ACK": true,
+	"ZADD": true, "ZPOPMAX": true, "SET": true, "DEL": true,
+}
+
+// resparity is the least number of arguments of each command, the command included
+var resparity = map[string]int{
+	"PING": 1, "ECHO": 2, "AUTH": 2, "QUIT": 1, "SELECT": 2, "COMMAND": 1, "CLIENT": 2,
+	"LPUSH": 3, "RPUSH": 3, "LPOP": 2, "RPOP": 2, "ACK": 3, "LLEN": 2,
+	"ZADD": 4, "ZPOPMAX": 2, "ZCARD": 2,
+	"SET": 3, "GET": 2, "DEL": 2,
+}
+
+// exec runs one command and writes its reply, it returns true when the client quits
+func (c *respconn) exec(args []string) bool {
+	name := strings.ToUpper(args[0])
+	arity, ok := resparity[name]
+	if !ok {
+		c.error(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return false
+	}
+
+	if len(args) < arity {
+		c.error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(name)))
+		return false
+	}
+
+	if !c.authed && name != "AUTH" && name != "QUIT" {
+		c.error("NOAUTH Authentication required.")
+		return false
+	}
+
+	if respwrites[name] && c.s.apps.follower.Load() {
+		c.error("READONLY You can't write against a read only replica.")
+		return false
+	}
+
+	switch name {
+	case "PING":
+		if len(args) > 1 {
+			c.bulk(args[1])
+		} else {
+			c.simple("PONG")
+		}
+	case "ECHO":
+		c.bulk(args[1])
+	case "AUTH":
+		// AUTH <password> or AUTH <username> <password>, the user name is ignored
+		if c.s.options.Secret == "" {
+			c.error("ERR AUTH called without any password configured")
+		} else if args[len(args)-1] != c.s.options.Secret {
+			c.error("WRONGPASS invalid password")
+		} else {
+			c.authed = true
+			c.simple("OK")
+		}
+	case "QUIT":
+		c.simple("OK")
+		return true
+	case "SELECT":
+		if args[1] != "0" {
+			c.error("ERR DB index is out of range")
+		} else {
+			c.simple("OK")
+		}
+	case "COMMAND":
+		// clients ask for command docs on connect, there are none to give
+		c.array(0)
+	case "CLIENT":
+		c.simple("OK")
+	default:
+		c.data(name, args)
+	}
+	return false
+}
+
+// data runs the commands on apps, unless the server is paused
+func (c *respconn) data(name string, args []string) {
+	if c.s.paused.Load() {
+		c.error("ERR " + ErrPaused.Error())
+		return
+	}
+
+	appname, key, err := channeltoappchannel(args[1])
+	if err != nil {
+		c.error("ERR " + err.Error())
+		return
+	}
+
+	a, err := c.s.apps.ensure(appname)
+	if err != nil {
+		c.error("ERR " + err.Error())
+		return
+	}
+
+	switch name {
+	case "LPUSH", "RPUSH":
+		for _, id := range args[2:] {
+			if err := a.Push(key, id); err != nil {
+				c.error("ERR " + err.Error())
+				return
+			}
+		}
+		c.count(a.Count(key))
+	case "LPOP", "RPOP":
+		count, ok := c.count1(args)
+		if !ok {
+			return
+		}
+
+		if count == 0 {
+			c.array(0)
+			return
+		}
+
+		ids, _, err := a.PopWait(key, count, 0)
+		if err != nil {
+			c.error("ERR " + err.Error())
+			return
+		}
+
+		if len(args) == 2 {
+			if len(ids) == 0 {
+				c.null()
+			} else {
+				c.bulk(ids[0])
+			}
+			return
+		}
+
+		if len(ids) == 0 {
+			c.nullarray()
+			return
+		}
+
+		c.array(len(ids))
+		for _, id := range ids {
+			c.bulk(id)
+		}
+	case "ACK":
+		for _, id := range args[2:] {
+			if err := a.Ack(key, id); err != nil {
+				c.error("ERR " + err.Error())
+				return
+			}
+		}
+		c.integer(len(args) - 2)
+	case "LLEN":
+		c.count(a.Count(key))
+	case "ZADD":
+		if len(args)%2 != 0 {
+			c.error("ERR syntax error")
+			return
+		}
+
+		var items []ScoredItem
+		for i := 2; i < len(args); i += 2 {
+			score, err := strconv.ParseFloat(args[i], 64)
+			if err != nil || math.IsNaN(score) {
+				c.error("ERR value is not a valid float")
+				return
+			}
+			items = append(items, ScoredItem{ID: args[i+1], Score: score})
+		}
+		c.count(a.ZAdd(key, items...))
+	case "ZPOPMAX":
+		count, ok := c.count1(args)
+		if !ok {
+			return
+		}
+
+		items, err := a.ZPopMax(key, count)
+		if err != nil {
+			c.error("ERR " + err.Error())
+			return
+		}
+
+		c.array(2 * len(items))
+		for _, item := range items {
+			c.bulk(item.ID)
+			c.bulk(formatscore(item.Score))
+		}
+	case "ZCARD":
+		c.count(a.ZCard(key))
+	case "SET":
+		if len(args) != 3 {
+			c.error("ERR syntax error")
+			return
+		}
+
+		if err := a.SetValue(key, []byte(args[2])); err != nil {
+			c.error("ERR " + err.Error())
+			return
+		}
+		c.simple("OK")
+	case "GET":
+		value, err := a.Value(key)
+		if err != nil {
+			c.error("ERR " + err.Error())
+			return
+		}
+
+		if value == nil {
+			c.null()
+			return
+		}
+		c.bulk(string(value))
+	case "DEL":
+		deleted := 0
+		for _, k := range args[1:] {
+			found, err := c.del(k)
+			if err != nil {
+				c.error("ERR " + err.Error())
+				return
+			}
+
+			if found {
+				deleted++
+			}
+		}
+		c.integer(deleted)
+	}
+}
+
+// del drops the channel, the scored channel and the value a key names
+func (c *respconn) del(k string) (bool, error) {
+	appname, key, err := channeltoappchannel(k)
+	if err != nil {
+		return false, err
+	}
+
+	a, err := c.s.apps.ensure(appname)
+	if err != nil {
+		return false, err
+	}
+
+	depth, err := a.Count(key)
+	if err != nil {
+		return false, err
+	}
+
+	inflight, err := a.InFlight(key)
+	if err != nil {
+		return false, err
+	}
+
+	if depth > 0 || inflight > 0 {
+		if err := a.ResetChannel(key); err != nil {
+			return false, err
+		}
+	}
+
+	scored, err := a.DeleteScored(key)
+	if err != nil {
+		return false, err
+	}
+
+	value, err := a.DeleteValue(key)
+	if err != nil {
+		return false, err
+	}
+	return depth > 0 || inflight > 0 || scored || value, nil
+}
+
+// count1 parses the optional count of a pop, 1 when there is none
+func (c *respconn) count1(args []string) (int, bool) {
+	if len(args) < 3 {
+		return 1, true
+	}
+
+	count, err := strconv.Atoi(args[2])
+	if err != nil || count < 0 {
+		c.error("ERR value is out of range, must be positive")
+		return 0, false
+	}
+	return count, true
+}
+
+func (c *respconn) count(n int, err error) {
+	if err != nil {
+		c.error("ERR " + err.Error())
+		return
+	}
+	c.integer(n)
+}
+
+// formatscore writes a score the way Redis does
+func formatscore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'f', -1, 64)
+}
@@ -0,0 +1,111 @@
+package solidq
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+type respclient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dialresp(t *testing.T, s *Server) *respclient {
+	t.Helper()
+	conn, err := net.Dial("tcp", s.resp.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &respclient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// do sends a command and returns the first line of the reply, with the value of a bulk string
+func (c *respclient) do(args ...string) string {
+	c.t.Helper()
+	var b strings.Builder
+	b.WriteString("*" + strconv.Itoa(len(args)) + "\r\n")
+	for _, arg := range args {
+		b.WriteString("$" + strconv.Itoa(len(arg)) + "\r\n" + arg + "\r\n")
+	}
+
+	if _, err := c.conn.Write([]byte(b.String())); err != nil {
+		c.t.Fatal(err)
+	}
+
+	line := c.line()
+	if strings.HasPrefix(line, "$") && line != "$-1" {
+		return line + " " + c.line()
+	}
+	return line
+}
+
+func (c *respclient) line() string {
+	c.t.Helper()
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+func TestRESP(t *testing.T) {
+	s, err := NewServer(&SeverOptions{RootPath: t.TempDir(), Secret: "secret", RESPAddr: "127.0.0.1:0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	big := strings.Repeat("x", 10000)
+	if reply := dialresp(t, s).do("AUTH", big); !strings.HasPrefix(reply, "-ERR Protocol error") {
+		t.Errorf("a big argument before AUTH: %q, want a protocol error", reply)
+	}
+
+	c := dialresp(t, s)
+	if reply := c.do("AUTH", "secret"); reply != "+OK" {
+		t.Fatalf("AUTH: %q", reply)
+	}
+
+	if reply := c.do("LPUSH", "big", big); reply != ":1" {
+		t.Errorf("a big argument after AUTH: %q, want :1", reply)
+	}
+
+	a, err := s.apps.ensure("core")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := a.SetChannelConfig("jobs", ChannelConfig{MaxInFlight: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if reply := c.do("RPUSH", "jobs", "a", "b"); reply != ":2" {
+		t.Fatalf("RPUSH: %q", reply)
+	}
+
+	if reply := c.do("LPOP", "jobs"); reply != "$1 a" {
+		t.Fatalf("LPOP: %q, want a", reply)
+	}
+
+	if reply := c.do("LPOP", "jobs"); reply != "$-1" {
+		t.Errorf("LPOP with the only slot taken: %q, want nothing", reply)
+	}
+
+	if reply := c.do("ACK", "jobs", "a"); reply != ":1" {
+		t.Errorf("ACK: %q", reply)
+	}
+
+	if reply := c.do("LPOP", "jobs"); reply != "$1 b" {
+		t.Errorf("LPOP after the ACK: %q, want b", reply)
+	}
+
+	s.paused.Store(true)
+	if reply := c.do("LLEN", "jobs"); reply != "-ERR paused" {
+		t.Errorf("LLEN on a paused server: %q", reply)
+	}
+}
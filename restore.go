@@ -0,0 +1,217 @@
+package solidq
+
+import (
+	"archive/tar"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// Restore replaces the app DB with the snapshot read from r. The snapshot is written next to
+// the DB file and checked before anything is touched; requests wait on the handle lock while
+// the files are swapped, so none of them sees a closed DB.
+func (q *Que) Restore(r io.Reader) error {
+	tmp, err := receivesnapshot(q.path, r)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+
+	if err := q.swap(tmp); err != nil {
+		return err
+	}
+
+	if err := q.markrecurring(); err != nil {
+		return err
+	}
+
+	// followers can't continue a log from before the restore
+	return q.newepoch()
+}
+
+// restoreshards replaces every shard of a sharded app from a tar stream, the backup of the app
+// or a full backup, whose entries of other apps are skipped. All shards are received and checked
+// before the first one is swapped.
+func (a *App) restoreshards(r io.Reader) error {
+	shards := make(map[string]*Que, len(a.shards))
+	for _, q := range a.shards {
+		shards[filepath.Base(q.path)] = q
+	}
+
+	received := make(map[*Que]string, len(a.shards))
+	defer func() {
+		for _, tmp := range received {
+			os.Remove(tmp)
+		}
+	}()
+
+	tr := tar.NewReader(r)
+	for {
+		h, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("invalid backup: %w", err)
+		}
+
+		q, ok := shards[filepath.Base(h.Name)]
+		if !ok || h.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		if _, dup := received[q]; dup {
+			return invalidf("the backup holds %s twice", h.Name)
+		}
+
+		tmp, err := receivesnapshot(q.path, tr)
+		if err != nil {
+			return err
+		}
+		received[q] = tmp
+	}
+
+	for _, q := range a.shards {
+		if _, ok := received[q]; !ok {
+			return invalidf("the backup misses %s, the app has %d shards", filepath.Base(q.path), len(a.shards))
+		}
+	}
+
+	for _, q := range a.shards {
+		if err := q.swap(received[q]); err != nil {
+			return err
+		}
+		delete(received, q)
+
+		// followers can't continue a log from before the restore
+		if err := q.newepoch(); err != nil {
+			return err
+		}
+	}
+	return a.meta().markrecurring()
+}
+
+// receivesnapshot writes a snapshot to a temp file next to path and checks it, the caller removes the file
+func receivesnapshot(path string, r io.Reader) (string, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".restore-*")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(tmp, r)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+
+	if err == nil {
+		if verr := validatesnapshot(tmp.Name()); verr != nil {
+			err = fmt.Errorf("invalid snapshot: %w", verr)
+		}
+	}
+
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", err
+	}
+	return tmp.Name(), nil
+}
+
+// validatesnapshot opens a file as a bbolt DB and runs a consistency check on it
+func validatesnapshot(path string) error {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	return db.View(func(tx *bbolt.Tx) error {
+		var first error
+		// drain every error, the checker runs inside the transaction
+		for err := range tx.Check() {
+			if first == nil {
+				first = err
+			}
+		}
+		return first
+	})
+}
+
+// swap closes the DB, moves the file at newpath in its place and opens it again.
+// The previous file is put back if the new one can't be opened.
+func (q *Que) swap(newpath string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.swaplocked(newpath)
+}
+
+// swaplocked is swap for callers already holding q.mu. The new file replaces the live one in a
+// single rename, so a crash leaves either of them at the path. The previous file is kept as .old
+// until the new one opened.
+func (q *Que) swaplocked(newpath string) error {
+	if err := q.closelocked(); err != nil {
+		return err
+	}
+
+	old := q.path + ".old"
+	os.Remove(old)
+	if err := keepcopy(q.path, old); err != nil && !os.IsNotExist(err) {
+		q.openlocked()
+		return err
+	}
+
+	if err := os.Rename(newpath, q.path); err != nil {
+		os.Remove(old)
+		q.openlocked()
+		return err
+	}
+
+	if err := q.openlocked(); err != nil {
+		os.Rename(old, q.path)
+		q.openlocked()
+		return err
+	}
+
+	os.Remove(old)
+
+	// the jobs of the new file may be due earlier than those of the old one
+	q.nextdue.Store(0)
+	q.wake()
+	return nil
+}
+
+// keepcopy links path to dst, or copies it where the file system has no hard links
+func keepcopy(path, dst string) error {
+	if err := os.Link(path, dst); err == nil || os.IsNotExist(err) {
+		return err
+	}
+
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, src)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
@@ -0,0 +1,160 @@
+package solidq
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestRestoreSwapsFile(t *testing.T) {
+	src, dst := openque(t), openque(t)
+	if _, err := src.SetRecurring(RecurringJob{Name: "tick", Channel: "jobs", Interval: 1}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := src.Push("jobs", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	var snapshot bytes.Buffer
+	if _, err := src.Backup(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	// dst knows it has no jobs, the restored file has one
+	if _, err := dst.FireRecurring(time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if due := dst.nextdue.Load(); due != -1 {
+		t.Fatalf("nextdue %d before the restore, want -1", due)
+	}
+
+	if err := dst.Restore(&snapshot); err != nil {
+		t.Fatal(err)
+	}
+
+	if due := dst.nextdue.Load(); due != 0 {
+		t.Errorf("nextdue %d after the restore, want 0 so the jobs are looked at again", due)
+	}
+
+	if n, err := dst.Count("jobs"); err != nil || n != 1 {
+		t.Errorf("count %d %v after the restore, want 1", n, err)
+	}
+
+	if _, err := os.Stat(dst.path + ".old"); !os.IsNotExist(err) {
+		t.Errorf("previous file left behind: %v", err)
+	}
+
+	if fired, err := dst.FireRecurring(time.Now().Add(2 * time.Second)); err != nil || fired != 1 {
+		t.Errorf("fired %d %v after the restore, want 1", fired, err)
+	}
+}
+
+func TestRestoreSharded(t *testing.T) {
+	r, err := newregistry(t.TempDir(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.closeall()
+
+	src, err := r.create("orders", 3, ShardByID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := src.Push("jobs", strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var backup bytes.Buffer
+	n, err := src.Backup(&backup)
+	if err != nil || n != int64(backup.Len()) {
+		t.Fatalf("backup of %d bytes, %d written: %v", n, backup.Len(), err)
+	}
+
+	var names []string
+	tr := tar.NewReader(bytes.NewReader(backup.Bytes()))
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, h.Name)
+	}
+
+	if len(names) != 3 || names[0] != "orders.db" || names[2] != "orders.db.2" {
+		t.Fatalf("tar entries %v, want one per shard", names)
+	}
+
+	// the entries of other apps in a full backup are skipped
+	mail, err := r.ensure("mail")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mail.Push("jobs", "other"); err != nil {
+		t.Fatal(err)
+	}
+
+	var full bytes.Buffer
+	if err := r.backupall(&full); err != nil {
+		t.Fatal(err)
+	}
+
+	for name, stream := range map[string][]byte{"app backup": backup.Bytes(), "full backup": full.Bytes()} {
+		dst, err := OpenApp(filepath.Join(t.TempDir(), "orders.db"), 3, ShardByID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if err := dst.Push("jobs", "stale"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := dst.Restore(bytes.NewReader(stream)); err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+
+		if count, err := dst.Count("jobs"); err != nil || count != 20 {
+			t.Errorf("%s: count %d %v after the restore, want 20", name, count, err)
+		}
+		dst.Close()
+	}
+
+	// a backup missing a shard leaves the app as it was
+	var partial bytes.Buffer
+	tw := tar.NewWriter(&partial)
+	if err := src.shards[0].tarsnapshot(tw); err != nil {
+		t.Fatal(err)
+	}
+	tw.Close()
+
+	dst, err := OpenApp(filepath.Join(t.TempDir(), "orders.db"), 3, ShardByID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+
+	if err := dst.Push("jobs", "kept"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := dst.Restore(&partial); !errors.As(err, new(invalid)) {
+		t.Errorf("restore of a partial backup returned %v, want an invalid error", err)
+	}
+
+	if count, err := dst.Count("jobs"); err != nil || count != 1 {
+		t.Errorf("count %d %v after a failed restore, want 1", count, err)
+	}
+}
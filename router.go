@@ -0,0 +1,37 @@
+package solidq
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/sfi2k7/blueweb"
+	"github.com/sfi2k7/solidq/routes"
+)
+
+// router registers blueweb handlers on a plain httprouter, so the server owns its http.Server
+// and can be shut down with a deadline
+type router struct {
+	mux    *httprouter.Router
+	routes []routes.Route
+}
+
+func newrouter() *router {
+	return &router{mux: httprouter.New()}
+}
+
+// Handle registers a route of the shared route table, the client calls the same table
+func (r *router) Handle(route routes.Route, fn blueweb.Handler) {
+	r.routes = append(r.routes, route)
+	r.handle(route.Method, route.Path, fn)
+}
+
+func (r *router) handle(method, path string, fn blueweb.Handler) {
+	r.mux.Handler(method, path, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		fn(&blueweb.Context{ResponseWriter: w, Request: req})
+	}))
+}
+
+// params reads a route parameter, blueweb.Context.Params only sees params set by blueweb's own router
+func params(ctx *blueweb.Context, name string) string {
+	return httprouter.ParamsFromContext(ctx.Request.Context()).ByName(name)
+}
@@ -0,0 +1,135 @@
+package routes
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Error codes of the v2 API, a failed response carries one next to its HTTP status
+const (
+	CodeInvalid      = "invalid_argument" // 400
+	CodeUnauthorized = "unauthorized"     // 401
+	CodeNotFound     = "not_found"        // 404
+	CodeConflict     = "conflict"         // 409
+	CodeNotSupported = "not_supported"    // 501
+	CodeAtCapacity   = "at_capacity"      // 429
+	CodePaused       = "paused"           // 503
+	CodeReadOnly     = "read_only"        // 503
+	CodeUnavailable  = "unavailable"      // 503
+	CodeInternal     = "internal"         // 500
+)
+
+// Codes lists every error code of the v2 API
+var Codes = []string{
+	CodeInvalid, CodeUnauthorized, CodeNotFound, CodeConflict, CodeNotSupported, CodeAtCapacity,
+	CodePaused, CodeReadOnly, CodeUnavailable, CodeInternal,
+}
+
+// Request holds every field a v2 route may take, as a JSON body or in the query string. App
+// defaults to core.
+type Request struct {
+	App      string          `json:"app,omitempty"`
+	Channel  string          `json:"channel,omitempty"`
+	ID       string          `json:"id,omitempty"`
+	IDs      []string        `json:"ids,omitempty"`
+	Count    int             `json:"count,omitempty"`
+	Wait     Duration        `json:"wait,omitempty"`
+	Delay    Duration        `json:"delay,omitempty"`
+	Mode     string          `json:"mode,omitempty"`
+	Shards   int             `json:"shards,omitempty"`
+	ShardBy  string          `json:"shardby,omitempty"`
+	Physical bool            `json:"physical,omitempty"`
+	Config   json.RawMessage `json:"config,omitempty"` // fields of a channel config to change
+}
+
+// Query writes the request as a query string, without the config
+func (r Request) Query() url.Values {
+	q := url.Values{}
+	for name, value := range map[string]string{"app": r.App, "channel": r.Channel, "id": r.ID, "mode": r.Mode, "shardby": r.ShardBy} {
+		if value != "" {
+			q.Set(name, value)
+		}
+	}
+
+	for name, value := range map[string]int{"count": r.Count, "shards": r.Shards} {
+		if value != 0 {
+			q.Set(name, strconv.Itoa(value))
+		}
+	}
+
+	for name, value := range map[string]Duration{"wait": r.Wait, "delay": r.Delay} {
+		if value != 0 {
+			q.Set(name, time.Duration(value).String())
+		}
+	}
+
+	for _, id := range r.IDs {
+		q.Add("ids", id)
+	}
+
+	if r.Physical {
+		q.Set("physical", "true")
+	}
+	return q
+}
+
+// FromQuery reads the fields of a request from a query string
+func (r *Request) FromQuery(q url.Values) error {
+	r.App, r.Channel, r.ID, r.IDs = q.Get("app"), q.Get("channel"), q.Get("id"), q["ids"]
+	r.Mode, r.ShardBy, r.Physical = q.Get("mode"), q.Get("shardby"), q.Get("physical") == "true"
+	r.Wait, r.Delay = Duration(ParseDuration(q.Get("wait"))), Duration(ParseDuration(q.Get("delay")))
+
+	for name, field := range map[string]*int{"count": &r.Count, "shards": &r.Shards} {
+		if str := q.Get(name); str != "" {
+			n, err := strconv.Atoi(str)
+			if err != nil {
+				return fmt.Errorf("%s must be a number", name)
+			}
+			*field = n
+		}
+	}
+	return nil
+}
+
+// Duration is a Go duration like "1.5s" or a number of seconds
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var str string
+	if err := json.Unmarshal(b, &str); err == nil {
+		*d = Duration(ParseDuration(str))
+		return nil
+	}
+
+	seconds, err := strconv.ParseFloat(string(b), 64)
+	if err != nil || seconds < 0 {
+		return fmt.Errorf("duration must be like 1.5s or a number of seconds")
+	}
+	*d = Duration(seconds * float64(time.Second))
+	return nil
+}
+
+// ParseDuration accepts Go durations like 1.5s or a plain number of seconds, anything else is 0
+func ParseDuration(str string) time.Duration {
+	if str == "" {
+		return 0
+	}
+
+	d, err := time.ParseDuration(str)
+	if err != nil {
+		seconds, _ := strconv.Atoi(str)
+		d = time.Duration(seconds) * time.Second
+	}
+
+	if d < 0 {
+		return 0
+	}
+	return d
+}
@@ -0,0 +1,190 @@
+// Package routes is the contract of the HTTP API, shared by the server that registers the routes
+// and the clients that call them: every route with its parameters, the v2 request and the v2
+// error codes.
+package routes
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Media types of request and response bodies
+const (
+	JSON   = "application/json"
+	NDJSON = "application/x-ndjson"
+	Binary = "application/octet-stream"
+	Tar    = "application/x-tar"
+)
+
+// Param is a path or query parameter of a route
+type Param struct {
+	Name     string
+	In       string // path or query
+	Doc      string
+	Required bool
+}
+
+// Route is one endpoint of the HTTP API
+type Route struct {
+	Name     string // the operation, unique across the API
+	Method   string
+	Path     string // the router pattern, :name marks a path parameter
+	Doc      string
+	Params   []Param
+	Body     string // media type of the request body, empty when there is none
+	Produces string // media type of the response, JSON when empty
+}
+
+// URL fills the path parameters of the route in order, each value is escaped
+func (r Route) URL(values ...string) string {
+	segments := strings.Split(r.Path, "/")
+	for i, segment := range segments {
+		if strings.HasPrefix(segment, ":") && len(values) > 0 {
+			segments[i], values = url.PathEscape(values[0]), values[1:]
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+// Match tells whether a request is for the route, :params match any one segment
+func (r Route) Match(method, path string) bool {
+	if method != r.Method {
+		return false
+	}
+
+	want, got := strings.Split(r.Path, "/"), strings.Split(path, "/")
+	if len(want) != len(got) {
+		return false
+	}
+
+	for i, segment := range want {
+		if strings.HasPrefix(segment, ":") {
+			if got[i] == "" {
+				return false
+			}
+		} else if segment != got[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// V2 tells whether the route belongs to the v2 API, which answers failures with an HTTP status
+func (r Route) V2() bool {
+	return strings.HasPrefix(r.Path, "/v2/")
+}
+
+func path(name, doc string) Param {
+	return Param{Name: name, In: "path", Doc: doc, Required: true}
+}
+
+func query(name, doc string) Param {
+	return Param{Name: name, In: "query", Doc: doc}
+}
+
+var (
+	item     = path("item", "app:channel:id, channel:id or id, the app defaults to core and the channel to default")
+	channel  = path("channel", "app:channel or a channel of the core app")
+	appname  = path("appname", "name of the app")
+	shard    = query("shard", "shard of a sharded app, 0 by default")
+	wait     = query("wait", "how long to wait for an item when there is none, a duration like 1.5s or seconds, at most 60s")
+	pausech  = query("channel", "pause only this channel")
+	v2app    = query("app", "name of the app, core by default")
+	v2ch     = Param{Name: "channel", In: "query", Doc: "name of the channel", Required: true}
+	v2count  = query("count", "how many IDs to return")
+	physical = query("physical", "true lists every app file instead of the open apps")
+)
+
+// The v1 routes under /solidq answer 200 with success false when they fail
+var (
+	PauseServer  = Route{Name: "pauseServer", Method: http.MethodGet, Path: "/solidq/pause", Doc: "Pauses pushes and pops of the whole server. The switch is in memory only and a restart lifts it, use pauseApp for a pause that is kept"}
+	ResumeServer = Route{Name: "resumeServer", Method: http.MethodGet, Path: "/solidq/unpause", Doc: "Lifts the server wide pause"}
+	Push         = Route{Name: "push", Method: http.MethodPost, Path: "/solidq/push/:item", Doc: "Pushes an item", Params: []Param{item}}
+	Pop          = Route{Name: "pop", Method: http.MethodGet, Path: "/solidq/pop/:channel/:count", Doc: "Pops up to count items", Params: []Param{channel, path("count", "how many items to pop"), wait}}
+	Nack         = Route{Name: "nack", Method: http.MethodPost, Path: "/solidq/nack/:item", Doc: "Hands a popped item back for a retry", Params: []Param{item, query("delay", "delay before the retry, the channel's backoff by default")}}
+	Ack          = Route{Name: "ack", Method: http.MethodPost, Path: "/solidq/ack/:item", Doc: "Releases a popped item", Params: []Param{item}}
+	Config       = Route{Name: "config", Method: http.MethodGet, Path: "/solidq/config/:channel", Doc: "Returns the config of a channel and how many of its items are in flight", Params: []Param{channel}}
+	SetConfig    = Route{Name: "setConfig", Method: http.MethodPost, Path: "/solidq/config/:channel", Doc: "Changes the config of a channel, parameters left out keep their value", Params: []Param{
+		channel,
+		query("maxinflight", "how many items may be in flight, 0 for no cap"),
+		query("lease", "seconds an in-flight item is held before it is put back"),
+		query("backoffbase", "delay before the first retry, like 1.5s or a number of seconds"),
+		query("backoffmultiplier", "growth of the retry delay per attempt"),
+		query("backoffmax", "upper bound of the retry delay, like 10m or a number of seconds"),
+		query("backoffjitter", "0..1, random spread of the retry delay"),
+	}}
+	ListApps      = Route{Name: "listApps", Method: http.MethodGet, Path: "/solidq/listapps/:physical", Doc: "Lists the apps", Params: []Param{path("physical", "true lists every app file instead of the open apps")}}
+	Count         = Route{Name: "count", Method: http.MethodGet, Path: "/solidq/count/:channel/:count", Doc: "Returns the number of items in a channel", Params: []Param{channel, path("count", "unused")}}
+	Peek          = Route{Name: "peek", Method: http.MethodGet, Path: "/solidq/peek/:channel/:count", Doc: "Returns up to count IDs without popping them", Params: []Param{channel, path("count", "how many IDs to return")}}
+	Reset         = Route{Name: "reset", Method: http.MethodGet, Path: "/solidq/reset/:channel", Doc: "Removes every item of a channel", Params: []Param{channel, query("channel", "overrides the channel of the path, for older clients")}}
+	Channels      = Route{Name: "channels", Method: http.MethodGet, Path: "/solidq/channels/:appname", Doc: "Lists the channels of an app with their depth and pauses", Params: []Param{appname}}
+	PauseApp      = Route{Name: "pauseApp", Method: http.MethodGet, Path: "/solidq/pause/:appname", Doc: "Pauses an app or one of its channels, the pause is kept across restarts", Params: []Param{appname, pausech, query("mode", "all (default) or consume, which keeps accepting pushes")}}
+	ResumeApp     = Route{Name: "resumeApp", Method: http.MethodGet, Path: "/solidq/unpause/:appname", Doc: "Lifts a pause of an app or one of its channels", Params: []Param{appname, pausech}}
+	ListRecurring = Route{Name: "listRecurring", Method: http.MethodGet, Path: "/solidq/recurring/:appname", Doc: "Lists the recurring jobs of an app", Params: []Param{appname}}
+	SetRecurring  = Route{Name: "setRecurring", Method: http.MethodPost, Path: "/solidq/recurring/:appname", Doc: "Creates or replaces a recurring job", Params: []Param{appname}, Body: JSON}
+	GetRecurring  = Route{Name: "getRecurring", Method: http.MethodGet, Path: "/solidq/recurring/:appname/:name", Doc: "Returns a recurring job", Params: []Param{appname, path("name", "name of the job")}}
+	DelRecurring  = Route{Name: "deleteRecurring", Method: http.MethodDelete, Path: "/solidq/recurring/:appname/:name", Doc: "Deletes a recurring job", Params: []Param{appname, path("name", "name of the job")}}
+	Export        = Route{Name: "export", Method: http.MethodGet, Path: "/solidq/export/:appname/:channel", Doc: "Streams every item of a channel", Params: []Param{appname, path("channel", "name of the channel")}, Produces: NDJSON}
+	Import        = Route{Name: "import", Method: http.MethodPost, Path: "/solidq/import/:appname/:channel", Doc: "Adds the items of an export to a channel", Params: []Param{appname, path("channel", "name of the channel"), query("duplicates", "skip (default), overwrite or error")}, Body: NDJSON}
+	Backup        = Route{Name: "backup", Method: http.MethodGet, Path: "/solidq/admin/backup/:appname", Doc: "Streams a consistent copy of the DB file of an app, a tar of the files of its shards for a sharded app", Params: []Param{appname}, Produces: Binary}
+	BackupAll     = Route{Name: "backupAll", Method: http.MethodGet, Path: "/solidq/admin/backup", Doc: "Streams a tar of every app file", Produces: Tar}
+	Restore       = Route{Name: "restore", Method: http.MethodPost, Path: "/solidq/admin/restore/:appname", Doc: "Replaces an app with a backup. Not available in a cluster, its nodes restore from the cluster's snapshots", Params: []Param{appname}, Body: Binary}
+	Compact       = Route{Name: "compact", Method: http.MethodGet, Path: "/solidq/admin/compact/:appname", Doc: "Rewrites the DB file of an app to give free pages back", Params: []Param{appname}}
+	Repair        = Route{Name: "repair", Method: http.MethodGet, Path: "/solidq/admin/repair/:appname", Doc: "Recounts every channel, returns the channels whose depth was corrected", Params: []Param{appname}}
+	CreateApp     = Route{Name: "createApp", Method: http.MethodPost, Path: "/solidq/apps/:appname", Doc: "Creates an app", Params: []Param{appname, query("shards", "number of DB files to spread the app over"), query("shardby", "channel (default) or id")}}
+	DeleteApp     = Route{Name: "deleteApp", Method: http.MethodDelete, Path: "/solidq/apps/:appname", Doc: "Deletes an app with every channel in it", Params: []Param{appname}}
+	Durability    = Route{Name: "durability", Method: http.MethodGet, Path: "/solidq/durability/:appname", Doc: "Returns how an app commits pushes", Params: []Param{appname}}
+	SetDurability = Route{Name: "setDurability", Method: http.MethodPost, Path: "/solidq/durability/:appname", Doc: "Sets how an app commits pushes", Params: []Param{appname, Param{Name: "mode", In: "query", Doc: "always, batched or nosync", Required: true}}}
+	CreateChannel = Route{Name: "createChannel", Method: http.MethodPost, Path: "/solidq/channels/:appname/:channel", Doc: "Declares a channel, required before use in strict mode", Params: []Param{appname, path("channel", "name of the channel")}}
+	Snapshot      = Route{Name: "snapshot", Method: http.MethodGet, Path: "/solidq/replication/snapshot/:appname", Doc: "Streams the DB file of a shard with its log position in the X-Solidq-Epoch and X-Solidq-Seq headers", Params: []Param{appname, shard}, Produces: Binary}
+	Log           = Route{Name: "log", Method: http.MethodGet, Path: "/solidq/replication/log/:appname", Doc: "Returns the mutation log of a shard after a position", Params: []Param{appname, shard, query("epoch", "epoch of the log"), Param{Name: "after", In: "query", Doc: "log sequence to read after", Required: true}, wait}}
+	Changes       = Route{Name: "changes", Method: http.MethodGet, Path: "/solidq/changes/:appname", Doc: "Streams the change feed of a shard", Params: []Param{appname, shard, query("since", "offset to resume after"), query("follow", "true keeps the stream open for new changes")}, Produces: NDJSON}
+	Promote       = Route{Name: "promote", Method: http.MethodPost, Path: "/solidq/admin/promote", Doc: "Turns a follower into a primary"}
+	Cluster       = Route{Name: "cluster", Method: http.MethodGet, Path: "/solidq/cluster", Doc: "Returns the members of the cluster and its leader"}
+	Join          = Route{Name: "join", Method: http.MethodPost, Path: "/solidq/cluster/join", Doc: "Adds a voting member to the cluster", Params: []Param{
+		Param{Name: "id", In: "query", Doc: "ID of the node", Required: true},
+		Param{Name: "raft", In: "query", Doc: "host:port of its Raft transport", Required: true},
+		Param{Name: "http", In: "query", Doc: "URL of its HTTP API", Required: true},
+	}}
+	RemoveMember = Route{Name: "removeMember", Method: http.MethodDelete, Path: "/solidq/cluster/:id", Doc: "Removes a member from the cluster", Params: []Param{path("id", "ID of the node")}}
+	OpenAPI      = Route{Name: "openapi", Method: http.MethodGet, Path: "/solidq/openapi.json", Doc: "Returns this OpenAPI document, it needs no secret"}
+)
+
+// The v2 routes take a Request, as a JSON body or in the query string, and answer failures
+// with an HTTP status and an error code
+var (
+	V2Push          = Route{Name: "v2Push", Method: http.MethodPost, Path: "/v2/push", Doc: "Pushes id or ids to a channel, count is how many were pushed", Body: JSON}
+	V2Pop           = Route{Name: "v2Pop", Method: http.MethodPost, Path: "/v2/pop", Doc: "Pops up to count items, waiting up to wait. 429 when every in-flight slot of a capped channel is taken.", Body: JSON}
+	V2Ack           = Route{Name: "v2Ack", Method: http.MethodPost, Path: "/v2/ack", Doc: "Releases a popped item", Body: JSON}
+	V2Nack          = Route{Name: "v2Nack", Method: http.MethodPost, Path: "/v2/nack", Doc: "Hands a popped item back for a retry after delay, the channel's backoff by default", Body: JSON}
+	V2Count         = Route{Name: "v2Count", Method: http.MethodGet, Path: "/v2/count", Doc: "Returns the number of items in a channel", Params: []Param{v2app, v2ch}}
+	V2Peek          = Route{Name: "v2Peek", Method: http.MethodGet, Path: "/v2/peek", Doc: "Returns up to count IDs without popping them, 100 by default", Params: []Param{v2app, v2ch, v2count}}
+	V2Reset         = Route{Name: "v2Reset", Method: http.MethodPost, Path: "/v2/reset", Doc: "Removes every item of a channel", Body: JSON}
+	V2Config        = Route{Name: "v2Config", Method: http.MethodGet, Path: "/v2/config", Doc: "Returns the config of a channel and how many of its items are in flight", Params: []Param{v2app, v2ch}}
+	V2SetConfig     = Route{Name: "v2SetConfig", Method: http.MethodPost, Path: "/v2/config", Doc: "Changes the fields of the channel config that are sent", Body: JSON}
+	V2Apps          = Route{Name: "v2Apps", Method: http.MethodGet, Path: "/v2/apps", Doc: "Lists the apps", Params: []Param{physical}}
+	V2CreateApp     = Route{Name: "v2CreateApp", Method: http.MethodPost, Path: "/v2/apps", Doc: "Creates an app, 409 when it exists", Body: JSON}
+	V2DeleteApp     = Route{Name: "v2DeleteApp", Method: http.MethodDelete, Path: "/v2/apps", Doc: "Deletes an app with every channel in it, 404 when there is none", Body: JSON}
+	V2Channels      = Route{Name: "v2Channels", Method: http.MethodGet, Path: "/v2/channels", Doc: "Lists the channels of an app with their depth and pauses", Params: []Param{v2app}}
+	V2CreateChannel = Route{Name: "v2CreateChannel", Method: http.MethodPost, Path: "/v2/channels", Doc: "Declares a channel, required before use in strict mode", Body: JSON}
+	V2Pause         = Route{Name: "v2Pause", Method: http.MethodPost, Path: "/v2/pause", Doc: "Pauses an app or one of its channels, mode all or consume", Body: JSON}
+	V2Resume        = Route{Name: "v2Resume", Method: http.MethodPost, Path: "/v2/resume", Doc: "Lifts a pause of an app or one of its channels", Body: JSON}
+)
+
+// ReadOnly lists the routes that change nothing on the server, the ones a follower serves
+var ReadOnly = []Route{
+	Config, ListApps, Count, Peek, Channels, ListRecurring, GetRecurring, Export, Backup, BackupAll,
+	Durability, Snapshot, Log, Changes, Cluster, OpenAPI,
+	V2Count, V2Peek, V2Config, V2Apps, V2Channels,
+}
+
+// All lists every route of the API
+var All = []Route{
+	PauseServer, ResumeServer, Push, Pop, Nack, Ack, Config, SetConfig, ListApps, Count, Peek, Reset,
+	Channels, PauseApp, ResumeApp, ListRecurring, SetRecurring, GetRecurring, DelRecurring, Export,
+	Import, Backup, BackupAll, Restore, Compact, Repair, CreateApp, DeleteApp, Durability,
+	SetDurability, CreateChannel, Snapshot, Log, Changes, Promote, Cluster, Join, RemoveMember, OpenAPI,
+	V2Push, V2Pop, V2Ack, V2Nack, V2Count, V2Peek, V2Reset, V2Config, V2SetConfig, V2Apps,
+	V2CreateApp, V2DeleteApp, V2Channels, V2CreateChannel, V2Pause, V2Resume,
+}
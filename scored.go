@@ -0,0 +1,203 @@
+package solidq
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"go.etcd.io/bbolt"
+)
+
+// Scored channels hand out their items highest score first. They live next to the plain channel
+// of the same name and have no leases, retries or pauses. Like values they are not in the
+// mutation log, so followers and the change feed don't see them.
+
+const valuesbucket = internalprefix + "values"
+
+var errNaNScore = errors.New("score is not a number")
+
+// ScoredItem is an item of a scored channel
+type ScoredItem struct {
+	ID    string  `json:"id"`
+	Score float64 `json:"score"`
+}
+
+// scoredbucket holds the items of a scored channel by score, scoresbucket their score by ID
+func scoredbucket(channel string) []byte {
+	return []byte(internalprefix + "scored:" + channel)
+}
+
+func scoresbucket(channel string) []byte {
+	return []byte(internalprefix + "scores:" + channel)
+}
+
+// scorebits maps a score to an integer that sorts the same way
+func scorebits(score float64) uint64 {
+	bits := math.Float64bits(score)
+	if bits&(1<<63) == 0 {
+		return bits ^ 1<<63
+	}
+	return ^bits
+}
+
+func bitsscore(bits uint64) float64 {
+	if bits&(1<<63) != 0 {
+		return math.Float64frombits(bits ^ 1<<63)
+	}
+	return math.Float64frombits(^bits)
+}
+
+func scorekey(bits uint64, id string) []byte {
+	key := make([]byte, 8+len(id))
+	binary.BigEndian.PutUint64(key, bits)
+	copy(key[8:], id)
+	return key
+}
+
+// ZAdd puts items in a scored channel, an item already there gets its new score. It returns
+// how many items were new.
+func (q *Que) ZAdd(channel string, items ...ScoredItem) (int, error) {
+	added := 0
+	err := q.write(func(tx *bbolt.Tx) error {
+		added = 0
+		if err := q.checkchannel(tx, channel); err != nil {
+			return err
+		}
+
+		scored, err := tx.CreateBucketIfNotExists(scoredbucket(channel))
+		if err != nil {
+			return err
+		}
+
+		scores, err := tx.CreateBucketIfNotExists(scoresbucket(channel))
+		if err != nil {
+			return err
+		}
+
+		for _, item := range items {
+			if math.IsNaN(item.Score) {
+				return errNaNScore
+			}
+
+			if old := scores.Get([]byte(item.ID)); len(old) == 8 {
+				if err := scored.Delete(scorekey(binary.BigEndian.Uint64(old), item.ID)); err != nil {
+					return err
+				}
+			} else {
+				added++
+			}
+
+			bits := scorebits(item.Score)
+			if err := scored.Put(scorekey(bits, item.ID), nil); err != nil {
+				return err
+			}
+
+			if err := scores.Put([]byte(item.ID), logkey(bits)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return added, err
+}
+
+// ZPopMax removes and returns up to count items with the highest scores
+func (q *Que) ZPopMax(channel string, count int) ([]ScoredItem, error) {
+	var items []ScoredItem
+	err := q.update(func(tx *bbolt.Tx) error {
+		scored, scores := tx.Bucket(scoredbucket(channel)), tx.Bucket(scoresbucket(channel))
+		if scored == nil || scores == nil {
+			return nil
+		}
+
+		c := scored.Cursor()
+		for k, _ := c.Last(); k != nil && len(items) < count; k, _ = c.Last() {
+			item := ScoredItem{ID: string(k[8:]), Score: bitsscore(binary.BigEndian.Uint64(k))}
+			if err := c.Delete(); err != nil {
+				return err
+			}
+
+			if err := scores.Delete([]byte(item.ID)); err != nil {
+				return err
+			}
+			items = append(items, item)
+		}
+		return nil
+	})
+
+	return items, err
+}
+
+// ZCard returns the number of items in a scored channel
+func (q *Que) ZCard(channel string) (int, error) {
+	var count int
+	err := q.view(func(tx *bbolt.Tx) error {
+		if b := tx.Bucket(scoresbucket(channel)); b != nil {
+			count = countkeys(b)
+		}
+		return nil
+	})
+
+	return count, err
+}
+
+// DeleteScored drops a scored channel, it reports whether there was one
+func (q *Que) DeleteScored(channel string) (bool, error) {
+	existed := false
+	err := q.update(func(tx *bbolt.Tx) error {
+		existed = false
+		for _, name := range [][]byte{scoredbucket(channel), scoresbucket(channel)} {
+			err := tx.DeleteBucket(name)
+			if err == nil {
+				existed = true
+			} else if err != bbolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return existed, err
+}
+
+// SetValue stores a value under a key of the app
+func (q *Que) SetValue(key string, value []byte) error {
+	return q.write(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(valuesbucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), value)
+	})
+}
+
+// Value returns the value of a key, nil when it is not set
+func (q *Que) Value(key string) ([]byte, error) {
+	var value []byte
+	err := q.view(func(tx *bbolt.Tx) error {
+		if b := tx.Bucket([]byte(valuesbucket)); b != nil {
+			if v := b.Get([]byte(key)); v != nil {
+				value = append([]byte{}, v...)
+			}
+		}
+		return nil
+	})
+
+	return value, err
+}
+
+// DeleteValue removes a key, it reports whether the key was set
+func (q *Que) DeleteValue(key string) (bool, error) {
+	existed := false
+	err := q.update(func(tx *bbolt.Tx) error {
+		b := tx.Bucket([]byte(valuesbucket))
+		existed = b != nil && b.Get([]byte(key)) != nil
+		if !existed {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+
+	return existed, err
+}
@@ -1,23 +1,102 @@
 package solidq
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/sfi2k7/blueweb"
+	"github.com/sfi2k7/solidq/routes"
 )
 
 type response struct {
-	Success  bool           `json:"success"`
-	Ids      []string       `json:"ids,omitempty"`
-	Error    string         `json:"error"`
-	Count    int            `json:"count,omitempty"`
-	Channels map[string]int `json:"channels,omitempty"`
-	Apps     []string       `json:"apps,omitempty"`
-	IsPaused bool           `json:"isPaused"`
-	Took     string         `json:"took"`
+	Success  bool              `json:"success"`
+	Ids      []string          `json:"ids,omitempty"`
+	Error    string            `json:"error"`
+	Count    int               `json:"count,omitempty"`
+	Channels map[string]int    `json:"channels,omitempty"`
+	Apps     []string          `json:"apps,omitempty"`
+	IsPaused bool              `json:"isPaused"`
+	Config   *ChannelConfig    `json:"config,omitempty"`
+	InFlight int               `json:"inFlight,omitempty"`
+	MustAck  bool              `json:"mustAck,omitempty"`
+	Jobs     []RecurringJob    `json:"jobs,omitempty"`
+	Paused   map[string]string `json:"paused,omitempty"`
+	Skipped  int               `json:"skipped,omitempty"`
+	Before   int64             `json:"sizeBefore,omitempty"`
+	After    int64             `json:"sizeAfter,omitempty"`
+	Durable  string            `json:"durability,omitempty"`
+	Log      []LogEntry        `json:"log,omitempty"`
+	Cluster  *ClusterStatus    `json:"cluster,omitempty"`
+	Code     string            `json:"code,omitempty"`
+	Took     string            `json:"took"`
+}
+
+// maxPopWait caps how long a long-polling pop may hold a request
+const maxPopWait = 60 * time.Second
+
+func parsewait(str string) time.Duration {
+	wait := routes.ParseDuration(str)
+	if wait > maxPopWait {
+		return maxPopWait
+	}
+	return wait
+}
+
+// configquery reads the settings of a v1 config request into cc. A value that does not parse is
+// an invalid error, not a zero that would quietly drop the setting.
+func configquery(ctx *blueweb.Context, cc *ChannelConfig) error {
+	ints := map[string]*int{"maxinflight": &cc.MaxInFlight, "lease": &cc.Lease}
+	for name, field := range ints {
+		if v := ctx.Query(name); v != "" {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return invalidf("%s must be a whole number, not %q", name, v)
+			}
+			*field = n
+		}
+	}
+
+	floats := map[string]*float64{"backoffmultiplier": &cc.Backoff.Multiplier, "backoffjitter": &cc.Backoff.Jitter}
+	for name, field := range floats {
+		if v := ctx.Query(name); v != "" {
+			f, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return invalidf("%s must be a number, not %q", name, v)
+			}
+			*field = f
+		}
+	}
+
+	durations := map[string]*routes.Duration{"backoffbase": &cc.Backoff.Base, "backoffmax": &cc.Backoff.Max}
+	for name, field := range durations {
+		if v := ctx.Query(name); v != "" {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				seconds, serr := strconv.Atoi(v)
+				if serr != nil {
+					return invalidf("%s must be a duration like 1.5s or a number of seconds, not %q", name, v)
+				}
+				d = time.Duration(seconds) * time.Second
+			}
+
+			if d < 0 {
+				return invalidf("%s cannot be negative", name)
+			}
+			*field = routes.Duration(d)
+		}
+	}
+	return nil
 }
 
 type SeverOptions struct {
@@ -27,6 +106,74 @@ type SeverOptions struct {
 	CrossOrigin bool
 	Auth        blueweb.Middleware
 	Secret      string
+
+	// CompactThreshold turns on automatic compaction of apps whose free page ratio passes it (0..1)
+	CompactThreshold float64
+	// CompactInterval is how often the free page ratio is checked, an hour by default
+	CompactInterval time.Duration
+
+	// IdleTimeout closes the DB of apps unused for this long, they are reopened on their next request
+	IdleTimeout time.Duration
+	// MaxOpenApps caps how many app DBs are open at once, the least recently used is closed first
+	MaxOpenApps int
+
+	// ShutdownTimeout bounds how long a signal triggered shutdown waits for requests in flight, 30s by default
+	ShutdownTimeout time.Duration
+
+	// Strict rejects apps and channels that were not created first through the apps and channels endpoints
+	Strict bool
+
+	// Durability is the default durability mode of apps without their own, batched by default
+	Durability string
+
+	// Replicate keeps a mutation log in every app file, so followers can replicate this server
+	Replicate bool
+	// Follow is the URL of a primary to replicate, the server then only serves reads until promoted
+	Follow string
+	// FollowSecret is the secret of the primary
+	FollowSecret string
+
+	// ChangeFeed keeps a mutation log in every app file and serves it at /solidq/changes
+	ChangeFeed bool
+	// ChangeLogEntries is how many log entries each app file keeps, ChangeLogAge how old they may get
+	// and ChangeLogBytes how many bytes of them. With none set 100000 entries are kept.
+	ChangeLogEntries int
+	ChangeLogAge     time.Duration
+	ChangeLogBytes   int64
+
+	// ClusterID names this node in a Raft cluster, with ClusterAddr the host:port it takes Raft
+	// traffic on. Every change then goes through the Raft log and followers forward requests to
+	// the leader, which also fires the recurring jobs. Restoring an app and the values of the fp
+	// set and delete commands are not available in a cluster.
+	ClusterID   string
+	ClusterAddr string
+	// ClusterHTTP is the URL other members forward requests to, http://<ClusterAddr host>:<Port> by default
+	ClusterHTTP string
+	// ClusterBootstrap starts a new cluster with this node as its only member
+	ClusterBootstrap bool
+	// ClusterJoin is the URL of a member to join the cluster through
+	ClusterJoin string
+
+	// RESPAddr is where the Redis protocol front-end listens, like :6380. Empty turns it off.
+	RESPAddr string
+
+	// FPRedisAddr turns on the Redis bridge: foreign packets popped from the FPKey sorted set of
+	// that server are applied, and a reply for each is pushed to its target list or FPReplyKey.
+	// The keys are solidq:fpset and solidq:fpreplies by default.
+	FPRedisAddr     string
+	FPRedisPassword string
+	FPKey           string
+	FPReplyKey      string
+	// FPQueue replaces the Redis server of the bridge, to run it against a stand-in
+	FPQueue FPQueue
+
+	// FPAddr is where the line protocol listens, foreign packets one per line, like :7070. Empty turns it off.
+	FPAddr string
+
+	// Storage is the backend apps are kept in, bolt files by default. The memory backend keeps
+	// plain channels only, without in-flight tracking, retries, pauses or recurring jobs, and
+	// can't replicate, join a cluster or run strict.
+	Storage string
 }
 
 var defaultOptions = SeverOptions{
@@ -37,92 +184,162 @@ var defaultOptions = SeverOptions{
 	Secret:      "secret",
 }
 
-func channeltoappchannel(channel string) (app string, ch string) {
+func channeltoappchannel(channel string) (app string, ch string, err error) {
 	//example: "core:channel1" -> app="core", ch="channel1"
+	app, ch = "core", channel
 	parts := strings.Split(channel, ":")
 	if len(parts) == 2 {
-		return parts[0], parts[1]
+		app, ch = parts[0], parts[1]
 	}
 
-	return "core", channel
+	if err := validapp(app); err != nil {
+		return "", "", err
+	}
+	return app, ch, validchannel(ch)
 }
 
 //app:channel:id
 
-func extractaci(str string) (app string, channel string, id string) {
+func extractaci(str string) (app string, channel string, id string, err error) {
 	//example: "core:channel:id" -> app="core", channel="channel", id="id"
 
 	parts := strings.Split(str, ":")
-	if len(parts) == 1 {
-		return "core", "default", parts[0]
+	switch len(parts) {
+	case 1:
+		app, channel, id = "core", "default", parts[0]
+	case 2:
+		app, channel, id = "core", parts[0], parts[1]
+	case 3:
+		app, channel, id = parts[0], parts[1], parts[2]
+	default:
+		app, channel, id = "core", "default", str
 	}
 
-	if len(parts) == 2 {
-		return "core", parts[0], parts[1]
+	if err := validapp(app); err != nil {
+		return "", "", "", err
 	}
+	return app, channel, id, validchannel(channel)
+}
 
-	if len(parts) == 3 {
-		return parts[0], parts[1], parts[2]
-	}
+// Server is a solidq server with its own set of apps. Serve it with Start, or mount Handler
+// in another mux; either way Shutdown stops it.
+type Server struct {
+	options *SeverOptions
+	apps    *registry
+	http    *http.Server
+	follow  *follower
+	cluster *cluster
+	resp    *tcpserver
+	fp      *tcpserver
+	stop    chan struct{}
+	once    sync.Once
+	loops   sync.WaitGroup
 
-	return "core", "default", str
+	// paused is a server wide, in-memory switch. Use the per app pause endpoints to persist a pause.
+	paused atomic.Bool
 }
 
+// StartQueServer runs a server until SIGINT or SIGTERM, then shuts it down gracefully
 func StartQueServer(options *SeverOptions) error {
-	isPaused := false
+	s, err := NewServer(options)
+	if err != nil {
+		return err
+	}
+
+	exit := make(chan os.Signal, 2)
+	signal.Notify(exit, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(exit)
+
+	done := make(chan error, 1)
+	go func() {
+		if _, ok := <-exit; !ok {
+			return
+		}
+
+		fmt.Println("Shutting down...")
+		ctx, cancel := context.WithTimeout(context.Background(), s.options.ShutdownTimeout)
+		defer cancel()
+		done <- s.Shutdown(ctx)
+	}()
+
+	if err := s.Start(); err != nil {
+		signal.Stop(exit)
+		close(exit)
+		return err
+	}
+	return <-done
+}
+
+// NewServer opens the root path and starts the background schedulers. Requests are served by
+// Start, or by mounting Handler.
+func NewServer(options *SeverOptions) (*Server, error) {
 	if options == nil {
 		options = &defaultOptions
 	}
 
-	middle := func(fn func(ctx *blueweb.Context)) blueweb.Handler {
-		return func(ctx *blueweb.Context) {
-			//Cross-Origin Resource Sharing (CORS)
-			if options.CrossOrigin {
-				ctx.SetHeader("Content-Type", "application/json")
-				ctx.SetHeader("Access-Control-Allow-Origin", "*")
-				ctx.SetHeader("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-				ctx.SetHeader("Access-Control-Allow-Headers", "Content-Type, Authorization")
-				if ctx.Method() == "OPTIONS" {
-					ctx.Status(200)
-					return
-				}
-			}
+	// defaults are filled in on a copy, the caller's options stay as they were
+	opts := *options
+	options = &opts
 
-			//Simple Authentication
-			if options.Secret != "" {
-				var token = ctx.Query("secret")
-				if token == "" {
-					token = ctx.Query("api_key")
-					if token == "" {
-						token = ctx.Query("key")
-						if token == "" {
-							token = ctx.Query("access_token")
-							if token == "" {
-								token = ctx.Header("Authorization")
-							}
-						}
-					}
-				}
+	if options.Durability != "" {
+		if err := validdurability(options.Durability); err != nil {
+			return nil, err
+		}
+	}
 
-				if len(token) == 0 || token != options.Secret {
-					ctx.Json(response{Error: "Unauthorized"})
-					return
-				}
-			}
+	if options.Storage == "" {
+		options.Storage = StorageBolt
+	}
 
-			//Custom Authentication
-			if options.Auth != nil {
-				success := options.Auth(ctx)
-				if !success {
-					ctx.Json(response{Error: "Unauthorized"})
-					return
-				}
-			}
+	if err := validstorage(options.Storage); err != nil {
+		return nil, err
+	}
+
+	if options.Storage != StorageBolt && (options.Replicate || options.Follow != "" || options.ChangeFeed || options.ClusterID != "" || options.Strict) {
+		return nil, fmt.Errorf("the %s storage can't replicate, keep a change feed, join a cluster or run strict", options.Storage)
+	}
+
+	apps, err := newregistry(options.RootPath, options.MaxOpenApps, options.Strict)
+	if err != nil {
+		return nil, err
+	}
+	apps.backend = options.Storage
+	apps.durability = options.Durability
+	apps.mutationlog = options.Replicate || options.Follow != "" || options.ChangeFeed
+	apps.logentries = options.ChangeLogEntries
+	apps.logage = options.ChangeLogAge
+	apps.logbytes = options.ChangeLogBytes
+
+	s := &Server{options: options, apps: apps, stop: make(chan struct{})}
+	if options.Follow != "" {
+		apps.follower.Store(true)
+		s.follow = newfollower(apps, options.Follow, options.FollowSecret)
+	}
+
+	if options.ClusterID != "" {
+		if options.Follow != "" {
+			return nil, errors.New("a cluster node can not follow a primary")
+		}
+
+		if options.RESPAddr != "" {
+			return nil, errors.New("a cluster node can not serve the Redis protocol")
+		}
+
+		apps.clustered = true
+		if s.cluster, err = newcluster(apps, options); err != nil {
+			return nil, err
+		}
+	}
 
-			ctx.State = time.Now()
-			//Call the handler
-			fn(ctx)
+	if err := s.listen(); err != nil {
+		if s.cluster != nil {
+			s.cluster.close()
 		}
+		return nil, err
+	}
+
+	middle := func(fn func(ctx *blueweb.Context)) blueweb.Handler {
+		return s.middleware(fn, false)
 	}
 
 	pauserfunc := func(c *blueweb.Context) {
@@ -133,33 +350,41 @@ func StartQueServer(options *SeverOptions) error {
 		return time.Since(t.(time.Time)).String()
 	}
 
-	api := blueweb.NewRouter()
+	api := newrouter()
 
-	api.Get("/solidq/pause", middle(func(ctx *blueweb.Context) {
-		isPaused = true
+	api.Handle(routes.PauseServer, middle(func(ctx *blueweb.Context) {
+		s.paused.Store(true)
 		ctx.Json(response{Success: true, Took: inttotimesince(ctx.State)})
 	}))
 
-	api.Get("/solidq/unpause", middle(func(ctx *blueweb.Context) {
-		isPaused = false
+	api.Handle(routes.ResumeServer, middle(func(ctx *blueweb.Context) {
+		s.paused.Store(false)
 		ctx.Json(response{Success: true, Took: inttotimesince(ctx.State)})
 	}))
 
-	api.Post("/solidq/push/:item", middle(func(ctx *blueweb.Context) {
-		if isPaused {
+	api.Handle(routes.Push, middle(func(ctx *blueweb.Context) {
+		if s.paused.Load() {
 			pauserfunc(ctx)
 			return
 		}
 
-		app, channel, workid := extractaci(ctx.Params("item"))
+		app, channel, workid, err := extractaci(params(ctx, "item"))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
 
-		localqueue, err := enusureQ(app)
+		localqueue, err := s.queue(app)
 		if err != nil {
 			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
 			return
 		}
 
 		err = localqueue.Push(channel, workid)
+		if err == ErrPaused {
+			pauserfunc(ctx)
+			return
+		}
 
 		if err != nil {
 			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
@@ -169,20 +394,22 @@ func StartQueServer(options *SeverOptions) error {
 		ctx.Json(response{Success: true, Took: inttotimesince(ctx.State)})
 	}))
 
-	api.Get("/solidq/pop/:channel/:count", middle(func(ctx *blueweb.Context) {
-		if isPaused {
+	api.Handle(routes.Pop, middle(func(ctx *blueweb.Context) {
+		if s.paused.Load() {
 			pauserfunc(ctx)
 			return
 		}
 
-		channel := ctx.Params("channel")
-		count := ctx.Params("count")
+		channel := params(ctx, "channel")
+		count := params(ctx, "count")
 
-		fmt.Println("Pop request for channel:", channel, "with count:", count)
-		var app string
-		app, channel = channeltoappchannel(channel)
+		app, channel, err := channeltoappchannel(channel)
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
 
-		localqueue, err := enusureQ(app)
+		localqueue, err := s.queue(app)
 		if err != nil {
 			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
 			return
@@ -193,7 +420,12 @@ func StartQueServer(options *SeverOptions) error {
 			co = 1
 		}
 
-		ids, err := localqueue.PopWithCount(channel, co)
+		ids, mustack, err := localqueue.PopWait(channel, co, parsewait(ctx.Query("wait")))
+		if err == ErrPaused {
+			pauserfunc(ctx)
+			return
+		}
+
 		if err != nil {
 			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
 			return
@@ -204,17 +436,122 @@ func StartQueServer(options *SeverOptions) error {
 			return
 		}
 
-		ctx.Json(response{Success: true, Ids: ids, Took: inttotimesince(ctx.State)})
+		ctx.Json(response{Success: true, Ids: ids, MustAck: mustack, Took: inttotimesince(ctx.State)})
+	}))
+
+	api.Handle(routes.Nack, middle(func(ctx *blueweb.Context) {
+		app, channel, workid, err := extractaci(params(ctx, "item"))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		localqueue, err := s.queue(app)
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		err = localqueue.Nack(channel, workid, routes.ParseDuration(ctx.Query("delay")))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		ctx.Json(response{Success: true, Took: inttotimesince(ctx.State)})
+	}))
+
+	api.Handle(routes.Ack, middle(func(ctx *blueweb.Context) {
+		app, channel, workid, err := extractaci(params(ctx, "item"))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		localqueue, err := s.queue(app)
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		err = localqueue.Ack(channel, workid)
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		ctx.Json(response{Success: true, Took: inttotimesince(ctx.State)})
+	}))
+
+	api.Handle(routes.Config, middle(func(ctx *blueweb.Context) {
+		app, channel, err := channeltoappchannel(params(ctx, "channel"))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		localqueue, err := s.apps.ensure(app)
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		cc, err := localqueue.ChannelConfig(channel)
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		inflight, err := localqueue.InFlight(channel)
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		ctx.Json(response{Success: true, Config: &cc, InFlight: inflight, Took: inttotimesince(ctx.State)})
+	}))
+
+	api.Handle(routes.SetConfig, middle(func(ctx *blueweb.Context) {
+		app, channel, err := channeltoappchannel(params(ctx, "channel"))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		localqueue, err := s.queue(app)
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		cc, err := localqueue.ChannelConfig(channel)
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		if err := configquery(ctx, &cc); err != nil {
+			writev2(ctx, http.StatusBadRequest, response{Error: err.Error(), Code: routes.CodeInvalid, Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		err = localqueue.SetChannelConfig(channel, cc)
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		ctx.Json(response{Success: true, Config: &cc, Took: inttotimesince(ctx.State)})
 	}))
 
-	api.Get("/solidq/listapps/:physical", middle(func(ctx *blueweb.Context) {
-		if isPaused {
+	api.Handle(routes.ListApps, middle(func(ctx *blueweb.Context) {
+		if s.paused.Load() {
 			pauserfunc(ctx)
 			return
 		}
 
-		isPhysical := ctx.Params("physical") == "true"
-		apps, err := listapps(isPhysical)
+		isPhysical := params(ctx, "physical") == "true"
+		apps, err := s.apps.list(isPhysical)
 		if err != nil {
 			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
 			return
@@ -223,17 +560,20 @@ func StartQueServer(options *SeverOptions) error {
 		ctx.Json(response{Success: true, Apps: apps})
 	}))
 
-	api.Get("/solidq/count/:channel/:count", middle(func(ctx *blueweb.Context) {
-		if isPaused {
+	api.Handle(routes.Count, middle(func(ctx *blueweb.Context) {
+		if s.paused.Load() {
 			pauserfunc(ctx)
 			return
 		}
 
-		channel := ctx.Params("channel")
-		var app string
-		app, channel = channeltoappchannel(channel)
+		channel := params(ctx, "channel")
+		app, channel, err := channeltoappchannel(channel)
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
 
-		localqueue, err := enusureQ(app)
+		localqueue, err := s.apps.ensure(app)
 		if err != nil {
 			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
 			return
@@ -247,17 +587,52 @@ func StartQueServer(options *SeverOptions) error {
 		ctx.Json(response{Success: true, Count: count, Took: inttotimesince(ctx.State)})
 	}))
 
-	api.Get("/solidq/reset/:channel", middle(func(ctx *blueweb.Context) {
-		if isPaused {
+	api.Handle(routes.Peek, middle(func(ctx *blueweb.Context) {
+		app, channel, err := channeltoappchannel(params(ctx, "channel"))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		count, err := strconv.Atoi(params(ctx, "count"))
+		if err != nil || count < 1 {
+			ctx.Json(response{Error: "count must be a positive number", Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		localqueue, err := s.apps.ensure(app)
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		ids, err := localqueue.Peek(channel, count)
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+		ctx.Json(response{Success: true, Ids: ids, Count: len(ids), Took: inttotimesince(ctx.State)})
+	}))
+
+	api.Handle(routes.Reset, middle(func(ctx *blueweb.Context) {
+		if s.paused.Load() {
 			pauserfunc(ctx)
 			return
 		}
 
-		channel := ctx.Query("channel")
-		var app string
-		app, channel = channeltoappchannel(channel)
+		// older clients sent the channel in the query
+		channel := params(ctx, "channel")
+		if q := ctx.Query("channel"); q != "" {
+			channel = q
+		}
+
+		app, channel, err := channeltoappchannel(channel)
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
 
-		localqueue, err := enusureQ(app)
+		localqueue, err := s.queue(app)
 		if err != nil {
 			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
 			return
@@ -271,15 +646,15 @@ func StartQueServer(options *SeverOptions) error {
 		ctx.Json(response{Success: true, Took: inttotimesince(ctx.State)})
 	}))
 
-	api.Get("/solidq/channels/:appname", middle(func(ctx *blueweb.Context) {
-		if isPaused {
+	api.Handle(routes.Channels, middle(func(ctx *blueweb.Context) {
+		if s.paused.Load() {
 			pauserfunc(ctx)
 			return
 		}
 
-		app := ctx.Params("appname")
+		app := params(ctx, "appname")
 
-		localqueue, err := enusureQ(app)
+		localqueue, err := s.apps.ensure(app)
 		if err != nil {
 			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
 			return
@@ -290,12 +665,677 @@ func StartQueServer(options *SeverOptions) error {
 			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
 			return
 		}
-		ctx.Json(response{Success: true, Channels: channels, Took: inttotimesince(ctx.State)})
+
+		paused, err := localqueue.PauseStates()
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+		ctx.Json(response{Success: true, Channels: channels, Paused: paused, IsPaused: paused[appwide] != "", Took: inttotimesince(ctx.State)})
+	}))
+
+	// ?channel= narrows the pause to one channel, ?mode=consume keeps accepting pushes
+	api.Handle(routes.PauseApp, middle(func(ctx *blueweb.Context) {
+		localqueue, err := s.queue(params(ctx, "appname"))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		err = localqueue.Pause(ctx.Query("channel"), ctx.Query("mode"))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+		ctx.Json(response{Success: true, Took: inttotimesince(ctx.State)})
 	}))
 
-	api.Config().SetDev(true).SetPort(options.Port).StopOnInterrupt()
+	api.Handle(routes.ResumeApp, middle(func(ctx *blueweb.Context) {
+		localqueue, err := s.queue(params(ctx, "appname"))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
 
-	api.StartServer()
+		err = localqueue.Resume(ctx.Query("channel"))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+		ctx.Json(response{Success: true, Took: inttotimesince(ctx.State)})
+	}))
 
-	return nil
+	api.Handle(routes.ListRecurring, middle(func(ctx *blueweb.Context) {
+		localqueue, err := s.apps.ensure(params(ctx, "appname"))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		jobs, err := localqueue.ListRecurring()
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+		ctx.Json(response{Success: true, Jobs: jobs, Took: inttotimesince(ctx.State)})
+	}))
+
+	api.Handle(routes.SetRecurring, middle(func(ctx *blueweb.Context) {
+		var job RecurringJob
+		if err := ctx.ParseBody(&job); err != nil {
+			ctx.Json(response{Error: "invalid recurring job: " + err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		localqueue, err := s.queue(params(ctx, "appname"))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		job, err = localqueue.SetRecurring(job)
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+		ctx.Json(response{Success: true, Jobs: []RecurringJob{job}, Took: inttotimesince(ctx.State)})
+	}))
+
+	api.Handle(routes.GetRecurring, middle(func(ctx *blueweb.Context) {
+		localqueue, err := s.apps.ensure(params(ctx, "appname"))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		job, err := localqueue.GetRecurring(params(ctx, "name"))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+		ctx.Json(response{Success: true, Jobs: []RecurringJob{*job}, Took: inttotimesince(ctx.State)})
+	}))
+
+	api.Handle(routes.DelRecurring, middle(func(ctx *blueweb.Context) {
+		localqueue, err := s.queue(params(ctx, "appname"))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		err = localqueue.DeleteRecurring(params(ctx, "name"))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+		ctx.Json(response{Success: true, Took: inttotimesince(ctx.State)})
+	}))
+
+	api.Handle(routes.Export, middle(func(ctx *blueweb.Context) {
+		if err := validchannel(params(ctx, "channel")); err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		localqueue, err := s.apps.ensure(params(ctx, "appname"))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		ctx.SetHeader("Content-Type", "application/x-ndjson")
+		if _, err := localqueue.Export(params(ctx, "channel"), ctx.ResponseWriter); err != nil {
+			fmt.Println("Error exporting channel:", params(ctx, "channel"), err)
+		}
+	}))
+
+	// ?duplicates=skip|overwrite|error decides what happens to IDs already in the channel
+	api.Handle(routes.Import, middle(func(ctx *blueweb.Context) {
+		if err := validchannel(params(ctx, "channel")); err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		localqueue, err := s.queue(params(ctx, "appname"))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		imported, skipped, err := localqueue.Import(params(ctx, "channel"), ctx.Request.Body, ctx.Query("duplicates"))
+		if err == ErrPaused {
+			pauserfunc(ctx)
+			return
+		}
+
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Count: imported, Skipped: skipped, Took: inttotimesince(ctx.State)})
+			return
+		}
+		ctx.Json(response{Success: true, Count: imported, Skipped: skipped, Took: inttotimesince(ctx.State)})
+	}))
+
+	api.Handle(routes.Backup, middle(func(ctx *blueweb.Context) {
+		app := params(ctx, "appname")
+
+		localqueue, err := s.apps.ensure(app)
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		if localqueue.Shards() > 1 {
+			ctx.SetHeader("Content-Type", "application/x-tar")
+			ctx.SetHeader("Content-Disposition", "attachment; filename=\""+app+".tar\"")
+		} else {
+			ctx.SetHeader("Content-Type", "application/octet-stream")
+			ctx.SetHeader("Content-Disposition", "attachment; filename=\""+app+".db\"")
+		}
+
+		// the status is already out once streaming starts, a failure can only cut the stream short
+		if _, err := localqueue.Backup(ctx.ResponseWriter); err != nil {
+			fmt.Println("Error streaming backup of app:", app, err)
+		}
+	}))
+
+	api.Handle(routes.BackupAll, middle(func(ctx *blueweb.Context) {
+		ctx.SetHeader("Content-Type", "application/x-tar")
+		ctx.SetHeader("Content-Disposition", "attachment; filename=\"solidq.tar\"")
+
+		if err := s.apps.backupall(ctx.ResponseWriter); err != nil {
+			fmt.Println("Error streaming backup of all apps:", err)
+		}
+	}))
+
+	api.Handle(routes.Restore, middle(func(ctx *blueweb.Context) {
+		// swapping an app's files under the Raft log would leave the members apart, a node
+		// restores from the cluster's snapshots instead
+		if s.cluster != nil {
+			ctx.Json(response{Error: ErrNotClustered.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		localqueue, err := s.apps.ensure(params(ctx, "appname"))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		err = localqueue.Restore(ctx.Request.Body)
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+		ctx.Json(response{Success: true, Took: inttotimesince(ctx.State)})
+	}))
+
+	api.Handle(routes.Compact, middle(func(ctx *blueweb.Context) {
+		localqueue, err := s.apps.ensure(params(ctx, "appname"))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		before, after, err := localqueue.Compact()
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Before: before, After: after, Took: inttotimesince(ctx.State)})
+			return
+		}
+		ctx.Json(response{Success: true, Before: before, After: after, Took: inttotimesince(ctx.State)})
+	}))
+
+	// recounts every channel, the response lists the channels whose depth counter was corrected
+	api.Handle(routes.Repair, middle(func(ctx *blueweb.Context) {
+		localqueue, err := s.apps.ensure(params(ctx, "appname"))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		fixed, err := localqueue.RepairDepths()
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+		ctx.Json(response{Success: true, Channels: fixed, Count: len(fixed), Took: inttotimesince(ctx.State)})
+	}))
+
+	// ?shards=4&shardby=channel|id spreads a new app over several files
+	api.Handle(routes.CreateApp, middle(func(ctx *blueweb.Context) {
+		shards, _ := strconv.Atoi(ctx.Query("shards"))
+		err := s.createapp(params(ctx, "appname"), shards, ctx.Query("shardby"))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+		ctx.Json(response{Success: true, Took: inttotimesince(ctx.State)})
+	}))
+
+	api.Handle(routes.Durability, middle(func(ctx *blueweb.Context) {
+		localqueue, err := s.apps.ensure(params(ctx, "appname"))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		mode, err := localqueue.Durability()
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+		ctx.Json(response{Success: true, Durable: mode, Took: inttotimesince(ctx.State)})
+	}))
+
+	// ?mode=always|batched|nosync
+	api.Handle(routes.SetDurability, middle(func(ctx *blueweb.Context) {
+		localqueue, err := s.apps.ensure(params(ctx, "appname"))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		mode := ctx.Query("mode")
+		if err := localqueue.SetDurability(mode); err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+		ctx.Json(response{Success: true, Durable: mode, Took: inttotimesince(ctx.State)})
+	}))
+
+	api.Handle(routes.CreateChannel, middle(func(ctx *blueweb.Context) {
+		localqueue, err := s.queue(params(ctx, "appname"))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		err = localqueue.CreateChannel(params(ctx, "channel"))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+		ctx.Json(response{Success: true, Took: inttotimesince(ctx.State)})
+	}))
+
+	// streams the DB file of one shard, the log position it is at is in the X-Solidq-Epoch and X-Solidq-Seq headers
+	api.Handle(routes.Snapshot, middle(func(ctx *blueweb.Context) {
+		q, err := s.apps.shard(params(ctx, "appname"), ctx.Query("shard"))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		_, err = q.Snapshot(ctx.ResponseWriter, func(epoch string, seq uint64) {
+			ctx.SetHeader("Content-Type", "application/octet-stream")
+			ctx.SetHeader("X-Solidq-Epoch", epoch)
+			ctx.SetHeader("X-Solidq-Seq", strconv.FormatUint(seq, 10))
+		})
+
+		// once the file started streaming the status is sent, a follower sees the broken snapshot
+		if err != nil && ctx.ResponseWriter.Header().Get("X-Solidq-Epoch") == "" {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+		}
+	}))
+
+	// ?shard=0&epoch=...&after=<seq>&wait=30s
+	api.Handle(routes.Log, middle(func(ctx *blueweb.Context) {
+		q, err := s.apps.shard(params(ctx, "appname"), ctx.Query("shard"))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		after, err := strconv.ParseUint(ctx.Query("after"), 10, 64)
+		if err != nil {
+			ctx.Json(response{Error: "after must be a log sequence", Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		entries, err := q.ReadLog(ctx.Query("epoch"), after, parsewait(ctx.Query("wait")))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+		ctx.Json(response{Success: true, Log: entries, Count: len(entries), Took: inttotimesince(ctx.State)})
+	}))
+
+	// streams the change log of one shard as newline delimited JSON, starting after ?since=<seq>.
+	// ?follow=true keeps the stream open for new changes. The log epoch is in the X-Solidq-Epoch
+	// header, offsets from another epoch must not be resumed.
+	api.Handle(routes.Changes, middle(func(ctx *blueweb.Context) {
+		q, err := s.apps.shard(params(ctx, "appname"), ctx.Query("shard"))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		since := uint64(0)
+		if str := ctx.Query("since"); str != "" {
+			if since, err = strconv.ParseUint(str, 10, 64); err != nil {
+				ctx.Json(response{Error: "since must be a change offset", Took: inttotimesince(ctx.State)})
+				return
+			}
+		}
+
+		follow := ctx.Query("follow") == "true"
+		epoch, entries, err := q.Changes(since, 0)
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		ctx.SetHeader("Content-Type", "application/x-ndjson")
+		ctx.SetHeader("X-Solidq-Epoch", epoch)
+		enc := json.NewEncoder(ctx.ResponseWriter)
+		flusher, _ := ctx.ResponseWriter.(http.Flusher)
+		for {
+			for _, e := range entries {
+				if err := enc.Encode(e); err != nil {
+					return
+				}
+				since = e.Seq
+			}
+
+			if flusher != nil {
+				flusher.Flush()
+			}
+
+			if len(entries) == 0 && (!follow || q.draining.Load() || ctx.Request.Context().Err() != nil) {
+				return
+			}
+
+			var current string
+			current, entries, err = q.Changes(since, time.Second)
+			if err != nil || current != epoch {
+				// the stream ends, the reader resumes or starts over from its last offset
+				return
+			}
+		}
+	}))
+
+	// stops replicating the primary and starts taking writes
+	api.Handle(routes.Promote, middle(func(ctx *blueweb.Context) {
+		if !s.apps.follower.Load() {
+			ctx.Json(response{Error: "this server is not a follower", Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		if err := s.apps.promote(s.follow); err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+		ctx.Json(response{Success: true, Took: inttotimesince(ctx.State)})
+	}))
+
+	api.Handle(routes.Cluster, middle(func(ctx *blueweb.Context) {
+		if s.cluster == nil {
+			ctx.Json(response{Error: "this server is not part of a cluster", Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		status, err := s.cluster.status()
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+		ctx.Json(response{Success: true, Cluster: status, Took: inttotimesince(ctx.State)})
+	}))
+
+	// ?id=<node>&raft=<host:port>&http=<url> adds a voting member
+	api.Handle(routes.Join, middle(func(ctx *blueweb.Context) {
+		if s.cluster == nil {
+			ctx.Json(response{Error: "this server is not part of a cluster", Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		if err := s.cluster.addmember(ctx.Query("id"), ctx.Query("raft"), ctx.Query("http")); err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+		ctx.Json(response{Success: true, Took: inttotimesince(ctx.State)})
+	}))
+
+	api.Handle(routes.RemoveMember, middle(func(ctx *blueweb.Context) {
+		if s.cluster == nil {
+			ctx.Json(response{Error: "this server is not part of a cluster", Took: inttotimesince(ctx.State)})
+			return
+		}
+
+		if err := s.cluster.removemember(params(ctx, "id")); err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+		ctx.Json(response{Success: true, Took: inttotimesince(ctx.State)})
+	}))
+
+	api.Handle(routes.DeleteApp, middle(func(ctx *blueweb.Context) {
+		err := s.deleteapp(params(ctx, "appname"))
+		if err != nil {
+			ctx.Json(response{Error: err.Error(), Took: inttotimesince(ctx.State)})
+			return
+		}
+		ctx.Json(response{Success: true, Took: inttotimesince(ctx.State)})
+	}))
+
+	s.routev2(api, &s.paused)
+	s.routeopenapi(api)
+
+	if options.ShutdownTimeout <= 0 {
+		options.ShutdownTimeout = 30 * time.Second
+	}
+
+	s.http = &http.Server{Addr: ":" + strconv.Itoa(options.Port), Handler: api.mux}
+
+	if options.IdleTimeout > 0 {
+		s.run(func() { apps.runidle(options.IdleTimeout, s.stop) })
+	}
+
+	fire := firerecurring
+	if s.cluster != nil {
+		fire = s.cluster.firerecurring
+	}
+	s.run(func() { apps.runrecurring(s.stop, fire) })
+
+	// cluster nodes only trim while applying the Raft log, their files must stay alike
+	if apps.mutationlog && !apps.clustered {
+		s.run(func() { apps.runlogtrim(s.stop) })
+	}
+
+	if s.follow != nil {
+		s.run(func() { s.follow.run(s.stop) })
+	}
+
+	if s.cluster != nil {
+		s.run(func() { s.cluster.run(s.stop) })
+	}
+
+	if s.resp != nil {
+		s.run(s.resp.serve)
+	}
+
+	if s.fp != nil {
+		s.run(s.fp.serve)
+	}
+
+	if options.FPRedisAddr != "" || options.FPQueue != nil {
+		bridge := newfpbridge(s, options)
+		s.run(func() { bridge.run(s.stop) })
+	}
+
+	if options.CompactThreshold > 0 {
+		interval := options.CompactInterval
+		if interval <= 0 {
+			interval = time.Hour
+		}
+		s.run(func() { apps.runcompaction(options.CompactThreshold, interval, s.stop) })
+	}
+	return s, nil
+}
+
+// middleware forwards requests to the cluster leader, checks the secret and the custom Auth and
+// keeps writes off followers. v2 handlers get their rejections with an HTTP status and a code.
+func (s *Server) middleware(fn func(ctx *blueweb.Context), v2 bool) blueweb.Handler {
+	options := s.options
+	return func(ctx *blueweb.Context) {
+		reject := func(status int, code string, err error) {
+			if v2 {
+				writev2(ctx, status, response{Error: err.Error(), Code: code})
+				return
+			}
+			ctx.Json(response{Error: err.Error()})
+		}
+
+		// cluster members forward to the leader, which checks the request itself
+		if s.cluster != nil && !clusterlocal(ctx.Method(), ctx.Request.URL.Path) {
+			leader, err := s.cluster.leaderurl(ctx.Request)
+			if err != nil {
+				reject(http.StatusServiceUnavailable, routes.CodeUnavailable, err)
+				return
+			}
+
+			if leader != nil {
+				s.cluster.forward(leader, ctx.ResponseWriter, ctx.Request)
+				return
+			}
+		}
+
+		//Cross-Origin Resource Sharing (CORS)
+		if options.CrossOrigin {
+			ctx.SetHeader("Content-Type", "application/json")
+			ctx.SetHeader("Access-Control-Allow-Origin", "*")
+			ctx.SetHeader("Access-Control-Allow-Methods", "GET, POST, DELETE, OPTIONS")
+			ctx.SetHeader("Access-Control-Allow-Headers", "Content-Type, Authorization")
+			if ctx.Method() == "OPTIONS" {
+				ctx.Status(200)
+				return
+			}
+		}
+
+		//Simple Authentication
+		if options.Secret != "" {
+			var token = ctx.Query("secret")
+			if token == "" {
+				token = ctx.Query("api_key")
+				if token == "" {
+					token = ctx.Query("key")
+					if token == "" {
+						token = ctx.Query("access_token")
+						if token == "" {
+							token = ctx.Header("Authorization")
+						}
+					}
+				}
+			}
+
+			if len(token) == 0 || token != options.Secret {
+				reject(http.StatusUnauthorized, routes.CodeUnauthorized, errUnauthorized)
+				return
+			}
+		}
+
+		//Custom Authentication
+		if options.Auth != nil {
+			success := options.Auth(ctx)
+			if !success {
+				reject(http.StatusUnauthorized, routes.CodeUnauthorized, errUnauthorized)
+				return
+			}
+		}
+
+		if s.apps.follower.Load() && !followerallows(ctx.Method(), ctx.Request.URL.Path) {
+			reject(http.StatusServiceUnavailable, routes.CodeReadOnly, errReadOnly)
+			return
+		}
+
+		ctx.State = time.Now()
+		//Call the handler
+		fn(ctx)
+	}
+}
+
+// listen opens the ports of the TCP protocols, they are served once the server runs
+func (s *Server) listen() error {
+	var err error
+	if s.options.RESPAddr != "" {
+		if s.resp, err = listentcp("RESP", s.options.RESPAddr, s.serveresp); err != nil {
+			return err
+		}
+	}
+
+	if s.options.FPAddr != "" {
+		if s.fp, err = listentcp("FP", s.options.FPAddr, s.servefp); err != nil {
+			if s.resp != nil {
+				s.resp.ln.Close()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// Handler returns the HTTP handler of the server, to mount in another mux or an httptest.Server
+func (s *Server) Handler() http.Handler {
+	return s.http.Handler
+}
+
+// Start listens on the configured port and serves requests. It returns nil once Shutdown stops it.
+func (s *Server) Start() error {
+	fmt.Println("Listening on", s.http.Addr)
+	err := s.http.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
+
+func (s *Server) run(loop func()) {
+	s.loops.Add(1)
+	go func() {
+		defer s.loops.Done()
+		loop()
+	}()
+}
+
+// Shutdown stops accepting requests, waits for the ones in flight until ctx is done,
+// stops the background schedulers and closes every app DB. Long polls return early.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.once.Do(func() { close(s.stop) })
+
+	s.apps.drain()
+
+	err := s.http.Shutdown(ctx)
+
+	if s.resp != nil {
+		s.resp.close()
+	}
+
+	if s.fp != nil {
+		s.fp.close()
+	}
+
+	stopped := make(chan struct{})
+	go func() {
+		s.loops.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+
+	// no change may reach the apps once they are closed
+	if s.cluster != nil {
+		if cerr := s.cluster.close(); err == nil {
+			err = cerr
+		}
+	}
+
+	if cerr := s.apps.closeall(); err == nil {
+		err = cerr
+	}
+	return err
 }
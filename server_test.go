@@ -0,0 +1,187 @@
+package solidq
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/sfi2k7/solidq/routes"
+)
+
+func TestNewServerKeepsOptions(t *testing.T) {
+	options := &SeverOptions{RootPath: t.TempDir()}
+	s, err := NewServer(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	if options.ShutdownTimeout != 0 {
+		t.Errorf("NewServer set ShutdownTimeout of the caller's options to %v", options.ShutdownTimeout)
+	}
+
+	if s.options == options {
+		t.Error("the server keeps the caller's options instead of a copy")
+	}
+}
+
+func TestSetConfigInvalid(t *testing.T) {
+	s, ts := testserver(t, &SeverOptions{RootPath: t.TempDir()})
+
+	set := func(query string) (int, response) {
+		t.Helper()
+		res, err := http.Post(ts.URL+"/solidq/config/orders:jobs?"+query, "", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer res.Body.Close()
+
+		var r response
+		if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+			t.Fatal(err)
+		}
+		return res.StatusCode, r
+	}
+
+	if status, r := set("maxinflight=3&lease=30&backoffbase=1.5s"); status != http.StatusOK || !r.Success {
+		t.Fatalf("valid config: %d %+v", status, r)
+	}
+
+	for _, query := range []string{"maxinflight=1O", "lease=30s", "backoffbase=soon", "backoffmax=-1s", "backoffmultiplier=x", "backoffjitter=half"} {
+		if status, r := set(query); status != http.StatusBadRequest || r.Code != routes.CodeInvalid {
+			t.Errorf("%s: %d %+v, want an invalid error", query, status, r)
+		}
+	}
+
+	a, err := s.apps.ensure("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cc, err := a.ChannelConfig("jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cc.MaxInFlight != 3 || cc.Lease != 30 || cc.Backoff.Base != routes.Duration(1500*time.Millisecond) {
+		t.Errorf("config after the rejected changes %+v", cc)
+	}
+}
+
+func TestNewServerDefaults(t *testing.T) {
+	s, err := NewServer(&SeverOptions{RootPath: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	if s.options.ShutdownTimeout <= 0 || s.options.Storage != StorageBolt {
+		t.Errorf("defaults not filled in: %+v", s.options)
+	}
+
+	for _, options := range []*SeverOptions{
+		{RootPath: t.TempDir(), Durability: "sometimes"},
+		{RootPath: t.TempDir(), Storage: "tape"},
+		{RootPath: t.TempDir(), Storage: StorageMemory, Replicate: true},
+		{RootPath: t.TempDir(), ClusterID: "a", Follow: "http://primary"},
+	} {
+		if s, err := NewServer(options); err == nil {
+			s.Shutdown(context.Background())
+			t.Errorf("options %+v were accepted", options)
+		}
+	}
+}
+
+// freeport returns a port nothing listens on right now
+func freeport(t *testing.T) int {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestShutdownOrder(t *testing.T) {
+	port := freeport(t)
+	s, err := NewServer(&SeverOptions{RootPath: t.TempDir(), Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan error, 1)
+	go func() { started <- s.Start() }()
+
+	base := "http://127.0.0.1:" + strconv.Itoa(port)
+	eventually(t, "the server to listen", func() bool {
+		res, err := http.Get(base + "/solidq/listapps/false")
+		if err == nil {
+			res.Body.Close()
+		}
+		return err == nil
+	})
+
+	a, err := s.apps.ensure("orders")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	polled := make(chan response, 1)
+	go func() {
+		var r response
+		res, err := http.Get(base + "/solidq/pop/orders:jobs/1?wait=30s")
+		if err == nil {
+			json.NewDecoder(res.Body).Decode(&r)
+			res.Body.Close()
+		} else {
+			r.Error = err.Error()
+		}
+		polled <- r
+	}()
+
+	// let the long poll start waiting
+	time.Sleep(200 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	if err := s.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if took := time.Since(start); took > 5*time.Second {
+		t.Errorf("shutdown took %v", took)
+	}
+
+	if err := <-started; err != nil {
+		t.Errorf("Start returned %v after a shutdown", err)
+	}
+
+	// the poll is drained before the apps are closed, it ends as an empty pop, not an error
+	select {
+	case r := <-polled:
+		if !r.Success || len(r.Ids) != 0 {
+			t.Errorf("long poll ended with %+v", r)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the long poll did not return on shutdown")
+	}
+
+	if a.meta().isopen() {
+		t.Error("app still open after the shutdown")
+	}
+
+	if apps, _ := s.apps.list(false); len(apps) != 0 {
+		t.Errorf("apps %v still registered", apps)
+	}
+
+	if err := a.Push("jobs", "late"); err == nil {
+		t.Error("push to a closed app was accepted")
+	}
+}
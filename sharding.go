@@ -0,0 +1,852 @@
+package solidq
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.etcd.io/bbolt"
+)
+
+// how a sharded app spreads its items over its files
+const (
+	ShardByChannel = "channel" // every channel lives in one file, chosen by hashing its name
+	ShardByID      = "id"      // items of a channel are spread over every file by hashing their ID
+)
+
+const maxShards = 64
+
+// App is an app of a registry, stored in one bbolt file or sharded over several so busy
+// channels don't wait on one writer lock. The first file holds the layout, the recurring jobs,
+// pause states and declared channels. The others are named after it with a .1, .2... suffix.
+//
+// An app of another storage backend has no files, store holds its channels instead and the
+// features beyond plain channels return errNotStored.
+type App struct {
+	shards []*Que
+	by     string
+	next   atomic.Uint64 // where pops of an ID sharded channel start, so shards drain evenly
+	capped sync.Mutex    // serializes pops of capped channels sharded by ID, their cap spans every shard
+	store  *storedapp
+}
+
+func shardpath(path string, i int) string {
+	if i == 0 {
+		return path
+	}
+	return path + "." + strconv.Itoa(i)
+}
+
+// OpenApp opens an app DB on its own, outside of a server. shards and by set the layout of a new
+// app; an existing app keeps the layout it was created with and 0 accepts it.
+func OpenApp(path string, shards int, by string) (*App, error) {
+	return openapp(path, nil, shards, by)
+}
+
+func openapp(path string, apps *registry, shards int, by string) (*App, error) {
+	if shards < 0 || shards > maxShards {
+		return nil, invalidf("shards must be between 1 and %d", maxShards)
+	}
+
+	if by == "" {
+		by = ShardByChannel
+	}
+
+	if by != ShardByChannel && by != ShardByID {
+		return nil, invalidf("shard by must be channel or id")
+	}
+
+	first := &Que{path: path, apps: apps}
+	if err := first.openlocked(); err != nil {
+		return nil, err
+	}
+
+	n, storedby, err := first.layout(shards, by)
+	if err != nil {
+		first.Close()
+		return nil, err
+	}
+
+	a := &App{shards: []*Que{first}, by: storedby}
+	for i := 1; i < n; i++ {
+		q := &Que{path: shardpath(path, i), apps: apps}
+		if err := q.openlocked(); err != nil {
+			a.Close()
+			return nil, err
+		}
+		a.shards = append(a.shards, q)
+	}
+
+	now := time.Now().UnixNano()
+	for _, q := range a.shards {
+		q.lastused.Store(now)
+	}
+	return a, nil
+}
+
+// layout reads the shard layout of the app, writing the requested one if the app has none yet
+func (q *Que) layout(shards int, by string) (int, string, error) {
+	n, storedby := 0, ""
+	err := q.db.Update(func(tx *bbolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(settingsbucket))
+		if err != nil {
+			return err
+		}
+
+		n, _ = strconv.Atoi(string(b.Get([]byte("shards"))))
+		storedby = string(b.Get([]byte("shardby")))
+		if n > 0 {
+			return nil
+		}
+
+		n, storedby = 1, ShardByChannel
+		if shards > 1 {
+			n, storedby = shards, by
+		}
+
+		if err := b.Put([]byte("shards"), []byte(strconv.Itoa(n))); err != nil {
+			return err
+		}
+		return b.Put([]byte("shardby"), []byte(storedby))
+	})
+	if err != nil {
+		return 0, "", err
+	}
+
+	if shards > 0 && (shards != n || (n > 1 && by != storedby)) {
+		return 0, "", fmt.Errorf("app is sharded %d ways by %s, the layout can't be changed", n, storedby)
+	}
+	return n, storedby, nil
+}
+
+func (a *App) Shards() int {
+	if a.store != nil {
+		return 1
+	}
+	return len(a.shards)
+}
+
+func (a *App) ShardBy() string {
+	return a.by
+}
+
+// hash picks one of n shards for s
+func hash(s string, n int) int {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return int(h.Sum32() % uint32(n))
+}
+
+// owner returns the shard holding a channel, nil when its items are spread over every shard
+func (a *App) owner(channel string) *Que {
+	if len(a.shards) == 1 {
+		return a.shards[0]
+	}
+
+	if a.by == ShardByID {
+		return nil
+	}
+	return a.shards[hash(channel, len(a.shards))]
+}
+
+// item returns the shard holding one item of a channel
+func (a *App) item(channel, id string) *Que {
+	if q := a.owner(channel); q != nil {
+		return q
+	}
+	return a.shards[hash(id, len(a.shards))]
+}
+
+// holders returns every shard that may hold items of a channel
+func (a *App) holders(channel string) []*Que {
+	if q := a.owner(channel); q != nil {
+		return []*Que{q}
+	}
+	return a.shards
+}
+
+// meta returns the shard holding app wide state
+func (a *App) meta() *Que {
+	return a.shards[0]
+}
+
+// also returns the holders of a channel with the first shard added, for state that the first
+// shard has to know about too
+func (a *App) also(channel string) []*Que {
+	holders := a.holders(channel)
+	if holders[0] == a.meta() {
+		return holders
+	}
+	return append([]*Que{a.meta()}, holders...)
+}
+
+func (a *App) Close() error {
+	if a.store != nil {
+		return a.store.Close()
+	}
+
+	var first error
+	for _, q := range a.shards {
+		if err := q.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (a *App) Push(channel, id string) error {
+	if a.store != nil {
+		return a.store.Push(channel, id)
+	}
+	return a.pushat(stamp{}, channel, id)
+}
+
+func (a *App) pushat(st stamp, channel, id string) error {
+	return a.item(channel, id).pushat(st, channel, id)
+}
+
+// PopWait pops from the shard holding the channel. Items spread by ID are popped from every
+// shard in turn, starting at a different one on each call.
+func (a *App) PopWait(channel string, count int, wait time.Duration) ([]string, bool, error) {
+	if a.store != nil {
+		return a.store.PopWait(channel, count, wait)
+	}
+
+	if q := a.owner(channel); q != nil {
+		return q.PopWait(channel, count, wait)
+	}
+
+	deadline := time.Now().Add(wait)
+	for {
+		changed := make([]<-chan struct{}, len(a.shards))
+		for i, q := range a.shards {
+			changed[i] = q.waiter()
+		}
+
+		ids, mustack, err := a.popat(stamp{}, channel, count)
+		if err != nil || len(ids) > 0 {
+			return ids, mustack, err
+		}
+
+		left := time.Until(deadline)
+		if left <= 0 || a.meta().draining.Load() {
+			return nil, false, nil
+		}
+
+		if left > time.Second {
+			left = time.Second
+		}
+		anychange(changed, left)
+	}
+}
+
+// popat pops once without waiting. Entries from the Raft log start at a shard picked by their
+// index, so every node pops from the same shards. A MaxInFlight cap of a channel sharded by ID
+// counts the items in flight on every shard.
+func (a *App) popat(st stamp, channel string, count int) ([]string, bool, error) {
+	if q := a.owner(channel); q != nil {
+		return q.popat(st, channel, count)
+	}
+
+	var ids []string
+	var mustack bool
+
+	cc, err := a.ChannelConfig(channel)
+	if err != nil {
+		return nil, false, err
+	}
+
+	if cc.MaxInFlight > 0 {
+		a.capped.Lock()
+		defer a.capped.Unlock()
+
+		inflight := 0
+		for _, q := range a.shards {
+			n, err := q.leased(channel, cc.lease(), st.time())
+			if err != nil {
+				return nil, false, err
+			}
+			inflight += n
+		}
+
+		if inflight >= cc.MaxInFlight {
+			return nil, false, nil
+		}
+
+		if count > cc.MaxInFlight-inflight {
+			count = cc.MaxInFlight - inflight
+		}
+	}
+
+	start := int(st.index % uint64(len(a.shards)))
+	if st.index == 0 {
+		start = int(a.next.Add(1))
+	}
+
+	for i := range a.shards {
+		if len(ids) >= count {
+			break
+		}
+
+		q := a.shards[(start+i)%len(a.shards)]
+		got, ack, err := q.popat(st, channel, count-len(ids))
+		if err != nil {
+			return ids, mustack, err
+		}
+
+		ids = append(ids, got...)
+		mustack = mustack || ack
+	}
+	return ids, mustack, nil
+}
+
+// anychange waits until one of the channels is closed or timeout passes
+func anychange(changed []<-chan struct{}, timeout time.Duration) {
+	done := make(chan struct{})
+	defer close(done)
+
+	woke := make(chan struct{}, len(changed))
+	for _, c := range changed {
+		go func(c <-chan struct{}) {
+			select {
+			case <-c:
+				woke <- struct{}{}
+			case <-done:
+			}
+		}(c)
+	}
+
+	select {
+	case <-woke:
+	case <-time.After(timeout):
+	}
+}
+
+// Ack of a stored app has nothing to release, its pops are not tracked
+func (a *App) Ack(channel, id string) error {
+	if a.store != nil {
+		return nil
+	}
+	return a.ackat(stamp{}, channel, id)
+}
+
+func (a *App) ackat(st stamp, channel, id string) error {
+	return a.item(channel, id).ackat(st, channel, id)
+}
+
+func (a *App) Nack(channel, id string, delay time.Duration) error {
+	if a.store != nil {
+		return errNotStored
+	}
+	return a.nackat(stamp{}, channel, id, delay)
+}
+
+func (a *App) nackat(st stamp, channel, id string, delay time.Duration) error {
+	return a.item(channel, id).nackat(st, channel, id, delay)
+}
+
+func (a *App) Count(channel string) (int, error) {
+	if a.store != nil {
+		return a.store.Count(channel)
+	}
+
+	total := 0
+	for _, q := range a.holders(channel) {
+		n, err := q.Count(channel)
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// Peek returns up to count IDs without removing them. Across ID shards they are merged in key order,
+// which is not necessarily the order pops would return them in.
+func (a *App) Peek(channel string, count int) ([]string, error) {
+	if a.store != nil {
+		return a.store.Peek(channel, count)
+	}
+
+	var ids []string
+	for _, q := range a.holders(channel) {
+		more, err := q.Peek(channel, count)
+		if err != nil {
+			return ids, err
+		}
+		ids = append(ids, more...)
+	}
+
+	sort.Strings(ids)
+	if len(ids) > count {
+		ids = ids[:count]
+	}
+	return ids, nil
+}
+
+func (a *App) InFlight(channel string) (int, error) {
+	if a.store != nil {
+		return 0, nil
+	}
+
+	total := 0
+	for _, q := range a.holders(channel) {
+		n, err := q.InFlight(channel)
+		if err != nil {
+			return total, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+func (a *App) ListChannelsWithCount() (map[string]int, error) {
+	if a.store != nil {
+		return a.store.ListChannelsWithCount()
+	}
+
+	channels := make(map[string]int)
+	for _, q := range a.shards {
+		counts, err := q.ListChannelsWithCount()
+		if err != nil {
+			return nil, err
+		}
+
+		for channel, n := range counts {
+			channels[channel] += n
+		}
+	}
+	return channels, nil
+}
+
+func (a *App) ResetChannel(channel string) error {
+	if a.store != nil {
+		return a.store.ResetChannel(channel)
+	}
+	return a.resetat(stamp{}, channel)
+}
+
+func (a *App) resetat(st stamp, channel string) error {
+	for _, q := range a.holders(channel) {
+		if err := q.resetat(st, channel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CreateChannel declares the channel on its shards and on the first one, where recurring jobs check it
+func (a *App) CreateChannel(channel string) error {
+	if a.store != nil {
+		return validchannel(channel)
+	}
+	return a.createchannelat(stamp{}, channel)
+}
+
+func (a *App) createchannelat(st stamp, channel string) error {
+	for _, q := range a.also(channel) {
+		if err := q.createchannelat(st, channel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *App) ChannelConfig(channel string) (ChannelConfig, error) {
+	if a.store != nil {
+		return ChannelConfig{}, nil
+	}
+	return a.holders(channel)[0].ChannelConfig(channel)
+}
+
+// SetChannelConfig applies the config on every shard of the channel. A MaxInFlight cap of a
+// channel sharded by ID holds for all of its shards together.
+func (a *App) SetChannelConfig(channel string, cc ChannelConfig) error {
+	if a.store != nil {
+		return errNotStored
+	}
+
+	return a.setconfigat(stamp{}, channel, cc)
+}
+
+func (a *App) setconfigat(st stamp, channel string, cc ChannelConfig) error {
+	for _, q := range a.holders(channel) {
+		if err := q.setconfigat(st, channel, cc); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Pause keeps the pause on the first shard too, so recurring jobs see it
+func (a *App) Pause(channel, mode string) error {
+	if a.store != nil {
+		return errNotStored
+	}
+
+	return a.pauseat(stamp{}, channel, mode)
+}
+
+func (a *App) pauseat(st stamp, channel, mode string) error {
+	targets := a.shards
+	if channel != "" {
+		targets = a.also(channel)
+	}
+
+	for _, q := range targets {
+		if err := q.pauseat(st, channel, mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *App) Resume(channel string) error {
+	if a.store != nil {
+		return errNotStored
+	}
+
+	return a.resumeat(stamp{}, channel)
+}
+
+func (a *App) resumeat(st stamp, channel string) error {
+	targets := a.shards
+	if channel != "" {
+		targets = a.also(channel)
+	}
+
+	for _, q := range targets {
+		if err := q.resumeat(st, channel); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *App) PauseStates() (map[string]string, error) {
+	if a.store != nil {
+		return map[string]string{}, nil
+	}
+
+	return a.meta().PauseStates()
+}
+
+func (a *App) SetRecurring(job RecurringJob) (RecurringJob, error) {
+	if a.store != nil {
+		return job, errNotStored
+	}
+
+	return a.setrecurringat(stamp{}, job)
+}
+
+func (a *App) setrecurringat(st stamp, job RecurringJob) (RecurringJob, error) {
+	return a.meta().setrecurringat(st, job)
+}
+
+func (a *App) GetRecurring(name string) (*RecurringJob, error) {
+	if a.store != nil {
+		return nil, errNotStored
+	}
+
+	return a.meta().GetRecurring(name)
+}
+
+func (a *App) ListRecurring() ([]RecurringJob, error) {
+	if a.store != nil {
+		return []RecurringJob{}, nil
+	}
+
+	return a.meta().ListRecurring()
+}
+
+func (a *App) DeleteRecurring(name string) error {
+	if a.store != nil {
+		return errNotStored
+	}
+
+	return a.deleterecurringat(stamp{}, name)
+}
+
+func (a *App) deleterecurringat(st stamp, name string) error {
+	return a.meta().deleterecurringat(st, name)
+}
+
+// FireRecurring fires the jobs stored on the first shard. On a sharded app the runs of other
+// shards are pushed once the jobs are saved, a crash in between loses those runs.
+func (a *App) FireRecurring(now time.Time) (int, error) {
+	if a.store != nil {
+		return 0, nil
+	}
+
+	return a.firerecurringat(stamp{now: now})
+}
+
+func (a *App) firerecurringat(st stamp) (int, error) {
+	if len(a.shards) == 1 {
+		return a.meta().firerecurring(st, nil)
+	}
+
+	// runs of the first shard go in its own transaction, a log entry applies once per file
+	runs := make(map[*Que][]recurringrun)
+	fired, err := a.meta().firerecurring(st, func(tx *bbolt.Tx, r recurringrun) error {
+		q := a.item(r.channel, r.id)
+		if q == a.meta() {
+			return putitem(tx, r.channel, r.id, r.payload)
+		}
+		runs[q] = append(runs[q], r)
+		return nil
+	})
+	if err != nil {
+		return fired, err
+	}
+
+	for q, batch := range runs {
+		err := q.writeat(st, func(tx *bbolt.Tx) error {
+			for _, r := range batch {
+				if err := putitem(tx, r.channel, r.id, r.payload); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fired, err
+		}
+		q.wake()
+	}
+	return fired, nil
+}
+
+func (a *App) Export(channel string, w io.Writer) (int, error) {
+	if a.store != nil {
+		return 0, errNotStored
+	}
+
+	total := 0
+	for _, q := range a.holders(channel) {
+		n, err := q.Export(channel, w)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// Import routes every item to its shard, committing every importBatch items per shard
+func (a *App) Import(channel string, r io.Reader, duplicates string) (int, int, error) {
+	if a.store != nil {
+		return 0, 0, errNotStored
+	}
+
+	if q := a.owner(channel); q != nil {
+		return q.Import(channel, r, duplicates)
+	}
+
+	if err := validduplicates(duplicates); err != nil {
+		return 0, 0, err
+	}
+
+	imported, skipped := 0, 0
+	batches := make([][]ExportItem, len(a.shards))
+	flush := func(i int) error {
+		n, s, err := a.shards[i].importbatch(channel, batches[i], duplicates)
+		imported += n
+		skipped += s
+		batches[i] = batches[i][:0]
+		return err
+	}
+
+	err := readitems(r, func(item ExportItem) error {
+		i := hash(item.ID, len(a.shards))
+		batches[i] = append(batches[i], item)
+		if len(batches[i]) < importBatch {
+			return nil
+		}
+		return flush(i)
+	})
+	if err != nil {
+		return imported, skipped, err
+	}
+
+	for i := range batches {
+		if err := flush(i); err != nil {
+			return imported, skipped, err
+		}
+	}
+	return imported, skipped, nil
+}
+
+// importat writes one batch of an import applied from the Raft log, split by shard
+func (a *App) importat(st stamp, channel string, items []ExportItem, duplicates string) (int, int, error) {
+	if err := validduplicates(duplicates); err != nil {
+		return 0, 0, err
+	}
+
+	batches := make(map[*Que][]ExportItem)
+	for _, item := range items {
+		q := a.item(channel, item.ID)
+		batches[q] = append(batches[q], item)
+	}
+
+	imported, skipped := 0, 0
+	for _, q := range a.shards {
+		n, s, err := q.importbatchat(st, channel, batches[q], duplicates)
+		imported += n
+		skipped += s
+		if err != nil {
+			return imported, skipped, err
+		}
+	}
+	return imported, skipped, nil
+}
+
+func (a *App) Durability() (string, error) {
+	if a.store != nil {
+		return "", errNotStored
+	}
+
+	return a.meta().Durability()
+}
+
+func (a *App) SetDurability(mode string) error {
+	if a.store != nil {
+		return errNotStored
+	}
+
+	for _, q := range a.shards {
+		if err := q.SetDurability(mode); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (a *App) RepairDepths() (map[string]int, error) {
+	if a.store != nil {
+		return nil, errNotStored
+	}
+
+	fixed := make(map[string]int)
+	for _, q := range a.shards {
+		f, err := q.RepairDepths()
+		if err != nil {
+			return fixed, err
+		}
+
+		for channel, n := range f {
+			fixed[channel] += n
+		}
+	}
+	return fixed, nil
+}
+
+// Compact compacts every shard and returns the total sizes
+func (a *App) Compact() (int64, int64, error) {
+	if a.store != nil {
+		return 0, 0, errNotStored
+	}
+
+	var before, after int64
+	for _, q := range a.shards {
+		b, f, err := q.Compact()
+		before += b
+		after += f
+		if err != nil {
+			return before, after, err
+		}
+	}
+	return before, after, nil
+}
+
+// Backup streams the file of the app, or a tar of the files of all its shards when it has more
+// than one
+func (a *App) Backup(w io.Writer) (int64, error) {
+	if a.store != nil {
+		return 0, errNotStored
+	}
+
+	if len(a.shards) > 1 {
+		return a.backupshards(w)
+	}
+	return a.meta().Backup(w)
+}
+
+// Restore takes what Backup streams, a sharded app also takes a full backup holding it
+func (a *App) Restore(r io.Reader) error {
+	if a.store != nil {
+		return errNotStored
+	}
+
+	if len(a.shards) > 1 {
+		return a.restoreshards(r)
+	}
+	return a.meta().Restore(r)
+}
+
+// scored returns the shard of a scored channel, which is not spread over shards by ID
+func (a *App) scored(channel string) *Que {
+	return a.holders(channel)[0]
+}
+
+func (a *App) ZAdd(channel string, items ...ScoredItem) (int, error) {
+	if a.store != nil {
+		return 0, errNotStored
+	}
+
+	return a.scored(channel).ZAdd(channel, items...)
+}
+
+func (a *App) ZPopMax(channel string, count int) ([]ScoredItem, error) {
+	if a.store != nil {
+		return nil, errNotStored
+	}
+
+	return a.scored(channel).ZPopMax(channel, count)
+}
+
+func (a *App) ZCard(channel string) (int, error) {
+	if a.store != nil {
+		return 0, errNotStored
+	}
+
+	return a.scored(channel).ZCard(channel)
+}
+
+func (a *App) DeleteScored(channel string) (bool, error) {
+	if a.store != nil {
+		return false, errNotStored
+	}
+
+	return a.scored(channel).DeleteScored(channel)
+}
+
+// values are kept on the first shard
+func (a *App) SetValue(key string, value []byte) error {
+	if a.store != nil {
+		return errNotStored
+	}
+
+	return a.meta().SetValue(key, value)
+}
+
+func (a *App) Value(key string) ([]byte, error) {
+	if a.store != nil {
+		return nil, errNotStored
+	}
+
+	return a.meta().Value(key)
+}
+
+func (a *App) DeleteValue(key string) (bool, error) {
+	if a.store != nil {
+		return false, errNotStored
+	}
+
+	return a.meta().DeleteValue(key)
+}
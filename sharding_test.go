@@ -0,0 +1,67 @@
+package solidq
+
+import (
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestShardedCap(t *testing.T) {
+	a, err := OpenApp(filepath.Join(t.TempDir(), "sharded.db"), 4, ShardByID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+
+	if err := a.SetChannelConfig("jobs", ChannelConfig{MaxInFlight: 3}); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 20; i++ {
+		if err := a.Push("jobs", strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ids, _, err := a.PopWait("jobs", 10, 0)
+	if err != nil || len(ids) != 3 {
+		t.Fatalf("popped %v %v, want 3 items under a cap of 3 over 4 shards", ids, err)
+	}
+
+	if more, _, err := a.PopWait("jobs", 10, 0); err != nil || len(more) != 0 {
+		t.Fatalf("popped %v %v past the cap", more, err)
+	}
+
+	if err := a.Ack("jobs", ids[0]); err != nil {
+		t.Fatal(err)
+	}
+
+	if more, _, err := a.PopWait("jobs", 10, 0); err != nil || len(more) != 1 {
+		t.Fatalf("popped %v %v after one ack, want 1", more, err)
+	}
+
+	if n, err := a.InFlight("jobs"); err != nil || n != 3 {
+		t.Errorf("%d %v in flight, want 3", n, err)
+	}
+}
+
+func TestHashInRange(t *testing.T) {
+	for i := 0; i < 1000; i++ {
+		for _, n := range []int{1, 3, 64} {
+			if h := hash("item-"+strconv.Itoa(i), n); h < 0 || h >= n {
+				t.Fatalf("hash of item-%d over %d shards is %d", i, n, h)
+			}
+		}
+	}
+}
+
+// BenchmarkShardedPush measures concurrent pushes to an app sharded by channel and by ID
+func BenchmarkShardedPush(b *testing.B) {
+	for _, by := range []string{ShardByChannel, ShardByID} {
+		for _, mode := range []string{DurabilityAlways, DurabilityBatched} {
+			b.Run(by+"/"+mode, func(b *testing.B) {
+				benchpush(b, mode, 4, by)
+			})
+		}
+	}
+}
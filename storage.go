@@ -0,0 +1,208 @@
+package solidq
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Storage backends a server keeps its apps in
+const (
+	StorageBolt   = "bolt"   // one bbolt file per app, or per shard, with every feature
+	StorageMemory = "memory" // a MemoryQue per app, lost on shutdown, with plain channels only
+)
+
+func validstorage(backend string) error {
+	if backend != StorageBolt && backend != StorageMemory {
+		return invalidf("storage must be bolt or memory")
+	}
+	return nil
+}
+
+// errNotStored is returned by features only the bbolt backend has
+var errNotStored = errors.New("not supported by the storage backend of this server")
+
+// Storage is the set of queue operations a backend provides. *Que is the bbolt backend and the
+// default; MemoryQue keeps everything in memory for tests and ephemeral queues. A new backend
+// should pass storagetest.TestStorage.
+//
+// IDs are unique per channel and popped in ascending byte order.
+type Storage interface {
+	Push(channel, id string) error
+	PopWithCount(channel string, count int) ([]string, error)
+	Peek(channel string, count int) ([]string, error)
+	Count(channel string) (int, error)
+	ListChannelsWithCount() (map[string]int, error)
+	ResetChannel(channel string) error
+	Close() error
+}
+
+var (
+	_ Storage = (*Que)(nil)
+	_ Storage = (*MemoryQue)(nil)
+)
+
+// MemoryQue is a Storage that lives in memory and is lost on Close
+type MemoryQue struct {
+	mu       sync.Mutex
+	channels map[string][]string // sorted IDs per channel
+	closed   bool
+}
+
+func NewMemoryQue() *MemoryQue {
+	return &MemoryQue{channels: make(map[string][]string)}
+}
+
+func (m *MemoryQue) Push(channel, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return errNotOpen
+	}
+
+	ids := m.channels[channel]
+	i := sort.SearchStrings(ids, id)
+	if i < len(ids) && ids[i] == id {
+		return nil
+	}
+
+	ids = append(ids, "")
+	copy(ids[i+1:], ids[i:])
+	ids[i] = id
+	m.channels[channel] = ids
+	return nil
+}
+
+func (m *MemoryQue) PopWithCount(channel string, count int) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, errNotOpen
+	}
+
+	ids, ok := m.channels[channel]
+	if !ok || len(ids) == 0 || count <= 0 {
+		return nil, nil
+	}
+
+	if count > len(ids) {
+		count = len(ids)
+	}
+
+	popped := append([]string(nil), ids[:count]...)
+	m.channels[channel] = append(ids[:0], ids[count:]...)
+	return popped, nil
+}
+
+func (m *MemoryQue) Peek(channel string, count int) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, errNotOpen
+	}
+
+	ids := m.channels[channel]
+	if count > len(ids) {
+		count = len(ids)
+	}
+
+	if count <= 0 {
+		return nil, nil
+	}
+	return append([]string(nil), ids[:count]...), nil
+}
+
+func (m *MemoryQue) Count(channel string) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return 0, errNotOpen
+	}
+	return len(m.channels[channel]), nil
+}
+
+func (m *MemoryQue) ListChannelsWithCount() (map[string]int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return nil, errNotOpen
+	}
+
+	channels := make(map[string]int, len(m.channels))
+	for name, ids := range m.channels {
+		channels[name] = len(ids)
+	}
+	return channels, nil
+}
+
+func (m *MemoryQue) ResetChannel(channel string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.closed {
+		return errNotOpen
+	}
+
+	delete(m.channels, channel)
+	return nil
+}
+
+func (m *MemoryQue) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.closed = true
+	m.channels = nil
+	return nil
+}
+
+// storedapp is an app kept in a Storage other than bbolt files. Popped items are not tracked,
+// so they need no ack.
+type storedapp struct {
+	Storage
+	w        waiters
+	draining atomic.Bool
+}
+
+func (r *registry) openstored() (*App, error) {
+	return &App{store: &storedapp{Storage: NewMemoryQue()}}, nil
+}
+
+func (sa *storedapp) Push(channel, id string) error {
+	if id == "" {
+		return invalidf("work ID cannot be empty")
+	}
+
+	err := sa.Storage.Push(channel, id)
+	sa.w.wake()
+	return err
+}
+
+func (sa *storedapp) PopWait(channel string, count int, wait time.Duration) ([]string, bool, error) {
+	deadline := time.Now().Add(wait)
+	for {
+		changed := sa.w.changed()
+
+		ids, err := sa.PopWithCount(channel, count)
+		if err != nil || len(ids) > 0 {
+			return ids, false, err
+		}
+
+		left := time.Until(deadline)
+		if left <= 0 || sa.draining.Load() {
+			return nil, false, nil
+		}
+
+		select {
+		case <-changed:
+		case <-time.After(left):
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package solidq_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/sfi2k7/solidq"
+	"github.com/sfi2k7/solidq/client"
+	"github.com/sfi2k7/solidq/routes"
+	"github.com/sfi2k7/solidq/storagetest"
+)
+
+func TestBoltStorage(t *testing.T) {
+	dir := t.TempDir()
+	n := 0
+	storagetest.TestStorage(t, func() (solidq.Storage, error) {
+		n++
+		return solidq.OpenQue(filepath.Join(dir, strconv.Itoa(n)+".db"))
+	})
+}
+
+func TestMemoryStorage(t *testing.T) {
+	storagetest.TestStorage(t, func() (solidq.Storage, error) {
+		return solidq.NewMemoryQue(), nil
+	})
+}
+
+func TestMemoryServer(t *testing.T) {
+	s, err := solidq.NewServer(&solidq.SeverOptions{RootPath: t.TempDir(), Storage: solidq.StorageMemory})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Shutdown(context.Background())
+
+	ts := httptest.NewServer(s.Handler())
+	defer ts.Close()
+
+	c, err := client.NewClient(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := c.Push("orders:jobs", "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n, err := c.Count("orders:jobs"); err != nil || n != 1 {
+		t.Fatalf("count %d %v, want 1", n, err)
+	}
+
+	ids, err := c.Pop("orders:jobs", 5)
+	if err != nil || len(ids) != 1 || ids[0] != "a" {
+		t.Fatalf("pop %v %v, want [a]", ids, err)
+	}
+
+	var serr *client.ServerError
+	if err := c.Pause("orders", "jobs", false); !errors.As(err, &serr) || serr.Code != routes.CodeNotSupported || serr.Status != http.StatusNotImplemented {
+		t.Errorf("pause on the memory storage: %v, want a 501 not_supported", err)
+	}
+
+	if _, err := solidq.NewServer(&solidq.SeverOptions{RootPath: t.TempDir(), Storage: solidq.StorageMemory, Replicate: true}); err == nil {
+		t.Error("a memory server was allowed to replicate")
+	}
+}
@@ -0,0 +1,191 @@
+// Package storagetest checks that a solidq.Storage behaves like the bbolt backend.
+// Call TestStorage from a backend's tests, in the spirit of testing/fstest.
+package storagetest
+
+import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/sfi2k7/solidq"
+)
+
+// TestStorage runs every check as a subtest against a fresh store from open. Stores are closed
+// by TestStorage.
+func TestStorage(t *testing.T, open func() (solidq.Storage, error)) {
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s, err := open()
+			if err != nil {
+				t.Fatalf("opening storage: %v", err)
+			}
+
+			defer func() {
+				if err := s.Close(); err != nil {
+					t.Errorf("close: %v", err)
+				}
+			}()
+
+			if err := c.run(s); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+var cases = []struct {
+	name string
+	run  func(s solidq.Storage) error
+}{
+	{"PushPop", pushpop},
+	{"Order", order},
+	{"Duplicates", duplicates},
+	{"PopEmpty", popempty},
+	{"Peek", peek},
+	{"ListChannels", listchannels},
+	{"Reset", reset},
+}
+
+func push(s solidq.Storage, channel string, ids ...string) error {
+	for _, id := range ids {
+		if err := s.Push(channel, id); err != nil {
+			return fmt.Errorf("push %s: %w", id, err)
+		}
+	}
+	return nil
+}
+
+func expect(what string, got, want interface{}) error {
+	if !reflect.DeepEqual(got, want) {
+		return fmt.Errorf("%s: got %v, want %v", what, got, want)
+	}
+	return nil
+}
+
+func pushpop(s solidq.Storage) error {
+	if err := push(s, "jobs", "1", "2", "3"); err != nil {
+		return err
+	}
+
+	n, err := s.Count("jobs")
+	if err != nil {
+		return err
+	}
+	if err := expect("count", n, 3); err != nil {
+		return err
+	}
+
+	ids, err := s.PopWithCount("jobs", 2)
+	if err != nil {
+		return err
+	}
+	if err := expect("pop", ids, []string{"1", "2"}); err != nil {
+		return err
+	}
+
+	n, err = s.Count("jobs")
+	if err != nil {
+		return err
+	}
+	return expect("count after pop", n, 1)
+}
+
+func order(s solidq.Storage) error {
+	if err := push(s, "jobs", "b", "c", "a", "10", "09"); err != nil {
+		return err
+	}
+
+	ids, err := s.PopWithCount("jobs", 10)
+	if err != nil {
+		return err
+	}
+	return expect("pop order", ids, []string{"09", "10", "a", "b", "c"})
+}
+
+func duplicates(s solidq.Storage) error {
+	if err := push(s, "jobs", "1", "1", "2"); err != nil {
+		return err
+	}
+
+	n, err := s.Count("jobs")
+	if err != nil {
+		return err
+	}
+	return expect("count", n, 2)
+}
+
+func popempty(s solidq.Storage) error {
+	ids, err := s.PopWithCount("missing", 5)
+	if err != nil {
+		return err
+	}
+	if len(ids) != 0 {
+		return fmt.Errorf("pop of a missing channel returned %v", ids)
+	}
+
+	n, err := s.Count("missing")
+	if err != nil {
+		return err
+	}
+	return expect("count of a missing channel", n, 0)
+}
+
+func peek(s solidq.Storage) error {
+	for i := 0; i < 5; i++ {
+		if err := push(s, "jobs", strconv.Itoa(i)); err != nil {
+			return err
+		}
+	}
+
+	ids, err := s.Peek("jobs", 3)
+	if err != nil {
+		return err
+	}
+	if err := expect("peek", ids, []string{"0", "1", "2"}); err != nil {
+		return err
+	}
+
+	n, err := s.Count("jobs")
+	if err != nil {
+		return err
+	}
+	return expect("count after peek", n, 5)
+}
+
+func listchannels(s solidq.Storage) error {
+	if err := push(s, "a", "1", "2"); err != nil {
+		return err
+	}
+	if err := push(s, "b", "1"); err != nil {
+		return err
+	}
+
+	channels, err := s.ListChannelsWithCount()
+	if err != nil {
+		return err
+	}
+	return expect("channels", channels, map[string]int{"a": 2, "b": 1})
+}
+
+func reset(s solidq.Storage) error {
+	if err := push(s, "a", "1", "2"); err != nil {
+		return err
+	}
+	if err := push(s, "b", "1"); err != nil {
+		return err
+	}
+
+	if err := s.ResetChannel("a"); err != nil {
+		return err
+	}
+	if err := s.ResetChannel("never-pushed"); err != nil {
+		return fmt.Errorf("reset of a missing channel: %w", err)
+	}
+
+	channels, err := s.ListChannelsWithCount()
+	if err != nil {
+		return err
+	}
+	return expect("channels after reset", channels, map[string]int{"b": 1})
+}
@@ -0,0 +1,75 @@
+package solidq
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// tcpserver accepts connections for one of the TCP protocols and serves each on its own goroutine
+type tcpserver struct {
+	name   string
+	ln     net.Listener
+	handle func(conn net.Conn)
+	wg     sync.WaitGroup
+
+	mu     sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+}
+
+func listentcp(name, addr string, handle func(conn net.Conn)) (*tcpserver, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return &tcpserver{name: name, ln: ln, handle: handle, conns: make(map[net.Conn]struct{})}, nil
+}
+
+// serve accepts connections until close is called
+func (t *tcpserver) serve() {
+	fmt.Println(t.name, "listening on", t.ln.Addr())
+	for {
+		conn, err := t.ln.Accept()
+		if err != nil {
+			var ne net.Error
+			if errors.As(err, &ne) && ne.Timeout() {
+				continue
+			}
+			return
+		}
+
+		t.mu.Lock()
+		if t.closed {
+			t.mu.Unlock()
+			conn.Close()
+			return
+		}
+		t.conns[conn] = struct{}{}
+		t.wg.Add(1)
+		t.mu.Unlock()
+
+		go func() {
+			defer t.wg.Done()
+			t.handle(conn)
+
+			t.mu.Lock()
+			delete(t.conns, conn)
+			t.mu.Unlock()
+		}()
+	}
+}
+
+// close stops accepting, drops every connection and waits for the commands running on them
+func (t *tcpserver) close() {
+	t.mu.Lock()
+	t.closed = true
+	t.ln.Close()
+	for conn := range t.conns {
+		conn.Close()
+	}
+	t.mu.Unlock()
+
+	t.wg.Wait()
+}
@@ -0,0 +1,357 @@
+package solidq
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/sfi2k7/blueweb"
+	"github.com/sfi2k7/solidq/routes"
+)
+
+// The v2 API takes app, channel and ID as separate fields, from a JSON body or the query string,
+// so an ID may hold any character. A failure comes with its HTTP status and one of the codes
+// of the routes package, the /solidq routes keep answering 200 for backward compatibility.
+
+var (
+	errUnauthorized = errors.New("Unauthorized")
+	errReadOnly     = errors.New("this server is a follower, send writes to the primary")
+	errAtCapacity   = errors.New("channel is at its max in-flight, ack items to pop more")
+)
+
+// v2PeekDefault is how many IDs a peek returns without a count
+const v2PeekDefault = 100
+
+func readv2(ctx *blueweb.Context) (*routes.Request, error) {
+	r := &routes.Request{}
+	if err := r.FromQuery(ctx.Request.URL.Query()); err != nil {
+		return nil, invalidf("%v", err)
+	}
+
+	body, err := ctx.Body()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(bytes.TrimSpace(body)) > 0 {
+		if err := json.Unmarshal(body, r); err != nil {
+			return nil, invalidf("invalid JSON body: %v", err)
+		}
+	}
+
+	if r.App == "" {
+		r.App = "core"
+	}
+	return r, validapp(r.App)
+}
+
+// classify maps an error to its HTTP status and code
+func classify(err error) (int, string) {
+	var inv invalid
+	switch {
+	case errors.As(err, &inv):
+		return http.StatusBadRequest, routes.CodeInvalid
+	case errors.Is(err, errUnauthorized):
+		return http.StatusUnauthorized, routes.CodeUnauthorized
+	case errors.Is(err, ErrAppNotFound), errors.Is(err, ErrUnknownChannel), errors.Is(err, errAppDeleted):
+		return http.StatusNotFound, routes.CodeNotFound
+	case errors.Is(err, ErrAppExists), errors.Is(err, ErrNotInFlight):
+		return http.StatusConflict, routes.CodeConflict
+	case errors.Is(err, ErrNotClustered), errors.Is(err, errNotStored):
+		return http.StatusNotImplemented, routes.CodeNotSupported
+	case errors.Is(err, errAtCapacity):
+		return http.StatusTooManyRequests, routes.CodeAtCapacity
+	case errors.Is(err, ErrPaused):
+		return http.StatusServiceUnavailable, routes.CodePaused
+	case errors.Is(err, errReadOnly):
+		return http.StatusServiceUnavailable, routes.CodeReadOnly
+	case errors.Is(err, ErrNoLeader), errors.Is(err, errNotOpen), errors.Is(err, errAppReplaced):
+		return http.StatusServiceUnavailable, routes.CodeUnavailable
+	}
+	return http.StatusInternalServerError, routes.CodeInternal
+}
+
+func writev2(ctx *blueweb.Context, status int, res response) {
+	ctx.SetHeader("Content-Type", "application/json")
+	ctx.Status(status)
+	ctx.Json(res)
+}
+
+// v2 wraps a v2 handler, a nil error answers 200 with the response it returned
+func (s *Server) v2(fn func(r *routes.Request) (response, error)) blueweb.Handler {
+	return s.middleware(func(ctx *blueweb.Context) {
+		res := response{}
+		r, err := readv2(ctx)
+		if err == nil {
+			res, err = fn(r)
+		}
+
+		status := http.StatusOK
+		if err != nil {
+			status, res.Code = classify(err)
+			res.Error = err.Error()
+		}
+
+		res.Success = err == nil
+		res.Took = time.Since(ctx.State.(time.Time)).String()
+		writev2(ctx, status, res)
+	}, true)
+}
+
+// channelqueue validates the channel of a request and returns the queue of its app
+func (s *Server) channelqueue(r *routes.Request) (queue, error) {
+	if err := validchannel(r.Channel); err != nil {
+		return nil, err
+	}
+	return s.queue(r.App)
+}
+
+// routev2 registers the v2 API. paused is the server wide pause of /solidq/pause.
+func (s *Server) routev2(api *router, paused *atomic.Bool) {
+	// {app, channel, id} or {app, channel, ids: [...]}, count is how many were pushed
+	api.Handle(routes.V2Push, s.v2(func(r *routes.Request) (response, error) {
+		if paused.Load() {
+			return response{}, ErrPaused
+		}
+
+		q, err := s.channelqueue(r)
+		if err != nil {
+			return response{}, err
+		}
+
+		ids := r.IDs
+		if r.ID != "" {
+			ids = append([]string{r.ID}, ids...)
+		}
+
+		if len(ids) == 0 {
+			return response{}, invalidf("work ID cannot be empty")
+		}
+
+		for i, id := range ids {
+			if err := q.Push(r.Channel, id); err != nil {
+				return response{Count: i}, err
+			}
+		}
+		return response{Count: len(ids)}, nil
+	}))
+
+	// {app, channel, count, wait}, an empty channel answers 200 without IDs and a capped
+	// channel with every slot taken 429
+	api.Handle(routes.V2Pop, s.v2(func(r *routes.Request) (response, error) {
+		if paused.Load() {
+			return response{}, ErrPaused
+		}
+
+		if r.Count < 0 {
+			return response{}, invalidf("count cannot be negative")
+		}
+
+		count := r.Count
+		if count == 0 {
+			count = 1
+		}
+
+		wait := time.Duration(r.Wait)
+		if wait > maxPopWait {
+			wait = maxPopWait
+		}
+
+		q, err := s.channelqueue(r)
+		if err != nil {
+			return response{}, err
+		}
+
+		ids, mustack, err := q.PopWait(r.Channel, count, wait)
+		if err != nil || len(ids) > 0 {
+			return response{Ids: ids, Count: len(ids), MustAck: mustack}, err
+		}
+
+		full, err := s.full(r.App, r.Channel)
+		if err == nil && full {
+			err = errAtCapacity
+		}
+		return response{}, err
+	}))
+
+	api.Handle(routes.V2Ack, s.v2(func(r *routes.Request) (response, error) {
+		q, err := s.channelqueue(r)
+		if err != nil {
+			return response{}, err
+		}
+		return response{}, q.Ack(r.Channel, r.ID)
+	}))
+
+	// {app, channel, id, delay}, without a delay the channel's backoff decides
+	api.Handle(routes.V2Nack, s.v2(func(r *routes.Request) (response, error) {
+		q, err := s.channelqueue(r)
+		if err != nil {
+			return response{}, err
+		}
+		return response{}, q.Nack(r.Channel, r.ID, time.Duration(r.Delay))
+	}))
+
+	api.Handle(routes.V2Count, s.v2(func(r *routes.Request) (response, error) {
+		q, err := s.channelqueue(r)
+		if err != nil {
+			return response{}, err
+		}
+
+		count, err := q.Count(r.Channel)
+		return response{Count: count}, err
+	}))
+
+	api.Handle(routes.V2Peek, s.v2(func(r *routes.Request) (response, error) {
+		if r.Count < 0 {
+			return response{}, invalidf("count cannot be negative")
+		}
+
+		count := r.Count
+		if count == 0 {
+			count = v2PeekDefault
+		}
+
+		q, err := s.channelqueue(r)
+		if err != nil {
+			return response{}, err
+		}
+
+		ids, err := q.Peek(r.Channel, count)
+		return response{Ids: ids, Count: len(ids)}, err
+	}))
+
+	api.Handle(routes.V2Reset, s.v2(func(r *routes.Request) (response, error) {
+		if paused.Load() {
+			return response{}, ErrPaused
+		}
+
+		q, err := s.channelqueue(r)
+		if err != nil {
+			return response{}, err
+		}
+		return response{}, q.ResetChannel(r.Channel)
+	}))
+
+	api.Handle(routes.V2Config, s.v2(func(r *routes.Request) (response, error) {
+		if err := validchannel(r.Channel); err != nil {
+			return response{}, err
+		}
+
+		a, err := s.apps.ensure(r.App)
+		if err != nil {
+			return response{}, err
+		}
+
+		cc, err := a.ChannelConfig(r.Channel)
+		if err != nil {
+			return response{}, err
+		}
+
+		inflight, err := a.InFlight(r.Channel)
+		return response{Config: &cc, InFlight: inflight}, err
+	}))
+
+	// {app, channel, config}, only the fields of config that are sent change
+	api.Handle(routes.V2SetConfig, s.v2(func(r *routes.Request) (response, error) {
+		q, err := s.channelqueue(r)
+		if err != nil {
+			return response{}, err
+		}
+
+		cc, err := q.ChannelConfig(r.Channel)
+		if err != nil {
+			return response{}, err
+		}
+
+		if len(r.Config) > 0 {
+			if err := json.Unmarshal(r.Config, &cc); err != nil {
+				return response{}, invalidf("invalid config: %v", err)
+			}
+		}
+
+		if err := q.SetChannelConfig(r.Channel, cc); err != nil {
+			return response{}, err
+		}
+		return response{Config: &cc}, nil
+	}))
+
+	// ?physical=true lists every app file instead of the open apps
+	api.Handle(routes.V2Apps, s.v2(func(r *routes.Request) (response, error) {
+		apps, err := s.apps.list(r.Physical)
+		return response{Apps: apps}, err
+	}))
+
+	// {app, shards, shardby}, 409 when the app exists
+	api.Handle(routes.V2CreateApp, s.v2(func(r *routes.Request) (response, error) {
+		return response{}, s.createapp(r.App, r.Shards, r.ShardBy)
+	}))
+
+	api.Handle(routes.V2DeleteApp, s.v2(func(r *routes.Request) (response, error) {
+		return response{}, s.deleteapp(r.App)
+	}))
+
+	api.Handle(routes.V2Channels, s.v2(func(r *routes.Request) (response, error) {
+		a, err := s.apps.ensure(r.App)
+		if err != nil {
+			return response{}, err
+		}
+
+		channels, err := a.ListChannelsWithCount()
+		if err != nil {
+			return response{}, err
+		}
+
+		states, err := a.PauseStates()
+		return response{Channels: channels, Paused: states, IsPaused: states[appwide] != ""}, err
+	}))
+
+	api.Handle(routes.V2CreateChannel, s.v2(func(r *routes.Request) (response, error) {
+		q, err := s.channelqueue(r)
+		if err != nil {
+			return response{}, err
+		}
+		return response{}, q.CreateChannel(r.Channel)
+	}))
+
+	// {app, channel, mode}, without a channel the whole app pauses
+	api.Handle(routes.V2Pause, s.v2(func(r *routes.Request) (response, error) {
+		if r.Channel != "" {
+			if err := validchannel(r.Channel); err != nil {
+				return response{}, err
+			}
+		}
+
+		q, err := s.queue(r.App)
+		if err != nil {
+			return response{}, err
+		}
+		return response{}, q.Pause(r.Channel, r.Mode)
+	}))
+
+	api.Handle(routes.V2Resume, s.v2(func(r *routes.Request) (response, error) {
+		q, err := s.queue(r.App)
+		if err != nil {
+			return response{}, err
+		}
+		return response{}, q.Resume(r.Channel)
+	}))
+}
+
+// full tells whether a capped channel has every in-flight slot taken
+func (s *Server) full(appname, channel string) (bool, error) {
+	a, err := s.apps.ensure(appname)
+	if err != nil {
+		return false, err
+	}
+
+	cc, err := a.ChannelConfig(channel)
+	if err != nil || cc.MaxInFlight == 0 {
+		return false, err
+	}
+
+	inflight, err := a.InFlight(channel)
+	return inflight >= cc.MaxInFlight, err
+}
@@ -0,0 +1,203 @@
+package solidq_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/sfi2k7/solidq"
+	"github.com/sfi2k7/solidq/routes"
+)
+
+// The v2 API contract: statuses and error codes of every endpoint, run against in-process servers
+
+const secret = "secret"
+
+type result struct {
+	Success bool     `json:"success"`
+	Error   string   `json:"error"`
+	Code    string   `json:"code"`
+	Ids     []string `json:"ids"`
+	Count   int      `json:"count"`
+}
+
+// contract is one request and what it must answer
+type contract struct {
+	name   string
+	method string
+	path   string
+	body   string
+	secret string
+	status int
+	code   string
+	check  func(r result) error
+}
+
+// serve starts a server with the secret behind an httptest.Server and returns its URL
+func serve(t *testing.T, options *solidq.SeverOptions) string {
+	t.Helper()
+	options.Secret = secret
+	s, err := solidq.NewServer(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts := httptest.NewServer(s.Handler())
+	t.Cleanup(func() {
+		s.Shutdown(context.Background())
+		ts.Close()
+	})
+	return ts.URL
+}
+
+func TestV2Primary(t *testing.T) {
+	base := serve(t, &solidq.SeverOptions{RootPath: t.TempDir(), Replicate: true})
+
+	ids := func(want ...string) func(r result) error {
+		return func(r result) error {
+			if strings.Join(r.Ids, ",") != strings.Join(want, ",") {
+				return fmt.Errorf("ids %v, want %v", r.Ids, want)
+			}
+			return nil
+		}
+	}
+
+	verify(t, base, []contract{
+		{name: "no secret", method: "POST", path: "/v2/push", body: `{"channel":"jobs","id":"a"}`, secret: "-", status: 401, code: routes.CodeUnauthorized},
+		{name: "wrong secret", method: "GET", path: "/v2/count?channel=jobs", secret: "nope", status: 401, code: routes.CodeUnauthorized},
+		{name: "push an ID with colons", method: "POST", path: "/v2/push", body: `{"channel":"jobs","id":"order:42:x"}`, status: 200},
+		{name: "push by query", method: "POST", path: "/v2/push?channel=jobs&id=b", status: 200},
+		{name: "push many", method: "POST", path: "/v2/push", body: `{"channel":"jobs","ids":["c","d"]}`, status: 200, check: func(r result) error {
+			if r.Count != 2 {
+				return fmt.Errorf("count %d, want 2", r.Count)
+			}
+			return nil
+		}},
+		{name: "peek", method: "GET", path: "/v2/peek?channel=jobs", status: 200, check: ids("b", "c", "d", "order:42:x")},
+		{name: "count", method: "GET", path: "/v2/count?channel=jobs", status: 200, check: func(r result) error {
+			if r.Count != 4 {
+				return fmt.Errorf("count %d, want 4", r.Count)
+			}
+			return nil
+		}},
+		{name: "pop", method: "POST", path: "/v2/pop", body: `{"channel":"jobs","count":4}`, status: 200, check: ids("b", "c", "d", "order:42:x")},
+		{name: "pop an empty channel", method: "POST", path: "/v2/pop", body: `{"channel":"jobs","wait":0.1}`, status: 200, check: ids()},
+		{name: "ack", method: "POST", path: "/v2/ack", body: `{"channel":"jobs","id":"order:42:x"}`, status: 200},
+		{name: "nack", method: "POST", path: "/v2/nack", body: `{"channel":"jobs","id":"b","delay":"1h"}`, status: 200},
+		{name: "bad channel name", method: "POST", path: "/v2/push", body: `{"channel":"no spaces","id":"a"}`, status: 400, code: routes.CodeInvalid},
+		{name: "no channel", method: "GET", path: "/v2/count", status: 400, code: routes.CodeInvalid},
+		{name: "bad app name", method: "GET", path: "/v2/count?app=../etc&channel=jobs", status: 400, code: routes.CodeInvalid},
+		{name: "no work ID", method: "POST", path: "/v2/push", body: `{"channel":"jobs"}`, status: 400, code: routes.CodeInvalid},
+		{name: "malformed body", method: "POST", path: "/v2/push", body: `{"channel":`, status: 400, code: routes.CodeInvalid},
+		{name: "bad count", method: "GET", path: "/v2/peek?channel=jobs&count=many", status: 400, code: routes.CodeInvalid},
+		{name: "negative count", method: "POST", path: "/v2/pop", body: `{"channel":"jobs","count":-1}`, status: 400, code: routes.CodeInvalid},
+		{name: "bad wait", method: "POST", path: "/v2/pop", body: `{"channel":"jobs","wait":true}`, status: 400, code: routes.CodeInvalid},
+		{name: "bad pause mode", method: "POST", path: "/v2/pause", body: `{"mode":"sometimes"}`, status: 400, code: routes.CodeInvalid},
+		{name: "create app", method: "POST", path: "/v2/apps", body: `{"app":"orders","shards":2}`, status: 200},
+		{name: "create app twice", method: "POST", path: "/v2/apps", body: `{"app":"orders"}`, status: 409, code: routes.CodeConflict},
+		{name: "bad shards", method: "POST", path: "/v2/apps", body: `{"app":"wide","shards":1000}`, status: 400, code: routes.CodeInvalid},
+		{name: "list apps", method: "GET", path: "/v2/apps", status: 200},
+		{name: "delete app", method: "DELETE", path: "/v2/apps?app=orders", status: 200},
+		{name: "delete a missing app", method: "DELETE", path: "/v2/apps?app=orders", status: 404, code: routes.CodeNotFound},
+		{name: "cap a channel", method: "POST", path: "/v2/config", body: `{"channel":"capped","config":{"maxInFlight":1}}`, status: 200},
+		{name: "bad config", method: "POST", path: "/v2/config", body: `{"channel":"capped","config":{"maxInFlight":-1}}`, status: 400, code: routes.CodeInvalid},
+		{name: "read config", method: "GET", path: "/v2/config?channel=capped", status: 200},
+		{name: "push to the capped channel", method: "POST", path: "/v2/push", body: `{"channel":"capped","ids":["x","y"]}`, status: 200},
+		{name: "pop the only slot", method: "POST", path: "/v2/pop", body: `{"channel":"capped","count":2}`, status: 200, check: ids("x")},
+		{name: "pop with every slot taken", method: "POST", path: "/v2/pop", body: `{"channel":"capped"}`, status: 429, code: routes.CodeAtCapacity},
+		{name: "free the slot", method: "POST", path: "/v2/ack", body: `{"channel":"capped","id":"x"}`, status: 200},
+		{name: "pop after the ack", method: "POST", path: "/v2/pop", body: `{"channel":"capped"}`, status: 200, check: ids("y")},
+		{name: "pause a channel", method: "POST", path: "/v2/pause", body: `{"channel":"jobs"}`, status: 200},
+		{name: "push to a paused channel", method: "POST", path: "/v2/push", body: `{"channel":"jobs","id":"e"}`, status: 503, code: routes.CodePaused},
+		{name: "list channels", method: "GET", path: "/v2/channels", status: 200},
+		{name: "resume", method: "POST", path: "/v2/resume", body: `{"channel":"jobs"}`, status: 200},
+		{name: "reset", method: "POST", path: "/v2/reset", body: `{"channel":"jobs"}`, status: 200},
+		{name: "v1 keeps answering 200", method: "POST", path: "/solidq/push/jobs:a", secret: "nope", status: 200, check: func(r result) error {
+			if r.Success || r.Error != "Unauthorized" {
+				return fmt.Errorf("v1 answered %+v", r)
+			}
+			return nil
+		}},
+	})
+}
+
+func TestV2Strict(t *testing.T) {
+	base := serve(t, &solidq.SeverOptions{RootPath: t.TempDir(), Strict: true})
+
+	verify(t, base, []contract{
+		{name: "unknown app", method: "GET", path: "/v2/count?app=nope&channel=jobs", status: 404, code: routes.CodeNotFound},
+		{name: "create app", method: "POST", path: "/v2/apps", body: `{"app":"known"}`, status: 200},
+		{name: "unknown channel", method: "POST", path: "/v2/push", body: `{"app":"known","channel":"jobs","id":"a"}`, status: 404, code: routes.CodeNotFound},
+		{name: "create channel", method: "POST", path: "/v2/channels", body: `{"app":"known","channel":"jobs"}`, status: 200},
+		{name: "push to the created channel", method: "POST", path: "/v2/push", body: `{"app":"known","channel":"jobs","id":"a"}`, status: 200},
+	})
+}
+
+func TestV2Follower(t *testing.T) {
+	base := serve(t, &solidq.SeverOptions{RootPath: t.TempDir(), Follow: "http://127.0.0.1:1", FollowSecret: secret})
+
+	verify(t, base, []contract{
+		{name: "write to a follower", method: "POST", path: "/v2/push", body: `{"channel":"jobs","id":"a"}`, status: 503, code: routes.CodeReadOnly},
+		{name: "read from a follower", method: "GET", path: "/v2/count?channel=jobs", status: 200},
+	})
+}
+
+// verify runs the contracts in order, each depends on the ones before it
+func verify(t *testing.T, base string, contracts []contract) {
+	t.Helper()
+	for _, c := range contracts {
+		if err := c.run(base); err != nil {
+			t.Errorf("%s %s (%s): %v", c.method, c.path, c.name, err)
+		}
+	}
+}
+
+func (c contract) run(base string) error {
+	req, err := http.NewRequest(c.method, base+c.path, bytes.NewBufferString(c.body))
+	if err != nil {
+		return err
+	}
+
+	switch c.secret {
+	case "":
+		req.Header.Set("Authorization", secret)
+	case "-":
+	default:
+		req.Header.Set("Authorization", c.secret)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	raw, err := io.ReadAll(res.Body)
+	if err != nil {
+		return err
+	}
+
+	var r result
+	if err := json.Unmarshal(raw, &r); err != nil {
+		return fmt.Errorf("status %d, body %q is not JSON", res.StatusCode, raw)
+	}
+
+	if res.StatusCode != c.status || r.Code != c.code {
+		return fmt.Errorf("got %d %q (%s), want %d %q", res.StatusCode, r.Code, r.Error, c.status, c.code)
+	}
+
+	if r.Success != (c.status == http.StatusOK) && strings.HasPrefix(c.path, "/v2/") {
+		return fmt.Errorf("success is %v with status %d", r.Success, res.StatusCode)
+	}
+
+	if c.check != nil {
+		return c.check(r)
+	}
+	return nil
+}